@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/jedisct1/dlog"
+)
+
+type ClientACL struct {
+	sync.Mutex
+	allowed       []*net.IPNet
+	denied        []*net.IPNet
+	refuse        bool
+	deniedCount   uint64
+	unlistedCount uint64
+}
+
+func parseCIDRs(cidrsStr []string) ([]*net.IPNet, error) {
+	var cidrs []*net.IPNet
+	for _, cidrStr := range cidrsStr {
+		if !strings.Contains(cidrStr, "/") {
+			ip := net.ParseIP(cidrStr)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid client address: [%s]", cidrStr)
+			}
+			if ip.To4() != nil {
+				cidrStr += "/32"
+			} else {
+				cidrStr += "/128"
+			}
+		}
+		_, cidr, err := net.ParseCIDR(cidrStr)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid client network: [%s]", cidrStr)
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+func NewClientACL(allowedStr []string, deniedStr []string, refuse bool) (*ClientACL, error) {
+	allowed, err := parseCIDRs(allowedStr)
+	if err != nil {
+		return nil, err
+	}
+	denied, err := parseCIDRs(deniedStr)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientACL{allowed: allowed, denied: denied, refuse: refuse}, nil
+}
+
+func cidrsContain(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Clients matching denied_clients are rejected. If allowed_clients is not
+// empty, clients that don't match it are rejected as well.
+
+func (acl *ClientACL) allows(clientAddr net.Addr) bool {
+	ip := ClientIP(clientAddr)
+	if ip == nil {
+		return true
+	}
+	if cidrsContain(acl.denied, ip) {
+		acl.Lock()
+		acl.deniedCount++
+		count := acl.deniedCount
+		acl.Unlock()
+		dlog.Debugf("Query from [%v] rejected by denied_clients (%d so far)", ip, count)
+		return false
+	}
+	if len(acl.allowed) > 0 && !cidrsContain(acl.allowed, ip) {
+		acl.Lock()
+		acl.unlistedCount++
+		count := acl.unlistedCount
+		acl.Unlock()
+		dlog.Debugf("Query from [%v] rejected - not in allowed_clients (%d so far)", ip, count)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/jedisct1/dlog"
+)
+
+type AdminServerStatus struct {
+	Name    string             `json:"name"`
+	Proto   string             `json:"proto"`
+	Failing bool               `json:"failing"`
+	RTT     float64            `json:"rtt_ms"`
+	Stats   ServerStatsSummary `json:"stats"`
+}
+
+type AdminCacheStatus struct {
+	Entries   int                          `json:"entries"`
+	Size      int                          `json:"size"`
+	Listeners map[string]map[string]uint64 `json:"listeners"`
+}
+
+type AdminRulesStatus struct {
+	Kind  string `json:"kind"`
+	File  string `json:"file"`
+	Count int    `json:"count"`
+}
+
+func (proxy *Proxy) adminServers() []AdminServerStatus {
+	summaries := proxy.serverStats.summaries()
+	proxy.serversInfo.RLock()
+	defer proxy.serversInfo.RUnlock()
+	servers := make([]AdminServerStatus, 0, len(proxy.serversInfo.inner))
+	for i := range proxy.serversInfo.inner {
+		serverInfo := &proxy.serversInfo.inner[i]
+		serverInfo.RLock()
+		servers = append(servers, AdminServerStatus{
+			Name:    serverInfo.Name,
+			Proto:   serverInfo.Proto.String(),
+			Failing: serverInfo.failing,
+			RTT:     serverInfo.rtt.Value() * 1024 / 1000000,
+			Stats:   summaries[serverInfo.Name],
+		})
+		serverInfo.RUnlock()
+	}
+	return servers
+}
+
+func (proxy *Proxy) adminCache() AdminCacheStatus {
+	status := AdminCacheStatus{Listeners: make(map[string]map[string]uint64)}
+	status.Entries, status.Size = cachedResponses.entries()
+	proxy.cacheStats.Lock()
+	for listenAddrStr, stats := range proxy.cacheStats.listeners {
+		status.Listeners[listenAddrStr] = map[string]uint64{
+			"hits":       atomic.LoadUint64(&stats.hits),
+			"misses":     atomic.LoadUint64(&stats.misses),
+			"insertions": atomic.LoadUint64(&stats.insertions),
+			"evictions":  atomic.LoadUint64(&stats.evictions),
+		}
+	}
+	proxy.cacheStats.Unlock()
+	return status
+}
+
+func adminRules() []AdminRulesStatus {
+	rulesFiles.Lock()
+	files := rulesFiles.files
+	rulesFiles.Unlock()
+	rules := make([]AdminRulesStatus, 0, len(files))
+	for _, rulesFile := range files {
+		rulesFile.RLock()
+		rules = append(rules, AdminRulesStatus{Kind: rulesFile.kind, File: rulesFile.fileName, Count: rulesFile.matcher.count})
+		rulesFile.RUnlock()
+	}
+	return rules
+}
+
+// Sources are downloaded again even if their cache file is still fresh,
+// then rules files are reloaded to pick up the new content
+
+func (proxy *Proxy) adminRefreshSources() []string {
+	failures := []string{}
+	for _, source := range proxy.rulesSources {
+		err := source.fetch(0)
+		proxy.metrics.sourceFetched(source.url, err)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", source.url, err))
+		}
+	}
+	reloadRulesFiles(true)
+	return failures
+}
+
+type AdminStatus struct {
+	Servers []AdminServerStatus `json:"servers"`
+	Cache   AdminCacheStatus    `json:"cache"`
+	Rules   []AdminRulesStatus  `json:"rules"`
+}
+
+type AdminHandler struct {
+	proxy *Proxy
+}
+
+func (handler AdminHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	proxy := handler.proxy
+	authorization := request.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(authorization), []byte("Bearer "+proxy.adminAPIToken)) != 1 {
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	var response interface{}
+	switch request.URL.Path {
+	case "/status", "/servers", "/cache", "/rules":
+		if request.Method != "GET" {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		switch request.URL.Path {
+		case "/status":
+			response = AdminStatus{Servers: proxy.adminServers(), Cache: proxy.adminCache(), Rules: adminRules()}
+		case "/servers":
+			response = proxy.adminServers()
+		case "/cache":
+			response = proxy.adminCache()
+		case "/rules":
+			response = adminRules()
+		}
+	case "/cache/flush", "/sources/refresh", "/rules/reload", "/log-level":
+		if request.Method != "POST" {
+			writer.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		switch request.URL.Path {
+		case "/cache/flush":
+			name := request.URL.Query().Get("name")
+			if len(name) == 0 {
+				name = "."
+			}
+			count := cachedResponses.flush(name)
+			cacheLog.Noticef("Cache flushed for [%s] - %d entries removed", name, count)
+			response = map[string]int{"flushed": count}
+		case "/sources/refresh":
+			response = map[string][]string{"errors": proxy.adminRefreshSources()}
+		case "/rules/reload":
+			reloadRulesFiles(true)
+			response = adminRules()
+		case "/log-level":
+			component := request.URL.Query().Get("component")
+			level, err := strconv.Atoi(request.URL.Query().Get("level"))
+			if err == nil {
+				err = setLogLevel(component, level)
+			}
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+				return
+			}
+			response = map[string]int{"level": level}
+		}
+	default:
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	encoded, err := json.Marshal(response)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(encoded)
+}
+
+// The API only listens on loopback addresses, and every request must include
+// the token as a bearer token
+
+func checkAdminAPIAddress(listenAddrStr string) error {
+	host, _, err := net.SplitHostPort(listenAddrStr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errors.New("The admin API can only listen on a loopback address")
+	}
+	return nil
+}
+
+func (proxy *Proxy) adminAPIListener(listenAddrStr string) error {
+	listener, err := net.Listen("tcp", listenAddrStr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		listenersLog.Noticef("Now serving the admin API on http://%v", listener.Addr())
+		if err := http.Serve(listener, AdminHandler{proxy: proxy}); err != nil {
+			dlog.Errorf("Admin API: %s", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+type ClientIPMode int
+
+const (
+	ClientIPModeFull ClientIPMode = iota
+	ClientIPModeTruncate
+	ClientIPModeHash
+	ClientIPModeOmit
+)
+
+type ClientIPAnonymizer struct {
+	mode ClientIPMode
+	key  [32]byte
+}
+
+// Truncated addresses keep their /24 (IPv4) or /56 (IPv6) network. Hashes are
+// keyed with a secret that changes on every restart, so that the same client
+// can be followed within a log, but addresses cannot be recovered by hashing
+// all of them.
+
+func NewClientIPAnonymizer(mode string) (*ClientIPAnonymizer, error) {
+	anonymizer := ClientIPAnonymizer{}
+	switch strings.ToLower(mode) {
+	case "", "full":
+		anonymizer.mode = ClientIPModeFull
+	case "truncate":
+		anonymizer.mode = ClientIPModeTruncate
+	case "hash":
+		anonymizer.mode = ClientIPModeHash
+		if _, err := rand.Read(anonymizer.key[:]); err != nil {
+			return nil, err
+		}
+	case "omit":
+		anonymizer.mode = ClientIPModeOmit
+	default:
+		return nil, fmt.Errorf("Unsupported client IP logging mode: [%s]", mode)
+	}
+	return &anonymizer, nil
+}
+
+func (anonymizer *ClientIPAnonymizer) anonymize(ip net.IP) string {
+	if anonymizer == nil {
+		return ip.String()
+	}
+	switch anonymizer.mode {
+	case ClientIPModeTruncate:
+		if ipv4 := ip.To4(); ipv4 != nil {
+			return ipv4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return ip.Mask(net.CIDRMask(56, 128)).String()
+	case ClientIPModeHash:
+		mac := hmac.New(sha256.New, anonymizer.key[:])
+		mac.Write(ip.To16())
+		return hex.EncodeToString(mac.Sum(nil)[:8])
+	case ClientIPModeOmit:
+		return "-"
+	}
+	return ip.String()
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"syscall"
+)
+
+const (
+	BindToInterfaceSupported = true
+	ipv6BoundIf              = 0x7d
+)
+
+func bindToInterfaceControl(interfaceName string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		iface, err := net.InterfaceByName(interfaceName)
+		if err != nil {
+			return err
+		}
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			if strings.HasSuffix(network, "6") {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, ipv6BoundIf, iface.Index)
+			} else {
+				sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_BOUND_IF, iface.Index)
+			}
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"syscall"
+)
+
+const BindToInterfaceSupported = true
+
+func bindToInterfaceControl(interfaceName string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, interfaceName)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
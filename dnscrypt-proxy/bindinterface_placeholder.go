@@ -0,0 +1,11 @@
+// +build !linux,!darwin
+
+package main
+
+import "syscall"
+
+const BindToInterfaceSupported = false
+
+func bindToInterfaceControl(interfaceName string) func(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const BlockedResponseTTL = 600
+
+type BlockedResponse struct {
+	rcode int
+	ipv4  net.IP
+	ipv6  net.IP
+}
+
+// Blocked queries can get a "refused", "nxdomain" or "empty" response, or
+// fixed addresses, such as "0.0.0.0" or "192.168.1.10,fd00::10"
+
+func ParseBlockedResponse(str string) (*BlockedResponse, error) {
+	switch strings.ToLower(str) {
+	case "", "refused":
+		return &BlockedResponse{rcode: dns.RcodeRefused}, nil
+	case "nxdomain":
+		return &BlockedResponse{rcode: dns.RcodeNameError}, nil
+	case "empty":
+		return &BlockedResponse{rcode: dns.RcodeSuccess}, nil
+	}
+	blockedResponse := BlockedResponse{rcode: dns.RcodeSuccess}
+	for _, ipStr := range strings.Split(str, ",") {
+		ip := net.ParseIP(strings.Trim(strings.TrimSpace(ipStr), "[]"))
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid blocked response: [%s]", str)
+		}
+		if ipv4 := ip.To4(); ipv4 != nil {
+			blockedResponse.ipv4 = ipv4
+		} else {
+			blockedResponse.ipv6 = ip
+		}
+	}
+	return &blockedResponse, nil
+}
+
+func (blockedResponse *BlockedResponse) synthesize(msg *dns.Msg) (*dns.Msg, error) {
+	synth, err := EmptyResponseFromMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	synth.Rcode = blockedResponse.rcode
+	question := msg.Question[0]
+	header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: BlockedResponseTTL}
+	switch {
+	case question.Qtype == dns.TypeA && blockedResponse.ipv4 != nil:
+		synth.Answer = []dns.RR{&dns.A{Hdr: header, A: blockedResponse.ipv4}}
+	case question.Qtype == dns.TypeAAAA && blockedResponse.ipv6 != nil:
+		synth.Answer = []dns.RR{&dns.AAAA{Hdr: header, AAAA: blockedResponse.ipv6}}
+	}
+	return synth, nil
+}
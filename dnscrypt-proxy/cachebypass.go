@@ -0,0 +1,27 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+type CacheBypassRules struct {
+	matcher *PatternMatcher
+}
+
+func NewCacheBypassRules(fileName string) (*CacheBypassRules, error) {
+	matcher := NewPatternMatcher()
+	err := parseRulesFile(fileName, func(line string, _ string, _ int) error {
+		return matcher.Add(line, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &CacheBypassRules{matcher: matcher}, nil
+}
+
+func (rules *CacheBypassRules) matches(msg *dns.Msg) bool {
+	if rules == nil || len(msg.Question) != 1 {
+		return false
+	}
+	return rules.matcher.Match(msg.Question[0].Name) != nil
+}
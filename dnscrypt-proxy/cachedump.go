@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/miekg/dns"
+)
+
+type CacheDumpEntry struct {
+	Name         string   `json:"name"`
+	Type         string   `json:"type"`
+	Rcode        string   `json:"rcode"`
+	TTLRemaining int64    `json:"ttl_remaining"`
+	Server       string   `json:"server,omitempty"`
+	Answers      []string `json:"answers,omitempty"`
+}
+
+func (cachedResponses *CachedResponses) dump() []CacheDumpEntry {
+	now := time.Now()
+	entries := []CacheDumpEntry{}
+	for _, shard := range cachedResponses.shards {
+		shard.RLock()
+		for _, key := range shard.cache.Keys() {
+			value, ok := shard.cache.Peek(key)
+			if !ok {
+				continue
+			}
+			cached := value.(CachedResponse)
+			if len(cached.msg.Question) != 1 {
+				continue
+			}
+			question := cached.msg.Question[0]
+			entry := CacheDumpEntry{
+				Name:         question.Name,
+				Type:         dns.TypeToString[question.Qtype],
+				Rcode:        dns.RcodeToString[cached.msg.Rcode],
+				TTLRemaining: int64(cached.expiration.Sub(now) / time.Second),
+				Server:       cached.server,
+			}
+			for _, rr := range cached.msg.Answer {
+				entry.Answers = append(entry.Answers, rr.String())
+			}
+			entries = append(entries, entry)
+		}
+		shard.RUnlock()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+		return entries[i].Type < entries[j].Type
+	})
+	return entries
+}
+
+func (cachedResponses *CachedResponses) dumpJSON(w io.Writer) (int, error) {
+	entries := cachedResponses.dump()
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return len(entries), encoder.Encode(entries)
+}
+
+// A TXT query for cache-dump.dnscrypt-proxy writes the content of the cache to cache_dump_file
+
+func (proxy *Proxy) cacheDumpResponse(msg *dns.Msg) []byte {
+	file, err := safefile.Create(proxy.cacheDumpFile, 0600)
+	if err != nil {
+		cacheLog.Warnf("Unable to dump the cache to [%s]: [%s]", proxy.cacheDumpFile, err)
+		return TXTResponseFromMessage(msg, []string{err.Error()})
+	}
+	defer file.Close()
+	count, err := cachedResponses.dumpJSON(file)
+	if err == nil {
+		err = file.Commit()
+	}
+	if err != nil {
+		cacheLog.Warnf("Unable to dump the cache to [%s]: [%s]", proxy.cacheDumpFile, err)
+		return TXTResponseFromMessage(msg, []string{err.Error()})
+	}
+	cacheLog.Noticef("%d cached responses dumped to [%s]", count, proxy.cacheDumpFile)
+	return TXTResponseFromMessage(msg, []string{fmt.Sprintf("%d entries dumped to [%s]", count, proxy.cacheDumpFile)})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/dchest/safefile"
+	"github.com/miekg/dns"
+)
+
+const CacheSnapshotInterval = 10 * time.Minute
+
+var cacheFileMagic = []byte{'D', 'P', 'C', '1'}
+
+// Each record is a cache key, an expiration timestamp and a length-prefixed DNS message
+
+func (cachedResponses *CachedResponses) save(fileName string, maxSize int, gracePeriod time.Duration) (int, error) {
+	var snapshot bytes.Buffer
+	snapshot.Write(cacheFileMagic)
+	count := 0
+	now := time.Now()
+	for _, shard := range cachedResponses.shards {
+		shard.RLock()
+		for _, key := range shard.cache.Keys() {
+			cachedAny, ok := shard.cache.Peek(key)
+			if !ok {
+				continue
+			}
+			cached := cachedAny.(CachedResponse)
+			if now.After(cached.expiration.Add(gracePeriod)) {
+				continue
+			}
+			packet, err := cached.msg.Pack()
+			if err != nil || len(packet) > 0xffff {
+				continue
+			}
+			if snapshot.Len()+32+8+2+len(packet) > maxSize {
+				break
+			}
+			cacheKey := key.([32]byte)
+			var header [8 + 2]byte
+			binary.BigEndian.PutUint64(header[0:8], uint64(cached.expiration.Unix()))
+			binary.BigEndian.PutUint16(header[8:10], uint16(len(packet)))
+			snapshot.Write(cacheKey[:])
+			snapshot.Write(header[:])
+			snapshot.Write(packet)
+			count++
+		}
+		shard.RUnlock()
+	}
+	return count, safefile.WriteFile(fileName, snapshot.Bytes(), 0600)
+}
+
+func (cachedResponses *CachedResponses) load(fileName string, maxSize int, gracePeriod time.Duration) (int, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	snapshot, err := ioutil.ReadAll(io.LimitReader(file, int64(maxSize)))
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.HasPrefix(snapshot, cacheFileMagic) {
+		return 0, errors.New("Unsupported cache file format")
+	}
+	snapshot = snapshot[len(cacheFileMagic):]
+	count := 0
+	now := time.Now()
+	for len(snapshot) >= 32+8+2 {
+		var cacheKey [32]byte
+		copy(cacheKey[:], snapshot[0:32])
+		expiration := time.Unix(int64(binary.BigEndian.Uint64(snapshot[32:40])), 0)
+		packetLength := int(binary.BigEndian.Uint16(snapshot[40:42]))
+		snapshot = snapshot[42:]
+		if len(snapshot) < packetLength {
+			break
+		}
+		packet := snapshot[:packetLength]
+		snapshot = snapshot[packetLength:]
+		if now.After(expiration.Add(gracePeriod)) {
+			continue
+		}
+		msg := dns.Msg{}
+		if err := msg.Unpack(packet); err != nil {
+			continue
+		}
+		shard := cachedResponses.shard(cacheKey)
+		if shard == nil {
+			break
+		}
+		stats := &CachedResponseStats{ttl: expiration.Sub(now)}
+		shard.Lock()
+		shard.cache.Add(cacheKey, CachedResponse{expiration: expiration, msg: msg, stats: stats})
+		shard.Unlock()
+		count++
+	}
+	return count, nil
+}
+
+func (proxy *Proxy) saveCache() {
+	count, err := cachedResponses.save(proxy.cacheFile, proxy.cacheFileMaxSize, proxy.cacheServeStale)
+	if err != nil {
+		cacheLog.Warnf("Unable to save the cache to [%s]: [%s]", proxy.cacheFile, err)
+		return
+	}
+	cacheLog.Infof("%d cached responses saved to [%s]", count, proxy.cacheFile)
+}
+
+// The cache is restored at startup, and saved periodically as well as on exit
+
+func (proxy *Proxy) startCacheSnapshots() {
+	count, err := cachedResponses.load(proxy.cacheFile, proxy.cacheFileMaxSize, proxy.cacheServeStale)
+	if err != nil && !os.IsNotExist(err) {
+		cacheLog.Warnf("Unable to load the cache from [%s]: [%s]", proxy.cacheFile, err)
+	} else if err == nil {
+		cacheLog.Noticef("%d cached responses loaded from [%s]", count, proxy.cacheFile)
+	}
+	go func() {
+		for {
+			time.Sleep(CacheSnapshotInterval)
+			proxy.saveCache()
+		}
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		proxy.saveCache()
+		os.Exit(0)
+	}()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/miekg/dns"
+)
+
+// Removes every entry for name and its subdomains, or the whole cache if name is the root
+
+func (cachedResponses *CachedResponses) flush(name string) int {
+	name = strings.ToLower(dns.Fqdn(name))
+	count := 0
+	for _, shard := range cachedResponses.shards {
+		shard.Lock()
+		if name == "." {
+			count += shard.cache.Len()
+			shard.cache.Purge()
+			shard.Unlock()
+			continue
+		}
+		for _, key := range shard.cache.Keys() {
+			value, ok := shard.cache.Peek(key)
+			if !ok {
+				continue
+			}
+			question := value.(CachedResponse).msg.Question
+			if len(question) != 1 {
+				continue
+			}
+			qName := strings.ToLower(question[0].Name)
+			if qName == name || strings.HasSuffix(qName, "."+name) {
+				shard.cache.Remove(key)
+				count++
+			}
+		}
+		shard.Unlock()
+	}
+	return count
+}
+
+func (proxy *Proxy) startCacheFlushSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			count := cachedResponses.flush(".")
+			cacheLog.Noticef("Cache flushed - %d entries removed", count)
+		}
+	}()
+}
+
+// A TXT query for [<name>.]flush.dnscrypt-proxy flushes the cache
+// for <name> and its subdomains, or the whole cache if there is no name
+
+func (proxy *Proxy) cacheFlushResponse(msg *dns.Msg, name string) []byte {
+	if len(name) == 0 {
+		name = "."
+	}
+	count := cachedResponses.flush(name)
+	cacheLog.Noticef("Cache flushed for [%s] - %d entries removed", name, count)
+	return TXTResponseFromMessage(msg, []string{fmt.Sprintf("%d entries flushed", count)})
+}
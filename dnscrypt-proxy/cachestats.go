@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+type CacheStats struct {
+	hits       uint64
+	misses     uint64
+	insertions uint64
+	evictions  uint64
+}
+
+type CacheStatsRegistry struct {
+	sync.Mutex
+	listeners map[string]*CacheStats
+}
+
+func (registry *CacheStatsRegistry) forListener(listenAddrStr string) *CacheStats {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.listeners == nil {
+		registry.listeners = make(map[string]*CacheStats)
+	}
+	stats, ok := registry.listeners[listenAddrStr]
+	if !ok {
+		stats = &CacheStats{}
+		registry.listeners[listenAddrStr] = stats
+	}
+	return stats
+}
+
+func (stats *CacheStats) String() string {
+	return fmt.Sprintf("hits=%d misses=%d insertions=%d evictions=%d",
+		atomic.LoadUint64(&stats.hits), atomic.LoadUint64(&stats.misses),
+		atomic.LoadUint64(&stats.insertions), atomic.LoadUint64(&stats.evictions))
+}
+
+func (registry *CacheStatsRegistry) lines() []string {
+	registry.Lock()
+	defer registry.Unlock()
+	var lines []string
+	for listenAddrStr, stats := range registry.listeners {
+		lines = append(lines, fmt.Sprintf("%s %s", listenAddrStr, stats))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func (cachedResponses *CachedResponses) entries() (count int, capacity int) {
+	for _, shard := range cachedResponses.shards {
+		count += shard.cache.Len()
+		capacity += shard.size
+	}
+	return count, capacity
+}
+
+// A TXT query for cache-stats.dnscrypt-proxy returns the cache occupancy,
+// followed by the counters of every listener
+
+func (proxy *Proxy) cacheStatsResponse(msg *dns.Msg) []byte {
+	count, capacity := cachedResponses.entries()
+	lines := []string{fmt.Sprintf("entries=%d size=%d", count, capacity)}
+	return TXTResponseFromMessage(msg, append(lines, proxy.cacheStats.lines()...))
+}
@@ -7,11 +7,8 @@ import (
 	"strings"
 	"time"
 
-	"github.com/jedisct1/dlog"
-	"github.com/jedisct1/xsecretbox"
 	"github.com/miekg/dns"
 	"golang.org/x/crypto/ed25519"
-	"golang.org/x/crypto/nacl/box"
 )
 
 type CertInfo struct {
@@ -30,8 +27,14 @@ func FetchCurrentCert(proxy *Proxy, proto string, pk ed25519.PublicKey, serverAd
 	}
 	query := new(dns.Msg)
 	query.SetQuestion(providerName, dns.TypeTXT)
-	client := dns.Client{Net: proto, UDPSize: uint16(MaxDNSUDPPacketSize)}
-	in, _, err := client.Exchange(query, serverAddress)
+	var in *dns.Msg
+	var err error
+	if proto == "tcp" {
+		in, err = exchangeOverTCP(proxy, query, serverAddress)
+	} else {
+		client := dns.Client{Net: proto, UDPSize: uint16(MaxDNSUDPPacketSize)}
+		in, _, err = client.Exchange(query, serverAddress)
+	}
 	if err != nil {
 		return CertInfo{}, err
 	}
@@ -39,17 +42,21 @@ func FetchCurrentCert(proxy *Proxy, proto string, pk ed25519.PublicKey, serverAd
 	certInfo := CertInfo{CryptoConstruction: UndefinedConstruction}
 	highestSerial := uint32(0)
 	for _, answerRr := range in.Answer {
-		binCert, err := packTxtString(strings.Join(answerRr.(*dns.TXT).Txt, ""))
+		txt, ok := answerRr.(*dns.TXT)
+		if !ok {
+			continue
+		}
+		binCert, err := packTxtString(strings.Join(txt.Txt, ""))
 		if err != nil {
-			dlog.Warnf("[%v] Unable to unpack the certificate", providerName)
+			certsLog.Warnf("[%v] Unable to unpack the certificate", providerName)
 			continue
 		}
 		if len(binCert) < 124 {
-			dlog.Warnf("[%v] Certificate too short", providerName)
+			certsLog.Warnf("[%v] Certificate too short", providerName)
 			continue
 		}
 		if !bytes.Equal(binCert[:4], CertMagic[:4]) {
-			dlog.Warnf("[%v] Invalid cert magic", providerName)
+			certsLog.Warnf("[%v] Invalid cert magic", providerName)
 			continue
 		}
 		cryptoConstruction := CryptoConstruction(0)
@@ -59,56 +66,51 @@ func FetchCurrentCert(proxy *Proxy, proto string, pk ed25519.PublicKey, serverAd
 		case 0x0002:
 			cryptoConstruction = XChacha20Poly1305
 		default:
-			dlog.Infof("[%v] Unsupported crypto construction", providerName)
+			certsLog.Infof("[%v] Unsupported crypto construction", providerName)
 			continue
 		}
 		signature := binCert[8:72]
 		signed := binCert[72:]
 		if !ed25519.Verify(pk, signed, signature) {
-			dlog.Warnf("[%v] Incorrect signature", providerName)
+			certsLog.Warnf("[%v] Incorrect signature", providerName)
 			continue
 		}
 		serial := binary.BigEndian.Uint32(binCert[112:116])
 		tsBegin := binary.BigEndian.Uint32(binCert[116:120])
 		tsEnd := binary.BigEndian.Uint32(binCert[120:124])
 		if now > tsEnd || now < tsBegin {
-			dlog.Infof("[%v] Certificate not valid at the current date", providerName)
+			certsLog.Infof("[%v] Certificate not valid at the current date", providerName)
 			continue
 		}
 		if serial < highestSerial {
-			dlog.Infof("[%v] Superseded by a previous certificate", providerName)
+			certsLog.Infof("[%v] Superseded by a previous certificate", providerName)
 			continue
 		}
 		if serial == highestSerial {
 			if cryptoConstruction < certInfo.CryptoConstruction {
-				dlog.Infof("[%v] Keeping the previous, preferred crypto construction", providerName)
+				certsLog.Infof("[%v] Keeping the previous, preferred crypto construction", providerName)
 				continue
 			} else {
-				dlog.Infof("[%v] Upgrading the construction from %v to %v", providerName, certInfo.CryptoConstruction, cryptoConstruction)
+				certsLog.Infof("[%v] Upgrading the construction from %v to %v", providerName, certInfo.CryptoConstruction, cryptoConstruction)
 			}
 		}
 		if cryptoConstruction != XChacha20Poly1305 && cryptoConstruction != XSalsa20Poly1305 {
-			dlog.Warnf("[%v] Cryptographic construction %v not supported", providerName, cryptoConstruction)
+			certsLog.Warnf("[%v] Cryptographic construction %v not supported", providerName, cryptoConstruction)
 			continue
 		}
 		var serverPk [32]byte
 		copy(serverPk[:], binCert[72:104])
-		var sharedKey [32]byte
-		if cryptoConstruction == XChacha20Poly1305 {
-			sharedKey, err = xsecretbox.SharedKey(proxy.proxySecretKey, serverPk)
-			if err != nil {
-				dlog.Errorf("[%v] Weak public key", providerName)
-				continue
-			}
-		} else {
-			box.Precompute(&sharedKey, &serverPk, &proxy.proxySecretKey)
+		sharedKey, err := ComputeSharedKey(cryptoConstruction, &proxy.proxySecretKey, &serverPk)
+		if err != nil {
+			certsLog.Errorf("[%v] Weak public key", providerName)
+			continue
 		}
-		certInfo.SharedKey = sharedKey
+		certInfo.SharedKey = *sharedKey
 		highestSerial = serial
 		certInfo.CryptoConstruction = cryptoConstruction
 		copy(certInfo.ServerPk[:], serverPk[:])
 		copy(certInfo.MagicQuery[:], binCert[104:112])
-		dlog.Noticef("[%v] Valid cert found", providerName)
+		certsLog.Noticef("[%v] Valid cert found (%v)", providerName, cryptoConstruction)
 	}
 	if certInfo.CryptoConstruction == UndefinedConstruction {
 		return certInfo, errors.New("No useable certificate found")
@@ -116,6 +118,20 @@ func FetchCurrentCert(proxy *Proxy, proto string, pk ed25519.PublicKey, serverAd
 	return certInfo, nil
 }
 
+func exchangeOverTCP(proxy *Proxy, query *dns.Msg, serverAddress string) (*dns.Msg, error) {
+	conn, err := proxy.xTransport.Dial("tcp", serverAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(proxy.timeout))
+	dnsConn := &dns.Conn{Conn: conn}
+	if err := dnsConn.WriteMsg(query); err != nil {
+		return nil, err
+	}
+	return dnsConn.ReadMsg()
+}
+
 func isDigit(b byte) bool { return b >= '0' && b <= '9' }
 
 func dddToByte(s []byte) byte {
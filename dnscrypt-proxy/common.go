@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/binary"
 	"errors"
+	"io"
 	"net"
 )
 
@@ -14,6 +15,17 @@ const (
 	XChacha20Poly1305
 )
 
+func (cryptoConstruction CryptoConstruction) String() string {
+	switch cryptoConstruction {
+	case XSalsa20Poly1305:
+		return "XSalsa20-Poly1305"
+	case XChacha20Poly1305:
+		return "XChaCha20-Poly1305"
+	default:
+		return "undefined"
+	}
+}
+
 const (
 	ClientMagicLen = 8
 )
@@ -38,25 +50,22 @@ func PrefixWithSize(packet []byte) ([]byte, error) {
 	return packet, nil
 }
 
-func ReadPrefixed(conn *net.TCPConn) ([]byte, error) {
-	buf := make([]byte, 2+MaxDNSPacketSize)
-	packetLength, pos := -1, 0
-	for {
-		readnb, err := (*conn).Read(buf[pos:])
-		if err != nil {
-			return buf, err
-		}
-		pos += readnb
-		if pos >= 2 && packetLength < 0 {
-			packetLength = int(binary.BigEndian.Uint16(buf[0:2]))
-			if packetLength > MaxDNSPacketSize-1 {
-				return buf, errors.New("Packet too large")
-			}
-		}
-		if pos >= 2+packetLength {
-			return buf[2:pos], nil
-		}
+// Reads exactly one length-prefixed packet, so that connections can be reused
+
+func ReadPrefixed(conn io.Reader) ([]byte, error) {
+	var prefix [2]byte
+	if _, err := io.ReadFull(conn, prefix[:]); err != nil {
+		return nil, err
+	}
+	packetLength := int(binary.BigEndian.Uint16(prefix[:]))
+	if packetLength > MaxDNSPacketSize-1 {
+		return nil, errors.New("Packet too large")
 	}
+	packet := make([]byte, packetLength)
+	if _, err := io.ReadFull(conn, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
 }
 
 func Min(a, b int) int {
@@ -72,3 +81,13 @@ func Max(a, b int) int {
 	}
 	return b
 }
+
+func ClientIP(clientAddr net.Addr) net.IP {
+	switch addr := clientAddr.(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
+}
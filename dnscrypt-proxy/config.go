@@ -1,9 +1,13 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
 	"flag"
 	"fmt"
+	"net"
+	"net/url"
+	"os"
 	"strings"
 	"time"
 
@@ -12,42 +16,345 @@ import (
 )
 
 type Config struct {
-	ServerNames      []string `toml:"server_names"`
-	ListenAddresses  []string `toml:"listen_addresses"`
-	Daemonize        bool
-	ForceTCP         bool `toml:"force_tcp"`
-	Timeout          int  `toml:"timeout_ms"`
-	CertRefreshDelay int  `toml:"cert_refresh_delay"`
-	BlockIPv6        bool `toml:"block_ipv6"`
-	Cache            bool
-	CacheSize        int                     `toml:"cache_size"`
-	CacheNegTTL      uint32                  `toml:"cache_neg_ttl"`
-	CacheMinTTL      uint32                  `toml:"cache_min_ttl"`
-	CacheMaxTTL      uint32                  `toml:"cache_max_ttl"`
-	ServersConfig    map[string]ServerConfig `toml:"servers"`
-	SourcesConfig    map[string]SourceConfig `toml:"sources"`
+	ServerNames        []string `toml:"server_names"`
+	ListenAddresses    []string `toml:"listen_addresses"`
+	ListenersPerAddr   int      `toml:"listeners_per_address"`
+	ListenInterface    string   `toml:"listen_interface"`
+	ListenDualStack    bool     `toml:"listen_dual_stack"`
+	ProxyProtocolFrom  []string `toml:"proxy_protocol_from"`
+	TransparentAddrs   []string `toml:"transparent_listen_addresses"`
+	NamedPipes         []string `toml:"named_pipes"`
+	RateLimitQPS       int      `toml:"rate_limit_qps"`
+	RateLimitBurst     int      `toml:"rate_limit_burst"`
+	RateLimitSlip      int      `toml:"rate_limit_slip"`
+	MaxActiveQueries   int      `toml:"max_active_queries"`
+	MaxQueuedQueries   int      `toml:"max_queued_queries"`
+	AllowedClients     []string `toml:"allowed_clients"`
+	DeniedClients      []string `toml:"denied_clients"`
+	ClientACLAction    string   `toml:"clients_acl_action"`
+	Daemonize          bool
+	LogFormat          string         `toml:"log_format"`
+	LogLevels          map[string]int `toml:"log_levels"`
+	ForceTCP           bool           `toml:"force_tcp"`
+	TCPFastOpen        bool           `toml:"tcp_fast_open"`
+	FallbackResolver   string         `toml:"fallback_resolver"`
+	IgnoreSystemDNS    bool           `toml:"ignore_system_dns"`
+	FallbackLastResort bool           `toml:"fallback_last_resort"`
+	DNS0x20            bool           `toml:"dns0x20"`
+	DNS0x20Exempt      []string       `toml:"dns0x20_exempt_servers"`
+	EphemeralKeys      bool           `toml:"ephemeral_keys"`
+	EphemeralKeysScope string         `toml:"ephemeral_keys_scope"`
+	Proxy              string         `toml:"proxy"`
+	HTTPProxy          string         `toml:"http_proxy"`
+	KeepAlive          int            `toml:"keepalive"`
+	MaxIdleConns       int            `toml:"max_idle_conns"`
+	MaxConns           int            `toml:"max_conns"`
+	PadTo              int            `toml:"pad_to"`
+	RandomPadding      bool           `toml:"random_padding"`
+	Timeout            int            `toml:"timeout_ms"`
+	CertRefreshDelay   int            `toml:"cert_refresh_delay"`
+	BlockIPv6          bool           `toml:"block_ipv6"`
+	ForwardECS         bool           `toml:"forward_ecs"`
+	ForwardECSIPv4Mask int            `toml:"forward_ecs_ipv4_prefix"`
+	ForwardECSIPv6Mask int            `toml:"forward_ecs_ipv6_prefix"`
+	EDNSClientSubnet   string         `toml:"edns_client_subnet"`
+	Cache              bool
+	CacheSize          int                       `toml:"cache_size"`
+	CacheNegTTL        uint32                    `toml:"cache_neg_ttl"`
+	CacheNXDomainTTL   *uint32                   `toml:"cache_neg_nxdomain_ttl"`
+	CacheNoDataTTL     *uint32                   `toml:"cache_neg_nodata_ttl"`
+	CacheServFailTTL   uint32                    `toml:"cache_neg_servfail_ttl"`
+	CacheTTLJitter     int                       `toml:"cache_ttl_jitter"`
+	CacheMinTTL        uint32                    `toml:"cache_min_ttl"`
+	CacheMaxTTL        uint32                    `toml:"cache_max_ttl"`
+	CacheShards        int                       `toml:"cache_shards"`
+	CachePolicy        string                    `toml:"cache_policy"`
+	CacheServeStale    int                       `toml:"cache_serve_stale"`
+	CachePrefetchHits  uint32                    `toml:"cache_prefetch_min_hits"`
+	CacheFile          string                    `toml:"cache_file"`
+	CacheFileMaxSize   int                       `toml:"cache_file_max_size"`
+	CacheBypassFile    string                    `toml:"cache_bypass_file"`
+	SharedCache        string                    `toml:"shared_cache"`
+	CacheFlushQueries  bool                      `toml:"cache_flush_queries"`
+	CacheStatsQueries  bool                      `toml:"cache_stats_queries"`
+	StatsQueries       bool                      `toml:"stats_queries"`
+	ServerStatsLog     int                       `toml:"server_stats_log_interval"`
+	CacheDumpFile      string                    `toml:"cache_dump_file"`
+	AggressiveNSEC     bool                      `toml:"cache_aggressive_nsec"`
+	ClientTTLMin       uint32                    `toml:"client_ttl_min"`
+	ClientTTLMax       uint32                    `toml:"client_ttl_max"`
+	QueryPluginsOrder  []string                  `toml:"query_plugins_order"`
+	RespPluginsOrder   []string                  `toml:"response_plugins_order"`
+	BlockedQueryTypes  []string                  `toml:"blocked_query_types"`
+	BlockedQueryResp   string                    `toml:"blocked_query_response"`
+	SystemHosts        bool                      `toml:"system_hosts"`
+	HostsFiles         []string                  `toml:"hosts_files"`
+	SpecialUseNames    bool                      `toml:"special_use_names"`
+	BlockDoHCanary     bool                      `toml:"block_doh_canary"`
+	DoHCanaryNames     []string                  `toml:"doh_canary_names"`
+	RulesReloadDelay   int                       `toml:"rules_reload_interval"`
+	Schedules          map[string]ScheduleConfig `toml:"schedules"`
+	Whitelist          WhitelistConfig           `toml:"whitelist"`
+	Blacklist          BlacklistConfig           `toml:"blacklist"`
+	Policies           map[string]PolicyConfig   `toml:"policies"`
+	ThreatFeeds        map[string]ThreatConfig   `toml:"threat_feeds"`
+	BlacklistIP        BlacklistIPConfig         `toml:"ip_blacklist"`
+	RewriteIP          RewriteIPConfig           `toml:"ip_rewriting"`
+	Rebinding          RebindingConfig           `toml:"rebinding_protection"`
+	Cloaking           CloakingConfig            `toml:"cloaking"`
+	SafeSearch         SafeSearchConfig          `toml:"safe_search"`
+	CaptivePortals     CaptivePortalsConfig      `toml:"captive_portals"`
+	ExternalPolicy     ExternalPolicyConfig      `toml:"external_policy"`
+	Hooks              HooksConfig               `toml:"hooks"`
+	Webhook            WebhookConfig             `toml:"webhook"`
+	Syslog             SyslogConfig              `toml:"syslog"`
+	EventLog           EventLogConfig            `toml:"event_log"`
+	QueryLog           QueryLogConfig            `toml:"query_log"`
+	LogShipping        LogShippingConfig         `toml:"log_shipping"`
+	Dnstap             DnstapConfig              `toml:"dnstap"`
+	NXLog              NXLogConfig               `toml:"nx_log"`
+	BlockedLog         BlockedLogConfig          `toml:"blocked_log"`
+	SuspiciousLog      SuspiciousLogConfig       `toml:"suspicious_log"`
+	Forwarding         ForwardingConfig          `toml:"forwarding"`
+	DNS64              DNS64Config               `toml:"dns64"`
+	LocalDoH           LocalDoHConfig            `toml:"local_doh"`
+	LocalDoT           LocalDoTConfig            `toml:"local_dot"`
+	Metrics            MetricsConfig             `toml:"metrics"`
+	StatsD             StatsDConfig              `toml:"statsd"`
+	AdminAPI           AdminAPIConfig            `toml:"admin_api"`
+	Control            ControlConfig             `toml:"control"`
+	HealthCheck        HealthCheckConfig         `toml:"health_check"`
+	ListenersConfig    map[string]ListenerConfig `toml:"listeners"`
+	ServersConfig      map[string]ServerConfig   `toml:"servers"`
+	SourcesConfig      map[string]SourceConfig   `toml:"sources"`
+	ODoHRoutes         []ODoHRouteConfig         `toml:"odoh_routes"`
 }
 
 func newConfig() Config {
 	return Config{
 		ListenAddresses:  []string{"127.0.0.1:53"},
+		ListenersPerAddr: 1,
+		RateLimitSlip:    2,
+		MaxActiveQueries: 250,
+		MaxQueuedQueries: 250,
 		Timeout:          2500,
 		CertRefreshDelay: 30,
+		KeepAlive:        int(DefaultKeepAlive / time.Second),
+		MaxIdleConns:     DefaultMaxIdleConns,
 		Cache:            true,
 		CacheSize:        256,
+		CachePolicy:      "arc",
+		CacheShards:      8,
 		CacheNegTTL:      60,
 		CacheMinTTL:      60,
 		CacheMaxTTL:      8600,
+		CacheFileMaxSize: 1048576,
+		Blacklist:        BlacklistConfig{CNAMEBlocking: "block", CNAMEMaxDepth: 8},
+		Cloaking:         CloakingConfig{CloakTTL: 600},
+		ExternalPolicy:   ExternalPolicyConfig{Timeout: 100, FailOpen: true},
+		Syslog:           SyslogConfig{Facility: "daemon"},
+		EventLog:         EventLogConfig{Source: "dnscrypt-proxy"},
+		LogShipping:      LogShippingConfig{BatchSize: 500, FlushInterval: 10},
+		StatsD:           StatsDConfig{Prefix: "dnscrypt_proxy", FlushInterval: 10},
+		SuspiciousLog:    SuspiciousLogConfig{MaxNameLength: 100, MaxLabels: 10, QueryTypes: []string{"NULL", "ANY", "AXFR", "IXFR", "HINFO"}},
 	}
 }
 
 type ServerConfig struct {
-	Stamp        string
-	ProviderName string `toml:"provider_name"`
-	Address      string
-	PublicKey    string `toml:"public_key"`
-	NoLog        bool   `toml:"no_log"`
-	DNSSEC       bool   `toml:"dnssec"`
+	Stamp          string
+	ProviderName   string `toml:"provider_name"`
+	Address        string
+	URL            string
+	TLSServerName  string            `toml:"tls_server_name"`
+	TLSPinnedCerts []string          `toml:"tls_pinned_certs"`
+	PublicKey      string            `toml:"public_key"`
+	NoLog          bool              `toml:"no_log"`
+	DNSSEC         bool              `toml:"dnssec"`
+	ODoH           bool              `toml:"odoh"`
+	IPPreference   string            `toml:"ip_preference"`
+	ForceTCP       bool              `toml:"force_tcp"`
+	ForceUDP       bool              `toml:"force_udp"`
+	DoHMethod      string            `toml:"doh_method"`
+	DoHHeaders     map[string]string `toml:"doh_headers"`
+	TLSCAFile      string            `toml:"tls_ca_file"`
+	ECS            string            `toml:"edns_client_subnet"`
+}
+
+type ListenerConfig struct {
+	Cache       *bool
+	BlockIPv6   *bool    `toml:"block_ipv6"`
+	ServerNames []string `toml:"server_names"`
+	Policy      string
+}
+
+type LocalDoHConfig struct {
+	ListenAddresses []string `toml:"listen_addresses"`
+	Path            string
+	CertFile        string `toml:"cert_file"`
+	CertKeyFile     string `toml:"cert_key_file"`
+}
+
+type WhitelistConfig struct {
+	File string `toml:"whitelist_file"`
+}
+
+type BlacklistConfig struct {
+	File            string `toml:"blacklist_file"`
+	BlockedResponse string `toml:"blocked_response"`
+	CNAMEBlocking   string `toml:"cname_blocking"`
+	CNAMEMaxDepth   int    `toml:"cname_max_depth"`
+}
+
+type PolicyConfig struct {
+	Clients       []string
+	WhitelistFile string `toml:"whitelist_file"`
+	BlacklistFile string `toml:"blacklist_file"`
+}
+
+type ThreatConfig struct {
+	File   string
+	Source string
+}
+
+type BlacklistIPConfig struct {
+	File string `toml:"blacklist_file"`
+}
+
+type RewriteIPConfig struct {
+	File string `toml:"rewriting_file"`
+}
+
+type RebindingConfig struct {
+	Enabled     bool
+	Action      string
+	AllowedFile string `toml:"allowed_names_file"`
+}
+
+type ExternalPolicyConfig struct {
+	URL      string
+	Timeout  int  `toml:"timeout_ms"`
+	FailOpen bool `toml:"fail_open"`
+}
+
+type WebhookConfig struct {
+	URL     string            `toml:"url"`
+	Headers map[string]string `toml:"headers"`
+}
+
+type HooksConfig struct {
+	OnBlocked    []string `toml:"on_blocked"`
+	OnServerDown []string `toml:"on_server_down"`
+}
+
+type CaptivePortalsConfig struct {
+	File      string   `toml:"map_file"`
+	Resolvers []string `toml:"resolvers"`
+}
+
+type CloakingConfig struct {
+	File     string `toml:"cloaking_file"`
+	CloakTTL uint32 `toml:"cloak_ttl"`
+}
+
+type SafeSearchConfig struct {
+	File string `toml:"rules_file"`
+}
+
+type SyslogConfig struct {
+	Address     string
+	Facility    string
+	LogMessages bool `toml:"log_messages"`
+}
+
+type EventLogConfig struct {
+	Enabled bool
+	Source  string
+}
+
+type LogShippingConfig struct {
+	URL           string
+	Headers       map[string]string
+	BatchSize     int    `toml:"batch_size"`
+	FlushInterval int    `toml:"flush_interval"`
+	SpoolDir      string `toml:"spool_dir"`
+}
+
+type DnstapConfig struct {
+	Address  string
+	Identity string
+}
+
+type QueryLogConfig struct {
+	File         string
+	Format       string
+	IgnoredNames []string `toml:"ignored_names"`
+	Sampling     int
+	MaxPerName   int    `toml:"max_lines_per_name"`
+	ClientIPs    string `toml:"client_ips"`
+}
+
+type NXLogConfig struct {
+	File   string
+	Format string
+}
+
+type BlockedLogConfig struct {
+	File   string
+	Format string
+}
+
+type SuspiciousLogConfig struct {
+	File          string
+	Format        string
+	MaxNameLength int      `toml:"max_name_length"`
+	MaxLabels     int      `toml:"max_labels"`
+	QueryTypes    []string `toml:"query_types"`
+}
+
+type ForwardingConfig struct {
+	File string `toml:"forwarding_file"`
+}
+
+type DNS64Config struct {
+	Prefixes  []string `toml:"prefix"`
+	Resolvers []string `toml:"resolver"`
+}
+
+type LocalDoTConfig struct {
+	ListenAddresses []string `toml:"listen_addresses"`
+	CertFile        string   `toml:"cert_file"`
+	CertKeyFile     string   `toml:"cert_key_file"`
+}
+
+type MetricsConfig struct {
+	ListenAddress string `toml:"listen_address"`
+	Path          string
+}
+
+type StatsDConfig struct {
+	Address       string
+	Prefix        string
+	Tags          []string
+	DogStatsD     bool `toml:"dogstatsd"`
+	FlushInterval int  `toml:"flush_interval"`
+}
+
+type AdminAPIConfig struct {
+	ListenAddress string `toml:"listen_address"`
+	Token         string
+}
+
+type ControlConfig struct {
+	Socket string
+}
+
+type HealthCheckConfig struct {
+	ListenAddress string `toml:"listen_address"`
+}
+
+type ODoHRouteConfig struct {
+	ServerName string `toml:"server_name"`
+	Via        []string
 }
 
 type SourceConfig struct {
@@ -58,52 +365,620 @@ type SourceConfig struct {
 	RefreshDelay   int    `toml:"refresh_delay"`
 }
 
+func checkSourceConfig(sourceName string, source *SourceConfig) error {
+	if source.URL == "" {
+		return fmt.Errorf("Missing URL for source [%s]", sourceName)
+	}
+	if source.MinisignKeyStr == "" {
+		return fmt.Errorf("Missing Minisign key for source [%s]", sourceName)
+	}
+	if source.CacheFile == "" {
+		return fmt.Errorf("Missing cache file for source [%s]", sourceName)
+	}
+	if source.FormatStr == "" {
+		return fmt.Errorf("Missing format for source [%s]", sourceName)
+	}
+	if source.RefreshDelay <= 0 {
+		source.RefreshDelay = 24
+	}
+	return nil
+}
+
 func ConfigLoad(proxy *Proxy, config_file string) error {
 	configFile := flag.String("config", "dnscrypt-proxy.toml", "path to the configuration file")
+	showStamp := flag.String("show-stamp", "", "decode and print a server stamp, then exit")
+	control := flag.String("control", "", "send a command to a running instance (status, reload, refresh, flush[=name], log-level=[component:]level), then exit")
 	flag.Parse()
+	if len(*showStamp) > 0 {
+		stamp, err := NewServerStampFromString(*showStamp)
+		if err != nil {
+			return err
+		}
+		fmt.Println(stamp.Describe())
+		os.Exit(0)
+	}
 	config := newConfig()
 	if _, err := toml.DecodeFile(*configFile, &config); err != nil {
 		return err
 	}
+	if len(*control) > 0 {
+		if err := runControlCommand(config.Control.Socket, *control); err != nil {
+			return err
+		}
+		os.Exit(0)
+	}
 	proxy.timeout = time.Duration(config.Timeout) * time.Millisecond
+	proxy.xTransport = NewXTransport(proxy.timeout)
+	if len(config.Metrics.ListenAddress) > 0 || len(config.StatsD.Address) > 0 {
+		proxy.metrics = NewMetrics(config.Metrics.Path)
+		proxy.metricsAddress = config.Metrics.ListenAddress
+	}
+	if len(config.StatsD.Address) > 0 {
+		if config.StatsD.FlushInterval <= 0 {
+			return errors.New("statsd flush_interval must be positive")
+		}
+		statsd, err := NewStatsD(config.StatsD.Address, config.StatsD.Prefix, config.StatsD.Tags, config.StatsD.DogStatsD)
+		if err != nil {
+			return err
+		}
+		proxy.statsd = statsd
+		proxy.statsdInterval = time.Duration(config.StatsD.FlushInterval) * time.Second
+	}
+	if len(config.AdminAPI.ListenAddress) > 0 {
+		if len(config.AdminAPI.Token) == 0 {
+			return errors.New("A token is required to enable the admin API")
+		}
+		if err := checkAdminAPIAddress(config.AdminAPI.ListenAddress); err != nil {
+			return err
+		}
+		proxy.adminAPIAddress, proxy.adminAPIToken = config.AdminAPI.ListenAddress, config.AdminAPI.Token
+	}
+	proxy.controlSocket = config.Control.Socket
+	proxy.healthCheckAddress = config.HealthCheck.ListenAddress
+	if config.KeepAlive < 0 || config.MaxIdleConns < 0 || config.MaxConns < 0 {
+		return errors.New("keepalive, max_idle_conns and max_conns cannot be negative")
+	}
+	proxy.xTransport.keepAlive = time.Duration(config.KeepAlive) * time.Second
+	proxy.xTransport.maxIdleConns = config.MaxIdleConns
+	proxy.xTransport.maxConns = config.MaxConns
+	proxy.xTransport.rebuildTransport()
+	if config.TCPFastOpen {
+		if TCPFastOpenSupported {
+			proxy.xTransport.tcpFastOpen = true
+		} else {
+			dlog.Warn("TCP Fast Open is not supported on this platform")
+		}
+	}
 	proxy.mainProto = "udp"
 	if config.ForceTCP {
 		proxy.mainProto = "tcp"
 	}
+	if len(config.FallbackResolver) > 0 {
+		fallbackResolver := config.FallbackResolver
+		if net.ParseIP(strings.Trim(fallbackResolver, "[]")) != nil {
+			fallbackResolver = net.JoinHostPort(strings.Trim(fallbackResolver, "[]"), "53")
+		}
+		if _, err := net.ResolveUDPAddr("udp", fallbackResolver); err != nil {
+			return fmt.Errorf("Invalid fallback resolver: [%s]", config.FallbackResolver)
+		}
+		proxy.xTransport.fallbackResolver = fallbackResolver
+		proxy.xTransport.ignoreSystemDNS = config.IgnoreSystemDNS
+		proxy.fallbackLastResort = config.FallbackLastResort
+	} else if config.FallbackLastResort {
+		return errors.New("fallback_last_resort requires a fallback_resolver")
+	}
+	proxy.dns0x20 = config.DNS0x20
+	for _, server := range config.DNS0x20Exempt {
+		server, err := normalizeForwardServer(server)
+		if err != nil {
+			return err
+		}
+		proxy.dns0x20Exempt = append(proxy.dns0x20Exempt, server)
+	}
+	if len(config.Proxy) > 0 {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil || proxyURL.Scheme != "socks5" || len(proxyURL.Host) == 0 {
+			return fmt.Errorf("Unsupported proxy: [%s]", config.Proxy)
+		}
+		proxy.xTransport.proxyURL = proxyURL
+		dlog.Warnf("Connections to servers are going through the proxy [%s] - UDP is disabled, all queries will be sent using TCP", proxyURL.Host)
+		proxy.mainProto = "tcp"
+		if proxy.fallbackLastResort {
+			dlog.Warn("The fallback resolver is never used as a last resort when a proxy is configured")
+			proxy.fallbackLastResort = false
+		}
+	}
+	if len(config.HTTPProxy) > 0 {
+		if len(config.Proxy) > 0 {
+			return errors.New("proxy and http_proxy cannot be used together")
+		}
+		httpProxyURL, err := url.Parse(config.HTTPProxy)
+		if err != nil || (httpProxyURL.Scheme != "http" && httpProxyURL.Scheme != "https") || len(httpProxyURL.Host) == 0 {
+			return fmt.Errorf("Unsupported HTTP proxy: [%s]", config.HTTPProxy)
+		}
+		proxy.xTransport.httpProxyURL = httpProxyURL
+		proxy.xTransport.rebuildTransport()
+		dlog.Noticef("DoH connections are going through the HTTP proxy [%s]", httpProxyURL.Host)
+	}
 	proxy.certRefreshDelay = time.Duration(config.CertRefreshDelay) * time.Minute
 	if len(config.ListenAddresses) == 0 {
 		return errors.New("No local IP/port configured")
 	}
 	proxy.listenAddresses = config.ListenAddresses
+	if len(config.TransparentAddrs) > 0 && !TransparentProxySupported {
+		return errors.New("Transparent proxying is not supported on this platform")
+	}
+	proxy.transparentAddresses = config.TransparentAddrs
+	if len(config.NamedPipes) > 0 && !NamedPipesSupported {
+		return errors.New("Named pipes are only supported on Windows")
+	}
+	proxy.namedPipes = config.NamedPipes
+	proxy.listenersPerAddress = Max(1, config.ListenersPerAddr)
+	if len(config.ListenInterface) > 0 && !BindToInterfaceSupported {
+		return errors.New("listen_interface is not supported on this platform")
+	}
+	proxy.listenInterface = config.ListenInterface
+	proxy.listenDualStack = config.ListenDualStack
+	proxyProtocolSources, err := parseCIDRs(config.ProxyProtocolFrom)
+	if err != nil {
+		return err
+	}
+	proxy.proxyProtocolSources = proxyProtocolSources
+	if len(config.AllowedClients) > 0 || len(config.DeniedClients) > 0 {
+		var refuse bool
+		switch strings.ToLower(config.ClientACLAction) {
+		case "", "refuse":
+			refuse = true
+		case "drop":
+		default:
+			return fmt.Errorf("Unsupported clients_acl_action: [%s]", config.ClientACLAction)
+		}
+		clientACL, err := NewClientACL(config.AllowedClients, config.DeniedClients, refuse)
+		if err != nil {
+			return err
+		}
+		proxy.clientACL = clientACL
+	}
+	if config.MaxActiveQueries > 0 {
+		proxy.queryQueue = NewQueryQueue(config.MaxActiveQueries, config.MaxQueuedQueries, proxy.timeout)
+	}
+	if config.RateLimitQPS > 0 {
+		rateLimiter, err := NewRateLimiter(config.RateLimitQPS, config.RateLimitBurst, config.RateLimitSlip)
+		if err != nil {
+			return err
+		}
+		proxy.rateLimiter = rateLimiter
+	}
+	if proxy.listenersPerAddress > 1 && !ReusePortSupported {
+		dlog.Warn("Multiple listeners per address require SO_REUSEPORT, which is not supported on this platform")
+		proxy.listenersPerAddress = 1
+	}
+	if len(config.LocalDoH.ListenAddresses) > 0 {
+		if len(config.LocalDoH.CertFile) == 0 || len(config.LocalDoH.CertKeyFile) == 0 {
+			return errors.New("A certificate and a key are required for the local DoH server")
+		}
+		cert, err := tls.LoadX509KeyPair(config.LocalDoH.CertFile, config.LocalDoH.CertKeyFile)
+		if err != nil {
+			return fmt.Errorf("Unable to load the local DoH server certificate: [%s]", err)
+		}
+		proxy.localDoHCert = cert
+		proxy.localDoHAddresses = config.LocalDoH.ListenAddresses
+		proxy.localDoHPath = config.LocalDoH.Path
+		if len(proxy.localDoHPath) == 0 {
+			proxy.localDoHPath = DefaultLocalDoHPath
+		}
+	}
+	if len(config.LocalDoT.ListenAddresses) > 0 {
+		if len(config.LocalDoT.CertFile) == 0 || len(config.LocalDoT.CertKeyFile) == 0 {
+			return errors.New("A certificate and a key are required for the local DoT server")
+		}
+		cert, err := tls.LoadX509KeyPair(config.LocalDoT.CertFile, config.LocalDoT.CertKeyFile)
+		if err != nil {
+			return fmt.Errorf("Unable to load the local DoT server certificate: [%s]", err)
+		}
+		proxy.localDoTCert = cert
+		for _, listenAddrStr := range config.LocalDoT.ListenAddresses {
+			if net.ParseIP(strings.Trim(listenAddrStr, "[]")) != nil {
+				listenAddrStr = net.JoinHostPort(strings.Trim(listenAddrStr, "[]"), fmt.Sprintf("%d", DefaultLocalDoTPort))
+			}
+			proxy.localDoTAddresses = append(proxy.localDoTAddresses, listenAddrStr)
+		}
+	}
 	proxy.daemonize = config.Daemonize
+	if config.LogFormat != "" && config.LogFormat != "text" && config.LogFormat != "json" {
+		return fmt.Errorf("Unsupported log format: [%s]", config.LogFormat)
+	}
+	globalLogLevel := dlog.SeverityNotice
+	if logLevelFlag := flag.Lookup("loglevel"); logLevelFlag != nil {
+		if getter, ok := logLevelFlag.Value.(flag.Getter); ok {
+			if level, ok := getter.Get().(dlog.Severity); ok {
+				globalLogLevel = level
+			}
+		}
+	}
+	if err := setLogLevels(globalLogLevel, config.LogLevels); err != nil {
+		return err
+	}
+	proxy.ephemeralKeys = config.EphemeralKeys
+	switch strings.ToLower(config.EphemeralKeysScope) {
+	case "", "query":
+	case "server":
+		proxy.ephemeralKeysPerServer = true
+	default:
+		return fmt.Errorf("Unsupported ephemeral_keys_scope: [%s]", config.EphemeralKeysScope)
+	}
+	if config.PadTo < 0 || config.PadTo > MaxDNSUDPPacketSize/4 {
+		return fmt.Errorf("Invalid pad_to value: %d", config.PadTo)
+	}
+	proxy.padTo = config.PadTo
+	proxy.randomPadding = config.RandomPadding && config.PadTo > 0
 	proxy.pluginBlockIPv6 = config.BlockIPv6
+	proxy.pluginSpecialNames = config.SpecialUseNames
+	if config.BlockDoHCanary {
+		proxy.pluginDoHCanary = NewPluginDoHCanary(config.DoHCanaryNames)
+	}
+	if len(config.BlockedQueryTypes) > 0 {
+		pluginBlockQueryTypes, err := NewPluginBlockQueryTypes(config.BlockedQueryTypes, config.BlockedQueryResp)
+		if err != nil {
+			return err
+		}
+		proxy.pluginBlockQueryTypes = pluginBlockQueryTypes
+	}
+	for sourceName, source := range config.SourcesConfig {
+		if source.FormatStr != "rules" {
+			continue
+		}
+		if err := checkSourceConfig(sourceName, &source); err != nil {
+			return err
+		}
+		sourceURL := source.URL
+		source, err := NewSource(proxy.xTransport, source.URL, source.MinisignKeyStr, source.CacheFile, source.FormatStr, time.Duration(source.RefreshDelay)*time.Hour)
+		proxy.metrics.sourceFetched(sourceURL, err)
+		if err != nil {
+			dlog.Criticalf("Unable use source [%s]: [%s]", sourceName, err)
+			continue
+		}
+		source.startRefresh(proxy.metrics)
+		proxy.rulesSources = append(proxy.rulesSources, &source)
+	}
+	proxy.queryPluginsOrder = DefaultQueryPluginsOrder
+	if len(config.QueryPluginsOrder) > 0 {
+		if err := checkPluginsOrder(config.QueryPluginsOrder, DefaultQueryPluginsOrder); err != nil {
+			return fmt.Errorf("query_plugins_order: %s", err)
+		}
+		proxy.queryPluginsOrder = config.QueryPluginsOrder
+	}
+	proxy.responsePluginsOrder = DefaultResponsePluginsOrder
+	if len(config.RespPluginsOrder) > 0 {
+		if err := checkPluginsOrder(config.RespPluginsOrder, DefaultResponsePluginsOrder); err != nil {
+			return fmt.Errorf("response_plugins_order: %s", err)
+		}
+		proxy.responsePluginsOrder = config.RespPluginsOrder
+	}
+	hostsFiles := config.HostsFiles
+	if config.SystemHosts {
+		hostsFiles = append([]string{systemHostsFile()}, hostsFiles...)
+	}
+	if len(hostsFiles) > 0 {
+		pluginHosts, err := NewPluginHosts(hostsFiles)
+		if err != nil {
+			return err
+		}
+		proxy.pluginHosts = pluginHosts
+	}
+	proxy.hooks = NewHooks(config.Hooks.OnBlocked, config.Hooks.OnServerDown)
+	if len(config.Webhook.URL) > 0 {
+		if proxy.webhook, err = NewWebhook(config.Webhook.URL, config.Webhook.Headers); err != nil {
+			return err
+		}
+	}
+	if len(config.Dnstap.Address) > 0 {
+		if proxy.dnstap, err = NewDnstap(config.Dnstap.Address, config.Dnstap.Identity); err != nil {
+			return err
+		}
+	}
+	clientIPs, err := NewClientIPAnonymizer(config.QueryLog.ClientIPs)
+	if err != nil {
+		return err
+	}
+	var eventLog *EventLog
+	if config.EventLog.Enabled {
+		if eventLog, err = NewEventLog(config.EventLog.Source); err != nil {
+			return err
+		}
+		proxy.eventLog = eventLog
+	}
+	var syslog *Syslog
+	if config.Syslog.LogMessages || includesName([]string{config.QueryLog.File, config.NXLog.File, config.BlockedLog.File, config.SuspiciousLog.File}, "syslog") {
+		if syslog, err = NewSyslog(config.Syslog.Address, config.Syslog.Facility); err != nil {
+			return err
+		}
+	}
+	if len(config.QueryLog.File) > 0 {
+		out, err := openQueryLogFile(config.QueryLog.File, syslog, eventLog, "queries")
+		if err != nil {
+			return err
+		}
+		queryLog, err := NewQueryLog(out, config.QueryLog.Format, config.QueryLog.IgnoredNames, clientIPs)
+		if err != nil {
+			return err
+		}
+		queryLog.setLimits(config.QueryLog.Sampling, config.QueryLog.MaxPerName)
+		proxy.queryLogs = append(proxy.queryLogs, queryLog)
+	}
+	if len(config.LogShipping.URL) > 0 {
+		shipper, err := NewLogShipper(config.LogShipping.URL, config.LogShipping.Headers, config.LogShipping.BatchSize,
+			time.Duration(config.LogShipping.FlushInterval)*time.Second, config.LogShipping.SpoolDir)
+		if err != nil {
+			return err
+		}
+		queryLog, err := NewQueryLog(shipper, "ndjson", config.QueryLog.IgnoredNames, clientIPs)
+		if err != nil {
+			return err
+		}
+		queryLog.setLimits(config.QueryLog.Sampling, config.QueryLog.MaxPerName)
+		proxy.queryLogs = append(proxy.queryLogs, queryLog)
+	}
+	if len(config.NXLog.File) > 0 {
+		out, err := openQueryLogFile(config.NXLog.File, syslog, eventLog, "nx")
+		if err != nil {
+			return err
+		}
+		nxLog, err := NewQueryLog(out, config.NXLog.Format, nil, clientIPs)
+		if err != nil {
+			return err
+		}
+		nxLog.filter = nxDomainFilter
+		proxy.queryLogs = append(proxy.queryLogs, nxLog)
+	}
+	if len(config.BlockedLog.File) > 0 {
+		out, err := openQueryLogFile(config.BlockedLog.File, syslog, eventLog, "blocked")
+		if err != nil {
+			return err
+		}
+		blockedLog, err := NewQueryLog(out, config.BlockedLog.Format, nil, clientIPs)
+		if err != nil {
+			return err
+		}
+		blockedLog.filter = blockedFilter
+		proxy.queryLogs = append(proxy.queryLogs, blockedLog)
+	}
+	if len(config.SuspiciousLog.File) > 0 {
+		suspicious, err := NewSuspiciousQueries(config.SuspiciousLog.MaxNameLength, config.SuspiciousLog.MaxLabels, config.SuspiciousLog.QueryTypes)
+		if err != nil {
+			return err
+		}
+		out, err := openQueryLogFile(config.SuspiciousLog.File, syslog, eventLog, "suspicious")
+		if err != nil {
+			return err
+		}
+		suspiciousLog, err := NewQueryLog(out, config.SuspiciousLog.Format, nil, clientIPs)
+		if err != nil {
+			return err
+		}
+		suspiciousLog.filter = suspicious.filter
+		proxy.queryLogs = append(proxy.queryLogs, suspiciousLog)
+	}
+	schedules := make(map[string]*WeeklyRanges)
+	for scheduleName, scheduleConfig := range config.Schedules {
+		weeklyRanges, err := ParseWeeklyRanges(scheduleConfig)
+		if err != nil {
+			return fmt.Errorf("Schedule [%s]: %s", scheduleName, err)
+		}
+		schedules[scheduleName] = weeklyRanges
+	}
+	if len(config.Whitelist.File) > 0 {
+		pluginWhitelist, err := NewPluginWhitelist(config.Whitelist.File, schedules)
+		if err != nil {
+			return err
+		}
+		proxy.pluginWhitelist = pluginWhitelist
+	}
+	blockedResponse, err := ParseBlockedResponse(config.Blacklist.BlockedResponse)
+	if err != nil {
+		return err
+	}
+	if len(config.Blacklist.File) > 0 {
+		pluginBlacklist, err := NewPluginBlacklist(config.Blacklist.File, schedules, blockedResponse)
+		if err != nil {
+			return err
+		}
+		proxy.pluginBlacklist = pluginBlacklist
+	}
+	if len(config.ThreatFeeds) > 0 {
+		files := make(map[string]string)
+		for category, feed := range config.ThreatFeeds {
+			fileName := feed.File
+			if len(feed.Source) > 0 {
+				source, ok := config.SourcesConfig[feed.Source]
+				if !ok || source.FormatStr != "rules" {
+					return fmt.Errorf("Threat feed [%s]: [%s] is not a rules source", category, feed.Source)
+				}
+				fileName = source.CacheFile
+			}
+			if len(fileName) == 0 {
+				return fmt.Errorf("Threat feed [%s]: missing file", category)
+			}
+			files[category] = fileName
+		}
+		pluginThreats, err := NewPluginThreats(files, blockedResponse)
+		if err != nil {
+			return err
+		}
+		proxy.pluginThreats = pluginThreats
+	}
+	proxy.cnameBlocking, err = ParseCNAMEBlockingAction(config.Blacklist.CNAMEBlocking)
+	if err != nil {
+		return err
+	}
+	proxy.cnameMaxDepth = config.Blacklist.CNAMEMaxDepth
+	for policyName, policyConfig := range config.Policies {
+		policy, err := NewClientPolicy(policyName, policyConfig, schedules, blockedResponse)
+		if err != nil {
+			return fmt.Errorf("Policy [%s]: %s", policyName, err)
+		}
+		proxy.clientPolicies = append(proxy.clientPolicies, policy)
+	}
+	if len(config.BlacklistIP.File) > 0 {
+		pluginBlacklistIP, err := NewPluginBlacklistIP(config.BlacklistIP.File)
+		if err != nil {
+			return err
+		}
+		proxy.pluginBlacklistIP = pluginBlacklistIP
+	}
+	if config.Rebinding.Enabled {
+		pluginRebinding, err := NewPluginRebinding(config.Rebinding.AllowedFile, config.Rebinding.Action)
+		if err != nil {
+			return err
+		}
+		proxy.pluginRebinding = pluginRebinding
+	}
+	if len(config.RewriteIP.File) > 0 {
+		pluginRewriteIP, err := NewPluginRewriteIP(config.RewriteIP.File)
+		if err != nil {
+			return err
+		}
+		proxy.pluginRewriteIP = pluginRewriteIP
+	}
+	if len(config.ExternalPolicy.URL) > 0 {
+		if config.ExternalPolicy.Timeout <= 0 {
+			return errors.New("The external policy timeout_ms must be positive")
+		}
+		pluginExternal, err := NewPluginExternal(config.ExternalPolicy.URL, time.Duration(config.ExternalPolicy.Timeout)*time.Millisecond, config.ExternalPolicy.FailOpen)
+		if err != nil {
+			return err
+		}
+		proxy.pluginExternal = pluginExternal
+	}
+	if len(config.CaptivePortals.File) > 0 {
+		pluginCaptivePortal, err := NewPluginCaptivePortal(proxy, config.CaptivePortals.File, config.CaptivePortals.Resolvers)
+		if err != nil {
+			return err
+		}
+		proxy.pluginCaptivePortal = pluginCaptivePortal
+	}
+	if len(config.Cloaking.File) > 0 {
+		pluginCloak, err := NewPluginCloak("cloaking", config.Cloaking.File, config.Cloaking.CloakTTL)
+		if err != nil {
+			return err
+		}
+		proxy.pluginCloak = pluginCloak
+	}
+	if len(config.SafeSearch.File) > 0 {
+		pluginSafeSearch, err := NewPluginCloak("safe search", config.SafeSearch.File, config.Cloaking.CloakTTL)
+		if err != nil {
+			return err
+		}
+		proxy.pluginSafeSearch = pluginSafeSearch
+	}
+	if len(config.Forwarding.File) > 0 {
+		pluginForward, err := NewPluginForward(proxy, config.Forwarding.File)
+		if err != nil {
+			return err
+		}
+		proxy.pluginForward = pluginForward
+	}
+	if config.RulesReloadDelay > 0 {
+		startRulesReloader(time.Duration(config.RulesReloadDelay) * time.Second)
+	}
+	if len(config.DNS64.Prefixes) > 0 || len(config.DNS64.Resolvers) > 0 {
+		pluginDNS64, err := NewPluginDNS64(proxy, config.DNS64.Prefixes, config.DNS64.Resolvers)
+		if err != nil {
+			return err
+		}
+		proxy.pluginDNS64 = pluginDNS64
+	}
 	proxy.cache = config.Cache
 	proxy.cacheSize = config.CacheSize
 	proxy.cacheNegTTL = config.CacheNegTTL
+	proxy.cacheNXDomainTTL = config.CacheNegTTL
+	if config.CacheNXDomainTTL != nil {
+		proxy.cacheNXDomainTTL = *config.CacheNXDomainTTL
+	}
+	proxy.cacheNoDataTTL = config.CacheNegTTL
+	if config.CacheNoDataTTL != nil {
+		proxy.cacheNoDataTTL = *config.CacheNoDataTTL
+	}
+	proxy.cacheServFailTTL = config.CacheServFailTTL
+	if config.CacheTTLJitter < 0 || config.CacheTTLJitter > 50 {
+		return fmt.Errorf("Invalid cache_ttl_jitter value: %d", config.CacheTTLJitter)
+	}
+	proxy.cacheTTLJitter = config.CacheTTLJitter
 	proxy.cacheMinTTL = config.CacheMinTTL
 	proxy.cacheMaxTTL = config.CacheMaxTTL
+	proxy.cacheShards = config.CacheShards
+	proxy.cachePolicy = strings.ToLower(config.CachePolicy)
+	proxy.forwardECS = config.ForwardECS
+	if config.ForwardECSIPv4Mask < 0 || config.ForwardECSIPv4Mask > 32 {
+		return fmt.Errorf("Invalid forward_ecs_ipv4_prefix value: %d", config.ForwardECSIPv4Mask)
+	}
+	if config.ForwardECSIPv6Mask < 0 || config.ForwardECSIPv6Mask > 128 {
+		return fmt.Errorf("Invalid forward_ecs_ipv6_prefix value: %d", config.ForwardECSIPv6Mask)
+	}
+	proxy.ecsIPv4Prefix = uint8(config.ForwardECSIPv4Mask)
+	proxy.ecsIPv6Prefix = uint8(config.ForwardECSIPv6Mask)
+	if len(config.EDNSClientSubnet) > 0 {
+		ecs, err := ParseECS(config.EDNSClientSubnet)
+		if err != nil {
+			return err
+		}
+		proxy.ecs = ecs
+	}
+	proxy.cachePrefetchMinHits = config.CachePrefetchHits
+	proxy.cacheServeStale = time.Duration(config.CacheServeStale) * time.Minute
+	proxy.cacheFile = config.CacheFile
+	proxy.cacheFileMaxSize = config.CacheFileMaxSize
+	if config.ClientTTLMax > 0 && config.ClientTTLMin > config.ClientTTLMax {
+		return errors.New("client_ttl_min cannot be larger than client_ttl_max")
+	}
+	if len(config.SharedCache) > 0 {
+		sharedCache, err := NewSharedCache(config.SharedCache)
+		if err != nil {
+			return err
+		}
+		proxy.sharedCache = sharedCache
+	}
+	proxy.cacheFlushQueries = config.CacheFlushQueries
+	proxy.cacheStatsQueries = config.CacheStatsQueries
+	proxy.statsQueries = config.StatsQueries
+	proxy.serverStatsInterval = time.Duration(config.ServerStatsLog) * time.Minute
+	proxy.cacheDumpFile = config.CacheDumpFile
+	proxy.cacheAggressiveNSEC = config.AggressiveNSEC
+	proxy.clientTTLMin = config.ClientTTLMin
+	proxy.clientTTLMax = config.ClientTTLMax
+	if len(config.CacheBypassFile) > 0 {
+		cacheBypass, err := NewCacheBypassRules(config.CacheBypassFile)
+		if err != nil {
+			return err
+		}
+		proxy.cacheBypass = cacheBypass
+	}
+	proxy.serversOptions = make(map[string]ServerOptions)
+	proxy.odohRoutes = make(map[string][]*url.URL)
+	for _, route := range config.ODoHRoutes {
+		for _, relayURLStr := range route.Via {
+			relayURL, err := url.Parse(relayURLStr)
+			if err != nil || relayURL.Scheme != "https" {
+				return fmt.Errorf("Invalid ODoH relay URL for [%s]: [%s]", route.ServerName, relayURLStr)
+			}
+			proxy.odohRoutes[route.ServerName] = append(proxy.odohRoutes[route.ServerName], relayURL)
+		}
+	}
 	if len(config.ServerNames) == 0 {
 		for serverName := range config.ServersConfig {
 			config.ServerNames = append(config.ServerNames, serverName)
 		}
 	}
 	for sourceName, source := range config.SourcesConfig {
-		if source.URL == "" {
-			return fmt.Errorf("Missing URL for source [%s]", sourceName)
-		}
-		if source.MinisignKeyStr == "" {
-			return fmt.Errorf("Missing Minisign key for source [%s]", sourceName)
-		}
-		if source.CacheFile == "" {
-			return fmt.Errorf("Missing cache file for source [%s]", sourceName)
-		}
-		if source.FormatStr == "" {
-			return fmt.Errorf("Missing format for source [%s]", sourceName)
+		if source.FormatStr == "rules" {
+			continue
 		}
-		if source.RefreshDelay <= 0 {
-			source.RefreshDelay = 24
+		if err := checkSourceConfig(sourceName, &source); err != nil {
+			return err
 		}
-		source, err := NewSource(source.URL, source.MinisignKeyStr, source.CacheFile, source.FormatStr, time.Duration(source.RefreshDelay)*time.Hour)
+		sourceURL := source.URL
+		source, err := NewSource(proxy.xTransport, source.URL, source.MinisignKeyStr, source.CacheFile, source.FormatStr, time.Duration(source.RefreshDelay)*time.Hour)
+		proxy.metrics.sourceFetched(sourceURL, err)
 		if err != nil {
 			dlog.Criticalf("Unable use source [%s]: [%s]", sourceName, err)
 			continue
@@ -117,6 +992,10 @@ func ConfigLoad(proxy *Proxy, config_file string) error {
 			if !includesName(config.ServerNames, registeredServer.name) {
 				continue
 			}
+			if !isSupportedProto(registeredServer.stamp.proto) {
+				dlog.Infof("[%s] %s servers are not supported yet - ignoring this server", registeredServer.name, registeredServer.stamp.proto.String())
+				continue
+			}
 			dlog.Infof("Adding [%s] to the set of wanted resolvers", registeredServer.name)
 			proxy.registeredServers = append(proxy.registeredServers, registeredServer)
 		}
@@ -129,19 +1008,122 @@ func ConfigLoad(proxy *Proxy, config_file string) error {
 		var stamp ServerStamp
 		var err error
 		if len(serverConfig.Stamp) > 0 {
-			dlog.Fatal("Stamps are not implemented yet")
+			stamp, err = NewServerStampFromString(serverConfig.Stamp)
+			if err != nil {
+				return fmt.Errorf("Stamp error for [%s]: [%s]", serverName, err)
+			}
+		} else if strings.HasPrefix(serverConfig.URL, "tls://") {
+			stamp, err = NewDoTServerStampFromLegacy(serverConfig.URL, serverConfig.Address, serverConfig.TLSServerName, serverConfig.TLSPinnedCerts)
+			if err != nil {
+				return err
+			}
+		} else if serverConfig.ODoH {
+			stamp, err = NewODoHTargetStampFromLegacy(serverConfig.URL)
+			if err != nil {
+				return err
+			}
+		} else if len(serverConfig.URL) > 0 {
+			stamp, err = NewDoHServerStampFromLegacy(serverConfig.URL, serverConfig.Address, serverConfig.TLSPinnedCerts)
+			if err != nil {
+				return err
+			}
 		} else {
 			stamp, err = NewServerStampFromLegacy(serverConfig.Address, serverConfig.PublicKey, serverConfig.ProviderName)
 			if err != nil {
 				return err
 			}
 		}
+		if len(serverConfig.Stamp) == 0 {
+			if serverConfig.DNSSEC {
+				stamp.props |= ServerInformalPropertyDNSSEC
+			}
+			if serverConfig.NoLog {
+				stamp.props |= ServerInformalPropertyNoLog
+			}
+		}
+		var options ServerOptions
+		if serverConfig.ForceTCP || serverConfig.ForceUDP {
+			if serverConfig.ForceTCP && serverConfig.ForceUDP {
+				return fmt.Errorf("[%s]: force_tcp and force_udp cannot be used together", serverName)
+			}
+			if stamp.proto != StampProtoTypeDNSCrypt {
+				dlog.Warnf("[%s] force_tcp and force_udp only apply to DNSCrypt servers - ignoring", serverName)
+			} else if serverConfig.ForceTCP {
+				options.forcedProto = "tcp"
+			} else if proxy.xTransport.proxyURL != nil {
+				dlog.Warnf("[%s] UDP cannot be used through a proxy - ignoring force_udp", serverName)
+			} else {
+				options.forcedProto = "udp"
+			}
+		}
+		if len(serverConfig.DoHMethod) > 0 || len(serverConfig.DoHHeaders) > 0 {
+			if stamp.proto != StampProtoTypeDoH {
+				dlog.Warnf("[%s] doh_method and doh_headers only apply to DoH servers - ignoring", serverName)
+			} else {
+				switch strings.ToUpper(serverConfig.DoHMethod) {
+				case "", "POST":
+				case "GET":
+					options.dohGET = true
+				default:
+					return fmt.Errorf("[%s]: unsupported DoH method [%s]", serverName, serverConfig.DoHMethod)
+				}
+				options.dohHeaders = serverConfig.DoHHeaders
+			}
+		}
+		if len(serverConfig.TLSCAFile) > 0 {
+			if stamp.proto != StampProtoTypeDoH && stamp.proto != StampProtoTypeTLS {
+				dlog.Warnf("[%s] tls_ca_file only applies to DoH and DoT servers - ignoring", serverName)
+			} else if options.rootCAs, err = loadCAFile(serverConfig.TLSCAFile); err != nil {
+				return fmt.Errorf("[%s]: %s", serverName, err)
+			}
+		}
+		if len(serverConfig.ECS) > 0 {
+			if options.ecs, err = ParseECS(serverConfig.ECS); err != nil {
+				return fmt.Errorf("[%s]: %s", serverName, err)
+			}
+		}
+		proxy.serversOptions[serverName] = options
+		if len(serverConfig.IPPreference) > 0 {
+			family, err := parseIPFamily(serverConfig.IPPreference)
+			if err != nil {
+				return fmt.Errorf("[%s]: %s", serverName, err)
+			}
+			proxy.xTransport.setPreferredIPFamily(stamp.dialHostName(), family)
+		}
+		if !isSupportedProto(stamp.proto) {
+			dlog.Errorf("[%s] %s servers are not supported yet - ignoring this server", serverName, stamp.proto.String())
+			continue
+		}
 		proxy.registeredServers = append(proxy.registeredServers,
 			RegisteredServer{name: serverName, stamp: stamp})
 	}
 	if len(proxy.registeredServers) == 0 {
 		return errors.New("No servers configured")
 	}
+	proxy.listenersOptions = make(map[string]*ListenerOptions)
+	for listenAddrStr, listenerConfig := range config.ListenersConfig {
+		for _, serverName := range listenerConfig.ServerNames {
+			if !includesRegisteredServer(proxy.registeredServers, serverName) {
+				dlog.Warnf("Listener [%s] uses [%s], which is not an enabled server", listenAddrStr, serverName)
+			}
+		}
+		listenerOptions := NewListenerOptions(proxy, listenerConfig.Cache, listenerConfig.BlockIPv6, listenerConfig.ServerNames)
+		if len(listenerConfig.Policy) > 0 {
+			if listenerOptions.policy = proxy.clientPolicies.named(listenerConfig.Policy); listenerOptions.policy == nil {
+				return fmt.Errorf("Listener [%s]: undefined policy [%s]", listenAddrStr, listenerConfig.Policy)
+			}
+		}
+		proxy.listenersOptions[normalizeListenAddr(listenAddrStr)] = listenerOptions
+	}
+	if proxy.cacheEnabled() && proxy.cacheSize <= 0 {
+		return errors.New("cache_size must be positive when the cache is enabled")
+	}
+	if !config.Syslog.LogMessages {
+		syslog = nil
+	}
+	if syslog != nil || eventLog != nil || config.LogFormat == "json" {
+		return captureLogs(syslog, eventLog, config.LogFormat == "json")
+	}
 	return nil
 }
 
@@ -153,3 +1135,16 @@ func includesName(names []string, name string) bool {
 	}
 	return false
 }
+
+func includesRegisteredServer(registeredServers []RegisteredServer, name string) bool {
+	for _, registeredServer := range registeredServers {
+		if strings.EqualFold(registeredServer.name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSupportedProto(proto StampProtoType) bool {
+	return proto != StampProtoTypeDoQ && proto != StampProtoTypePlain
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxIdleConns = 4
+)
+
+type idleConn struct {
+	conn      net.Conn
+	idleSince time.Time
+}
+
+// A pool of connections to a single upstream server. Idle connections are
+// evicted after idleTimeout, and connections are discarded after any error.
+// If maxConns > 0, at most maxConns connections can be in use at once.
+
+type ConnPool struct {
+	sync.Mutex
+	dial        func() (net.Conn, error)
+	maxIdle     int
+	idleTimeout time.Duration
+	waitTimeout time.Duration
+	slots       chan struct{}
+	idle        []idleConn
+	closed      bool
+}
+
+func NewConnPool(dial func() (net.Conn, error), maxIdle int, maxConns int, idleTimeout time.Duration, waitTimeout time.Duration) *ConnPool {
+	pool := ConnPool{
+		dial:        dial,
+		maxIdle:     maxIdle,
+		idleTimeout: idleTimeout,
+		waitTimeout: waitTimeout,
+	}
+	if maxConns > 0 {
+		pool.slots = make(chan struct{}, maxConns)
+	}
+	return &pool
+}
+
+func (xTransport *XTransport) NewConnPool(dial func() (net.Conn, error)) *ConnPool {
+	return NewConnPool(dial, xTransport.maxIdleConns, xTransport.maxConns, xTransport.keepAlive, xTransport.timeout)
+}
+
+func (pool *ConnPool) acquire() error {
+	if pool.slots == nil {
+		return nil
+	}
+	select {
+	case pool.slots <- struct{}{}:
+		return nil
+	case <-time.After(pool.waitTimeout):
+		return errors.New("Too many connections to the server")
+	}
+}
+
+func (pool *ConnPool) release() {
+	if pool.slots != nil {
+		<-pool.slots
+	}
+}
+
+func (pool *ConnPool) get(fresh bool) (net.Conn, bool, error) {
+	if err := pool.acquire(); err != nil {
+		return nil, false, err
+	}
+	now := time.Now()
+	pool.Lock()
+	for !fresh && len(pool.idle) > 0 {
+		n := len(pool.idle)
+		idle := pool.idle[n-1]
+		pool.idle = pool.idle[:n-1]
+		if now.Sub(idle.idleSince) < pool.idleTimeout {
+			pool.Unlock()
+			return idle.conn, true, nil
+		}
+		idle.conn.Close()
+	}
+	pool.Unlock()
+	conn, err := pool.dial()
+	if err != nil {
+		pool.release()
+		return nil, false, err
+	}
+	return conn, false, nil
+}
+
+func (pool *ConnPool) put(conn net.Conn) {
+	pool.release()
+	pool.Lock()
+	if pool.closed || len(pool.idle) >= pool.maxIdle {
+		pool.Unlock()
+		conn.Close()
+		return
+	}
+	pool.idle = append(pool.idle, idleConn{conn: conn, idleSince: time.Now()})
+	pool.Unlock()
+}
+
+func (pool *ConnPool) discard(conn net.Conn) {
+	conn.Close()
+	pool.release()
+}
+
+// Runs exchange on a pooled connection, retrying once on a new connection
+// if a reused one turns out to be unusable
+
+func (pool *ConnPool) Do(exchange func(conn net.Conn) error) error {
+	conn, reused, err := pool.get(false)
+	if err != nil {
+		return err
+	}
+	err = exchange(conn)
+	if err != nil && reused {
+		pool.discard(conn)
+		if conn, _, err = pool.get(true); err != nil {
+			return err
+		}
+		err = exchange(conn)
+	}
+	if err != nil {
+		pool.discard(conn)
+		return err
+	}
+	pool.put(conn)
+	return nil
+}
+
+func (pool *ConnPool) Close() {
+	pool.Lock()
+	pool.closed = true
+	for _, idle := range pool.idle {
+		idle.conn.Close()
+	}
+	pool.idle = nil
+	pool.Unlock()
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ControlTimeout = 30 * time.Second
+	ControlService = "/dnscrypt_proxy.control.v1.Control/"
+)
+
+// Encoding and decoding of the messages of control.proto
+
+func encodeServerStatus(server AdminServerStatus) []byte {
+	var out []byte
+	out = protoAppendString(out, 1, server.Name)
+	out = protoAppendString(out, 2, server.Proto)
+	out = protoAppendBool(out, 3, server.Failing)
+	out = protoAppendDouble(out, 4, server.RTT)
+	out = protoAppendUint(out, 5, server.Stats.Queries)
+	out = protoAppendUint(out, 6, server.Stats.Successes)
+	out = protoAppendUint(out, 7, server.Stats.Timeouts)
+	out = protoAppendUint(out, 8, server.Stats.Errors)
+	out = protoAppendDouble(out, 9, server.Stats.ErrorRate)
+	out = protoAppendDouble(out, 10, server.Stats.P50)
+	out = protoAppendDouble(out, 11, server.Stats.P90)
+	out = protoAppendDouble(out, 12, server.Stats.P99)
+	for bucket, count := range server.Stats.Histogram {
+		entry := protoAppendString(nil, 1, bucket)
+		entry = protoAppendUint(entry, 2, count)
+		out = protoAppendMessage(out, 13, entry)
+	}
+	return out
+}
+
+func decodeServerStatus(in []byte) (AdminServerStatus, error) {
+	server := AdminServerStatus{}
+	err := protoParse(in, func(field ProtoField) error {
+		switch field.number {
+		case 1:
+			server.Name = string(field.bytes)
+		case 2:
+			server.Proto = string(field.bytes)
+		case 3:
+			server.Failing = field.value != 0
+		case 4:
+			server.RTT = field.double()
+		case 5:
+			server.Stats.Queries = field.value
+		case 6:
+			server.Stats.Successes = field.value
+		case 7:
+			server.Stats.Timeouts = field.value
+		case 8:
+			server.Stats.Errors = field.value
+		case 9:
+			server.Stats.ErrorRate = field.double()
+		case 10:
+			server.Stats.P50 = field.double()
+		case 11:
+			server.Stats.P90 = field.double()
+		case 12:
+			server.Stats.P99 = field.double()
+		case 13:
+			var bucket string
+			var count uint64
+			if err := protoParse(field.bytes, func(entryField ProtoField) error {
+				switch entryField.number {
+				case 1:
+					bucket = string(entryField.bytes)
+				case 2:
+					count = entryField.value
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			if server.Stats.Histogram == nil {
+				server.Stats.Histogram = make(map[string]uint64)
+			}
+			server.Stats.Histogram[bucket] = count
+		}
+		return nil
+	})
+	return server, err
+}
+
+var controlCacheCounters = []string{"hits", "misses", "insertions", "evictions"}
+
+func encodeCacheStatus(cache AdminCacheStatus) []byte {
+	var out []byte
+	out = protoAppendUint(out, 1, uint64(cache.Entries))
+	out = protoAppendUint(out, 2, uint64(cache.Size))
+	for listenAddrStr, stats := range cache.Listeners {
+		var counters []byte
+		for i, counter := range controlCacheCounters {
+			counters = protoAppendUint(counters, i+1, stats[counter])
+		}
+		entry := protoAppendString(nil, 1, listenAddrStr)
+		entry = protoAppendMessage(entry, 2, counters)
+		out = protoAppendMessage(out, 3, entry)
+	}
+	return out
+}
+
+func decodeCacheStatus(in []byte) (AdminCacheStatus, error) {
+	cache := AdminCacheStatus{Listeners: make(map[string]map[string]uint64)}
+	err := protoParse(in, func(field ProtoField) error {
+		switch field.number {
+		case 1:
+			cache.Entries = int(field.value)
+		case 2:
+			cache.Size = int(field.value)
+		case 3:
+			var listenAddrStr string
+			stats := make(map[string]uint64)
+			for _, counter := range controlCacheCounters {
+				stats[counter] = 0
+			}
+			if err := protoParse(field.bytes, func(entryField ProtoField) error {
+				switch entryField.number {
+				case 1:
+					listenAddrStr = string(entryField.bytes)
+				case 2:
+					return protoParse(entryField.bytes, func(counterField ProtoField) error {
+						if counterField.number >= 1 && counterField.number <= len(controlCacheCounters) {
+							stats[controlCacheCounters[counterField.number-1]] = counterField.value
+						}
+						return nil
+					})
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			cache.Listeners[listenAddrStr] = stats
+		}
+		return nil
+	})
+	return cache, err
+}
+
+func encodeRulesStatus(rules AdminRulesStatus) []byte {
+	var out []byte
+	out = protoAppendString(out, 1, rules.Kind)
+	out = protoAppendString(out, 2, rules.File)
+	return protoAppendUint(out, 3, uint64(rules.Count))
+}
+
+func decodeRulesStatus(in []byte) (AdminRulesStatus, error) {
+	rules := AdminRulesStatus{}
+	err := protoParse(in, func(field ProtoField) error {
+		switch field.number {
+		case 1:
+			rules.Kind = string(field.bytes)
+		case 2:
+			rules.File = string(field.bytes)
+		case 3:
+			rules.Count = int(field.value)
+		}
+		return nil
+	})
+	return rules, err
+}
+
+func encodeRulesStatuses(out []byte, field int, rules []AdminRulesStatus) []byte {
+	for _, rulesFile := range rules {
+		out = protoAppendMessage(out, field, encodeRulesStatus(rulesFile))
+	}
+	return out
+}
+
+func (proxy *Proxy) controlServer() GRPCServer {
+	return GRPCServer{
+		ControlService + "Status": func(request []byte) ([]byte, error) {
+			var out []byte
+			for _, server := range proxy.adminServers() {
+				out = protoAppendMessage(out, 1, encodeServerStatus(server))
+			}
+			out = protoAppendMessage(out, 2, encodeCacheStatus(proxy.adminCache()))
+			return encodeRulesStatuses(out, 3, adminRules()), nil
+		},
+		ControlService + "ReloadRules": func(request []byte) ([]byte, error) {
+			reloadRulesFiles(true)
+			return encodeRulesStatuses(nil, 1, adminRules()), nil
+		},
+		ControlService + "RefreshSources": func(request []byte) ([]byte, error) {
+			var out []byte
+			for _, failure := range proxy.adminRefreshSources() {
+				out = protoAppendString(out, 1, failure)
+			}
+			return out, nil
+		},
+		ControlService + "FlushCache": func(request []byte) ([]byte, error) {
+			name := ""
+			if err := protoParse(request, func(field ProtoField) error {
+				if field.number == 1 {
+					name = string(field.bytes)
+				}
+				return nil
+			}); err != nil {
+				return nil, &GRPCError{code: GRPCStatusInvalidArgument, message: err.Error()}
+			}
+			if len(name) == 0 {
+				name = "."
+			}
+			count := cachedResponses.flush(name)
+			cacheLog.Noticef("Cache flushed for [%s] - %d entries removed", name, count)
+			return protoAppendUint(nil, 1, uint64(count)), nil
+		},
+		ControlService + "SetLogLevel": func(request []byte) ([]byte, error) {
+			component, level := "", 0
+			err := protoParse(request, func(field ProtoField) error {
+				switch field.number {
+				case 1:
+					component = string(field.bytes)
+				case 2:
+					level = int(field.value)
+				}
+				return nil
+			})
+			if err == nil {
+				err = setLogLevel(component, level)
+			}
+			if err != nil {
+				return nil, &GRPCError{code: GRPCStatusInvalidArgument, message: err.Error()}
+			}
+			return protoAppendUint(nil, 1, uint64(level)), nil
+		},
+	}
+}
+
+// The socket is only accessible to the user running the proxy, so that
+// requests don't need to be authenticated
+
+func (proxy *Proxy) controlSocketListener(socketPath string) error {
+	os.Remove(socketPath)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(socketPath, 0600); err != nil {
+		listener.Close()
+		return err
+	}
+	go func() {
+		listenersLog.Noticef("Now serving the control plane on unix:%s", socketPath)
+		if err := serveGRPC(listener, proxy.controlServer()); err != nil {
+			listenersLog.Error(err)
+		}
+	}()
+	return nil
+}
+
+// Commands: status, reload, refresh, flush[=<name>], log-level=[<component>:]<level>
+
+func controlRequest(command string) (string, []byte, error) {
+	parts := strings.SplitN(command, "=", 2)
+	argument := ""
+	if len(parts) == 2 {
+		argument = parts[1]
+	}
+	switch parts[0] {
+	case "status":
+		return "Status", nil, nil
+	case "reload":
+		return "ReloadRules", nil, nil
+	case "refresh":
+		return "RefreshSources", nil, nil
+	case "flush":
+		return "FlushCache", protoAppendString(nil, 1, argument), nil
+	case "log-level":
+		if len(argument) == 0 {
+			return "", nil, errors.New("Missing log level")
+		}
+		component := ""
+		if levelParts := strings.SplitN(argument, ":", 2); len(levelParts) == 2 {
+			component, argument = levelParts[0], levelParts[1]
+		}
+		level, err := strconv.ParseUint(argument, 10, 32)
+		if err != nil {
+			return "", nil, fmt.Errorf("Invalid log level: [%s]", argument)
+		}
+		request := protoAppendString(nil, 1, component)
+		return "SetLogLevel", protoAppendUint(request, 2, level), nil
+	}
+	return "", nil, fmt.Errorf("Unknown control command: [%s]", command)
+}
+
+func decodeControlResponse(method string, response []byte) (interface{}, error) {
+	switch method {
+	case "Status":
+		status := AdminStatus{Servers: []AdminServerStatus{}, Rules: []AdminRulesStatus{}}
+		err := protoParse(response, func(field ProtoField) error {
+			var err error
+			switch field.number {
+			case 1:
+				var server AdminServerStatus
+				if server, err = decodeServerStatus(field.bytes); err == nil {
+					status.Servers = append(status.Servers, server)
+				}
+			case 2:
+				status.Cache, err = decodeCacheStatus(field.bytes)
+			case 3:
+				var rules AdminRulesStatus
+				if rules, err = decodeRulesStatus(field.bytes); err == nil {
+					status.Rules = append(status.Rules, rules)
+				}
+			}
+			return err
+		})
+		return status, err
+	case "ReloadRules":
+		rules := []AdminRulesStatus{}
+		err := protoParse(response, func(field ProtoField) error {
+			if field.number != 1 {
+				return nil
+			}
+			rulesFile, err := decodeRulesStatus(field.bytes)
+			rules = append(rules, rulesFile)
+			return err
+		})
+		return rules, err
+	case "RefreshSources":
+		failures := []string{}
+		err := protoParse(response, func(field ProtoField) error {
+			if field.number == 1 {
+				failures = append(failures, string(field.bytes))
+			}
+			return nil
+		})
+		return map[string][]string{"errors": failures}, err
+	}
+	var value uint64
+	err := protoParse(response, func(field ProtoField) error {
+		if field.number == 1 {
+			value = field.value
+		}
+		return nil
+	})
+	if method == "FlushCache" {
+		return map[string]uint64{"flushed": value}, err
+	}
+	return map[string]uint64{"level": value}, err
+}
+
+func runControlCommand(socketPath string, command string) error {
+	if len(socketPath) == 0 {
+		return errors.New("The control socket is not configured")
+	}
+	method, request, err := controlRequest(command)
+	if err != nil {
+		return err
+	}
+	client, err := NewGRPCClient("http://dnscrypt-proxy", func(ctx context.Context, _, _ string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "unix", socketPath)
+	})
+	if err != nil {
+		return err
+	}
+	response, err := client.call(ControlService+method, request, ControlTimeout)
+	if err != nil {
+		return err
+	}
+	decoded, err := decodeControlResponse(method, response)
+	if err != nil {
+		return err
+	}
+	encoded, err := json.Marshal(decoded)
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(encoded))
+	return nil
+}
@@ -4,20 +4,142 @@ import (
 	"bytes"
 	"crypto/rand"
 	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jedisct1/xsecretbox"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/crypto/nacl/secretbox"
 )
 
 const (
-	NonceSize        = xsecretbox.NonceSize
-	HalfNonceSize    = xsecretbox.NonceSize / 2
-	TagSize          = xsecretbox.TagSize
-	PublicKeySize    = 32
-	QueryOverhead    = ClientMagicLen + PublicKeySize + HalfNonceSize + TagSize
-	ResponseOverhead = len(ServerMagic) + NonceSize + TagSize
+	NonceSize                   = xsecretbox.NonceSize
+	HalfNonceSize               = xsecretbox.NonceSize / 2
+	TagSize                     = xsecretbox.TagSize
+	PublicKeySize               = 32
+	QueryOverhead               = ClientMagicLen + PublicKeySize + HalfNonceSize + TagSize
+	ResponseOverhead            = len(ServerMagic) + NonceSize + TagSize
+	EphemeralKeysPoolSize       = 64
+	EphemeralKeysPoolExpiration = time.Hour
 )
 
+type EphemeralKey struct {
+	publicKey [32]byte
+	sharedKey [32]byte
+}
+
+func NewEphemeralKey(cryptoConstruction CryptoConstruction, serverPk *[32]byte) (EphemeralKey, error) {
+	var key EphemeralKey
+	var secretKey [32]byte
+	if _, err := rand.Read(secretKey[:]); err != nil {
+		return key, err
+	}
+	curve25519.ScalarBaseMult(&key.publicKey, &secretKey)
+	sharedKey, err := ComputeSharedKey(cryptoConstruction, &secretKey, serverPk)
+	if err != nil {
+		return key, err
+	}
+	key.sharedKey = *sharedKey
+	return key, nil
+}
+
+type EphemeralKeysPool struct {
+	cryptoConstruction CryptoConstruction
+	serverPk           [32]byte
+	keys               chan EphemeralKey
+	lastUsed           int64
+}
+
+// Ephemeral keys, including the shared key with each server, are precomputed
+// in the background, so that the key exchange is not on the query path.
+// Pools of servers that are not used any more, for example after a
+// certificate change, are eventually removed.
+
+type EphemeralKeysCache struct {
+	sync.Mutex
+	pools map[[32]byte]*EphemeralKeysPool
+	wake  chan struct{}
+}
+
+func NewEphemeralKeysCache() *EphemeralKeysCache {
+	cache := EphemeralKeysCache{
+		pools: make(map[[32]byte]*EphemeralKeysPool),
+		wake:  make(chan struct{}, 1),
+	}
+	go cache.run()
+	return &cache
+}
+
+func (cache *EphemeralKeysCache) get(serverInfo *ServerInfo) (EphemeralKey, error) {
+	cache.Lock()
+	pool, ok := cache.pools[serverInfo.ServerPk]
+	if !ok {
+		pool = &EphemeralKeysPool{
+			cryptoConstruction: serverInfo.CryptoConstruction,
+			serverPk:           serverInfo.ServerPk,
+			keys:               make(chan EphemeralKey, EphemeralKeysPoolSize),
+		}
+		cache.pools[serverInfo.ServerPk] = pool
+	}
+	cache.Unlock()
+	atomic.StoreInt64(&pool.lastUsed, time.Now().Unix())
+	select {
+	case cache.wake <- struct{}{}:
+	default:
+	}
+	select {
+	case key := <-pool.keys:
+		return key, nil
+	default:
+		return NewEphemeralKey(pool.cryptoConstruction, &pool.serverPk)
+	}
+}
+
+func (cache *EphemeralKeysCache) run() {
+	for {
+		select {
+		case <-cache.wake:
+		case <-time.After(EphemeralKeysPoolExpiration):
+		}
+		expiration := time.Now().Add(-EphemeralKeysPoolExpiration).Unix()
+		cache.Lock()
+		pools := make([]*EphemeralKeysPool, 0, len(cache.pools))
+		for serverPk, pool := range cache.pools {
+			if atomic.LoadInt64(&pool.lastUsed) < expiration {
+				delete(cache.pools, serverPk)
+				continue
+			}
+			pools = append(pools, pool)
+		}
+		cache.Unlock()
+		for _, pool := range pools {
+			for len(pool.keys) < cap(pool.keys) {
+				key, err := NewEphemeralKey(pool.cryptoConstruction, &pool.serverPk)
+				if err != nil {
+					break
+				}
+				pool.keys <- key
+			}
+		}
+	}
+}
+
+func ComputeSharedKey(cryptoConstruction CryptoConstruction, secretKey *[32]byte, serverPk *[32]byte) (*[32]byte, error) {
+	var sharedKey [32]byte
+	if cryptoConstruction == XChacha20Poly1305 {
+		var err error
+		sharedKey, err = xsecretbox.SharedKey(*secretKey, *serverPk)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		box.Precompute(&sharedKey, serverPk, secretKey)
+	}
+	return &sharedKey, nil
+}
+
 func pad(packet []byte, minSize int) []byte {
 	packet = append(packet, 0x80)
 	for len(packet) < minSize {
@@ -40,7 +162,15 @@ func unpad(packet []byte) ([]byte, error) {
 	}
 }
 
-func (proxy *Proxy) Encrypt(serverInfo *ServerInfo, packet []byte, proto string) (encrypted []byte, clientNonce []byte, err error) {
+func (proxy *Proxy) Encrypt(serverInfo *ServerInfo, packet []byte, proto string) (sharedKey *[32]byte, encrypted []byte, clientNonce []byte, err error) {
+	publicKey, sharedKey := &serverInfo.ClientPk, &serverInfo.SharedKey
+	if proxy.ephemeralKeysCache != nil {
+		var key EphemeralKey
+		if key, err = proxy.ephemeralKeysCache.get(serverInfo); err != nil {
+			return
+		}
+		publicKey, sharedKey = &key.publicKey, &key.sharedKey
+	}
 	nonce, clientNonce := make([]byte, NonceSize), make([]byte, HalfNonceSize)
 	rand.Read(clientNonce)
 	copy(nonce, clientNonce)
@@ -57,20 +187,20 @@ func (proxy *Proxy) Encrypt(serverInfo *ServerInfo, packet []byte, proto string)
 		err = errors.New("Question too large; cannot be padded")
 		return
 	}
-	encrypted = append(serverInfo.MagicQuery[:], proxy.proxyPublicKey[:]...)
+	encrypted = append(serverInfo.MagicQuery[:], publicKey[:]...)
 	encrypted = append(encrypted, nonce[:HalfNonceSize]...)
 	padded := pad(packet, paddedLength-QueryOverhead)
 	if serverInfo.CryptoConstruction == XChacha20Poly1305 {
-		encrypted = xsecretbox.Seal(encrypted, nonce, padded, serverInfo.SharedKey[:])
+		encrypted = xsecretbox.Seal(encrypted, nonce, padded, sharedKey[:])
 	} else {
 		var xsalsaNonce [24]byte
 		copy(xsalsaNonce[:], nonce)
-		encrypted = secretbox.Seal(encrypted, padded, &xsalsaNonce, &serverInfo.SharedKey)
+		encrypted = secretbox.Seal(encrypted, padded, &xsalsaNonce, sharedKey)
 	}
 	return
 }
 
-func (proxy *Proxy) Decrypt(serverInfo *ServerInfo, encrypted []byte, nonce []byte) ([]byte, error) {
+func (proxy *Proxy) Decrypt(serverInfo *ServerInfo, sharedKey *[32]byte, encrypted []byte, nonce []byte) ([]byte, error) {
 	serverMagicLen := len(ServerMagic)
 	responseHeaderLen := serverMagicLen + NonceSize
 	if len(encrypted) < responseHeaderLen+TagSize+int(MinDNSPacketSize) ||
@@ -85,12 +215,12 @@ func (proxy *Proxy) Decrypt(serverInfo *ServerInfo, encrypted []byte, nonce []by
 	var packet []byte
 	var err error
 	if serverInfo.CryptoConstruction == XChacha20Poly1305 {
-		packet, err = xsecretbox.Open(nil, serverNonce, encrypted[responseHeaderLen:], serverInfo.SharedKey[:])
+		packet, err = xsecretbox.Open(nil, serverNonce, encrypted[responseHeaderLen:], sharedKey[:])
 	} else {
 		var xsalsaServerNonce [24]byte
 		copy(xsalsaServerNonce[:], serverNonce)
 		var ok bool
-		packet, ok = secretbox.Open(nil, encrypted[responseHeaderLen:], &xsalsaServerNonce, &serverInfo.SharedKey)
+		packet, ok = secretbox.Open(nil, encrypted[responseHeaderLen:], &xsalsaServerNonce, sharedKey)
 		if !ok {
 			err = errors.New("Incorrect tag")
 		}
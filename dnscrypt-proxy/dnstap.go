@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	DnstapContentType    = "protobuf:dnstap.Dnstap"
+	DnstapQueueSize      = 1024
+	DnstapReconnectDelay = 10 * time.Second
+	DnstapTimeout        = 5 * time.Second
+)
+
+const (
+	dnstapMessageClientQuery    = 5
+	dnstapMessageClientResponse = 6
+)
+
+const (
+	frameStreamAccept = 0x01
+	frameStreamStart  = 0x02
+	frameStreamReady  = 0x04
+)
+
+// Messages are encoded as dnstap protobuf messages, sent as Frame Streams
+// data frames. When the collector is unreachable or too slow, they are dropped.
+
+type Dnstap struct {
+	network  string
+	address  string
+	identity string
+	frames   chan []byte
+}
+
+func NewDnstap(address string, identity string) (*Dnstap, error) {
+	if len(identity) == 0 {
+		identity, _ = os.Hostname()
+	}
+	dnstap := Dnstap{identity: identity, frames: make(chan []byte, DnstapQueueSize)}
+	switch {
+	case strings.HasPrefix(address, "unix:"):
+		dnstap.network, dnstap.address = "unix", address[5:]
+	case strings.HasPrefix(address, "tcp://"):
+		dnstap.network, dnstap.address = "tcp", address[6:]
+	default:
+		return nil, fmt.Errorf("Invalid dnstap address: [%s]", address)
+	}
+	go dnstap.run()
+	return &dnstap, nil
+}
+
+func appendProtoVarint(buf []byte, x uint64) []byte {
+	for x >= 0x80 {
+		buf = append(buf, byte(x)|0x80)
+		x >>= 7
+	}
+	return append(buf, byte(x))
+}
+
+func appendProtoUint(buf []byte, field int, x uint64) []byte {
+	buf = appendProtoVarint(buf, uint64(field)<<3)
+	return appendProtoVarint(buf, x)
+}
+
+func appendProtoFixed32(buf []byte, field int, x uint32) []byte {
+	buf = appendProtoVarint(buf, uint64(field)<<3|5)
+	return append(buf, byte(x), byte(x>>8), byte(x>>16), byte(x>>24))
+}
+
+func appendProtoBytes(buf []byte, field int, data []byte) []byte {
+	buf = appendProtoVarint(buf, uint64(field)<<3|2)
+	buf = appendProtoVarint(buf, uint64(len(data)))
+	return append(buf, data...)
+}
+
+var dnstapSocketProtocols = map[string]uint64{"udp": 1, "tcp": 2, "doh": 4}
+
+func (dnstap *Dnstap) encode(messageType uint64, clientProto string, clientAddr *net.Addr, queryTime time.Time, query []byte, responseTime time.Time, response []byte) []byte {
+	message := appendProtoUint(nil, 1, messageType)
+	if clientAddr != nil {
+		if ip := ClientIP(*clientAddr); ip != nil {
+			if ipv4 := ip.To4(); ipv4 != nil {
+				message = appendProtoUint(message, 2, 1)
+				message = appendProtoBytes(message, 4, ipv4)
+			} else {
+				message = appendProtoUint(message, 2, 2)
+				message = appendProtoBytes(message, 4, ip)
+			}
+		}
+		switch addr := (*clientAddr).(type) {
+		case *net.UDPAddr:
+			message = appendProtoUint(message, 6, uint64(addr.Port))
+		case *net.TCPAddr:
+			message = appendProtoUint(message, 6, uint64(addr.Port))
+		}
+	}
+	if socketProtocol, ok := dnstapSocketProtocols[clientProto]; ok {
+		message = appendProtoUint(message, 3, socketProtocol)
+	}
+	message = appendProtoUint(message, 8, uint64(queryTime.Unix()))
+	message = appendProtoFixed32(message, 9, uint32(queryTime.Nanosecond()))
+	if query != nil {
+		message = appendProtoBytes(message, 10, query)
+	}
+	if response != nil {
+		message = appendProtoUint(message, 12, uint64(responseTime.Unix()))
+		message = appendProtoFixed32(message, 13, uint32(responseTime.Nanosecond()))
+		message = appendProtoBytes(message, 14, response)
+	}
+	frame := appendProtoBytes(nil, 1, []byte(dnstap.identity))
+	frame = appendProtoBytes(frame, 2, []byte("dnscrypt-proxy"))
+	frame = appendProtoBytes(frame, 14, message)
+	return appendProtoUint(frame, 15, 1)
+}
+
+func (dnstap *Dnstap) send(frame []byte) {
+	select {
+	case dnstap.frames <- frame:
+	default:
+	}
+}
+
+func (dnstap *Dnstap) clientQuery(clientProto string, clientAddr *net.Addr, queryTime time.Time, query []byte) {
+	if dnstap == nil {
+		return
+	}
+	dnstap.send(dnstap.encode(dnstapMessageClientQuery, clientProto, clientAddr, queryTime, query, time.Time{}, nil))
+}
+
+func (dnstap *Dnstap) clientResponse(clientProto string, clientAddr *net.Addr, queryTime time.Time, response []byte) {
+	if dnstap == nil {
+		return
+	}
+	dnstap.send(dnstap.encode(dnstapMessageClientResponse, clientProto, clientAddr, queryTime, nil, time.Now(), response))
+}
+
+// Control frames start with an empty data frame, followed by their length,
+// their type, and the content type field
+
+func writeControlFrame(writer io.Writer, controlType uint32) error {
+	frame := make([]byte, 20+len(DnstapContentType))
+	binary.BigEndian.PutUint32(frame[4:8], uint32(12+len(DnstapContentType)))
+	binary.BigEndian.PutUint32(frame[8:12], controlType)
+	binary.BigEndian.PutUint32(frame[12:16], 1)
+	binary.BigEndian.PutUint32(frame[16:20], uint32(len(DnstapContentType)))
+	copy(frame[20:], DnstapContentType)
+	_, err := writer.Write(frame)
+	return err
+}
+
+func readControlFrame(reader io.Reader) (uint32, error) {
+	var header [12]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return 0, err
+	}
+	if binary.BigEndian.Uint32(header[0:4]) != 0 {
+		return 0, errors.New("Expected a control frame")
+	}
+	length := binary.BigEndian.Uint32(header[4:8])
+	if length < 4 || length > 512 {
+		return 0, errors.New("Invalid control frame")
+	}
+	if _, err := io.CopyN(ioutil.Discard, reader, int64(length-4)); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(header[8:12]), nil
+}
+
+// Bidirectional Frame Streams handshake: READY, then ACCEPT from the collector, then START
+
+func (dnstap *Dnstap) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout(dnstap.network, dnstap.address, DnstapTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(DnstapTimeout))
+	if err = writeControlFrame(conn, frameStreamReady); err == nil {
+		var controlType uint32
+		if controlType, err = readControlFrame(conn); err == nil && controlType != frameStreamAccept {
+			err = errors.New("Collector didn't accept the dnstap content type")
+		}
+		if err == nil {
+			err = writeControlFrame(conn, frameStreamStart)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (dnstap *Dnstap) run() {
+	for {
+		conn, err := dnstap.connect()
+		if err != nil {
+			dlog.Warnf("Unable to connect to the dnstap collector [%s]: %s", dnstap.address, err)
+			time.Sleep(DnstapReconnectDelay)
+			continue
+		}
+		dlog.Noticef("Sending dnstap messages to [%s]", dnstap.address)
+		writer := bufio.NewWriter(conn)
+		for err == nil {
+			frame := <-dnstap.frames
+			var length [4]byte
+			binary.BigEndian.PutUint32(length[:], uint32(len(frame)))
+			conn.SetWriteDeadline(time.Now().Add(DnstapTimeout))
+			if _, err = writer.Write(length[:]); err == nil {
+				_, err = writer.Write(frame)
+			}
+			if err == nil && len(dnstap.frames) == 0 {
+				err = writer.Flush()
+			}
+		}
+		dlog.Warnf("Connection to the dnstap collector [%s] lost: %s", dnstap.address, err)
+		conn.Close()
+		time.Sleep(DnstapReconnectDelay)
+	}
+}
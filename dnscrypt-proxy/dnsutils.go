@@ -1,6 +1,13 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -29,10 +36,264 @@ func EmptyResponseFromMessage(srcMsg *dns.Msg) (*dns.Msg, error) {
 	return dstMsg, nil
 }
 
+func TXTResponseFromMessage(srcMsg *dns.Msg, txts []string) []byte {
+	dstMsg, err := EmptyResponseFromMessage(srcMsg)
+	if err != nil {
+		return nil
+	}
+	for _, txt := range txts {
+		dstMsg.Answer = append(dstMsg.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: srcMsg.Question[0].Name, Rrtype: dns.TypeTXT, Class: srcMsg.Question[0].Qclass, Ttl: 0},
+			Txt: []string{txt},
+		})
+	}
+	response, err := dstMsg.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+func ErrorResponseFromQuery(query []byte, rcode int) ([]byte, error) {
+	msg := dns.Msg{}
+	if err := msg.Unpack(query); err != nil {
+		return nil, err
+	}
+	msg.Response = true
+	msg.Rcode = rcode
+	msg.Answer = nil
+	msg.Ns = nil
+	msg.Extra = nil
+	return msg.Pack()
+}
+
 func HasTCFlag(packet []byte) bool {
 	return packet[2]&2 == 2
 }
 
+func TransactionID(packet []byte) uint16 {
+	return binary.BigEndian.Uint16(packet[0:2])
+}
+
+func SetTransactionID(packet []byte, tid uint16) {
+	binary.BigEndian.PutUint16(packet[0:2], tid)
+}
+
+// Pads a query with an EDNS0 padding option (RFC 7830) so that its length is
+// a multiple of blockSize, as recommended by RFC 8467 - queries without an OPT
+// record are left untouched
+
+func AddEDNS0Padding(packet []byte, blockSize int, randomPadding bool) ([]byte, error) {
+	msg := dns.Msg{}
+	if err := msg.Unpack(packet); err != nil {
+		return packet, err
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return packet, nil
+	}
+	options := []dns.EDNS0{}
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0PADDING {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+	unpadded, err := msg.Pack()
+	if err != nil {
+		return packet, err
+	}
+	paddingLength := (blockSize - (len(unpadded)+4)%blockSize) % blockSize
+	if randomPadding {
+		var extraBlocks [1]byte
+		rand.Read(extraBlocks[:])
+		paddingLength += int(extraBlocks[0]%4) * blockSize
+	}
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, paddingLength)})
+	return msg.Pack()
+}
+
+// Advertises the idle timeout of a TCP connection (RFC 7828) - the option
+// is hop-by-hop, so that it is only added to responses sent to clients that
+// included it in their queries
+
+func AddTCPKeepAlive(packet []byte, timeout time.Duration) ([]byte, error) {
+	msg := dns.Msg{}
+	if err := msg.Unpack(packet); err != nil {
+		return packet, err
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return packet, nil
+	}
+	options := []dns.EDNS0{}
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0TCPKEEPALIVE {
+			options = append(options, option)
+		}
+	}
+	var data [2]byte
+	binary.BigEndian.PutUint16(data[:], uint16(timeout/(100*time.Millisecond)))
+	opt.Option = append(options, &dns.EDNS0_LOCAL{Code: dns.EDNS0TCPKEEPALIVE, Data: data[:]})
+	return msg.Pack()
+}
+
+func ClampTTLs(packet []byte, minTTL uint32, maxTTL uint32) ([]byte, error) {
+	msg := dns.Msg{}
+	if err := msg.Unpack(packet); err != nil {
+		return packet, err
+	}
+	for _, rrs := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range rrs {
+			header := rr.Header()
+			if header.Rrtype == dns.TypeOPT {
+				continue
+			}
+			if header.Ttl < minTTL {
+				header.Ttl = minTTL
+			}
+			if maxTTL > 0 && header.Ttl > maxTTL {
+				header.Ttl = maxTTL
+			}
+		}
+	}
+	return msg.Pack()
+}
+
+func GetECS(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+func RemoveECS(msg *dns.Msg) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := []dns.EDNS0{}
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0SUBNET {
+			options = append(options, option)
+		}
+	}
+	opt.Option = options
+}
+
+// Adds a fixed client subnet to a query that doesn't already carry one
+
+func AddECS(packet []byte, subnet *dns.EDNS0_SUBNET) ([]byte, bool, error) {
+	msg := dns.Msg{}
+	if err := msg.Unpack(packet); err != nil {
+		return packet, false, err
+	}
+	if GetECS(&msg) != nil {
+		return packet, false, nil
+	}
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(uint16(MaxDNSUDPPacketSize-ResponseOverhead), false)
+		opt = msg.IsEdns0()
+	}
+	opt.Option = append(opt.Option, subnet)
+	ecsPacket, err := msg.Pack()
+	if err != nil {
+		return packet, false, err
+	}
+	return ecsPacket, true, nil
+}
+
+func StripECS(packet []byte) ([]byte, error) {
+	msg := dns.Msg{}
+	if err := msg.Unpack(packet); err != nil {
+		return packet, err
+	}
+	if GetECS(&msg) == nil {
+		return packet, nil
+	}
+	RemoveECS(&msg)
+	return msg.Pack()
+}
+
+// Accepts a network such as 203.0.113.0/24, or an address, which is then
+// truncated to a /24 (IPv4) or a /56 (IPv6)
+
+func ParseECS(str string) (*dns.EDNS0_SUBNET, error) {
+	if !strings.Contains(str, "/") {
+		ip := net.ParseIP(str)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid client subnet: [%s]", str)
+		}
+		if ip.To4() != nil {
+			str += "/24"
+		} else {
+			str += "/56"
+		}
+	}
+	ip, ipNet, err := net.ParseCIDR(str)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid client subnet: [%s]", str)
+	}
+	ones, _ := ipNet.Mask.Size()
+	subnet := dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: uint8(ones), Address: ip.To4()}
+	if subnet.Address == nil {
+		subnet.Family, subnet.Address = 2, ip
+	}
+	return NormalizedECS(&subnet), nil
+}
+
+// Clears the address bits beyond the source prefix length (RFC 7871)
+
+func NormalizedECS(subnet *dns.EDNS0_SUBNET) *dns.EDNS0_SUBNET {
+	bits, ip := 32, subnet.Address.To4()
+	if subnet.Family == 2 {
+		bits, ip = 128, subnet.Address.To16()
+	}
+	if ip == nil || (subnet.Family != 1 && subnet.Family != 2) || int(subnet.SourceNetmask) > bits {
+		return nil
+	}
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        subnet.Family,
+		SourceNetmask: subnet.SourceNetmask,
+		Address:       ip.Mask(net.CIDRMask(int(subnet.SourceNetmask), bits)),
+	}
+}
+
+// Reduces the precision of a client subnet to at most maxIPv4Prefix or maxIPv6Prefix bits
+// - zero keeps the prefix length sent by the client
+
+func TruncatedECS(subnet *dns.EDNS0_SUBNET, maxIPv4Prefix uint8, maxIPv6Prefix uint8) *dns.EDNS0_SUBNET {
+	maxPrefix := maxIPv4Prefix
+	if subnet.Family == 2 {
+		maxPrefix = maxIPv6Prefix
+	}
+	if maxPrefix == 0 || subnet.SourceNetmask <= maxPrefix {
+		return subnet
+	}
+	truncated := *subnet
+	truncated.SourceNetmask = maxPrefix
+	return NormalizedECS(&truncated)
+}
+
+// Restricts a client subnet to the scope returned by a server, if it is less specific
+
+func ScopedECS(subnet *dns.EDNS0_SUBNET, scope uint8) *dns.EDNS0_SUBNET {
+	if scope >= subnet.SourceNetmask {
+		return subnet
+	}
+	scoped := *subnet
+	scoped.SourceNetmask = scope
+	return NormalizedECS(&scoped)
+}
+
 func NormalizeName(name *[]byte) {
 	for i, c := range *name {
 		if c >= 65 && c <= 90 {
@@ -56,3 +317,57 @@ func getMinTTL(msg *dns.Msg, minTTL uint32, maxTTL uint32, negCacheMinTTL uint32
 	}
 	return time.Duration(ttl) * time.Second
 }
+
+func questionNameEnd(packet []byte) int {
+	if len(packet) < 12 || binary.BigEndian.Uint16(packet[4:6]) != 1 {
+		return -1
+	}
+	for offset := 12; offset < len(packet); {
+		labelLen := int(packet[offset])
+		if labelLen == 0 {
+			return offset + 1
+		}
+		if labelLen&0xc0 != 0 {
+			return -1
+		}
+		offset += 1 + labelLen
+	}
+	return -1
+}
+
+// DNS 0x20: randomizes the case of the letters of the query name, that
+// servers are expected to copy verbatim in their responses
+
+func Randomize0x20(query []byte) []byte {
+	end := questionNameEnd(query)
+	if end < 0 {
+		return query
+	}
+	randomized := append([]byte{}, query...)
+	bits := make([]byte, end-12)
+	rand.Read(bits)
+	for offset := 12; offset < end-1; offset += 1 + int(randomized[offset]) {
+		for i := offset + 1; i <= offset+int(randomized[offset]); i++ {
+			c := randomized[i] | 0x20
+			if c >= 'a' && c <= 'z' && bits[i-12]&1 != 0 {
+				randomized[i] ^= 0x20
+			}
+		}
+	}
+	return randomized
+}
+
+// Responses whose query name doesn't have the same case as the randomized
+// query are rejected, others get the case of the original query back
+
+func Restore0x20(query []byte, randomized []byte, response []byte) error {
+	end := questionNameEnd(randomized)
+	if end < 0 {
+		return nil
+	}
+	if len(response) < end || !bytes.Equal(response[12:end], randomized[12:end]) {
+		return errors.New("Query name case mismatch in response")
+	}
+	copy(response[12:end], query[12:end])
+	return nil
+}
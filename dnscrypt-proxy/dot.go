@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	DefaultDoTPort = 853
+)
+
+type DoTClient struct {
+	xTransport *XTransport
+	addrStr    string
+	tlsConfig  *tls.Config
+	timeout    time.Duration
+	pool       *ConnPool
+}
+
+func NewDoTClient(xTransport *XTransport, addrStr string, serverName string, timeout time.Duration) *DoTClient {
+	client := &DoTClient{
+		xTransport: xTransport,
+		addrStr:    addrStr,
+		tlsConfig:  xTransport.tlsClientConfig(serverName),
+		timeout:    timeout,
+	}
+	client.pool = xTransport.NewConnPool(client.dial)
+	return client
+}
+
+func (client *DoTClient) dial() (net.Conn, error) {
+	rawConn, err := client.xTransport.Dial("tcp", client.addrStr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(rawConn, client.tlsConfig)
+	conn.SetDeadline(time.Now().Add(client.timeout))
+	if err := conn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (client *DoTClient) Close() {
+	client.pool.Close()
+}
+
+func (client *DoTClient) exchangeWithConn(conn net.Conn, query []byte) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(client.timeout))
+	prefixedQuery, err := PrefixWithSize(append([]byte{}, query...))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(prefixedQuery); err != nil {
+		return nil, err
+	}
+	response, err := ReadPrefixed(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < MinDNSPacketSize || TransactionID(response) != TransactionID(query) {
+		return nil, errors.New("Unexpected response")
+	}
+	return response, nil
+}
+
+func (client *DoTClient) Exchange(query []byte) ([]byte, error) {
+	var response []byte
+	err := client.pool.Do(func(conn net.Conn) error {
+		var err error
+		response, err = client.exchangeWithConn(conn, query)
+		return err
+	})
+	return response, err
+}
@@ -0,0 +1,29 @@
+package main
+
+import "strings"
+
+const (
+	EventLogError       = 1
+	EventLogWarning     = 2
+	EventLogInformation = 4
+	EventLogID          = 1
+)
+
+var eventLogTypes = map[string]uint16{
+	"WARNING": EventLogWarning, "ERROR": EventLogError, "CRITICAL": EventLogError, "FATAL": EventLogError,
+}
+
+type EventLogChannel struct {
+	eventLog *EventLog
+}
+
+func (channel *EventLogChannel) Write(p []byte) (int, error) {
+	if err := channel.eventLog.report(EventLogInformation, strings.TrimSuffix(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (eventLog *EventLog) channel() *EventLogChannel {
+	return &EventLogChannel{eventLog: eventLog}
+}
@@ -0,0 +1,17 @@
+// +build !windows
+
+package main
+
+import "errors"
+
+const EventLogSupported = false
+
+type EventLog struct{}
+
+func NewEventLog(source string) (*EventLog, error) {
+	return nil, errors.New("The Windows Event Log is not supported on this platform")
+}
+
+func (eventLog *EventLog) report(eventType uint16, message string) error {
+	return nil
+}
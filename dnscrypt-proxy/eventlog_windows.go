@@ -0,0 +1,51 @@
+package main
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const EventLogSupported = true
+
+var (
+	procRegisterEventSourceW = modadvapi32.NewProc("RegisterEventSourceW")
+	procReportEventW         = modadvapi32.NewProc("ReportEventW")
+)
+
+type EventLog struct {
+	sync.Mutex
+	handle syscall.Handle
+}
+
+// Events are written to the Application log. Without a registered message
+// file for the source, the Event Viewer prefixes them with a notice, but
+// still shows the message.
+
+func NewEventLog(source string) (*EventLog, error) {
+	sourceName, err := syscall.UTF16PtrFromString(source)
+	if err != nil {
+		return nil, err
+	}
+	r, _, err := procRegisterEventSourceW.Call(0, uintptr(unsafe.Pointer(sourceName)))
+	if r == 0 {
+		return nil, err
+	}
+	return &EventLog{handle: syscall.Handle(r)}, nil
+}
+
+func (eventLog *EventLog) report(eventType uint16, message string) error {
+	text, err := syscall.UTF16PtrFromString(message)
+	if err != nil {
+		return err
+	}
+	messages := []*uint16{text}
+	eventLog.Lock()
+	r, _, err := procReportEventW.Call(uintptr(eventLog.handle), uintptr(eventType), 0, EventLogID, 0,
+		uintptr(len(messages)), 0, uintptr(unsafe.Pointer(&messages[0])), 0)
+	eventLog.Unlock()
+	if r == 0 {
+		return err
+	}
+	return nil
+}
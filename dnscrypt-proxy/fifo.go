@@ -0,0 +1,59 @@
+// +build !windows
+
+package main
+
+import (
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const FifoDropReportInterval = time.Minute
+
+type FifoWriter struct {
+	sync.Mutex
+	path       string
+	fd         int
+	dropped    uint64
+	lastReport time.Time
+}
+
+// The FIFO is opened without blocking, and is reopened once a reader shows up.
+// Lines that cannot be written right away, because there is no reader or it
+// is not keeping up, are dropped, and regularly reported.
+
+func NewFifoWriter(path string) (*FifoWriter, error) {
+	writer := FifoWriter{path: path, fd: -1, lastReport: time.Now()}
+	return &writer, nil
+}
+
+func (writer *FifoWriter) Write(p []byte) (int, error) {
+	writer.Lock()
+	defer writer.Unlock()
+	if writer.fd < 0 {
+		fd, err := syscall.Open(writer.path, syscall.O_WRONLY|syscall.O_NONBLOCK|syscall.O_CLOEXEC, 0)
+		if err == nil {
+			writer.fd = fd
+		}
+	}
+	written := false
+	if writer.fd >= 0 {
+		n, err := syscall.Write(writer.fd, p)
+		if err == syscall.EPIPE {
+			syscall.Close(writer.fd)
+			writer.fd = -1
+		}
+		written = err == nil && n == len(p)
+	}
+	if !written {
+		writer.dropped++
+	}
+	if writer.dropped > 0 && time.Since(writer.lastReport) >= FifoDropReportInterval {
+		dlog.Warnf("[%s] %d log entries dropped - the reader is missing or too slow", writer.path, writer.dropped)
+		writer.dropped = 0
+		writer.lastReport = time.Now()
+	}
+	return len(p), nil
+}
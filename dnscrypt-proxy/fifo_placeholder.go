@@ -0,0 +1,15 @@
+// +build windows
+
+package main
+
+import "errors"
+
+type FifoWriter struct{}
+
+func NewFifoWriter(path string) (*FifoWriter, error) {
+	return nil, errors.New("Named pipes are not supported for logs on this platform")
+}
+
+func (writer *FifoWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("Named pipes are not supported for logs on this platform")
+}
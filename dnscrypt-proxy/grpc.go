@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A minimal gRPC implementation over HTTP/2 (cleartext or TLS), with just
+// enough of the protocol buffers encoding for the messages of policy.proto
+// and control.proto. Compression is not supported.
+
+const (
+	GRPCContentType    = "application/grpc"
+	GRPCMaxMessageSize = 4 * 1024 * 1024
+
+	GRPCStatusOK              = 0
+	GRPCStatusInvalidArgument = 3
+	GRPCStatusUnimplemented   = 12
+	GRPCStatusInternal        = 13
+
+	ProtoWireVarint  = 0
+	ProtoWireFixed64 = 1
+	ProtoWireBytes   = 2
+	ProtoWireFixed32 = 5
+)
+
+type GRPCError struct {
+	code    int
+	message string
+}
+
+func (err *GRPCError) Error() string {
+	if len(err.message) == 0 {
+		return fmt.Sprintf("gRPC status %d", err.code)
+	}
+	return fmt.Sprintf("gRPC status %d: %s", err.code, err.message)
+}
+
+func protoAppendVarint(out []byte, value uint64) []byte {
+	for value >= 0x80 {
+		out = append(out, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(out, byte(value))
+}
+
+func protoAppendTag(out []byte, field int, wireType int) []byte {
+	return protoAppendVarint(out, uint64(field)<<3|uint64(wireType))
+}
+
+// Fields set to their default value are omitted, as in proto3
+
+func protoAppendUint(out []byte, field int, value uint64) []byte {
+	if value == 0 {
+		return out
+	}
+	return protoAppendVarint(protoAppendTag(out, field, ProtoWireVarint), value)
+}
+
+func protoAppendBool(out []byte, field int, value bool) []byte {
+	if !value {
+		return out
+	}
+	return protoAppendUint(out, field, 1)
+}
+
+func protoAppendDouble(out []byte, field int, value float64) []byte {
+	if value == 0 {
+		return out
+	}
+	out = protoAppendTag(out, field, ProtoWireFixed64)
+	var encoded [8]byte
+	binary.LittleEndian.PutUint64(encoded[:], math.Float64bits(value))
+	return append(out, encoded[:]...)
+}
+
+func protoAppendBytes(out []byte, field int, value []byte) []byte {
+	if len(value) == 0 {
+		return out
+	}
+	return protoAppendMessage(out, field, value)
+}
+
+func protoAppendString(out []byte, field int, value string) []byte {
+	return protoAppendBytes(out, field, []byte(value))
+}
+
+// Embedded messages are always included, even if they are empty
+
+func protoAppendMessage(out []byte, field int, value []byte) []byte {
+	out = protoAppendVarint(protoAppendTag(out, field, ProtoWireBytes), uint64(len(value)))
+	return append(out, value...)
+}
+
+type ProtoField struct {
+	number   int
+	wireType int
+	value    uint64
+	bytes    []byte
+}
+
+func (field ProtoField) double() float64 {
+	return math.Float64frombits(field.value)
+}
+
+func protoReadVarint(in []byte) (uint64, int, error) {
+	var value uint64
+	for i := 0; i < len(in) && i < 10; i++ {
+		value |= uint64(in[i]&0x7f) << (7 * uint(i))
+		if in[i] < 0x80 {
+			return value, i + 1, nil
+		}
+	}
+	return 0, 0, errors.New("Invalid varint")
+}
+
+// Unknown fields are passed to fn like the others, and can be ignored
+
+func protoParse(in []byte, fn func(field ProtoField) error) error {
+	for len(in) > 0 {
+		tag, n, err := protoReadVarint(in)
+		if err != nil {
+			return err
+		}
+		in = in[n:]
+		field := ProtoField{number: int(tag >> 3), wireType: int(tag & 7)}
+		switch field.wireType {
+		case ProtoWireVarint:
+			if field.value, n, err = protoReadVarint(in); err != nil {
+				return err
+			}
+		case ProtoWireFixed64:
+			if n = 8; len(in) < n {
+				return errors.New("Truncated fixed64 field")
+			}
+			field.value = binary.LittleEndian.Uint64(in)
+		case ProtoWireFixed32:
+			if n = 4; len(in) < n {
+				return errors.New("Truncated fixed32 field")
+			}
+			field.value = uint64(binary.LittleEndian.Uint32(in))
+		case ProtoWireBytes:
+			length, lengthLen, err := protoReadVarint(in)
+			if err != nil {
+				return err
+			}
+			if length > uint64(len(in)-lengthLen) {
+				return errors.New("Truncated length-delimited field")
+			}
+			n = lengthLen + int(length)
+			field.bytes = in[lengthLen:n]
+		default:
+			return fmt.Errorf("Unsupported wire type: %d", field.wireType)
+		}
+		in = in[n:]
+		if err := fn(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func grpcFrame(message []byte) []byte {
+	frame := make([]byte, 5, 5+len(message))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(message)))
+	return append(frame, message...)
+}
+
+func grpcReadMessage(reader io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, errors.New("Compressed gRPC messages are not supported")
+	}
+	length := binary.BigEndian.Uint32(header[1:5])
+	if length > GRPCMaxMessageSize {
+		return nil, errors.New("gRPC message too large")
+	}
+	message := make([]byte, length)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+type GRPCClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+// http:// URLs use HTTP/2 without TLS (h2c), https:// URLs use HTTP/2 over TLS.
+// If dial is set, connections are made with it instead of the URL's host,
+// for example to connect to a unix socket.
+
+func NewGRPCClient(urlStr string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (*GRPCClient, error) {
+	parsedURL, err := url.Parse(urlStr)
+	if err != nil || len(parsedURL.Host) == 0 || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+		return nil, fmt.Errorf("Invalid gRPC URL: [%s]", urlStr)
+	}
+	protocols := new(http.Protocols)
+	if parsedURL.Scheme == "http" {
+		protocols.SetUnencryptedHTTP2(true)
+	} else {
+		protocols.SetHTTP2(true)
+	}
+	transport := &http.Transport{Protocols: protocols, DialContext: dial}
+	return &GRPCClient{baseURL: strings.TrimSuffix(urlStr, "/"), client: &http.Client{Transport: transport}}, nil
+}
+
+func (client *GRPCClient) call(method string, request []byte, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequest("POST", client.baseURL+method, bytes.NewReader(grpcFrame(request)))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", GRPCContentType)
+	req.Header.Set("TE", "trailers")
+	req.Header.Set("Grpc-Timeout", strconv.FormatInt(int64(timeout/time.Millisecond), 10)+"m")
+	resp, err := client.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected HTTP status code: %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, GRPCMaxMessageSize+5))
+	if err != nil {
+		return nil, err
+	}
+	status, message := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if len(status) == 0 {
+		status, message = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return nil, errors.New("Missing gRPC status")
+	}
+	if code != GRPCStatusOK {
+		message, _ = url.PathUnescape(message)
+		return nil, &GRPCError{code: code, message: message}
+	}
+	return grpcReadMessage(bytes.NewReader(body))
+}
+
+type GRPCMethod func(request []byte) ([]byte, error)
+
+// Maps full method names (/package.Service/Method) to their implementation
+
+type GRPCServer map[string]GRPCMethod
+
+func writeGRPCStatus(writer http.ResponseWriter, code int, message string) {
+	writer.Header().Set("Content-Type", GRPCContentType)
+	writer.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if len(message) > 0 {
+		writer.Header().Set("Grpc-Message", url.PathEscape(message))
+	}
+	writer.WriteHeader(http.StatusOK)
+}
+
+func (server GRPCServer) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if request.ProtoMajor != 2 || request.Method != "POST" || !strings.HasPrefix(request.Header.Get("Content-Type"), GRPCContentType) {
+		writer.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	method, ok := server[request.URL.Path]
+	if !ok {
+		writeGRPCStatus(writer, GRPCStatusUnimplemented, "Unknown method: "+request.URL.Path)
+		return
+	}
+	message, err := grpcReadMessage(request.Body)
+	if err != nil {
+		writeGRPCStatus(writer, GRPCStatusInvalidArgument, err.Error())
+		return
+	}
+	response, err := method(message)
+	if err != nil {
+		code := GRPCStatusInternal
+		if grpcErr, ok := err.(*GRPCError); ok {
+			code = grpcErr.code
+			err = errors.New(grpcErr.message)
+		}
+		writeGRPCStatus(writer, code, err.Error())
+		return
+	}
+	writer.Header().Set("Content-Type", GRPCContentType)
+	writer.WriteHeader(http.StatusOK)
+	writer.Write(grpcFrame(response))
+	writer.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(GRPCStatusOK))
+}
+
+func serveGRPC(listener net.Listener, server GRPCServer) error {
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	httpServer := http.Server{Handler: server, Protocols: protocols}
+	return httpServer.Serve(listener)
+}
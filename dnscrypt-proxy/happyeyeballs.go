@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// RFC 8305 - Happy Eyeballs v2
+
+const (
+	HappyEyeballsDelay = 250 * time.Millisecond
+	IPFamilyAny        = 0
+	IPFamilyIPv4       = 4
+	IPFamilyIPv6       = 6
+)
+
+type IPFamilies struct {
+	sync.RWMutex
+	preferred map[string]int
+	succeeded map[string]int
+}
+
+func ipFamily(ip string) int {
+	if parsed := net.ParseIP(ip); parsed != nil && parsed.To4() != nil {
+		return IPFamilyIPv4
+	}
+	return IPFamilyIPv6
+}
+
+func parseIPFamily(str string) (int, error) {
+	switch strings.ToLower(str) {
+	case "", "any":
+		return IPFamilyAny, nil
+	case "ipv4":
+		return IPFamilyIPv4, nil
+	case "ipv6":
+		return IPFamilyIPv6, nil
+	}
+	return IPFamilyAny, fmt.Errorf("Unsupported IP preference: [%s]", str)
+}
+
+func (xTransport *XTransport) setPreferredIPFamily(host string, family int) {
+	xTransport.ipFamilies.Lock()
+	xTransport.ipFamilies.preferred[host] = family
+	xTransport.ipFamilies.Unlock()
+}
+
+func (xTransport *XTransport) noticeIPFamily(host string, family int) {
+	xTransport.ipFamilies.Lock()
+	previous := xTransport.ipFamilies.succeeded[host]
+	xTransport.ipFamilies.succeeded[host] = family
+	xTransport.ipFamilies.Unlock()
+	if previous != family {
+		dlog.Debugf("[%s] is now reachable over IPv%d", host, family)
+	}
+}
+
+// The configured family goes first, then the one that succeeded last, then IPv6.
+// Addresses of both families are interleaved, as recommended by RFC 8305.
+
+func (xTransport *XTransport) sortByIPFamily(host string, ips []string) []string {
+	preferred := IPFamilyIPv6
+	xTransport.ipFamilies.RLock()
+	if family := xTransport.ipFamilies.preferred[host]; family != IPFamilyAny {
+		preferred = family
+	} else if family := xTransport.ipFamilies.succeeded[host]; family != IPFamilyAny {
+		preferred = family
+	}
+	xTransport.ipFamilies.RUnlock()
+	var first, second []string
+	for _, ip := range ips {
+		if ipFamily(ip) == preferred {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	sorted := make([]string, 0, len(ips))
+	for len(first) > 0 || len(second) > 0 {
+		if len(first) > 0 {
+			sorted = append(sorted, first[0])
+			first = first[1:]
+		}
+		if len(second) > 0 {
+			sorted = append(sorted, second[0])
+			second = second[1:]
+		}
+	}
+	return sorted
+}
+
+type dialResult struct {
+	conn net.Conn
+	ip   string
+	err  error
+}
+
+func (xTransport *XTransport) dialHappyEyeballs(ctx context.Context, dialer *net.Dialer, network string, host string, port string, ips []string) (net.Conn, error) {
+	ips = xTransport.sortByIPFamily(host, ips)
+	if len(ips) == 1 {
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ips[0], port))
+		if err == nil {
+			xTransport.noticeIPFamily(host, ipFamily(ips[0]))
+		}
+		return conn, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult, len(ips))
+	started, pending := 0, 0
+	var delay <-chan time.Time
+	startNext := func() {
+		ip := ips[started]
+		started++
+		pending++
+		go func() {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			results <- dialResult{conn: conn, ip: ip, err: err}
+		}()
+		delay = nil
+		if started < len(ips) {
+			delay = time.After(HappyEyeballsDelay)
+		}
+	}
+	startNext()
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-delay:
+			startNext()
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				xTransport.noticeIPFamily(host, ipFamily(result.ip))
+				return result.conn, nil
+			}
+			lastErr = result.err
+			if started < len(ips) {
+				startNext()
+			}
+		}
+	}
+	return nil, lastErr
+}
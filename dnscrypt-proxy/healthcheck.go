@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/jedisct1/dlog"
+)
+
+// /healthz succeeds as long as the process is running. /readyz only succeeds
+// once certificates of at least one server have been fetched, and while not
+// all servers are failing.
+
+type HealthCheckHandler struct {
+	proxy *Proxy
+}
+
+func (handler HealthCheckHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	switch request.URL.Path {
+	case "/healthz":
+		writer.Write([]byte("OK\n"))
+	case "/readyz":
+		if handler.proxy.serversInfo.allFailing() {
+			writer.WriteHeader(http.StatusServiceUnavailable)
+			writer.Write([]byte("No servers available\n"))
+			return
+		}
+		writer.Write([]byte("OK\n"))
+	default:
+		writer.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (proxy *Proxy) healthCheckListener(listenAddrStr string) error {
+	listener, err := net.Listen("tcp", listenAddrStr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		listenersLog.Noticef("Now serving health checks on http://%v", listener.Addr())
+		if err := http.Serve(listener, HealthCheckHandler{proxy: proxy}); err != nil {
+			dlog.Errorf("Health check server: %s", err)
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	HookTimeout        = 30 * time.Second
+	HookMaxConcurrency = 4
+)
+
+type Hooks struct {
+	onBlocked    []string
+	onServerDown []string
+	running      chan struct{}
+}
+
+func NewHooks(onBlocked []string, onServerDown []string) *Hooks {
+	if len(onBlocked) == 0 && len(onServerDown) == 0 {
+		return nil
+	}
+	return &Hooks{onBlocked: onBlocked, onServerDown: onServerDown, running: make(chan struct{}, HookMaxConcurrency)}
+}
+
+// Arguments can include placeholders such as {name}, replaced with the values of the event.
+// Events happening while too many commands are already running are dropped.
+
+func (hooks *Hooks) run(command []string, vars ...string) {
+	select {
+	case hooks.running <- struct{}{}:
+	default:
+		pluginsLog.Debugf("Too many running hooks - [%s] not started", command[0])
+		return
+	}
+	replacer := strings.NewReplacer(vars...)
+	args := make([]string, len(command)-1)
+	for i, arg := range command[1:] {
+		args[i] = replacer.Replace(arg)
+	}
+	go func() {
+		defer func() { <-hooks.running }()
+		ctx, cancel := context.WithTimeout(context.Background(), HookTimeout)
+		defer cancel()
+		if output, err := exec.CommandContext(ctx, command[0], args...).CombinedOutput(); err != nil {
+			pluginsLog.Warnf("Hook [%s] failed: %s %s", command[0], err, strings.TrimSpace(string(output)))
+		}
+	}()
+}
+
+func (hooks *Hooks) blocked(query []byte, clientAddr *net.Addr) {
+	if hooks == nil || len(hooks.onBlocked) == 0 {
+		return
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(query); err != nil || len(msg.Question) != 1 {
+		return
+	}
+	client := ""
+	if clientAddr != nil {
+		if ip := ClientIP(*clientAddr); ip != nil {
+			client = ip.String()
+		}
+	}
+	question := msg.Question[0]
+	hooks.run(hooks.onBlocked, "{name}", question.Name, "{type}", dns.TypeToString[question.Qtype], "{client}", client)
+}
+
+func (hooks *Hooks) serverDown(serverName string) {
+	if hooks == nil || len(hooks.onServerDown) == 0 {
+		return
+	}
+	hooks.run(hooks.onServerDown, "{server}", serverName)
+}
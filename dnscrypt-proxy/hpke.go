@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// Minimal HPKE (RFC 9180) sender, base mode only:
+// DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM
+
+const (
+	HPKEKemX25519HKDFSHA256 = 0x0020
+	HPKEKdfHKDFSHA256       = 0x0001
+	HPKEAeadAES128GCM       = 0x0001
+	HPKEModeBase            = 0x00
+	HPKENk                  = 16
+	HPKENn                  = 12
+	HPKENh                  = sha256.Size
+)
+
+type HPKEContext struct {
+	suiteID        []byte
+	aead           cipher.AEAD
+	baseNonce      []byte
+	exporterSecret []byte
+	seq            uint64
+}
+
+func hkdfExtract(salt []byte, ikm []byte) []byte {
+	mac := hmac.New(sha256.New, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+func hkdfExpand(prk []byte, info []byte, length int) []byte {
+	var out, prev []byte
+	for counter := byte(1); len(out) < length; counter++ {
+		mac := hmac.New(sha256.New, prk)
+		mac.Write(prev)
+		mac.Write(info)
+		mac.Write([]byte{counter})
+		prev = mac.Sum(nil)
+		out = append(out, prev...)
+	}
+	return out[:length]
+}
+
+func hpkeLabeledExtract(suiteID []byte, salt []byte, label string, ikm []byte) []byte {
+	labeledIKM := append([]byte("HPKE-v1"), suiteID...)
+	labeledIKM = append(labeledIKM, label...)
+	labeledIKM = append(labeledIKM, ikm...)
+	return hkdfExtract(salt, labeledIKM)
+}
+
+func hpkeLabeledExpand(suiteID []byte, prk []byte, label string, info []byte, length int) []byte {
+	labeledInfo := []byte{byte(length >> 8), byte(length)}
+	labeledInfo = append(labeledInfo, "HPKE-v1"...)
+	labeledInfo = append(labeledInfo, suiteID...)
+	labeledInfo = append(labeledInfo, label...)
+	labeledInfo = append(labeledInfo, info...)
+	return hkdfExpand(prk, labeledInfo, length)
+}
+
+func hpkeEncap(pkR []byte, skE [32]byte) (sharedSecret []byte, enc []byte, err error) {
+	if len(pkR) != 32 {
+		return nil, nil, errors.New("Invalid HPKE public key length")
+	}
+	var pkE, pkRArray, dh [32]byte
+	curve25519.ScalarBaseMult(&pkE, &skE)
+	copy(pkRArray[:], pkR)
+	curve25519.ScalarMult(&dh, &skE, &pkRArray)
+	if dh == [32]byte{} {
+		return nil, nil, errors.New("Weak HPKE public key")
+	}
+	return hpkeExtractAndExpand(dh[:], append(pkE[:], pkR...)), pkE[:], nil
+}
+
+func hpkeExtractAndExpand(dh []byte, kemContext []byte) []byte {
+	kemSuiteID := []byte{'K', 'E', 'M', 0, 0}
+	binary.BigEndian.PutUint16(kemSuiteID[3:], HPKEKemX25519HKDFSHA256)
+	eaePrk := hpkeLabeledExtract(kemSuiteID, nil, "eae_prk", dh)
+	return hpkeLabeledExpand(kemSuiteID, eaePrk, "shared_secret", kemContext, 32)
+}
+
+func HPKESetupBaseSender(pkR []byte, info []byte) ([]byte, *HPKEContext, error) {
+	var skE [32]byte
+	if _, err := rand.Read(skE[:]); err != nil {
+		return nil, nil, err
+	}
+	return hpkeSetupBaseSender(pkR, info, skE)
+}
+
+func hpkeSetupBaseSender(pkR []byte, info []byte, skE [32]byte) ([]byte, *HPKEContext, error) {
+	sharedSecret, enc, err := hpkeEncap(pkR, skE)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx, err := hpkeKeySchedule(sharedSecret, info)
+	if err != nil {
+		return nil, nil, err
+	}
+	return enc, ctx, nil
+}
+
+func hpkeKeySchedule(sharedSecret []byte, info []byte) (*HPKEContext, error) {
+	suiteID := []byte{'H', 'P', 'K', 'E', 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(suiteID[4:6], HPKEKemX25519HKDFSHA256)
+	binary.BigEndian.PutUint16(suiteID[6:8], HPKEKdfHKDFSHA256)
+	binary.BigEndian.PutUint16(suiteID[8:10], HPKEAeadAES128GCM)
+	pskIDHash := hpkeLabeledExtract(suiteID, nil, "psk_id_hash", nil)
+	infoHash := hpkeLabeledExtract(suiteID, nil, "info_hash", info)
+	keyScheduleContext := append([]byte{HPKEModeBase}, pskIDHash...)
+	keyScheduleContext = append(keyScheduleContext, infoHash...)
+	secret := hpkeLabeledExtract(suiteID, sharedSecret, "secret", nil)
+	key := hpkeLabeledExpand(suiteID, secret, "key", keyScheduleContext, HPKENk)
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	ctx := &HPKEContext{
+		suiteID:        suiteID,
+		aead:           aead,
+		baseNonce:      hpkeLabeledExpand(suiteID, secret, "base_nonce", keyScheduleContext, HPKENn),
+		exporterSecret: hpkeLabeledExpand(suiteID, secret, "exp", keyScheduleContext, HPKENh),
+	}
+	return ctx, nil
+}
+
+func (ctx *HPKEContext) nextNonce() []byte {
+	nonce := append([]byte{}, ctx.baseNonce...)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], ctx.seq)
+	for i := range seq {
+		nonce[len(nonce)-8+i] ^= seq[i]
+	}
+	ctx.seq++
+	return nonce
+}
+
+func (ctx *HPKEContext) Seal(aad []byte, pt []byte) []byte {
+	return ctx.aead.Seal(nil, ctx.nextNonce(), pt, aad)
+}
+
+func (ctx *HPKEContext) Export(exporterContext []byte, length int) []byte {
+	return hpkeLabeledExpand(ctx.suiteID, ctx.exporterSecret, "sec", exporterContext, length)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// RFC 9180, appendix A.1.1: DHKEM(X25519, HKDF-SHA256), HKDF-SHA256, AES-128-GCM, base mode
+
+func TestHPKEBaseSenderRFC9180(t *testing.T) {
+	info := mustDecodeHex(t, "4f6465206f6e2061204772656369616e2055726e")
+	pkR := mustDecodeHex(t, "3948cfe0ad1ddb695d780e59077195da6c56506b027329794ab02bca80815c4d")
+	var skE [32]byte
+	copy(skE[:], mustDecodeHex(t, "52c4a758a802cd8b936eceea314432798d5baf2d7e9235dc084ab1b9cfa2f736"))
+
+	enc, ctx, err := hpkeSetupBaseSender(pkR, info, skE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := mustDecodeHex(t, "37fda3567bdbd628e88668c3c8d7e97d1d1253b6d4ea6d44c150f741f1bf4431"); !bytes.Equal(enc, expected) {
+		t.Errorf("enc = %x, expected %x", enc, expected)
+	}
+	if expected := mustDecodeHex(t, "56d890e5accaaf011cff4b7d"); !bytes.Equal(ctx.baseNonce, expected) {
+		t.Errorf("base_nonce = %x, expected %x", ctx.baseNonce, expected)
+	}
+	if expected := mustDecodeHex(t, "45ff1c2e220db587171952c0592d5f5ebe103f1561a2614e38f2ffd47e99e3f8"); !bytes.Equal(ctx.exporterSecret, expected) {
+		t.Errorf("exporter_secret = %x, expected %x", ctx.exporterSecret, expected)
+	}
+
+	pt := mustDecodeHex(t, "4265617574792069732074727574682c20747275746820626561757479")
+	encryptions := []struct {
+		aad string
+		ct  string
+	}{
+		{"436f756e742d30", "f938558b5d72f1a23810b4be2ab4f84331acc02fc97babc53a52ae8218a355a96d8770ac83d07bea87e13c512a"},
+		{"436f756e742d31", "af2d7e9ac9ae7e270f46ba1f975be53c09f8d875bdc8535458c2494e8a6eab251c03d0c22a56b8ca42c2063b84"},
+	}
+	for i, encryption := range encryptions {
+		ct := ctx.Seal(mustDecodeHex(t, encryption.aad), pt)
+		if expected := mustDecodeHex(t, encryption.ct); !bytes.Equal(ct, expected) {
+			t.Errorf("sequence %d: ct = %x, expected %x", i, ct, expected)
+		}
+	}
+
+	exports := []struct {
+		context string
+		value   string
+	}{
+		{"", "3853fe2b4035195a573ffc53856e77058e15d9ea064de3e59f4961d0095250ee"},
+		{"00", "2e8f0b54673c7029649d4eb9d5e33bf1872cf76d623ff164ac185da9e88c21a5"},
+		{"54657374436f6e74657874", "e9e43065102c3836401bed8c3c3c75ae46be1639869391d62c61f1ec7af54931"},
+	}
+	for _, export := range exports {
+		value := ctx.Export(mustDecodeHex(t, export.context), 32)
+		if expected := mustDecodeHex(t, export.value); !bytes.Equal(value, expected) {
+			t.Errorf("export(%s) = %x, expected %x", export.context, value, expected)
+		}
+	}
+}
+
+func TestHPKEWeakPublicKey(t *testing.T) {
+	if _, _, err := HPKESetupBaseSender(make([]byte, 32), nil); err == nil {
+		t.Error("an all-zero public key was accepted")
+	}
+	if _, _, err := HPKESetupBaseSender(make([]byte, 31), nil); err == nil {
+		t.Error("a short public key was accepted")
+	}
+}
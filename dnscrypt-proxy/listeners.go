@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+type ListenerOptions struct {
+	cache          bool
+	blockIPv6      bool
+	serverNames    []string
+	cacheNamespace string
+	cacheStats     *CacheStats
+	policy         *ClientPolicy
+}
+
+func normalizeListenAddr(listenAddrStr string) string {
+	if addr, err := net.ResolveTCPAddr("tcp", listenAddrStr); err == nil {
+		return addr.String()
+	}
+	return listenAddrStr
+}
+
+// Listeners using a subset of the servers get their own cache namespace,
+// so that they never get responses cached for other listeners
+
+func NewListenerOptions(proxy *Proxy, cache *bool, blockIPv6 *bool, serverNames []string) *ListenerOptions {
+	options := ListenerOptions{cache: proxy.cache, blockIPv6: proxy.pluginBlockIPv6, serverNames: serverNames}
+	if cache != nil {
+		options.cache = *cache
+	}
+	if blockIPv6 != nil {
+		options.blockIPv6 = *blockIPv6
+	}
+	if len(serverNames) > 0 {
+		sortedNames := make([]string, len(serverNames))
+		for i, serverName := range serverNames {
+			sortedNames[i] = strings.ToLower(serverName)
+		}
+		sort.Strings(sortedNames)
+		options.cacheNamespace = strings.Join(sortedNames, ",")
+	}
+	return &options
+}
+
+type ListenAddr struct {
+	family  string
+	addrStr string
+}
+
+// With listen_dual_stack, wildcard addresses are bound using separate IPv4
+// and IPv6 sockets, instead of relying on IPv4-mapped IPv6 addresses
+
+func (proxy *Proxy) expandListenAddr(listenAddrStr string) []ListenAddr {
+	if !proxy.listenDualStack {
+		return []ListenAddr{{addrStr: listenAddrStr}}
+	}
+	host, port, err := net.SplitHostPort(listenAddrStr)
+	if err != nil {
+		return []ListenAddr{{addrStr: listenAddrStr}}
+	}
+	if ip := net.ParseIP(host); len(host) > 0 && (ip == nil || !ip.IsUnspecified()) {
+		return []ListenAddr{{addrStr: listenAddrStr}}
+	}
+	return []ListenAddr{
+		{family: "4", addrStr: net.JoinHostPort("0.0.0.0", port)},
+		{family: "6", addrStr: net.JoinHostPort("::", port)},
+	}
+}
+
+func chainControls(controls []func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	if len(controls) == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		for _, control := range controls {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func (proxy *Proxy) cacheEnabled() bool {
+	if proxy.cache {
+		return true
+	}
+	for _, options := range proxy.listenersOptions {
+		if options.cache {
+			return true
+		}
+	}
+	return false
+}
+
+func (proxy *Proxy) listenerOptions(listenAddrStr string) *ListenerOptions {
+	options := NewListenerOptions(proxy, nil, nil, nil)
+	if configuredOptions, ok := proxy.listenersOptions[normalizeListenAddr(listenAddrStr)]; ok {
+		listenerOptions := *configuredOptions
+		options = &listenerOptions
+	}
+	options.cacheStats = proxy.cacheStats.forListener(listenAddrStr)
+	return options
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	CacheFlushZone = "flush.dnscrypt-proxy."
+	CacheStatsZone = "cache-stats.dnscrypt-proxy."
+	CacheDumpZone  = "cache-dump.dnscrypt-proxy."
+	StatsZone      = "stats.dnscrypt-proxy."
+	StatsLocalZone = "stats.dnscrypt-proxy.local."
+)
+
+// TXT queries for the control zones are answered locally, and only
+// if they have been sent from the local host
+
+func (proxy *Proxy) localControlResponse(query []byte, clientAddr *net.Addr) []byte {
+	if (!proxy.cacheFlushQueries && !proxy.cacheStatsQueries && !proxy.statsQueries && len(proxy.cacheDumpFile) == 0) || clientAddr == nil {
+		return nil
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(query); err != nil || len(msg.Question) != 1 || msg.Question[0].Qtype != dns.TypeTXT {
+		return nil
+	}
+	qName := strings.ToLower(msg.Question[0].Name)
+	if !strings.HasSuffix(qName, ".dnscrypt-proxy.") && qName != StatsLocalZone {
+		return nil
+	}
+	if ip := ClientIP(*clientAddr); ip == nil || !ip.IsLoopback() {
+		return nil
+	}
+	if proxy.cacheFlushQueries && (qName == CacheFlushZone || strings.HasSuffix(qName, "."+CacheFlushZone)) {
+		return proxy.cacheFlushResponse(&msg, strings.TrimSuffix(strings.TrimSuffix(qName, CacheFlushZone), "."))
+	}
+	if proxy.cacheStatsQueries && qName == CacheStatsZone {
+		return proxy.cacheStatsResponse(&msg)
+	}
+	if len(proxy.cacheDumpFile) > 0 && qName == CacheDumpZone {
+		return proxy.cacheDumpResponse(&msg)
+	}
+	if proxy.statsQueries && (qName == StatsZone || qName == StatsLocalZone) {
+		return proxy.statsResponse(&msg)
+	}
+	return nil
+}
+
+// The active server is the one the last query was sent to, possibly the
+// fallback resolver
+
+func (proxy *Proxy) statsResponse(msg *dns.Msg) []byte {
+	proxy.serversInfo.RLock()
+	serversCount := len(proxy.serversInfo.inner)
+	proxy.serversInfo.RUnlock()
+	active, _ := proxy.activeServer.Load().(string)
+	if len(active) == 0 {
+		active = "-"
+	}
+	count, capacity := cachedResponses.entries()
+	truncated := []string{"truncated"}
+	for _, proto := range truncationProtos {
+		truncated = append(truncated, fmt.Sprintf("%s=%d", strings.ToLower(proto.String()), proxy.truncatedResponses.get(proto)))
+	}
+	lines := []string{
+		fmt.Sprintf("version=%s uptime=%ds", AppVersion, int64(time.Since(proxy.startTime).Seconds())),
+		fmt.Sprintf("servers=%d active=%s all_failing=%t", serversCount, active, proxy.serversInfo.allFailing()),
+		strings.Join(truncated, " "),
+		fmt.Sprintf("cache entries=%d size=%d", count, capacity),
+	}
+	return TXTResponseFromMessage(msg, append(lines, proxy.cacheStats.lines()...))
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultLocalDoHPath = "/dns-query"
+)
+
+type LocalDoHHandler struct {
+	proxy           *Proxy
+	listenerOptions *ListenerOptions
+}
+
+func (handler LocalDoHHandler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	proxy := handler.proxy
+	if request.URL.Path != proxy.localDoHPath {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var query []byte
+	var err error
+	switch request.Method {
+	case "GET":
+		query, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(request.URL.Query().Get("dns"), "="))
+	case "POST":
+		if request.Header.Get("Content-Type") != DoHMediaType {
+			writer.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		query, err = ioutil.ReadAll(io.LimitReader(request.Body, int64(MaxDNSPacketSize)))
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil || len(query) < MinDNSPacketSize {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var clientAddr net.Addr
+	if tcpAddr, err := net.ResolveTCPAddr("tcp", request.RemoteAddr); err == nil {
+		clientAddr = tcpAddr
+	}
+	response := proxy.processIncomingQuery(handler.listenerOptions, "doh", proxy.mainProto, query, &clientAddr, nil)
+	if len(response) < MinDNSPacketSize {
+		writer.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(response); err == nil {
+		ttl := getMinTTL(&msg, 0, proxy.cacheMaxTTL, 0)
+		writer.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", int(ttl.Seconds())))
+	}
+	writer.Header().Set("Content-Type", DoHMediaType)
+	writer.Write(response)
+}
+
+func (proxy *Proxy) localDoHListener(listenAddrStr string) error {
+	listener, err := net.Listen("tcp", listenAddrStr)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:      LocalDoHHandler{proxy: proxy, listenerOptions: proxy.listenerOptions(listenAddrStr)},
+		TLSConfig:    &tls.Config{Certificates: []tls.Certificate{proxy.localDoHCert}, MinVersion: tls.VersionTLS12},
+		ReadTimeout:  proxy.timeout,
+		WriteTimeout: 2 * proxy.timeout,
+	}
+	go func() {
+		listenersLog.Noticef("Now listening to https://%v%s [DoH]", listener.Addr(), proxy.localDoHPath)
+		if err := server.ServeTLS(listener, "", ""); err != nil {
+			listenersLog.Critical(err)
+		}
+	}()
+	return nil
+}
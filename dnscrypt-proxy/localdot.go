@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/tls"
+)
+
+const (
+	DefaultLocalDoTPort = 853
+)
+
+// TLS session tickets are enabled and rotated by crypto/tls, so that clients
+// such as Android's Private DNS can resume sessions without a full handshake
+
+func (proxy *Proxy) localDoTListener(listenAddrStr string) error {
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{proxy.localDoTCert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	listener, err := tls.Listen("tcp", listenAddrStr, tlsConfig)
+	if err != nil {
+		return err
+	}
+	listenerOptions := proxy.listenerOptions(listenAddrStr)
+	go func() {
+		defer listener.Close()
+		listenersLog.Noticef("Now listening to %v [DoT]", listener.Addr())
+		for {
+			clientPc, err := listener.Accept()
+			if err != nil {
+				continue
+			}
+			go proxy.serveTCPConn(clientPc, listenerOptions)
+		}
+	}()
+	return nil
+}
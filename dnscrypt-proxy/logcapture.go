@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const LogCaptureDrainTimeout = 2 * time.Second
+
+type LogLine struct {
+	Time    string   `json:"time"`
+	Module  string   `json:"module"`
+	Level   string   `json:"level"`
+	Message string   `json:"message"`
+	Values  []string `json:"values,omitempty"`
+}
+
+var logLineValues = regexp.MustCompile(`\[([^\]]*)\]`)
+
+// dlog lines look like "[2006-01-02 15:04:05] [dnscrypt-proxy] [NOTICE] message".
+// Values between brackets in the message, such as names and servers, are
+// extracted as well.
+
+func parseLogLine(line string) (LogLine, bool) {
+	parts := strings.SplitN(line, "] ", 4)
+	if len(parts) != 4 {
+		return LogLine{}, false
+	}
+	logLine := LogLine{
+		Time:    strings.TrimPrefix(parts[0], "["),
+		Module:  strings.TrimPrefix(parts[1], "["),
+		Level:   strings.TrimPrefix(parts[2], "["),
+		Message: parts[3],
+	}
+	if logLine.Module == "-" {
+		logLine.Module = SyslogAppName
+	}
+	for _, match := range logLineValues.FindAllStringSubmatch(logLine.Message, -1) {
+		logLine.Values = append(logLine.Values, match[1])
+	}
+	return logLine, true
+}
+
+type LogCapture struct {
+	syslog     *Syslog
+	eventLog   *EventLog
+	jsonFormat bool
+	stderr     *os.File
+	writer     *os.File
+	done       chan struct{}
+}
+
+var logCapture *LogCapture
+
+// Lines are sent to syslog with the severity they were logged with, or
+// written to the original standard error as JSON. Warnings and errors are
+// also written to the Windows Event Log if enabled.
+
+func (capture *LogCapture) handle(line string) {
+	logLine, ok := parseLogLine(line)
+	if ok && capture.jsonFormat {
+		if encoded, err := json.Marshal(logLine); err == nil {
+			line = string(encoded)
+		}
+	}
+	severity, message := SyslogSeverityInfo, line
+	if found, known := syslogSeverities[logLine.Level]; ok && known {
+		severity = found
+		if !capture.jsonFormat {
+			message = logLine.Message
+		}
+	}
+	if capture.syslog == nil || severity < SyslogSeverityCritical {
+		capture.stderr.WriteString(line + "\n")
+	}
+	if capture.syslog != nil {
+		if err := capture.syslog.send(severity, "", message); err != nil {
+			capture.stderr.WriteString(line + "\n")
+		}
+	}
+	if eventType, found := eventLogTypes[logLine.Level]; ok && found && capture.eventLog != nil {
+		capture.eventLog.report(eventType, logLine.Message)
+	}
+}
+
+// dlog only writes to the standard error; its lines are read back from a pipe
+
+func captureLogs(syslog *Syslog, eventLog *EventLog, jsonFormat bool) error {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	capture := &LogCapture{
+		syslog:     syslog,
+		eventLog:   eventLog,
+		jsonFormat: jsonFormat,
+		stderr:     os.Stderr,
+		writer:     writer,
+		done:       make(chan struct{}),
+	}
+	os.Stderr = writer
+	logCapture = capture
+	go func() {
+		scanner := bufio.NewScanner(reader)
+		for scanner.Scan() {
+			capture.handle(scanner.Text())
+		}
+		close(capture.done)
+	}()
+	return nil
+}
+
+// dlog exits as soon as a fatal error has been written, before it could be
+// read back from the pipe. So, fatal errors are handled synchronously instead,
+// once the lines still in the pipe have been handled.
+
+func logFatal(message interface{}) {
+	capture := logCapture
+	if capture == nil {
+		dlog.Fatal(message)
+		return
+	}
+	os.Stderr = capture.stderr
+	capture.writer.Close()
+	select {
+	case <-capture.done:
+	case <-time.After(LogCaptureDrainTimeout):
+	}
+	line := fmt.Sprintf("[%s] [-] [%s] %s", time.Now().Format("2006-01-02 15:04:05"),
+		dlog.SeverityName[dlog.SeverityFatal], strings.TrimSpace(fmt.Sprint(message)))
+	capture.handle(line)
+	os.Exit(255)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// The fatal error is logged from a child process, as the process exits right
+// after. Lines logged before must not be lost either.
+
+func TestLogFatalJSON(t *testing.T) {
+	if os.Getenv("DNSCRYPT_PROXY_TEST_LOG_FATAL") == "1" {
+		if err := captureLogs(nil, nil, true); err != nil {
+			os.Exit(1)
+		}
+		os.Stderr.WriteString("[2006-01-02 15:04:05] [-] [ERROR] Unable to use [example]\n")
+		logFatal("listen udp 192.0.2.1:53: bind: cannot assign requested address")
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLogFatalJSON$")
+	cmd.Env = append(os.Environ(), "DNSCRYPT_PROXY_TEST_LOG_FATAL=1")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 255 {
+		t.Fatalf("Unexpected exit status: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(stderr.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 lines, got %q", lines)
+	}
+	expected := []LogLine{
+		{Level: "ERROR", Message: "Unable to use [example]"},
+		{Level: "FATAL", Message: "listen udp 192.0.2.1:53: bind: cannot assign requested address"},
+	}
+	for i, line := range lines {
+		var logLine LogLine
+		if err := json.Unmarshal([]byte(line), &logLine); err != nil {
+			t.Fatalf("Line %d is not JSON: %q", i, line)
+		}
+		if logLine.Level != expected[i].Level || logLine.Message != expected[i].Message {
+			t.Errorf("Line %d: got %+v, expected %+v", i, logLine, expected[i])
+		}
+	}
+}
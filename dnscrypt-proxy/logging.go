@@ -0,0 +1,161 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+// Subsystems can log with their own level. Loggers without a level of their
+// own use the global one; their messages are handled by dlog as usual.
+
+type Logger struct {
+	level int32
+}
+
+var (
+	sourcesLog   = &Logger{level: -1}
+	certsLog     = &Logger{level: -1}
+	cacheLog     = &Logger{level: -1}
+	pluginsLog   = &Logger{level: -1}
+	listenersLog = &Logger{level: -1}
+)
+
+var logComponents = map[string]*Logger{
+	"sources":   sourcesLog,
+	"certs":     certsLog,
+	"cache":     cacheLog,
+	"plugins":   pluginsLog,
+	"listeners": listenersLog,
+}
+
+var logOutput struct {
+	sync.Mutex
+	globalLevel dlog.Severity
+}
+
+func setLogLevels(globalLevel dlog.Severity, levels map[string]int) error {
+	logOutput.globalLevel = globalLevel
+	for component, level := range levels {
+		logger, ok := logComponents[component]
+		if !ok {
+			return fmt.Errorf("Unknown log component: [%s]", component)
+		}
+		if level < int(dlog.SeverityDebug) || level > int(dlog.SeverityFatal) {
+			return fmt.Errorf("Invalid log level for [%s]: %d", component, level)
+		}
+		atomic.StoreInt32(&logger.level, int32(level))
+	}
+	return nil
+}
+
+// An empty component changes the global level
+
+func setLogLevel(component string, level int) error {
+	if len(component) > 0 {
+		return setLogLevels(logOutput.globalLevel, map[string]int{component: level})
+	}
+	if level < int(dlog.SeverityDebug) || level > int(dlog.SeverityFatal) {
+		return fmt.Errorf("Invalid log level: %d", level)
+	}
+	logLevelFlag := flag.Lookup("loglevel")
+	if logLevelFlag == nil {
+		return errors.New("Log level not configurable")
+	}
+	if err := logLevelFlag.Value.Set(strconv.Itoa(level)); err != nil {
+		return err
+	}
+	logOutput.globalLevel = dlog.Severity(level)
+	return nil
+}
+
+// Messages below the global level are written in the same format as dlog,
+// which would drop them
+
+func (logger *Logger) logf(severity dlog.Severity, format string, args ...interface{}) {
+	level := atomic.LoadInt32(&logger.level)
+	if level >= 0 && severity < dlog.Severity(level) {
+		return
+	}
+	if level < 0 || severity >= logOutput.globalLevel {
+		switch severity {
+		case dlog.SeverityDebug:
+			dlog.Debugf(format, args...)
+		case dlog.SeverityInfo:
+			dlog.Infof(format, args...)
+		case dlog.SeverityNotice:
+			dlog.Noticef(format, args...)
+		case dlog.SeverityWarning:
+			dlog.Warnf(format, args...)
+		case dlog.SeverityError:
+			dlog.Errorf(format, args...)
+		default:
+			dlog.Criticalf(format, args...)
+		}
+		return
+	}
+	message := strings.TrimSpace(fmt.Sprintf(format, args...))
+	if len(message) == 0 {
+		return
+	}
+	line := fmt.Sprintf("[%s] [-] [%s] %s\n", time.Now().Format("2006-01-02 15:04:05"), dlog.SeverityName[severity], message)
+	logOutput.Lock()
+	os.Stderr.WriteString(line)
+	logOutput.Unlock()
+}
+
+func (logger *Logger) Debugf(format string, args ...interface{}) {
+	logger.logf(dlog.SeverityDebug, format, args...)
+}
+
+func (logger *Logger) Infof(format string, args ...interface{}) {
+	logger.logf(dlog.SeverityInfo, format, args...)
+}
+
+func (logger *Logger) Noticef(format string, args ...interface{}) {
+	logger.logf(dlog.SeverityNotice, format, args...)
+}
+
+func (logger *Logger) Warnf(format string, args ...interface{}) {
+	logger.logf(dlog.SeverityWarning, format, args...)
+}
+
+func (logger *Logger) Errorf(format string, args ...interface{}) {
+	logger.logf(dlog.SeverityError, format, args...)
+}
+
+func (logger *Logger) Criticalf(format string, args ...interface{}) {
+	logger.logf(dlog.SeverityCritical, format, args...)
+}
+
+func (logger *Logger) Debug(message interface{}) {
+	logger.logf(dlog.SeverityDebug, "%v", message)
+}
+
+func (logger *Logger) Info(message interface{}) {
+	logger.logf(dlog.SeverityInfo, "%v", message)
+}
+
+func (logger *Logger) Notice(message interface{}) {
+	logger.logf(dlog.SeverityNotice, "%v", message)
+}
+
+func (logger *Logger) Warn(message interface{}) {
+	logger.logf(dlog.SeverityWarning, "%v", message)
+}
+
+func (logger *Logger) Error(message interface{}) {
+	logger.logf(dlog.SeverityError, "%v", message)
+}
+
+func (logger *Logger) Critical(message interface{}) {
+	logger.logf(dlog.SeverityCritical, "%v", message)
+}
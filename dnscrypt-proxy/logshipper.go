@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	LogShipperQueueSize  = 10000
+	LogShipperRetries    = 3
+	LogShipperTimeout    = 30 * time.Second
+	LogShipperMaxSpooled = 1000
+)
+
+// Query log entries are sent in batches, as gzip-compressed NDJSON documents.
+// Batches that cannot be sent after a few attempts are kept in the spool
+// directory, and sent again after the next successful request.
+
+type LogShipper struct {
+	url       string
+	headers   map[string]string
+	client    *http.Client
+	batchSize int
+	interval  time.Duration
+	spoolDir  string
+	lines     chan []byte
+}
+
+func NewLogShipper(urlStr string, headers map[string]string, batchSize int, interval time.Duration, spoolDir string) (*LogShipper, error) {
+	parsedURL, err := url.Parse(urlStr)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+		return nil, fmt.Errorf("Invalid log shipping URL: [%s]", urlStr)
+	}
+	if batchSize <= 0 || interval <= 0 {
+		return nil, fmt.Errorf("Log shipping batch_size and flush_interval must be positive")
+	}
+	if len(spoolDir) > 0 {
+		if err := os.MkdirAll(spoolDir, 0700); err != nil {
+			return nil, err
+		}
+	}
+	shipper := LogShipper{
+		url:       urlStr,
+		headers:   headers,
+		client:    &http.Client{Timeout: LogShipperTimeout},
+		batchSize: batchSize,
+		interval:  interval,
+		spoolDir:  spoolDir,
+		lines:     make(chan []byte, LogShipperQueueSize),
+	}
+	go shipper.run()
+	return &shipper, nil
+}
+
+// Entries are dropped when the queue is full
+
+func (shipper *LogShipper) Write(p []byte) (int, error) {
+	select {
+	case shipper.lines <- append([]byte{}, p...):
+	default:
+	}
+	return len(p), nil
+}
+
+func (shipper *LogShipper) run() {
+	ticker := time.NewTicker(shipper.interval)
+	var batch bytes.Buffer
+	count := 0
+	for {
+		select {
+		case line := <-shipper.lines:
+			batch.Write(line)
+			count++
+			if count < shipper.batchSize {
+				continue
+			}
+		case <-ticker.C:
+			if count == 0 {
+				continue
+			}
+		}
+		shipper.ship(batch.Bytes())
+		batch.Reset()
+		count = 0
+	}
+}
+
+func (shipper *LogShipper) ship(batch []byte) {
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(batch)
+	writer.Close()
+	body := compressed.Bytes()
+	var err error
+	for attempt := 0; attempt < LogShipperRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(1<<uint(attempt)) * time.Second)
+		}
+		if err = shipper.post(body); err == nil {
+			shipper.shipSpooled()
+			return
+		}
+	}
+	dlog.Warnf("Unable to ship query logs to [%s]: %s", shipper.url, err)
+	shipper.spool(body)
+}
+
+func (shipper *LogShipper) post(body []byte) error {
+	req, err := http.NewRequest("POST", shipper.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+	for name, value := range shipper.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := shipper.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (shipper *LogShipper) spooled() []string {
+	files, _ := filepath.Glob(filepath.Join(shipper.spoolDir, "*.ndjson.gz"))
+	sort.Strings(files)
+	return files
+}
+
+func (shipper *LogShipper) spool(body []byte) {
+	if len(shipper.spoolDir) == 0 {
+		return
+	}
+	if len(shipper.spooled()) >= LogShipperMaxSpooled {
+		dlog.Warnf("Log shipping spool is full - dropping a batch")
+		return
+	}
+	fileName := filepath.Join(shipper.spoolDir, fmt.Sprintf("%020d.ndjson.gz", time.Now().UnixNano()))
+	if err := ioutil.WriteFile(fileName, body, 0600); err != nil {
+		dlog.Warnf("Unable to spool query logs: %s", err)
+	}
+}
+
+func (shipper *LogShipper) shipSpooled() {
+	if len(shipper.spoolDir) == 0 {
+		return
+	}
+	for _, fileName := range shipper.spooled() {
+		if body, err := ioutil.ReadFile(fileName); err == nil {
+			if err = shipper.post(body); err != nil {
+				return
+			}
+		}
+		os.Remove(fileName)
+	}
+}
@@ -1,33 +1,170 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	mrand "math/rand"
 	"net"
+	"net/url"
 	"os"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
 	"golang.org/x/crypto/curve25519"
 )
 
+const (
+	TCPIdleTimeout       = 10 * time.Second
+	MaxTCPQueriesPerConn = 100
+)
+
+// Set at build time with -ldflags "-X main.AppVersion=<version>"
+
+var AppVersion = "dev"
+
 type Proxy struct {
-	proxyPublicKey        [32]byte
-	proxySecretKey        [32]byte
-	questionSizeEstimator QuestionSizeEstimator
-	serversInfo           ServersInfo
-	timeout               time.Duration
-	certRefreshDelay      time.Duration
-	mainProto             string
-	listenAddresses       []string
-	daemonize             bool
-	registeredServers     []RegisteredServer
-	pluginBlockIPv6       bool
-	cache                 bool
-	cacheSize             int
-	cacheNegTTL           uint32
-	cacheMinTTL           uint32
-	cacheMaxTTL           uint32
+	proxyPublicKey         [32]byte
+	proxySecretKey         [32]byte
+	questionSizeEstimator  QuestionSizeEstimator
+	serversInfo            ServersInfo
+	timeout                time.Duration
+	certRefreshDelay       time.Duration
+	mainProto              string
+	listenAddresses        []string
+	listenersPerAddress    int
+	listenInterface        string
+	listenDualStack        bool
+	transparentAddresses   []string
+	namedPipes             []string
+	clientACL              *ClientACL
+	proxyProtocolSources   []*net.IPNet
+	rateLimiter            *RateLimiter
+	queryQueue             *QueryQueue
+	listenersOptions       map[string]*ListenerOptions
+	localDoHAddresses      []string
+	localDoHPath           string
+	localDoHCert           tls.Certificate
+	localDoTAddresses      []string
+	localDoTCert           tls.Certificate
+	daemonize              bool
+	registeredServers      []RegisteredServer
+	serversOptions         map[string]ServerOptions
+	xTransport             *XTransport
+	odohRoutes             map[string][]*url.URL
+	fallbackLastResort     bool
+	dns0x20                bool
+	dns0x20Exempt          []string
+	fallbackInUse          int32
+	ephemeralKeys          bool
+	ephemeralKeysCache     *EphemeralKeysCache
+	ephemeralKeysPerServer bool
+	padTo                  int
+	randomPadding          bool
+	truncatedResponses     TruncationCounters
+	pluginBlockIPv6        bool
+	pluginSpecialNames     bool
+	pluginDoHCanary        *PluginDoHCanary
+	pluginWhitelist        *PluginWhitelist
+	pluginBlacklist        *PluginBlacklist
+	pluginBlacklistIP      *PluginBlacklistIP
+	pluginThreats          *PluginThreats
+	pluginCloak            *PluginCloak
+	pluginSafeSearch       *PluginCloak
+	pluginHosts            *PluginHosts
+	pluginCaptivePortal    *PluginCaptivePortal
+	pluginExternal         *PluginExternal
+	pluginRewriteIP        *PluginRewriteIP
+	pluginRebinding        *PluginRebinding
+	pluginForward          *PluginForward
+	pluginDNS64            *PluginDNS64
+	pluginBlockQueryTypes  *PluginBlockQueryTypes
+	clientPolicies         ClientPolicies
+	hooks                  *Hooks
+	webhook                *Webhook
+	queryLogs              []*QueryLog
+	dnstap                 *Dnstap
+	eventLog               *EventLog
+	metrics                *Metrics
+	metricsAddress         string
+	statsd                 *StatsD
+	statsdInterval         time.Duration
+	rulesSources           []*Source
+	adminAPIAddress        string
+	adminAPIToken          string
+	controlSocket          string
+	healthCheckAddress     string
+	queryPluginsOrder      []string
+	cnameBlocking          CNAMEBlockingAction
+	cnameMaxDepth          int
+	responsePluginsOrder   []string
+	cache                  bool
+	cacheSize              int
+	cachePolicy            string
+	cacheShards            int
+	cacheNegTTL            uint32
+	cacheNXDomainTTL       uint32
+	cacheNoDataTTL         uint32
+	cacheServFailTTL       uint32
+	cacheBypass            *CacheBypassRules
+	cacheFlushQueries      bool
+	cacheStatsQueries      bool
+	statsQueries           bool
+	startTime              time.Time
+	activeServer           atomic.Value
+	cacheDumpFile          string
+	cacheAggressiveNSEC    bool
+	cacheTTLJitter         int
+	cacheStats             CacheStatsRegistry
+	serverStats            ServerStatsRegistry
+	serverStatsInterval    time.Duration
+	sharedCache            SharedCache
+	clientTTLMin           uint32
+	clientTTLMax           uint32
+	cacheMinTTL            uint32
+	cacheMaxTTL            uint32
+	cacheServeStale        time.Duration
+	cachePrefetchMinHits   uint32
+	forwardECS             bool
+	ecsIPv4Prefix          uint8
+	ecsIPv6Prefix          uint8
+	ecs                    *dns.EDNS0_SUBNET
+	cacheFile              string
+	cacheFileMaxSize       int
+}
+
+type TruncationCounters struct {
+	sync.Mutex
+	counts map[StampProtoType]uint64
+}
+
+func (counters *TruncationCounters) increment(proto StampProtoType) uint64 {
+	counters.Lock()
+	if counters.counts == nil {
+		counters.counts = make(map[StampProtoType]uint64)
+	}
+	counters.counts[proto]++
+	count := counters.counts[proto]
+	counters.Unlock()
+	return count
+}
+
+// Protocols whose truncated responses can be retried over TCP
+
+var truncationProtos = []StampProtoType{StampProtoTypeDNSCrypt, StampProtoTypePlain}
+
+func (counters *TruncationCounters) get(proto StampProtoType) uint64 {
+	counters.Lock()
+	defer counters.Unlock()
+	return counters.counts[proto]
 }
 
 func main() {
@@ -35,7 +172,7 @@ func main() {
 	cdLocal()
 	proxy := Proxy{}
 	if err := ConfigLoad(&proxy, "dnscrypt-proxy.toml"); err != nil {
-		dlog.Fatal(err)
+		logFatal(err)
 	}
 	if proxy.daemonize {
 		Daemonize()
@@ -54,45 +191,128 @@ func cdLocal() {
 }
 
 func (proxy *Proxy) StartProxy() {
+	proxy.startTime = time.Now()
 	proxy.questionSizeEstimator = NewQuestionSizeEstimator()
+	if len(proxy.healthCheckAddress) > 0 {
+		if err := proxy.healthCheckListener(proxy.healthCheckAddress); err != nil {
+			logFatal(err)
+		}
+	}
 	if _, err := rand.Read(proxy.proxySecretKey[:]); err != nil {
-		dlog.Fatal(err)
+		logFatal(err)
 	}
 	curve25519.ScalarBaseMult(&proxy.proxyPublicKey, &proxy.proxySecretKey)
+	if proxy.ephemeralKeys && !proxy.ephemeralKeysPerServer {
+		proxy.ephemeralKeysCache = NewEphemeralKeysCache()
+	}
+	if proxy.cacheEnabled() {
+		if err := cachedResponses.init(proxy.cachePolicy, proxy.cacheShards, proxy.cacheSize); err != nil {
+			logFatal(err)
+		}
+		if len(proxy.cacheFile) > 0 {
+			proxy.startCacheSnapshots()
+		}
+		proxy.startCacheFlushSignal()
+	}
+	if proxy.cacheAggressiveNSEC {
+		if err := nsecCache.init(); err != nil {
+			logFatal(err)
+		}
+	}
 	for _, registeredServer := range proxy.registeredServers {
 		proxy.serversInfo.registerServer(proxy, registeredServer.name, registeredServer.stamp)
 	}
-	for _, listenAddrStr := range proxy.listenAddresses {
-		listenUDPAddr, err := net.ResolveUDPAddr("udp", listenAddrStr)
-		if err != nil {
-			dlog.Fatal(err)
+	activated, err := proxy.SystemDListeners()
+	if err != nil {
+		logFatal(err)
+	}
+	if !activated {
+		proxy.startListeners()
+	}
+	for _, listenAddrStr := range proxy.transparentAddresses {
+		if err := proxy.transparentListener(listenAddrStr); err != nil {
+			logFatal(err)
 		}
-		listenTCPAddr, err := net.ResolveTCPAddr("tcp", listenAddrStr)
-		if err != nil {
-			dlog.Fatal(err)
+	}
+	for _, pipeName := range proxy.namedPipes {
+		if err := proxy.namedPipeListener(pipeName); err != nil {
+			logFatal(err)
+		}
+	}
+	for _, listenAddrStr := range proxy.localDoHAddresses {
+		if err := proxy.localDoHListener(listenAddrStr); err != nil {
+			logFatal(err)
 		}
-		if err := proxy.udpListener(listenUDPAddr); err != nil {
-			dlog.Fatal(err)
+	}
+	for _, listenAddrStr := range proxy.localDoTAddresses {
+		if err := proxy.localDoTListener(listenAddrStr); err != nil {
+			logFatal(err)
+		}
+	}
+	if len(proxy.metricsAddress) > 0 {
+		if err := proxy.metricsListener(proxy.metricsAddress); err != nil {
+			logFatal(err)
 		}
-		if err := proxy.tcpListener(listenTCPAddr); err != nil {
-			dlog.Fatal(err)
+	}
+	if proxy.statsd != nil {
+		proxy.statsd.start(proxy, proxy.statsdInterval)
+	}
+	if proxy.serverStatsInterval > 0 {
+		proxy.serverStats.startSummaries(proxy.serverStatsInterval)
+	}
+	if len(proxy.adminAPIAddress) > 0 {
+		if err := proxy.adminAPIListener(proxy.adminAPIAddress); err != nil {
+			logFatal(err)
+		}
+	}
+	if len(proxy.controlSocket) > 0 {
+		if err := proxy.controlSocketListener(proxy.controlSocket); err != nil {
+			logFatal(err)
 		}
 	}
 	dlog.Notice("dnscrypt-proxy is ready")
+	if proxy.eventLog != nil {
+		proxy.eventLog.report(EventLogInformation, "dnscrypt-proxy is ready")
+	}
 	for {
 		time.Sleep(proxy.certRefreshDelay)
 		proxy.serversInfo.refresh(proxy)
+		cacheLog.Debugf("Cache entries per shard: %v", cachedResponses.occupancy())
 	}
 }
 
-func (proxy *Proxy) udpListener(listenAddr *net.UDPAddr) error {
-	clientPc, err := net.ListenUDP("udp", listenAddr)
-	if err != nil {
-		return err
+func (proxy *Proxy) startListeners() {
+	var controls []func(network, address string, c syscall.RawConn) error
+	if proxy.listenersPerAddress > 1 {
+		controls = append(controls, reusePortControl)
+	}
+	if len(proxy.listenInterface) > 0 {
+		controls = append(controls, bindToInterfaceControl(proxy.listenInterface))
+	}
+	listenConfig := net.ListenConfig{Control: chainControls(controls)}
+	for _, listenAddrStr := range proxy.listenAddresses {
+		listenerOptions := proxy.listenerOptions(listenAddrStr)
+		for _, listenAddr := range proxy.expandListenAddr(listenAddrStr) {
+			for i := 0; i < proxy.listenersPerAddress; i++ {
+				clientPc, err := listenConfig.ListenPacket(context.Background(), "udp"+listenAddr.family, listenAddr.addrStr)
+				if err != nil {
+					logFatal(err)
+				}
+				acceptPc, err := listenConfig.Listen(context.Background(), "tcp"+listenAddr.family, listenAddr.addrStr)
+				if err != nil {
+					logFatal(err)
+				}
+				proxy.udpListener(clientPc.(*net.UDPConn), listenerOptions)
+				proxy.tcpListener(acceptPc.(*net.TCPListener), listenerOptions)
+			}
+		}
 	}
+}
+
+func (proxy *Proxy) udpListener(clientPc *net.UDPConn, listenerOptions *ListenerOptions) {
 	go func() {
 		defer clientPc.Close()
-		dlog.Noticef("Now listening to %v [UDP]", listenAddr)
+		listenersLog.Noticef("Now listening to %v [UDP]", clientPc.LocalAddr())
 		for {
 			buffer := make([]byte, MaxDNSPacketSize-1)
 			length, clientAddr, err := clientPc.ReadFrom(buffer)
@@ -101,41 +321,58 @@ func (proxy *Proxy) udpListener(listenAddr *net.UDPAddr) error {
 			}
 			packet := buffer[:length]
 			go func() {
-				proxy.processIncomingQuery(proxy.serversInfo.getOne(), proxy.mainProto, packet, &clientAddr, clientPc)
+				proxy.processIncomingQuery(listenerOptions, "udp", proxy.mainProto, packet, &clientAddr, clientPc)
 			}()
 		}
 	}()
-	return nil
 }
 
-func (proxy *Proxy) tcpListener(listenAddr *net.TCPAddr) error {
-	acceptPc, err := net.ListenTCP("tcp", listenAddr)
-	if err != nil {
-		return err
+// Queries sent over the same connection are processed concurrently,
+// and responses are sent as soon as they are ready (RFC 7766, RFC 7858)
+
+func (proxy *Proxy) serveTCPConn(clientPc net.Conn, listenerOptions *ListenerOptions) {
+	defer clientPc.Close()
+	clientAddr := clientPc.RemoteAddr()
+	var wg sync.WaitGroup
+	for i := 0; i < MaxTCPQueriesPerConn; i++ {
+		clientPc.SetReadDeadline(time.Now().Add(TCPIdleTimeout))
+		packet, err := ReadPrefixed(clientPc)
+		if err != nil || len(packet) < MinDNSPacketSize {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			clientPc.SetWriteDeadline(time.Now().Add(proxy.timeout))
+			proxy.processIncomingQuery(listenerOptions, "tcp", "tcp", packet, &clientAddr, clientPc)
+		}()
 	}
+	wg.Wait()
+}
+
+func (proxy *Proxy) tcpListener(acceptPc *net.TCPListener, listenerOptions *ListenerOptions) {
 	go func() {
 		defer acceptPc.Close()
-		dlog.Noticef("Now listening to %v [TCP]", listenAddr)
+		listenersLog.Noticef("Now listening to %v [TCP]", acceptPc.Addr())
 		for {
 			clientPc, err := acceptPc.Accept()
 			if err != nil {
 				continue
 			}
 			go func() {
-				defer clientPc.Close()
-				clientPc.SetDeadline(time.Now().Add(proxy.timeout))
-				packet, err := ReadPrefixed(clientPc.(*net.TCPConn))
-				if err != nil || len(packet) < MinDNSPacketSize {
+				conn, err := proxy.acceptProxyProtocol(clientPc)
+				if err != nil {
+					listenersLog.Debugf("[%v]: %s", clientPc.RemoteAddr(), err)
+					clientPc.Close()
 					return
 				}
-				proxy.processIncomingQuery(proxy.serversInfo.getOne(), "tcp", packet, nil, clientPc)
+				proxy.serveTCPConn(conn, listenerOptions)
 			}()
 		}
 	}()
-	return nil
 }
 
-func (proxy *Proxy) exchangeWithUDPServer(serverInfo *ServerInfo, encryptedQuery []byte, clientNonce []byte) ([]byte, error) {
+func (proxy *Proxy) exchangeWithUDPServer(serverInfo *ServerInfo, sharedKey *[32]byte, encryptedQuery []byte, clientNonce []byte) ([]byte, error) {
 	pc, err := net.DialUDP("udp", nil, serverInfo.UDPAddr)
 	if err != nil {
 		return nil, err
@@ -149,86 +386,402 @@ func (proxy *Proxy) exchangeWithUDPServer(serverInfo *ServerInfo, encryptedQuery
 		return nil, err
 	}
 	encryptedResponse = encryptedResponse[:length]
-	return proxy.Decrypt(serverInfo, encryptedResponse, clientNonce)
+	return proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
 }
 
-func (proxy *Proxy) exchangeWithTCPServer(serverInfo *ServerInfo, encryptedQuery []byte, clientNonce []byte) ([]byte, error) {
-	pc, err := net.DialTCP("tcp", nil, serverInfo.TCPAddr)
+func (proxy *Proxy) exchangeWithTCPServer(serverInfo *ServerInfo, sharedKey *[32]byte, encryptedQuery []byte, clientNonce []byte) ([]byte, error) {
+	encryptedQuery, err := PrefixWithSize(encryptedQuery)
 	if err != nil {
 		return nil, err
 	}
-	pc.SetDeadline(time.Now().Add(serverInfo.Timeout))
-	encryptedQuery, err = PrefixWithSize(encryptedQuery)
+	var response []byte
+	err = serverInfo.tcpPool.Do(func(pc net.Conn) error {
+		pc.SetDeadline(time.Now().Add(serverInfo.Timeout))
+		if _, err := pc.Write(encryptedQuery); err != nil {
+			return err
+		}
+		encryptedResponse, err := ReadPrefixed(pc)
+		if err != nil {
+			return err
+		}
+		response, err = proxy.Decrypt(serverInfo, sharedKey, encryptedResponse, clientNonce)
+		return err
+	})
+	return response, err
+}
+
+func (proxy *Proxy) exchangeWithDoHServer(serverInfo *ServerInfo, query []byte) ([]byte, error) {
+	tid := TransactionID(query)
+	SetTransactionID(query, 0)
+	response, _, err := proxy.xTransport.DoHQuery(serverInfo.dohGET, serverInfo.URL, serverInfo.dohHeaders, query, serverInfo.Timeout)
+	SetTransactionID(query, tid)
 	if err != nil {
 		return nil, err
 	}
-	pc.Write(encryptedQuery)
+	SetTransactionID(response, tid)
+	return response, nil
+}
 
-	encryptedResponse, err := ReadPrefixed(pc)
-	pc.Close()
+func (proxy *Proxy) exchangeWithODoHServer(serverInfo *ServerInfo, query []byte) ([]byte, error) {
+	tid := TransactionID(query)
+	SetTransactionID(query, 0)
+	encryptedQuery, queryContext, err := serverInfo.odohTargetConfig.encryptQuery(query)
+	SetTransactionID(query, tid)
+	if err != nil {
+		return nil, err
+	}
+	postURL := serverInfo.URL
+	if len(serverInfo.odohRelays) > 0 {
+		relayURL := *serverInfo.odohRelays[mrand.Intn(len(serverInfo.odohRelays))]
+		parameters := relayURL.Query()
+		parameters.Set("targethost", serverInfo.URL.Host)
+		parameters.Set("targetpath", serverInfo.URL.Path)
+		relayURL.RawQuery = parameters.Encode()
+		postURL = &relayURL
+	}
+	resp, _, err := proxy.xTransport.Post(postURL, ODoHMediaType, ODoHMediaType, nil, encryptedQuery, serverInfo.Timeout)
 	if err != nil {
 		return nil, err
 	}
-	return proxy.Decrypt(serverInfo, encryptedResponse, clientNonce)
+	encryptedResponse, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(MaxDNSPacketSize+256)))
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response, err := queryContext.decryptResponse(encryptedResponse)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < MinDNSPacketSize {
+		return nil, errors.New("Response too short")
+	}
+	SetTransactionID(response, tid)
+	return response, nil
 }
 
-func (proxy *Proxy) processIncomingQuery(serverInfo *ServerInfo, serverProto string, query []byte, clientAddr *net.Addr, clientPc net.Conn) {
-	if len(query) < MinDNSPacketSize || serverInfo == nil {
-		return
+// UDP cannot go through the proxy, so plain DNS servers are queried using TCP
+// if one has been configured
+
+func (proxy *Proxy) plainServerProto(proto string) string {
+	if proxy.xTransport.proxyURL != nil {
+		return "tcp"
+	}
+	return proto
+}
+
+func (proxy *Proxy) exchangeWithPlainServer(proto string, serverAddrStr string, query []byte) ([]byte, error) {
+	proto = proxy.plainServerProto(proto)
+	originalQuery := query
+	use0x20 := proxy.dns0x20 && !includesName(proxy.dns0x20Exempt, serverAddrStr)
+	if use0x20 {
+		query = Randomize0x20(query)
+	}
+	var pc net.Conn
+	var err error
+	if proto == "udp" {
+		pc, err = net.Dial("udp", serverAddrStr)
+	} else {
+		pc, err = proxy.xTransport.Dial("tcp", serverAddrStr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer pc.Close()
+	pc.SetDeadline(time.Now().Add(proxy.timeout))
+	var response []byte
+	if proto == "udp" {
+		if _, err = pc.Write(query); err != nil {
+			return nil, err
+		}
+		response = make([]byte, MaxDNSPacketSize)
+		length, err := pc.Read(response)
+		if err != nil {
+			return nil, err
+		}
+		response = response[:length]
+	} else {
+		prefixedQuery, err := PrefixWithSize(append([]byte{}, query...))
+		if err != nil {
+			return nil, err
+		}
+		if _, err = pc.Write(prefixedQuery); err != nil {
+			return nil, err
+		}
+		if response, err = ReadPrefixed(pc); err != nil {
+			return nil, err
+		}
+	}
+	if len(response) < MinDNSPacketSize || TransactionID(response) != TransactionID(query) {
+		return nil, errors.New("Unexpected response")
+	}
+	if use0x20 {
+		if err := Restore0x20(originalQuery, query, response); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+}
+
+// Exchanges return the transport the response was received with, such as
+// "udp", "dnscrypt-tcp" or "odoh-relay"
+
+func (proxy *Proxy) exchangeWithFallbackResolver(serverProto string, query []byte) ([]byte, string, error) {
+	if atomic.CompareAndSwapInt32(&proxy.fallbackInUse, 0, 1) {
+		dlog.Warnf("All encrypted servers are unreachable - queries are now sent in plaintext to the fallback resolver [%s]", proxy.xTransport.fallbackResolver)
 	}
-	clientProto := "udp"
-	if clientAddr == nil {
-		clientProto = "tcp"
+	serverProto = proxy.plainServerProto(serverProto)
+	response, err := proxy.exchangeWithPlainServer(serverProto, proxy.xTransport.fallbackResolver, query)
+	if err == nil && serverProto == "udp" && HasTCFlag(response) {
+		count := proxy.truncatedResponses.increment(StampProtoTypePlain)
+		dlog.Debugf("[%s] Truncated response - retrying over TCP (%d truncated plain DNS responses so far)", proxy.xTransport.fallbackResolver, count)
+		response, err = proxy.exchangeWithPlainServer("tcp", proxy.xTransport.fallbackResolver, query)
+		serverProto = "tcp"
 	}
-	pluginsState := NewPluginsState(proxy, clientProto)
-	query, _ = pluginsState.ApplyQueryPlugins(query)
+	return response, serverProto, err
+}
+
+func (proxy *Proxy) exchangeWithServer(serverInfo *ServerInfo, serverProto string, query []byte) ([]byte, string, error) {
 	var response []byte
+	var transport string
 	var err error
-	if pluginsState.action != PluginsActionForward {
-		if pluginsState.synthResponse != nil {
-			response, err = pluginsState.synthResponse.PackBuffer(response)
-			if err != nil {
-				return
-			}
+	ecs := proxy.serversOptions[serverInfo.Name].ecs
+	if ecs == nil {
+		ecs = proxy.ecs
+	}
+	injectedECS := false
+	if ecs != nil {
+		if ecsQuery, added, err := AddECS(query, ecs); err == nil && added {
+			query, injectedECS = ecsQuery, true
 		}
 	}
-	if len(response) == 0 {
-		encryptedQuery, clientNonce, err := proxy.Encrypt(serverInfo, query, serverProto)
+	if proxy.padTo > 0 && serverInfo.Proto != StampProtoTypeODoHTarget {
+		if paddedQuery, err := AddEDNS0Padding(query, proxy.padTo, proxy.randomPadding); err == nil {
+			query = paddedQuery
+		}
+	}
+	if serverInfo.Proto == StampProtoTypeDNSCrypt {
+		if len(serverInfo.forcedProto) > 0 {
+			serverProto = serverInfo.forcedProto
+		}
+		sharedKey, encryptedQuery, clientNonce, err := proxy.Encrypt(serverInfo, query, serverProto)
 		if err != nil {
-			return
+			return nil, "", err
 		}
+		transport = "dnscrypt-" + serverProto
 		serverInfo.noticeBegin(proxy)
 		if serverProto == "udp" {
-			response, err = proxy.exchangeWithUDPServer(serverInfo, encryptedQuery, clientNonce)
+			response, err = proxy.exchangeWithUDPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
+			if err == nil && HasTCFlag(response) {
+				proxy.questionSizeEstimator.blindAdjust()
+				count := proxy.truncatedResponses.increment(StampProtoTypeDNSCrypt)
+				dlog.Debugf("[%s] Truncated response - retrying over TCP (%d truncated DNSCrypt responses so far)", serverInfo.Name, count)
+				if sharedKey, encryptedQuery, clientNonce, err = proxy.Encrypt(serverInfo, query, "tcp"); err == nil {
+					response, err = proxy.exchangeWithTCPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
+					transport = "dnscrypt-tcp"
+				}
+			}
 		} else {
-			response, err = proxy.exchangeWithTCPServer(serverInfo, encryptedQuery, clientNonce)
+			response, err = proxy.exchangeWithTCPServer(serverInfo, sharedKey, encryptedQuery, clientNonce)
+		}
+		if err != nil {
+			serverInfo.noticeFailure(proxy)
+			return nil, "", err
+		}
+	} else if serverInfo.Proto == StampProtoTypeDoH {
+		transport = "doh"
+		serverInfo.noticeBegin(proxy)
+		response, err = proxy.exchangeWithDoHServer(serverInfo, query)
+		if err != nil {
+			serverInfo.noticeFailure(proxy)
+			return nil, "", err
+		}
+	} else if serverInfo.Proto == StampProtoTypeODoHTarget {
+		transport = "odoh"
+		if len(serverInfo.odohRelays) > 0 {
+			transport = "odoh-relay"
 		}
+		serverInfo.noticeBegin(proxy)
+		response, err = proxy.exchangeWithODoHServer(serverInfo, query)
 		if err != nil {
 			serverInfo.noticeFailure(proxy)
-			return
+			return nil, "", err
 		}
-		response, _ = pluginsState.ApplyResponsePlugins(response)
+	} else if serverInfo.Proto == StampProtoTypeTLS {
+		transport = "dot"
+		serverInfo.noticeBegin(proxy)
+		response, err = serverInfo.dotClient.Exchange(query)
+		if err != nil {
+			serverInfo.noticeFailure(proxy)
+			return nil, "", err
+		}
+	} else {
+		return nil, "", errors.New("Unsupported protocol")
 	}
-	if clientAddr != nil {
-		if len(response) > MaxDNSUDPPacketSize {
-			response, err = TruncatedResponse(response)
+	if atomic.CompareAndSwapInt32(&proxy.fallbackInUse, 1, 0) {
+		dlog.Notice("Encrypted servers are reachable again - the fallback resolver is not used any more")
+	}
+	if injectedECS {
+		response, _ = StripECS(response)
+	}
+	return response, transport, nil
+}
+
+func (proxy *Proxy) processIncomingQuery(listenerOptions *ListenerOptions, clientProto string, serverProto string, query []byte, clientAddr *net.Addr, clientPc net.Conn) []byte {
+	if len(query) < MinDNSPacketSize {
+		return nil
+	}
+	start := time.Now()
+	proxy.dnstap.clientQuery(clientProto, clientAddr, start, query)
+	serverInfo := proxy.serversInfo.getOneAmong(listenerOptions.serverNames)
+	if serverInfo == nil && !proxy.fallbackLastResort && proxy.cacheServeStale == 0 {
+		return nil
+	}
+	pluginsState := NewPluginsState(proxy, clientProto, listenerOptions, proxy.clientPolicies.forClient(listenerOptions, clientAddr))
+	pluginsState.clientAddr = clientAddr
+	var response []byte
+	var err error
+	exchanged := false
+	if proxy.clientACL != nil && clientAddr != nil && !proxy.clientACL.allows(*clientAddr) {
+		if !proxy.clientACL.refuse {
+			return nil
+		}
+		if response, err = ErrorResponseFromQuery(query, dns.RcodeRefused); err != nil {
+			return nil
+		}
+		serverInfo = nil
+	} else if allowed, slip := proxy.checkRateLimit(clientAddr); !allowed {
+		if !slip || clientProto != "udp" {
+			return nil
+		}
+		if response, err = TruncatedResponse(query); err != nil {
+			return nil
+		}
+		serverInfo = nil
+	} else if response = proxy.localControlResponse(query, clientAddr); len(response) > 0 {
+		serverInfo = nil
+	} else if rcode := proxy.queryQueue.enter(); rcode != dns.RcodeSuccess {
+		if response, err = ErrorResponseFromQuery(query, rcode); err != nil {
+			return nil
+		}
+		serverInfo = nil
+	} else {
+		defer proxy.queryQueue.leave()
+		query, _ = pluginsState.ApplyQueryPlugins(query)
+		if pluginsState.action == PluginsActionDrop {
+			return nil
+		}
+		if pluginsState.action == PluginsActionReject {
+			proxy.hooks.blocked(query, clientAddr)
+		}
+		if pluginsState.action != PluginsActionForward && pluginsState.synthResponse != nil {
+			response, err = pluginsState.synthResponse.PackBuffer(response)
 			if err != nil {
-				return
+				return nil
 			}
 		}
-		clientPc.(net.PacketConn).WriteTo(response, *clientAddr)
+	}
+	if len(response) == 0 {
+		if serverInfo != nil {
+			exchangeStart := time.Now()
+			response, pluginsState.transport, err = proxy.exchangeWithServer(serverInfo, serverProto, query)
+			proxy.serverStats.record(serverInfo.Name, time.Since(exchangeStart), err)
+			if err == nil {
+				exchanged = true
+				proxy.metrics.serverResponse(serverInfo.Name, time.Since(exchangeStart))
+			}
+		}
+		if serverInfo == nil || err != nil {
+			if serverInfo != nil && !proxy.serversInfo.allFailing() {
+				return nil
+			}
+			serverInfo = nil
+			response = nil
+			if proxy.fallbackLastResort {
+				if response, pluginsState.transport, err = proxy.exchangeWithFallbackResolver(serverProto, query); err != nil {
+					response = nil
+				}
+			}
+		}
+		if len(response) > 0 {
+			pluginsState.serverInfo = serverInfo
+			if serverInfo != nil {
+				pluginsState.serverName = serverInfo.Name
+			} else {
+				pluginsState.serverName = proxy.xTransport.fallbackResolver
+			}
+			proxy.activeServer.Store(pluginsState.serverName)
+			response, _ = pluginsState.ApplyResponsePlugins(response)
+			if pluginsState.action == PluginsActionReject {
+				proxy.hooks.blocked(query, clientAddr)
+			}
+		} else if proxy.cacheServeStale > 0 && listenerOptions.cache {
+			if response = pluginsState.staleResponse(query, proxy.cacheServeStale); len(response) == 0 {
+				return nil
+			}
+			dlog.Debug("All servers are unreachable - serving a stale response")
+		} else {
+			return nil
+		}
+	}
+	if len(pluginsState.cloakedName) > 0 {
+		response = pluginsState.uncloak(response)
+	}
+	if pluginsState.ruleTTL > 0 {
+		response, _ = ClampTTLs(response, pluginsState.ruleTTL, pluginsState.ruleTTL)
+	}
+	if proxy.clientTTLMin > 0 || proxy.clientTTLMax > 0 {
+		response, _ = ClampTTLs(response, proxy.clientTTLMin, proxy.clientTTLMax)
+	}
+	if clientProto == "udp" {
 		if HasTCFlag(response) {
 			proxy.questionSizeEstimator.blindAdjust()
 		} else {
 			proxy.questionSizeEstimator.adjust(ResponseOverhead + len(response))
 		}
-	} else {
-		response, err = PrefixWithSize(response)
+		if len(response) > Min(MaxDNSUDPPacketSize, pluginsState.clientMaxPayloadSize) {
+			response, err = TruncatedResponse(response)
+			if err != nil {
+				return nil
+			}
+		}
+		clientPc.(net.PacketConn).WriteTo(response, *clientAddr)
+	} else if clientProto == "tcp" {
+		if pluginsState.tcpKeepAlive {
+			response, _ = AddTCPKeepAlive(response, TCPIdleTimeout)
+		}
+		prefixedResponse, err := PrefixWithSize(response)
 		if err != nil {
-			serverInfo.noticeFailure(proxy)
-			return
+			if exchanged {
+				serverInfo.noticeFailure(proxy)
+			}
+			return nil
 		}
-		clientPc.Write(response)
+		clientPc.Write(prefixedResponse)
+	}
+	proxy.dnstap.clientResponse(clientProto, clientAddr, start, response)
+	proxy.metrics.query(response, pluginsState.blockedBy)
+	for _, queryLog := range proxy.queryLogs {
+		queryLog.log(clientAddr, response, pluginsState.serverName, pluginsState.transport, pluginsState.cacheHit, time.Since(start), pluginsState.blockedBy)
+	}
+	if exchanged {
+		serverInfo.noticeSuccess(proxy)
+	}
+	if serverInfo != nil && pluginsState.prefetchStats != nil {
+		go proxy.prefetch(pluginsState, serverInfo, serverProto, query)
+	}
+	return response
+}
+
+// Popular entries are refreshed in the background shortly before they expire
+
+func (proxy *Proxy) prefetch(pluginsState PluginsState, serverInfo *ServerInfo, serverProto string, query []byte) {
+	response, _, err := proxy.exchangeWithServer(serverInfo, serverProto, query)
+	if err != nil {
+		atomic.StoreInt32(&pluginsState.prefetchStats.prefetching, 0)
+		return
 	}
+	pluginsState.serverInfo = serverInfo
+	pluginsState.serverName = serverInfo.Name
+	pluginsState.ApplyResponsePlugins(response)
 	serverInfo.noticeSuccess(proxy)
 }
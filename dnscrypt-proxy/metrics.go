@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const DefaultMetricsPath = "/metrics"
+
+var metricsLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type MetricsQueryKey struct {
+	rcode string
+	qtype string
+}
+
+type MetricsHistogram struct {
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+type MetricsSource struct {
+	lastSuccess time.Time
+	failures    uint64
+}
+
+type Metrics struct {
+	sync.Mutex
+	path    string
+	queries map[MetricsQueryKey]uint64
+	blocked map[string]uint64
+	servers map[string]*MetricsHistogram
+	sources map[string]*MetricsSource
+}
+
+func NewMetrics(path string) *Metrics {
+	if len(path) == 0 {
+		path = DefaultMetricsPath
+	}
+	return &Metrics{
+		path:    path,
+		queries: make(map[MetricsQueryKey]uint64),
+		blocked: make(map[string]uint64),
+		servers: make(map[string]*MetricsHistogram),
+		sources: make(map[string]*MetricsSource),
+	}
+}
+
+// Only the header and the question of responses are parsed
+
+func (metrics *Metrics) query(response []byte, blockedBy *BlockAttribution) {
+	if metrics == nil || len(response) < 12 {
+		return
+	}
+	key := MetricsQueryKey{rcode: dns.RcodeToString[int(response[3]&0x0f)], qtype: "-"}
+	if end := questionNameEnd(response); end > 0 && end+2 <= len(response) {
+		qtype := binary.BigEndian.Uint16(response[end : end+2])
+		if name, ok := dns.TypeToString[qtype]; ok {
+			key.qtype = name
+		} else {
+			key.qtype = "OTHER"
+		}
+	}
+	metrics.Lock()
+	metrics.queries[key]++
+	if blockedBy != nil {
+		metrics.blocked[blockedBy.plugin]++
+	}
+	metrics.Unlock()
+}
+
+func (metrics *Metrics) serverResponse(serverName string, latency time.Duration) {
+	if metrics == nil {
+		return
+	}
+	seconds := latency.Seconds()
+	metrics.Lock()
+	histogram, ok := metrics.servers[serverName]
+	if !ok {
+		histogram = &MetricsHistogram{buckets: make([]uint64, len(metricsLatencyBuckets))}
+		metrics.servers[serverName] = histogram
+	}
+	for i, bound := range metricsLatencyBuckets {
+		if seconds <= bound {
+			histogram.buckets[i]++
+		}
+	}
+	histogram.count++
+	histogram.sum += seconds
+	metrics.Unlock()
+}
+
+func (metrics *Metrics) sourceFetched(url string, err error) {
+	if metrics == nil {
+		return
+	}
+	metrics.Lock()
+	source, ok := metrics.sources[url]
+	if !ok {
+		source = &MetricsSource{}
+		metrics.sources[url] = source
+	}
+	if err == nil {
+		source.lastSuccess = time.Now()
+	} else {
+		source.failures++
+	}
+	metrics.Unlock()
+}
+
+func metricsLabel(value string) string {
+	return strconv.Quote(value)
+}
+
+// Metrics are written in the Prometheus text exposition format
+
+func (metrics *Metrics) write(proxy *Proxy, out *bytes.Buffer) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	out.WriteString("# HELP dnscrypt_proxy_queries_total Queries answered, by response code and query type\n")
+	out.WriteString("# TYPE dnscrypt_proxy_queries_total counter\n")
+	var lines []string
+	for key, count := range metrics.queries {
+		lines = append(lines, fmt.Sprintf("dnscrypt_proxy_queries_total{rcode=%s,qtype=%s} %d\n", metricsLabel(key.rcode), metricsLabel(key.qtype), count))
+	}
+	sort.Strings(lines)
+	out.WriteString(strings.Join(lines, ""))
+	out.WriteString("# HELP dnscrypt_proxy_blocked_total Queries blocked, by plugin\n")
+	out.WriteString("# TYPE dnscrypt_proxy_blocked_total counter\n")
+	lines = lines[:0]
+	for plugin, count := range metrics.blocked {
+		lines = append(lines, fmt.Sprintf("dnscrypt_proxy_blocked_total{plugin=%s} %d\n", metricsLabel(plugin), count))
+	}
+	sort.Strings(lines)
+	out.WriteString(strings.Join(lines, ""))
+	proxy.cacheStats.Lock()
+	listenAddrStrs := make([]string, 0, len(proxy.cacheStats.listeners))
+	for listenAddrStr := range proxy.cacheStats.listeners {
+		listenAddrStrs = append(listenAddrStrs, listenAddrStr)
+	}
+	sort.Strings(listenAddrStrs)
+	out.WriteString("# HELP dnscrypt_proxy_cache_hits_total Responses served from the cache, by listener\n")
+	out.WriteString("# TYPE dnscrypt_proxy_cache_hits_total counter\n")
+	for _, listenAddrStr := range listenAddrStrs {
+		stats := proxy.cacheStats.listeners[listenAddrStr]
+		fmt.Fprintf(out, "dnscrypt_proxy_cache_hits_total{listener=%s} %d\n", metricsLabel(listenAddrStr), atomic.LoadUint64(&stats.hits))
+	}
+	out.WriteString("# HELP dnscrypt_proxy_cache_misses_total Queries not found in the cache, by listener\n")
+	out.WriteString("# TYPE dnscrypt_proxy_cache_misses_total counter\n")
+	for _, listenAddrStr := range listenAddrStrs {
+		stats := proxy.cacheStats.listeners[listenAddrStr]
+		fmt.Fprintf(out, "dnscrypt_proxy_cache_misses_total{listener=%s} %d\n", metricsLabel(listenAddrStr), atomic.LoadUint64(&stats.misses))
+	}
+	proxy.cacheStats.Unlock()
+	count, capacity := cachedResponses.entries()
+	out.WriteString("# HELP dnscrypt_proxy_cache_entries Entries currently in the cache\n")
+	out.WriteString("# TYPE dnscrypt_proxy_cache_entries gauge\n")
+	fmt.Fprintf(out, "dnscrypt_proxy_cache_entries %d\n", count)
+	out.WriteString("# HELP dnscrypt_proxy_cache_size Maximum number of entries in the cache\n")
+	out.WriteString("# TYPE dnscrypt_proxy_cache_size gauge\n")
+	fmt.Fprintf(out, "dnscrypt_proxy_cache_size %d\n", capacity)
+	out.WriteString("# HELP dnscrypt_proxy_server_latency_seconds Time taken by upstream servers to respond\n")
+	out.WriteString("# TYPE dnscrypt_proxy_server_latency_seconds histogram\n")
+	serverNames := make([]string, 0, len(metrics.servers))
+	for serverName := range metrics.servers {
+		serverNames = append(serverNames, serverName)
+	}
+	sort.Strings(serverNames)
+	for _, serverName := range serverNames {
+		histogram := metrics.servers[serverName]
+		label := metricsLabel(serverName)
+		for i, bound := range metricsLatencyBuckets {
+			fmt.Fprintf(out, "dnscrypt_proxy_server_latency_seconds_bucket{server=%s,le=\"%s\"} %d\n", label, strconv.FormatFloat(bound, 'g', -1, 64), histogram.buckets[i])
+		}
+		fmt.Fprintf(out, "dnscrypt_proxy_server_latency_seconds_bucket{server=%s,le=\"+Inf\"} %d\n", label, histogram.count)
+		fmt.Fprintf(out, "dnscrypt_proxy_server_latency_seconds_sum{server=%s} %g\n", label, histogram.sum)
+		fmt.Fprintf(out, "dnscrypt_proxy_server_latency_seconds_count{server=%s} %d\n", label, histogram.count)
+	}
+	out.WriteString("# HELP dnscrypt_proxy_truncated_responses_total Truncated UDP responses retried over TCP, by protocol\n")
+	out.WriteString("# TYPE dnscrypt_proxy_truncated_responses_total counter\n")
+	for _, proto := range truncationProtos {
+		fmt.Fprintf(out, "dnscrypt_proxy_truncated_responses_total{proto=%s} %d\n", metricsLabel(strings.ToLower(proto.String())), proxy.truncatedResponses.get(proto))
+	}
+	urls := make([]string, 0, len(metrics.sources))
+	for url := range metrics.sources {
+		urls = append(urls, url)
+	}
+	sort.Strings(urls)
+	out.WriteString("# HELP dnscrypt_proxy_source_last_success_timestamp_seconds Last time a source was successfully fetched\n")
+	out.WriteString("# TYPE dnscrypt_proxy_source_last_success_timestamp_seconds gauge\n")
+	for _, url := range urls {
+		lastSuccess := int64(0)
+		if source := metrics.sources[url]; !source.lastSuccess.IsZero() {
+			lastSuccess = source.lastSuccess.Unix()
+		}
+		fmt.Fprintf(out, "dnscrypt_proxy_source_last_success_timestamp_seconds{source=%s} %d\n", metricsLabel(url), lastSuccess)
+	}
+	out.WriteString("# HELP dnscrypt_proxy_source_failures_total Failed source fetches\n")
+	out.WriteString("# TYPE dnscrypt_proxy_source_failures_total counter\n")
+	for _, url := range urls {
+		fmt.Fprintf(out, "dnscrypt_proxy_source_failures_total{source=%s} %d\n", metricsLabel(url), metrics.sources[url].failures)
+	}
+}
+
+func (proxy *Proxy) metricsListener(listenAddrStr string) error {
+	listener, err := net.Listen("tcp", listenAddrStr)
+	if err != nil {
+		return err
+	}
+	metrics := proxy.metrics
+	handler := http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		if request.URL.Path != metrics.path {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var out bytes.Buffer
+		metrics.write(proxy, &out)
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writer.Write(out.Bytes())
+	})
+	go func() {
+		listenersLog.Noticef("Now serving metrics on http://%v%s", listener.Addr(), metrics.path)
+		if err := http.Serve(listener, handler); err != nil {
+			dlog.Errorf("Metrics server: %s", err)
+		}
+	}()
+	return nil
+}
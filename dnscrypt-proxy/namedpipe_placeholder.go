@@ -0,0 +1,11 @@
+// +build !windows
+
+package main
+
+import "errors"
+
+const NamedPipesSupported = false
+
+func (proxy *Proxy) namedPipeListener(pipeName string) error {
+	return errors.New("Named pipes are not supported on this platform")
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	NamedPipesSupported       = true
+	pipeAccessDuplex          = 0x00000003
+	fileFlagFirstPipeInstance = 0x00080000
+	pipeTypeByte              = 0x00000000
+	pipeWait                  = 0x00000000
+	pipeRejectRemoteClients   = 0x00000008
+	pipeUnlimitedInstances    = 255
+	errorPipeConnected        = syscall.Errno(535)
+
+	// SYSTEM and administrators get full access, authenticated users can send queries
+	namedPipeSDDL = "D:P(A;;GA;;;SY)(A;;GA;;;BA)(A;;GRGW;;;AU)"
+)
+
+var (
+	modkernel32 = syscall.NewLazyDLL("kernel32.dll")
+	modadvapi32 = syscall.NewLazyDLL("advapi32.dll")
+
+	procCreateNamedPipeW                                     = modkernel32.NewProc("CreateNamedPipeW")
+	procConnectNamedPipe                                     = modkernel32.NewProc("ConnectNamedPipe")
+	procDisconnectNamedPipe                                  = modkernel32.NewProc("DisconnectNamedPipe")
+	procConvertStringSecurityDescriptorToSecurityDescriptorW = modadvapi32.NewProc("ConvertStringSecurityDescriptorToSecurityDescriptorW")
+)
+
+func namedPipeSecurityAttributes() (*syscall.SecurityAttributes, error) {
+	sddl, err := syscall.UTF16PtrFromString(namedPipeSDDL)
+	if err != nil {
+		return nil, err
+	}
+	var securityDescriptor uintptr
+	if r, _, err := procConvertStringSecurityDescriptorToSecurityDescriptorW.Call(uintptr(unsafe.Pointer(sddl)), 1, uintptr(unsafe.Pointer(&securityDescriptor)), 0); r == 0 {
+		return nil, err
+	}
+	securityAttributes := &syscall.SecurityAttributes{SecurityDescriptor: securityDescriptor}
+	securityAttributes.Length = uint32(unsafe.Sizeof(*securityAttributes))
+	return securityAttributes, nil
+}
+
+func createNamedPipe(pipeName string, securityAttributes *syscall.SecurityAttributes, first bool) (syscall.Handle, error) {
+	name, err := syscall.UTF16PtrFromString(pipeName)
+	if err != nil {
+		return syscall.InvalidHandle, err
+	}
+	openMode := uint32(pipeAccessDuplex)
+	if first {
+		openMode |= fileFlagFirstPipeInstance
+	}
+	r, _, err := procCreateNamedPipeW.Call(uintptr(unsafe.Pointer(name)), uintptr(openMode),
+		pipeTypeByte|pipeWait|pipeRejectRemoteClients, pipeUnlimitedInstances,
+		uintptr(MaxDNSPacketSize), uintptr(MaxDNSPacketSize), 0, uintptr(unsafe.Pointer(securityAttributes)))
+	if syscall.Handle(r) == syscall.InvalidHandle {
+		return syscall.InvalidHandle, err
+	}
+	return syscall.Handle(r), nil
+}
+
+// Local applications can send length-prefixed queries over a named pipe,
+// just like over TCP, without the proxy having to own a port
+
+func (proxy *Proxy) namedPipeListener(pipeName string) error {
+	securityAttributes, err := namedPipeSecurityAttributes()
+	if err != nil {
+		return err
+	}
+	handle, err := createNamedPipe(pipeName, securityAttributes, true)
+	if err != nil {
+		return err
+	}
+	listenerOptions := proxy.listenerOptions(pipeName)
+	go func() {
+		listenersLog.Noticef("Now listening to %s [named pipe]", pipeName)
+		for {
+			if r, _, err := procConnectNamedPipe.Call(uintptr(handle), 0); r == 0 && err != errorPipeConnected {
+				procDisconnectNamedPipe.Call(uintptr(handle))
+				continue
+			}
+			clientHandle := handle
+			if handle, err = createNamedPipe(pipeName, securityAttributes, false); err != nil {
+				listenersLog.Criticalf("Unable to create a new instance of [%s]: [%s]", pipeName, err)
+				syscall.CloseHandle(clientHandle)
+				return
+			}
+			go proxy.serveNamedPipeConn(clientHandle, listenerOptions)
+		}
+	}()
+	return nil
+}
+
+func (proxy *Proxy) serveNamedPipeConn(handle syscall.Handle, listenerOptions *ListenerOptions) {
+	clientPipe := os.NewFile(uintptr(handle), "named pipe")
+	defer func() {
+		procDisconnectNamedPipe.Call(uintptr(handle))
+		clientPipe.Close()
+	}()
+	for {
+		packet, err := ReadPrefixed(clientPipe)
+		if err != nil || len(packet) < MinDNSPacketSize {
+			return
+		}
+		response := proxy.processIncomingQuery(listenerOptions, "pipe", proxy.mainProto, packet, nil, nil)
+		if len(response) == 0 {
+			return
+		}
+		prefixedResponse, err := PrefixWithSize(response)
+		if err != nil {
+			return
+		}
+		if _, err := clientPipe.Write(prefixedResponse); err != nil {
+			return
+		}
+	}
+}
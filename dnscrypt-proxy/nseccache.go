@@ -0,0 +1,281 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/miekg/dns"
+)
+
+// Aggressive use of DNSSEC-validated cache (RFC 8198): NSEC and NSEC3 records
+// from authenticated NXDOMAIN responses are kept, and used to answer queries
+// for other names they prove to be non-existent without asking upstream.
+
+const (
+	NSECCacheMaxZones          = 1024
+	NSECCacheMaxRecordsPerZone = 1024
+	NSEC3MaxIterations         = 150
+)
+
+type NSECRecord struct {
+	rr         dns.RR
+	sigs       []dns.RR
+	expiration time.Time
+}
+
+type NSECZone struct {
+	soa     []dns.RR
+	records map[string]NSECRecord
+}
+
+type NSECCache struct {
+	sync.Mutex
+	zones *lru.Cache
+}
+
+var nsecCache NSECCache
+
+func (nsecCache *NSECCache) init() error {
+	zones, err := lru.New(NSECCacheMaxZones)
+	if err != nil {
+		return err
+	}
+	nsecCache.zones = zones
+	return nil
+}
+
+func canonicalNameCompare(a string, b string) int {
+	labelsA, labelsB := dns.SplitDomainName(strings.ToLower(a)), dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(labelsA) && i <= len(labelsB); i++ {
+		if c := strings.Compare(labelsA[len(labelsA)-i], labelsB[len(labelsB)-i]); c != 0 {
+			return c
+		}
+	}
+	return len(labelsA) - len(labelsB)
+}
+
+func isDelegation(types []uint16) bool {
+	ns, soa := false, false
+	for _, t := range types {
+		switch t {
+		case dns.TypeNS:
+			ns = true
+		case dns.TypeSOA:
+			soa = true
+		case dns.TypeDNAME:
+			return true
+		}
+	}
+	return ns && !soa
+}
+
+// Records at a delegation point don't prove anything about names below it
+
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	if dns.IsSubDomain(nsec.Hdr.Name, name) && isDelegation(nsec.TypeBitMap) {
+		return false
+	}
+	if canonicalNameCompare(nsec.Hdr.Name, nsec.NextDomain) < 0 {
+		return canonicalNameCompare(nsec.Hdr.Name, name) < 0 && canonicalNameCompare(name, nsec.NextDomain) < 0
+	}
+	return canonicalNameCompare(nsec.Hdr.Name, name) < 0
+}
+
+func closestEncloser(name string, other string) string {
+	labels := dns.SplitDomainName(name)
+	common := dns.CompareDomainName(name, other)
+	return dns.Fqdn(strings.Join(labels[len(labels)-common:], "."))
+}
+
+func (nsecCache *NSECCache) insert(msg *dns.Msg) {
+	if nsecCache.zones == nil || !msg.AuthenticatedData || msg.Rcode != dns.RcodeNameError {
+		return
+	}
+	var soa *dns.SOA
+	sigs := make(map[string][]dns.RR)
+	for _, rr := range msg.Ns {
+		switch rr := rr.(type) {
+		case *dns.SOA:
+			soa = rr
+		case *dns.RRSIG:
+			key := strings.ToLower(rr.Hdr.Name) + "/" + dns.TypeToString[rr.TypeCovered]
+			sigs[key] = append(sigs[key], rr)
+		}
+	}
+	if soa == nil {
+		return
+	}
+	zoneName := strings.ToLower(soa.Hdr.Name)
+	ttl := Min(int(soa.Hdr.Ttl), int(soa.Minttl))
+	now := time.Now()
+	nsecCache.Lock()
+	defer nsecCache.Unlock()
+	zone := &NSECZone{records: make(map[string]NSECRecord)}
+	if cached, ok := nsecCache.zones.Get(zoneName); ok {
+		zone = cached.(*NSECZone)
+	} else {
+		nsecCache.zones.Add(zoneName, zone)
+	}
+	zone.soa = append([]dns.RR{soa}, sigs[zoneName+"/SOA"]...)
+	for _, rr := range msg.Ns {
+		header := rr.Header()
+		if header.Rrtype != dns.TypeNSEC && header.Rrtype != dns.TypeNSEC3 {
+			continue
+		}
+		owner := strings.ToLower(header.Name)
+		if !dns.IsSubDomain(zoneName, owner) {
+			continue
+		}
+		if nsec3, ok := rr.(*dns.NSEC3); ok && nsec3.Iterations > NSEC3MaxIterations {
+			continue
+		}
+		if _, ok := zone.records[owner]; !ok && len(zone.records) >= NSECCacheMaxRecordsPerZone {
+			zone.removeExpired(now)
+			if len(zone.records) >= NSECCacheMaxRecordsPerZone {
+				continue
+			}
+		}
+		zone.records[owner] = NSECRecord{
+			rr:         rr,
+			sigs:       sigs[owner+"/"+dns.TypeToString[header.Rrtype]],
+			expiration: now.Add(time.Duration(Min(ttl, int(header.Ttl))) * time.Second),
+		}
+	}
+}
+
+func (zone *NSECZone) removeExpired(now time.Time) {
+	for owner, record := range zone.records {
+		if now.After(record.expiration) {
+			delete(zone.records, owner)
+		}
+	}
+}
+
+func (zone *NSECZone) find(now time.Time, match func(rr dns.RR) bool) *NSECRecord {
+	for _, record := range zone.records {
+		if now.Before(record.expiration) && match(record.rr) {
+			found := record
+			return &found
+		}
+	}
+	return nil
+}
+
+func (zone *NSECZone) nsecProof(now time.Time, qName string) []*NSECRecord {
+	nameProof := zone.find(now, func(rr dns.RR) bool {
+		nsec, ok := rr.(*dns.NSEC)
+		return ok && nsecCovers(nsec, qName)
+	})
+	if nameProof == nil {
+		return nil
+	}
+	nsec := nameProof.rr.(*dns.NSEC)
+	encloser := closestEncloser(qName, nsec.Hdr.Name)
+	if other := closestEncloser(qName, nsec.NextDomain); dns.CountLabel(other) > dns.CountLabel(encloser) {
+		encloser = other
+	}
+	wildcard := "*." + encloser
+	if nsecCovers(nsec, wildcard) {
+		return []*NSECRecord{nameProof}
+	}
+	wildcardProof := zone.find(now, func(rr dns.RR) bool {
+		nsec, ok := rr.(*dns.NSEC)
+		return ok && nsecCovers(nsec, wildcard)
+	})
+	if wildcardProof == nil {
+		return nil
+	}
+	return []*NSECRecord{nameProof, wildcardProof}
+}
+
+func (zone *NSECZone) nsec3Proof(now time.Time, zoneName string, qName string) []*NSECRecord {
+	labels := dns.SplitDomainName(qName)
+	for i := 1; i < len(labels); i++ {
+		encloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		if !dns.IsSubDomain(zoneName, encloser) {
+			break
+		}
+		encloserProof := zone.find(now, func(rr dns.RR) bool {
+			nsec3, ok := rr.(*dns.NSEC3)
+			return ok && nsec3.Match(encloser) && !isDelegation(nsec3.TypeBitMap)
+		})
+		if encloserProof == nil {
+			continue
+		}
+		nextCloser := dns.Fqdn(strings.Join(labels[i-1:], "."))
+		nextCloserProof := zone.find(now, func(rr dns.RR) bool {
+			nsec3, ok := rr.(*dns.NSEC3)
+			return ok && nsec3.Flags&1 == 0 && nsec3.Cover(nextCloser)
+		})
+		wildcardProof := zone.find(now, func(rr dns.RR) bool {
+			nsec3, ok := rr.(*dns.NSEC3)
+			return ok && nsec3.Cover("*."+encloser)
+		})
+		if nextCloserProof == nil || wildcardProof == nil {
+			return nil
+		}
+		return []*NSECRecord{encloserProof, nextCloserProof, wildcardProof}
+	}
+	return nil
+}
+
+func (nsecCache *NSECCache) synthesize(msg *dns.Msg, dnssec bool) *dns.Msg {
+	if nsecCache.zones == nil || len(msg.Question) != 1 {
+		return nil
+	}
+	qName := strings.ToLower(msg.Question[0].Name)
+	now := time.Now()
+	nsecCache.Lock()
+	defer nsecCache.Unlock()
+	labels := dns.SplitDomainName(qName)
+	for i := 1; i <= len(labels); i++ {
+		zoneName := dns.Fqdn(strings.Join(labels[i:], "."))
+		cached, ok := nsecCache.zones.Get(zoneName)
+		if !ok {
+			continue
+		}
+		zone := cached.(*NSECZone)
+		proof := zone.nsecProof(now, qName)
+		if proof == nil {
+			proof = zone.nsec3Proof(now, zoneName, qName)
+		}
+		if proof == nil {
+			return nil
+		}
+		ttl := proof[0].expiration
+		for _, record := range proof {
+			if record.expiration.Before(ttl) {
+				ttl = record.expiration
+			}
+		}
+		synth := new(dns.Msg)
+		synth.SetRcode(msg, dns.RcodeNameError)
+		synth.AuthenticatedData = msg.AuthenticatedData || dnssec
+		if opt := msg.IsEdns0(); opt != nil {
+			synth.SetEdns0(opt.UDPSize(), opt.Do())
+		}
+		authority := []dns.RR{zone.soa[0]}
+		if dnssec {
+			authority = append(authority, zone.soa[1:]...)
+			seen := make(map[dns.RR]bool)
+			for _, record := range proof {
+				if seen[record.rr] {
+					continue
+				}
+				seen[record.rr] = true
+				authority = append(authority, record.rr)
+				authority = append(authority, record.sigs...)
+			}
+		}
+		remaining := uint32(ttl.Sub(now) / time.Second)
+		for _, rr := range authority {
+			rr = dns.Copy(rr)
+			rr.Header().Ttl = remaining
+			synth.Ns = append(synth.Ns, rr)
+		}
+		return synth
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+)
+
+const (
+	ODoHVersion          = 0x0001
+	ODoHMediaType        = "application/oblivious-dns-message"
+	ODoHConfigsPath      = "/.well-known/odohconfigs"
+	ODoHMessageQuery     = 0x01
+	ODoHMessageResponse  = 0x02
+	ODoHResponseNonceLen = HPKENk
+	ODoHPaddingBlockSize = 128
+)
+
+type ODoHTargetConfig struct {
+	contents  []byte
+	publicKey []byte
+	keyID     []byte
+}
+
+type ODoHQueryContext struct {
+	hpkeContext *HPKEContext
+	queryPlain  []byte
+}
+
+func parseODoHTargetConfigs(configs []byte) ([]ODoHTargetConfig, error) {
+	if len(configs) < 2 {
+		return nil, errors.New("Short ODoH configuration")
+	}
+	length := int(binary.BigEndian.Uint16(configs[0:2]))
+	if len(configs) != length+2 {
+		return nil, errors.New("Invalid ODoH configuration length")
+	}
+	var targetConfigs []ODoHTargetConfig
+	for offset := 2; offset < len(configs); {
+		if offset+4 > len(configs) {
+			return nil, errors.New("Truncated ODoH configuration")
+		}
+		version := binary.BigEndian.Uint16(configs[offset : offset+2])
+		configLength := int(binary.BigEndian.Uint16(configs[offset+2 : offset+4]))
+		offset += 4
+		if offset+configLength > len(configs) {
+			return nil, errors.New("Truncated ODoH configuration")
+		}
+		contents := configs[offset : offset+configLength]
+		offset += configLength
+		if version != ODoHVersion || len(contents) < 8 {
+			continue
+		}
+		kemID := binary.BigEndian.Uint16(contents[0:2])
+		kdfID := binary.BigEndian.Uint16(contents[2:4])
+		aeadID := binary.BigEndian.Uint16(contents[4:6])
+		publicKeyLength := int(binary.BigEndian.Uint16(contents[6:8]))
+		if kemID != HPKEKemX25519HKDFSHA256 || kdfID != HPKEKdfHKDFSHA256 || aeadID != HPKEAeadAES128GCM ||
+			len(contents) != 8+publicKeyLength {
+			continue
+		}
+		keyID := hkdfExpand(hkdfExtract(nil, contents), []byte("odoh key id"), HPKENh)
+		targetConfigs = append(targetConfigs, ODoHTargetConfig{
+			contents:  contents,
+			publicKey: contents[8:],
+			keyID:     keyID,
+		})
+	}
+	return targetConfigs, nil
+}
+
+func appendWithLength(out []byte, in []byte) []byte {
+	out = append(out, byte(len(in)>>8), byte(len(in)))
+	return append(out, in...)
+}
+
+func (targetConfig *ODoHTargetConfig) encryptQuery(query []byte) ([]byte, *ODoHQueryContext, error) {
+	paddingLength := ODoHPaddingBlockSize - (len(query)+4)%ODoHPaddingBlockSize
+	queryPlain := appendWithLength(nil, query)
+	queryPlain = appendWithLength(queryPlain, make([]byte, paddingLength))
+	enc, hpkeContext, err := HPKESetupBaseSender(targetConfig.publicKey, []byte("odoh query"))
+	if err != nil {
+		return nil, nil, err
+	}
+	aad := appendWithLength([]byte{ODoHMessageQuery}, targetConfig.keyID)
+	encryptedMessage := append(enc, hpkeContext.Seal(aad, queryPlain)...)
+	message := appendWithLength([]byte{ODoHMessageQuery}, targetConfig.keyID)
+	message = appendWithLength(message, encryptedMessage)
+	return message, &ODoHQueryContext{hpkeContext: hpkeContext, queryPlain: queryPlain}, nil
+}
+
+func (queryContext *ODoHQueryContext) decryptResponse(message []byte) ([]byte, error) {
+	if len(message) < 5 || message[0] != ODoHMessageResponse {
+		return nil, errors.New("Invalid ODoH response")
+	}
+	nonceLength := int(binary.BigEndian.Uint16(message[1:3]))
+	if nonceLength != ODoHResponseNonceLen || len(message) < 3+nonceLength+2 {
+		return nil, errors.New("Invalid ODoH response nonce")
+	}
+	responseNonce := message[3 : 3+nonceLength]
+	encryptedLength := int(binary.BigEndian.Uint16(message[3+nonceLength : 5+nonceLength]))
+	encrypted := message[5+nonceLength:]
+	if len(encrypted) != encryptedLength {
+		return nil, errors.New("Invalid ODoH response length")
+	}
+	secret := queryContext.hpkeContext.Export([]byte("odoh response"), HPKENk)
+	salt := appendWithLength(append([]byte{}, queryContext.queryPlain...), responseNonce)
+	prk := hkdfExtract(salt, secret)
+	aead, err := newAESGCM(hkdfExpand(prk, []byte("odoh key"), HPKENk))
+	if err != nil {
+		return nil, err
+	}
+	nonce := hkdfExpand(prk, []byte("odoh nonce"), HPKENn)
+	aad := appendWithLength([]byte{ODoHMessageResponse}, responseNonce)
+	responsePlain, err := aead.Open(nil, nonce, encrypted, aad)
+	if err != nil {
+		return nil, err
+	}
+	if len(responsePlain) < 2 {
+		return nil, errors.New("Short ODoH response")
+	}
+	responseLength := int(binary.BigEndian.Uint16(responsePlain[0:2]))
+	if len(responsePlain) < 2+responseLength || responseLength < MinDNSPacketSize {
+		return nil, errors.New("Invalid ODoH response length")
+	}
+	padding := responsePlain[2+responseLength:]
+	if len(padding) < 2 || len(padding) != 2+int(binary.BigEndian.Uint16(padding[0:2])) {
+		return nil, errors.New("Invalid ODoH response padding length")
+	}
+	padding = padding[2:]
+	if subtle.ConstantTimeCompare(padding, make([]byte, len(padding))) != 1 {
+		return nil, errors.New("Invalid ODoH response padding")
+	}
+	return responsePlain[2 : 2+responseLength], nil
+}
+
+func (xTransport *XTransport) FetchODoHTargetConfig(targetURL *url.URL) (ODoHTargetConfig, error) {
+	configsURL := &url.URL{Scheme: targetURL.Scheme, Host: targetURL.Host, Path: ODoHConfigsPath}
+	resp, _, err := xTransport.Fetch("GET", configsURL, "", "", nil, nil, 0)
+	if err != nil {
+		return ODoHTargetConfig{}, err
+	}
+	defer resp.Body.Close()
+	configs, err := ioutil.ReadAll(io.LimitReader(resp.Body, 65536))
+	if err != nil {
+		return ODoHTargetConfig{}, err
+	}
+	targetConfigs, err := parseODoHTargetConfigs(configs)
+	if err != nil {
+		return ODoHTargetConfig{}, err
+	}
+	if len(targetConfigs) == 0 {
+		return ODoHTargetConfig{}, fmt.Errorf("No supported ODoH configuration found for [%s]", targetURL.Host)
+	}
+	return targetConfigs[0], nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"testing"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/curve25519"
+)
+
+// A minimal ODoH target (RFC 9230), to check that queries can be decrypted
+// and responses encrypted the way a real target would
+
+type testODoHTarget struct {
+	secretKey [32]byte
+	publicKey [32]byte
+}
+
+func newTestODoHTarget(t *testing.T) *testODoHTarget {
+	target := testODoHTarget{}
+	if _, err := rand.Read(target.secretKey[:]); err != nil {
+		t.Fatal(err)
+	}
+	curve25519.ScalarBaseMult(&target.publicKey, &target.secretKey)
+	return &target
+}
+
+func (target *testODoHTarget) configs() []byte {
+	contents := make([]byte, 8)
+	binary.BigEndian.PutUint16(contents[0:2], HPKEKemX25519HKDFSHA256)
+	binary.BigEndian.PutUint16(contents[2:4], HPKEKdfHKDFSHA256)
+	binary.BigEndian.PutUint16(contents[4:6], HPKEAeadAES128GCM)
+	binary.BigEndian.PutUint16(contents[6:8], uint16(len(target.publicKey)))
+	contents = append(contents, target.publicKey[:]...)
+	config := []byte{byte(ODoHVersion >> 8), byte(ODoHVersion & 0xff)}
+	config = appendWithLength(config, contents)
+	return appendWithLength(nil, config)
+}
+
+func readWithLength(t *testing.T, in []byte) ([]byte, []byte) {
+	t.Helper()
+	if len(in) < 2 || len(in) < 2+int(binary.BigEndian.Uint16(in[0:2])) {
+		t.Fatalf("Truncated field: %x", in)
+	}
+	length := int(binary.BigEndian.Uint16(in[0:2]))
+	return in[2 : 2+length], in[2+length:]
+}
+
+func (target *testODoHTarget) answer(t *testing.T, message []byte, response []byte) ([]byte, []byte) {
+	t.Helper()
+	if len(message) < 1 || message[0] != ODoHMessageQuery {
+		t.Fatalf("Unexpected message type")
+	}
+	keyID, rest := readWithLength(t, message[1:])
+	encryptedMessage, rest := readWithLength(t, rest)
+	if len(rest) != 0 || len(encryptedMessage) < 32 {
+		t.Fatalf("Unexpected query length")
+	}
+	enc, ct := encryptedMessage[:32], encryptedMessage[32:]
+	var pkE, dh [32]byte
+	copy(pkE[:], enc)
+	curve25519.ScalarMult(&dh, &target.secretKey, &pkE)
+	sharedSecret := hpkeExtractAndExpand(dh[:], append(append([]byte{}, enc...), target.publicKey[:]...))
+	ctx, err := hpkeKeySchedule(sharedSecret, []byte("odoh query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aad := appendWithLength([]byte{ODoHMessageQuery}, keyID)
+	queryPlain, err := ctx.aead.Open(nil, ctx.nextNonce(), ct, aad)
+	if err != nil {
+		t.Fatalf("Unable to decrypt the query: %v", err)
+	}
+	query, _ := readWithLength(t, queryPlain)
+
+	responseNonce := make([]byte, ODoHResponseNonceLen)
+	if _, err := rand.Read(responseNonce); err != nil {
+		t.Fatal(err)
+	}
+	secret := ctx.Export([]byte("odoh response"), HPKENk)
+	salt := appendWithLength(append([]byte{}, queryPlain...), responseNonce)
+	prk := hkdfExtract(salt, secret)
+	aead, err := newAESGCM(hkdfExpand(prk, []byte("odoh key"), HPKENk))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := hkdfExpand(prk, []byte("odoh nonce"), HPKENn)
+	responsePlain := appendWithLength(nil, response)
+	responsePlain = appendWithLength(responsePlain, make([]byte, 13))
+	encrypted := aead.Seal(nil, nonce, responsePlain, appendWithLength([]byte{ODoHMessageResponse}, responseNonce))
+	responseMessage := appendWithLength([]byte{ODoHMessageResponse}, responseNonce)
+	return query, appendWithLength(responseMessage, encrypted)
+}
+
+func TestODoHRoundTrip(t *testing.T) {
+	target := newTestODoHTarget(t)
+	targetConfigs, err := parseODoHTargetConfigs(target.configs())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targetConfigs) != 1 {
+		t.Fatalf("Expected 1 target configuration, got %d", len(targetConfigs))
+	}
+
+	msg := dns.Msg{}
+	msg.SetQuestion("example.com.", dns.TypeA)
+	query, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, queryContext, err := targetConfigs[0].encryptQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(message, query) {
+		t.Fatal("The query was sent in cleartext")
+	}
+
+	response := msg.Copy()
+	response.Response = true
+	responsePacket, err := response.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receivedQuery, responseMessage := target.answer(t, message, responsePacket)
+	if !bytes.Equal(receivedQuery, query) {
+		t.Fatalf("The target received %x instead of %x", receivedQuery, query)
+	}
+	decrypted, err := queryContext.decryptResponse(responseMessage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, responsePacket) {
+		t.Fatalf("Decrypted response %x, expected %x", decrypted, responsePacket)
+	}
+
+	responseMessage[len(responseMessage)-1] ^= 1
+	if _, err := queryContext.decryptResponse(responseMessage); err == nil {
+		t.Fatal("A modified response was accepted")
+	}
+}
+
+func TestODoHUnsupportedConfigs(t *testing.T) {
+	target := newTestODoHTarget(t)
+	configs := target.configs()
+	configs[6] ^= 0xff
+	targetConfigs, err := parseODoHTargetConfigs(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targetConfigs) != 0 {
+		t.Fatal("A configuration with an unsupported KEM was accepted")
+	}
+	if _, err := parseODoHTargetConfigs(configs[:len(configs)-1]); err == nil {
+		t.Fatal("A truncated configuration was accepted")
+	}
+}
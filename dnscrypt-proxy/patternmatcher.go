@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Patterns:
+//   example.com     example.com and all its subdomains
+//   =example.com    example.com only
+//   *.example.com   subdomains of example.com, but not example.com itself
+//   ads.*           names starting with "ads."
+//   *tracker        names ending with "tracker"
+//   *sex*           names containing "sex"
+//   ads[0-9].*.com  any other glob pattern, matched against the whole name
+//   /^ad[sv]\d+\./  a regular expression, matched against the name without the final dot
+
+type PatternRule struct {
+	pattern string
+	key     string
+	regex   *regexp.Regexp
+	value   interface{}
+}
+
+type PatternMatcher struct {
+	exact      map[string]*PatternRule
+	domains    map[string]*PatternRule
+	subdomains map[string]*PatternRule
+	prefixes   []*PatternRule
+	suffixes   []*PatternRule
+	substrings []*PatternRule
+	globs      []*PatternRule
+	regexes    []*PatternRule
+	count      int
+}
+
+func NewPatternMatcher() *PatternMatcher {
+	return &PatternMatcher{
+		exact:      make(map[string]*PatternRule),
+		domains:    make(map[string]*PatternRule),
+		subdomains: make(map[string]*PatternRule),
+	}
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+func (matcher *PatternMatcher) Add(pattern string, value interface{}) error {
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		regex, err := regexp.Compile("(?i)" + pattern[1:len(pattern)-1])
+		if err != nil {
+			return fmt.Errorf("Invalid regular expression: [%s]", pattern)
+		}
+		matcher.regexes = append(matcher.regexes, &PatternRule{pattern: pattern, regex: regex, value: value})
+		matcher.count++
+		return nil
+	}
+	pattern = strings.TrimSuffix(strings.ToLower(pattern), ".")
+	if len(pattern) == 0 {
+		return fmt.Errorf("Empty pattern")
+	}
+	rule := &PatternRule{pattern: pattern, value: value}
+	switch {
+	case strings.HasPrefix(pattern, "="):
+		matcher.exact[pattern[1:]] = rule
+	case !isGlob(pattern):
+		matcher.domains[pattern] = rule
+	case strings.HasPrefix(pattern, "*.") && !isGlob(pattern[2:]):
+		matcher.subdomains[pattern[2:]] = rule
+	case len(pattern) > 2 && strings.HasPrefix(pattern, "*") && strings.HasSuffix(pattern, "*") && !isGlob(pattern[1:len(pattern)-1]):
+		rule.key = pattern[1 : len(pattern)-1]
+		matcher.substrings = append(matcher.substrings, rule)
+	case strings.HasSuffix(pattern, "*") && !isGlob(pattern[:len(pattern)-1]):
+		rule.key = pattern[:len(pattern)-1]
+		matcher.prefixes = append(matcher.prefixes, rule)
+	case strings.HasPrefix(pattern, "*") && !isGlob(pattern[1:]):
+		rule.key = pattern[1:]
+		matcher.suffixes = append(matcher.suffixes, rule)
+	default:
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid pattern: [%s]", pattern)
+		}
+		matcher.globs = append(matcher.globs, rule)
+	}
+	matcher.count++
+	return nil
+}
+
+// Returns the most specific rule matching name, or nil if there is none
+
+func (matcher *PatternMatcher) Match(name string) *PatternRule {
+	if matcher == nil {
+		return nil
+	}
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if rule, ok := matcher.exact[name]; ok {
+		return rule
+	}
+	for domain := name; ; {
+		if rule, ok := matcher.domains[domain]; ok {
+			return rule
+		}
+		if rule, ok := matcher.subdomains[domain]; ok && domain != name {
+			return rule
+		}
+		idx := strings.IndexByte(domain, '.')
+		if idx < 0 {
+			break
+		}
+		domain = domain[idx+1:]
+	}
+	for _, rule := range matcher.prefixes {
+		if strings.HasPrefix(name, rule.key) {
+			return rule
+		}
+	}
+	for _, rule := range matcher.suffixes {
+		if strings.HasSuffix(name, rule.key) {
+			return rule
+		}
+	}
+	for _, rule := range matcher.substrings {
+		if strings.Contains(name, rule.key) {
+			return rule
+		}
+	}
+	for _, rule := range matcher.globs {
+		if matched, _ := path.Match(rule.pattern, name); matched {
+			return rule
+		}
+	}
+	for _, rule := range matcher.regexes {
+		if rule.regex.MatchString(name) {
+			return rule
+		}
+	}
+	return nil
+}
+
+func (matcher *PatternMatcher) logLoaded(kind string, fileName string) {
+	if len(matcher.regexes) > 0 {
+		pluginsLog.Noticef("%d %s rules loaded from [%s] (%d regular expressions)", matcher.count, kind, fileName, len(matcher.regexes))
+	} else {
+		pluginsLog.Noticef("%d %s rules loaded from [%s]", matcher.count, kind, fileName)
+	}
+}
+
+// Removes the ttl=<seconds> option of a rule, that sets the TTL of the records
+// returned for matching names
+
+func splitRuleTTL(parts []string) ([]string, uint32, error) {
+	remaining := make([]string, 0, len(parts))
+	ttl := uint32(0)
+	for _, part := range parts {
+		if !strings.HasPrefix(part, "ttl=") {
+			remaining = append(remaining, part)
+			continue
+		}
+		value, err := strconv.ParseUint(part[4:], 10, 32)
+		if err != nil || value == 0 {
+			return nil, 0, fmt.Errorf("Invalid TTL: [%s]", part)
+		}
+		ttl = uint32(value)
+	}
+	return remaining, ttl, nil
+}
+
+// Calls fn for every non-empty line of a rules file, with comments removed
+
+func parseRulesFile(fileName string, fn func(line string, comment string, lineNo int) error) error {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line, comment := scanner.Text(), ""
+		if idx := strings.IndexByte(line, '#'); idx >= 0 {
+			line, comment = line[:idx], strings.TrimSpace(line[idx+1:])
+		}
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if err := fn(line, comment, lineNo); err != nil {
+			return fmt.Errorf("%s at line %d of [%s]", err, lineNo, fileName)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type BlacklistRule struct {
+	schedule *WeeklyRanges
+	response *BlockedResponse
+	ttl      uint32
+	line     int
+}
+
+type PluginBlacklist struct {
+	rules    *RulesFile
+	response *BlockedResponse
+}
+
+// Rules can be followed by a schedule, by the response to return instead
+// of the default one, and by its TTL, such as "ads.example.com 0.0.0.0 @work ttl=60"
+
+func parseBlacklistRule(line string, schedules map[string]*WeeklyRanges) (string, *BlacklistRule, error) {
+	parts, ttl, err := splitRuleTTL(strings.Fields(line))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(parts) == 0 {
+		return "", nil, fmt.Errorf("Syntax error: [%s]", line)
+	}
+	rule := BlacklistRule{ttl: ttl}
+	for _, part := range parts[1:] {
+		if strings.HasPrefix(part, "@") {
+			if rule.schedule != nil {
+				return "", nil, fmt.Errorf("Syntax error: [%s]", line)
+			}
+			schedule, err := lookupSchedule(part[1:], schedules)
+			if err != nil {
+				return "", nil, err
+			}
+			rule.schedule = schedule
+			continue
+		}
+		if rule.response != nil {
+			return "", nil, fmt.Errorf("Syntax error: [%s]", line)
+		}
+		response, err := ParseBlockedResponse(part)
+		if err != nil {
+			return "", nil, err
+		}
+		rule.response = response
+	}
+	return parts[0], &rule, nil
+}
+
+func NewPluginBlacklist(fileName string, schedules map[string]*WeeklyRanges, response *BlockedResponse) (*PluginBlacklist, error) {
+	rules, err := NewRulesFile("blacklist", fileName, func(matcher *PatternMatcher) error {
+		return parseRulesFile(fileName, func(line string, _ string, lineNo int) error {
+			pattern, rule, err := parseBlacklistRule(line, schedules)
+			if err != nil {
+				return err
+			}
+			rule.line = lineNo
+			return matcher.Add(pattern, rule)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PluginBlacklist{rules: rules, response: response}, nil
+}
+
+func (plugin *PluginBlacklist) Name() string {
+	return "blacklist"
+}
+
+func (plugin *PluginBlacklist) Description() string {
+	return "Block DNS queries matching name patterns"
+}
+
+func (plugin *PluginBlacklist) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if pluginsState.whitelisted || len(msg.Question) != 1 {
+		return nil
+	}
+	qName := msg.Question[0].Name
+	rule := plugin.rules.Match(qName)
+	if rule == nil {
+		return nil
+	}
+	blacklistRule := rule.value.(*BlacklistRule)
+	if !blacklistRule.schedule.Match() {
+		return nil
+	}
+	pluginsLog.Debugf("[%s] blocked by rule [%s]", qName, rule.pattern)
+	response := plugin.response
+	if blacklistRule.response != nil {
+		response = blacklistRule.response
+	}
+	synth, err := response.synthesize(msg)
+	if err != nil {
+		return err
+	}
+	pluginsState.ruleTTL = blacklistRule.ttl
+	pluginsState.blockedBy = &BlockAttribution{plugin: "blacklist", fileName: plugin.rules.fileName, line: blacklistRule.line, rule: rule.pattern}
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionReject
+	return nil
+}
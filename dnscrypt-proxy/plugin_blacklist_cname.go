@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type CNAMEBlockingAction int
+
+const (
+	CNAMEBlockingOff CNAMEBlockingAction = iota
+	CNAMEBlockingLog
+	CNAMEBlockingBlock
+)
+
+func ParseCNAMEBlockingAction(str string) (CNAMEBlockingAction, error) {
+	switch strings.ToLower(str) {
+	case "off":
+		return CNAMEBlockingOff, nil
+	case "log":
+		return CNAMEBlockingLog, nil
+	case "", "block":
+		return CNAMEBlockingBlock, nil
+	}
+	return CNAMEBlockingOff, fmt.Errorf("Invalid CNAME blocking action: [%s]", str)
+}
+
+// Applies the blacklist of the client to the names a response is an alias of,
+// so that first-party names pointing to blocked names are blocked as well
+
+type PluginBlacklistCNAME struct {
+	blacklist *PluginBlacklist
+	action    CNAMEBlockingAction
+	maxDepth  int
+}
+
+func (plugin *PluginBlacklistCNAME) Name() string {
+	return "blacklist_cname"
+}
+
+func (plugin *PluginBlacklistCNAME) Description() string {
+	return "Block responses that are aliases of blacklisted names"
+}
+
+func (plugin *PluginBlacklistCNAME) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if pluginsState.whitelisted || len(msg.Question) != 1 {
+		return nil
+	}
+	qName := msg.Question[0].Name
+	name := qName
+	for depth := 0; depth < plugin.maxDepth; depth++ {
+		target := ""
+		for _, answer := range msg.Answer {
+			if cname, ok := answer.(*dns.CNAME); ok && strings.EqualFold(cname.Hdr.Name, name) {
+				target = cname.Target
+				break
+			}
+		}
+		if len(target) == 0 {
+			return nil
+		}
+		name = target
+		rule := plugin.blacklist.rules.Match(name)
+		if rule == nil {
+			continue
+		}
+		blacklistRule := rule.value.(*BlacklistRule)
+		if !blacklistRule.schedule.Match() {
+			continue
+		}
+		if plugin.action == CNAMEBlockingLog {
+			pluginsLog.Noticef("[%s] is an alias of [%s], matching rule [%s]", qName, name, rule.pattern)
+			return nil
+		}
+		pluginsLog.Debugf("[%s] blocked - alias of [%s], matching rule [%s]", qName, name, rule.pattern)
+		response := plugin.blacklist.response
+		if blacklistRule.response != nil {
+			response = blacklistRule.response
+		}
+		synth, err := response.synthesize(msg)
+		if err != nil {
+			return err
+		}
+		*msg = *synth
+		pluginsState.ruleTTL = blacklistRule.ttl
+		pluginsState.blockedBy = &BlockAttribution{plugin: "blacklist_cname", fileName: plugin.blacklist.rules.fileName, line: blacklistRule.line, rule: rule.pattern}
+		pluginsState.action = PluginsActionReject
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type IPBlacklistRule struct {
+	cidr *net.IPNet
+	rule string
+	line int
+}
+
+type PluginBlacklistIP struct {
+	fileName string
+	ips      map[string]IPBlacklistRule
+	cidrs    []IPBlacklistRule
+}
+
+func NewPluginBlacklistIP(fileName string) (*PluginBlacklistIP, error) {
+	plugin := PluginBlacklistIP{fileName: fileName, ips: make(map[string]IPBlacklistRule)}
+	err := parseRulesFile(fileName, func(line string, _ string, lineNo int) error {
+		if !strings.Contains(line, "/") {
+			ip := net.ParseIP(line)
+			if ip == nil {
+				return fmt.Errorf("Invalid IP address: [%s]", line)
+			}
+			plugin.ips[ip.String()] = IPBlacklistRule{rule: line, line: lineNo}
+			return nil
+		}
+		_, cidr, err := net.ParseCIDR(line)
+		if err != nil {
+			return fmt.Errorf("Invalid network: [%s]", line)
+		}
+		plugin.cidrs = append(plugin.cidrs, IPBlacklistRule{cidr: cidr, rule: line, line: lineNo})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	pluginsLog.Noticef("%d IP blacklist rules loaded from [%s]", len(plugin.ips)+len(plugin.cidrs), fileName)
+	return &plugin, nil
+}
+
+func (plugin *PluginBlacklistIP) Name() string {
+	return "blacklist_ip"
+}
+
+func (plugin *PluginBlacklistIP) Description() string {
+	return "Block responses containing specific IP addresses"
+}
+
+func (plugin *PluginBlacklistIP) match(ip net.IP) (*IPBlacklistRule, bool) {
+	if rule, ok := plugin.ips[ip.String()]; ok {
+		return &rule, true
+	}
+	for i := range plugin.cidrs {
+		if plugin.cidrs[i].cidr.Contains(ip) {
+			return &plugin.cidrs[i], true
+		}
+	}
+	return nil, false
+}
+
+// Turns a response into a REFUSED response, keeping only the EDNS options
+
+func refuseResponse(msg *dns.Msg) {
+	msg.Rcode = dns.RcodeRefused
+	msg.Answer = []dns.RR{}
+	msg.Ns = []dns.RR{}
+	extra := []dns.RR{}
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+}
+
+func (plugin *PluginBlacklistIP) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if pluginsState.whitelisted {
+		return nil
+	}
+	for _, answer := range msg.Answer {
+		var ip net.IP
+		switch answer := answer.(type) {
+		case *dns.A:
+			ip = answer.A
+		case *dns.AAAA:
+			ip = answer.AAAA
+		default:
+			continue
+		}
+		rule, ok := plugin.match(ip)
+		if !ok {
+			continue
+		}
+		if len(msg.Question) == 1 {
+			pluginsLog.Debugf("[%s] blocked - [%s] matches rule [%s]", msg.Question[0].Name, ip, rule.rule)
+		}
+		refuseResponse(msg)
+		pluginsState.blockedBy = &BlockAttribution{plugin: "blacklist_ip", fileName: plugin.fileName, line: rule.line, rule: rule.rule}
+		pluginsState.action = PluginsActionReject
+		return nil
+	}
+	return nil
+}
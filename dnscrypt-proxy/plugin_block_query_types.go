@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type PluginBlockQueryTypes struct {
+	qTypes map[uint16]bool
+	rcode  int
+}
+
+func parseQueryType(str string) (uint16, error) {
+	str = strings.ToUpper(strings.TrimSpace(str))
+	if qType, ok := dns.StringToType[str]; ok {
+		return qType, nil
+	}
+	if strings.HasPrefix(str, "TYPE") {
+		if qType, err := strconv.ParseUint(str[4:], 10, 16); err == nil {
+			return uint16(qType), nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown query type: [%s]", str)
+}
+
+// The response is either "refused", "notimp" or "empty"
+
+func NewPluginBlockQueryTypes(qTypes []string, response string) (*PluginBlockQueryTypes, error) {
+	plugin := PluginBlockQueryTypes{qTypes: make(map[uint16]bool)}
+	for _, str := range qTypes {
+		qType, err := parseQueryType(str)
+		if err != nil {
+			return nil, err
+		}
+		plugin.qTypes[qType] = true
+	}
+	switch strings.ToLower(response) {
+	case "", "refused":
+		plugin.rcode = dns.RcodeRefused
+	case "notimp":
+		plugin.rcode = dns.RcodeNotImplemented
+	case "empty":
+		plugin.rcode = dns.RcodeSuccess
+	default:
+		return nil, fmt.Errorf("Invalid blocked query response: [%s]", response)
+	}
+	return &plugin, nil
+}
+
+func (plugin *PluginBlockQueryTypes) Name() string {
+	return "block_query_types"
+}
+
+func (plugin *PluginBlockQueryTypes) Description() string {
+	return "Block queries for specific record types"
+}
+
+func (plugin *PluginBlockQueryTypes) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(msg.Question) != 1 {
+		return nil
+	}
+	question := msg.Question[0]
+	if !plugin.qTypes[question.Qtype] {
+		return nil
+	}
+	pluginsLog.Debugf("[%s] blocked - query type [%s]", question.Name, dns.TypeToString[question.Qtype])
+	synth, err := EmptyResponseFromMessage(msg)
+	if err != nil {
+		return err
+	}
+	synth.Rcode = plugin.rcode
+	pluginsState.synthResponse = synth
+	if plugin.rcode == dns.RcodeSuccess {
+		pluginsState.action = PluginsActionSynth
+	} else {
+		pluginsState.blockedBy = &BlockAttribution{plugin: "block_query_types", rule: dns.TypeToString[question.Qtype]}
+		pluginsState.action = PluginsActionReject
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const CaptivePortalTTL = 60
+
+type CaptivePortalRule struct {
+	ipv4 []net.IP
+	ipv6 []net.IP
+}
+
+type PluginCaptivePortal struct {
+	proxy     *Proxy
+	rules     *RulesFile
+	resolvers []string
+}
+
+// Rules list the names used by operating systems to detect captive portals.
+// Names followed by addresses are answered with these addresses. Other names
+// are sent to the network's own resolvers, so that portals can intercept them.
+
+func NewPluginCaptivePortal(proxy *Proxy, fileName string, resolvers []string) (*PluginCaptivePortal, error) {
+	plugin := PluginCaptivePortal{proxy: proxy}
+	for _, resolver := range resolvers {
+		resolver, err := normalizeForwardServer(resolver)
+		if err != nil {
+			return nil, err
+		}
+		plugin.resolvers = append(plugin.resolvers, resolver)
+	}
+	rules, err := NewRulesFile("captive portal", fileName, func(matcher *PatternMatcher) error {
+		return parseRulesFile(fileName, func(line string, _ string, _ int) error {
+			parts := strings.Fields(line)
+			if len(parts) > 2 {
+				return fmt.Errorf("Syntax error: [%s]", line)
+			}
+			rule := CaptivePortalRule{}
+			if len(parts) == 2 {
+				for _, ipStr := range strings.Split(parts[1], ",") {
+					ip := net.ParseIP(strings.TrimSpace(ipStr))
+					if ip == nil {
+						return fmt.Errorf("Invalid IP address: [%s]", ipStr)
+					}
+					if ipv4 := ip.To4(); ipv4 != nil {
+						rule.ipv4 = append(rule.ipv4, ipv4)
+					} else {
+						rule.ipv6 = append(rule.ipv6, ip)
+					}
+				}
+			}
+			return matcher.Add(parts[0], &rule)
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	plugin.rules = rules
+	return &plugin, nil
+}
+
+func (plugin *PluginCaptivePortal) Name() string {
+	return "captive_portal"
+}
+
+func (plugin *PluginCaptivePortal) Description() string {
+	return "Answer or route captive portal detection queries locally"
+}
+
+func (plugin *PluginCaptivePortal) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(msg.Question) != 1 {
+		return nil
+	}
+	question := msg.Question[0]
+	match := plugin.rules.Match(question.Name)
+	if match == nil {
+		return nil
+	}
+	rule := match.value.(*CaptivePortalRule)
+	if len(rule.ipv4) == 0 && len(rule.ipv6) == 0 {
+		resolvers := plugin.resolvers
+		if len(resolvers) == 0 && len(plugin.proxy.xTransport.fallbackResolver) > 0 {
+			resolvers = []string{plugin.proxy.xTransport.fallbackResolver}
+		}
+		if len(resolvers) == 0 {
+			return errors.New("No resolvers to send captive portal queries to")
+		}
+		synth, err := plugin.proxy.exchangeWithPlainServers(pluginsState, resolvers, msg)
+		if err != nil {
+			return err
+		}
+		pluginsState.synthResponse = synth
+		pluginsState.action = PluginsActionSynth
+		return nil
+	}
+	synth, err := EmptyResponseFromMessage(msg)
+	if err != nil {
+		return err
+	}
+	header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: CaptivePortalTTL}
+	switch question.Qtype {
+	case dns.TypeA:
+		for _, ip := range rule.ipv4 {
+			synth.Answer = append(synth.Answer, &dns.A{Hdr: header, A: ip})
+		}
+	case dns.TypeAAAA:
+		for _, ip := range rule.ipv6 {
+			synth.Answer = append(synth.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	}
+	pluginsLog.Debugf("[%s] answered by captive portal rule [%s]", question.Name, match.pattern)
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type CloakRule struct {
+	target string
+	ipv4   []net.IP
+	ipv6   []net.IP
+	ttl    uint32
+}
+
+type PluginCloak struct {
+	rules *RulesFile
+	ttl   uint32
+}
+
+// Rules map a pattern to either IP addresses (one rule per address) or another name.
+// Queries for names mapped to another name are sent upstream for that name instead,
+// and responses are turned into a CNAME to it.
+
+func NewPluginCloak(kind string, fileName string, ttl uint32) (*PluginCloak, error) {
+	rules, err := NewRulesFile(kind, fileName, func(matcher *PatternMatcher) error {
+		cloakRules := make(map[string]*CloakRule)
+		return parseRulesFile(fileName, func(line string, _ string, _ int) error {
+			parts, ttl, err := splitRuleTTL(strings.Fields(line))
+			if err != nil {
+				return err
+			}
+			if len(parts) != 2 {
+				return fmt.Errorf("Syntax error: [%s]", line)
+			}
+			pattern, target := parts[0], parts[1]
+			rule, ok := cloakRules[pattern]
+			if !ok {
+				rule = &CloakRule{}
+			}
+			if ttl > 0 {
+				rule.ttl = ttl
+			}
+			if ip := net.ParseIP(strings.Trim(target, "[]")); ip != nil {
+				if len(rule.target) > 0 {
+					return fmt.Errorf("[%s] is already mapped to a name", pattern)
+				}
+				if ipv4 := ip.To4(); ipv4 != nil {
+					rule.ipv4 = append(rule.ipv4, ipv4)
+				} else {
+					rule.ipv6 = append(rule.ipv6, ip)
+				}
+			} else {
+				if len(rule.target) > 0 || len(rule.ipv4) > 0 || len(rule.ipv6) > 0 {
+					return fmt.Errorf("[%s] is already mapped", pattern)
+				}
+				rule.target = dns.Fqdn(strings.ToLower(target))
+			}
+			if !ok {
+				cloakRules[pattern] = rule
+				return matcher.Add(pattern, rule)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PluginCloak{rules: rules, ttl: ttl}, nil
+}
+
+func (plugin *PluginCloak) Name() string {
+	return "cloak"
+}
+
+func (plugin *PluginCloak) Description() string {
+	return "Return fixed addresses or another name's records for specific names"
+}
+
+func (plugin *PluginCloak) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(msg.Question) != 1 {
+		return nil
+	}
+	question := &msg.Question[0]
+	if question.Qclass != dns.ClassINET || len(pluginsState.cloakedName) > 0 {
+		return nil
+	}
+	match := plugin.rules.Match(question.Name)
+	if match == nil {
+		return nil
+	}
+	rule := match.value.(*CloakRule)
+	if rule.ttl > 0 {
+		pluginsState.ruleTTL = rule.ttl
+	}
+	if len(rule.target) > 0 {
+		if strings.EqualFold(question.Name, rule.target) {
+			return nil
+		}
+		pluginsLog.Debugf("[%s] cloaked by [%s]", question.Name, rule.target)
+		pluginsState.cloakedName = question.Name
+		pluginsState.cloakTarget = rule.target
+		pluginsState.cloakTTL = plugin.ttl
+		question.Name = rule.target
+		return nil
+	}
+	synth, err := EmptyResponseFromMessage(msg)
+	if err != nil {
+		return err
+	}
+	header := dns.RR_Header{Name: question.Name, Class: dns.ClassINET, Ttl: plugin.ttl}
+	switch question.Qtype {
+	case dns.TypeA:
+		header.Rrtype = dns.TypeA
+		for _, ip := range rule.ipv4 {
+			synth.Answer = append(synth.Answer, &dns.A{Hdr: header, A: ip})
+		}
+	case dns.TypeAAAA:
+		header.Rrtype = dns.TypeAAAA
+		for _, ip := range rule.ipv6 {
+			synth.Answer = append(synth.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	}
+	pluginsLog.Debugf("[%s] cloaked by [%s]", question.Name, match.pattern)
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	return nil
+}
+
+// Responses for the name a query has been redirected to are returned as a CNAME to that name
+
+func (pluginsState *PluginsState) uncloak(response []byte) []byte {
+	msg := dns.Msg{}
+	if err := msg.Unpack(response); err != nil || len(msg.Question) != 1 {
+		return response
+	}
+	msg.Question[0].Name = pluginsState.cloakedName
+	cname := &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: pluginsState.cloakedName, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: pluginsState.cloakTTL},
+		Target: pluginsState.cloakTarget,
+	}
+	msg.Answer = append([]dns.RR{cname}, msg.Answer...)
+	uncloaked, err := msg.Pack()
+	if err != nil {
+		return response
+	}
+	return uncloaked
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const DNS64RefreshInterval = 1 * time.Hour
+
+var dns64WellKnownIPs = []net.IP{net.IPv4(192, 0, 0, 170).To4(), net.IPv4(192, 0, 0, 171).To4()}
+
+var dns64PrefixLengths = []int{96, 64, 56, 48, 40, 32}
+
+type PluginDNS64 struct {
+	sync.RWMutex
+	proxy     *Proxy
+	prefixes  []*net.IPNet
+	resolvers []string
+}
+
+func NewPluginDNS64(proxy *Proxy, prefixes []string, resolvers []string) (*PluginDNS64, error) {
+	plugin := PluginDNS64{proxy: proxy}
+	for _, prefixStr := range prefixes {
+		_, prefix, err := net.ParseCIDR(prefixStr)
+		if err != nil || prefix.IP.To4() != nil || !validDNS64PrefixLength(prefix) {
+			return nil, fmt.Errorf("Invalid DNS64 prefix: [%s]", prefixStr)
+		}
+		plugin.prefixes = append(plugin.prefixes, prefix)
+	}
+	for _, resolver := range resolvers {
+		resolver, err := normalizeForwardServer(resolver)
+		if err != nil {
+			return nil, err
+		}
+		plugin.resolvers = append(plugin.resolvers, resolver)
+	}
+	if len(plugin.prefixes) == 0 && len(plugin.resolvers) == 0 {
+		return nil, errors.New("DNS64 requires a prefix or a resolver to discover it from")
+	}
+	if len(plugin.prefixes) == 0 {
+		go plugin.refreshPrefixes()
+	}
+	return &plugin, nil
+}
+
+func validDNS64PrefixLength(prefix *net.IPNet) bool {
+	ones, bits := prefix.Mask.Size()
+	if bits != 128 {
+		return false
+	}
+	for _, length := range dns64PrefixLengths {
+		if ones == length {
+			return true
+		}
+	}
+	return false
+}
+
+// RFC 6052 - bits 64 to 71 of the address are left as zero
+
+func dns64Embed(prefix *net.IPNet, ipv4 net.IP) net.IP {
+	ones, _ := prefix.Mask.Size()
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP)
+	pos := ones / 8
+	for _, b := range ipv4 {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
+	}
+	return ip
+}
+
+func dns64Extract(ip net.IP, ones int) net.IP {
+	ipv4 := make(net.IP, net.IPv4len)
+	pos := ones / 8
+	for i := range ipv4 {
+		if pos == 8 {
+			pos++
+		}
+		ipv4[i] = ip[pos]
+		pos++
+	}
+	return ipv4
+}
+
+// RFC 7050 - the prefix is found in the AAAA records the network's resolvers return for ipv4only.arpa
+
+func (plugin *PluginDNS64) discoverPrefixes() ([]*net.IPNet, error) {
+	msg := dns.Msg{}
+	msg.SetQuestion("ipv4only.arpa.", dns.TypeAAAA)
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	err = errors.New("No DNS64 resolvers")
+	for _, resolver := range plugin.resolvers {
+		var response []byte
+		response, err = plugin.proxy.exchangeWithPlainServer("udp", resolver, query)
+		if err != nil {
+			continue
+		}
+		responseMsg := dns.Msg{}
+		if err = responseMsg.Unpack(response); err != nil {
+			continue
+		}
+		var prefixes []*net.IPNet
+		for _, answer := range responseMsg.Answer {
+			aaaa, ok := answer.(*dns.AAAA)
+			if !ok {
+				continue
+			}
+			for _, ones := range dns64PrefixLengths {
+				ipv4 := dns64Extract(aaaa.AAAA, ones)
+				if !ipv4.Equal(dns64WellKnownIPs[0]) && !ipv4.Equal(dns64WellKnownIPs[1]) {
+					continue
+				}
+				mask := net.CIDRMask(ones, 128)
+				prefixes = append(prefixes, &net.IPNet{IP: aaaa.AAAA.Mask(mask), Mask: mask})
+				break
+			}
+		}
+		if len(prefixes) > 0 {
+			return prefixes, nil
+		}
+		err = fmt.Errorf("[%s] didn't return any NAT64 prefix", resolver)
+	}
+	return nil, err
+}
+
+func (plugin *PluginDNS64) refreshPrefixes() {
+	for {
+		prefixes, err := plugin.discoverPrefixes()
+		if err != nil {
+			pluginsLog.Warnf("DNS64 prefix discovery failed: %s", err)
+		} else {
+			for _, prefix := range prefixes {
+				pluginsLog.Noticef("DNS64 prefix discovered: [%s]", prefix)
+			}
+			plugin.Lock()
+			plugin.prefixes = prefixes
+			plugin.Unlock()
+		}
+		time.Sleep(DNS64RefreshInterval)
+	}
+}
+
+func (plugin *PluginDNS64) Name() string {
+	return "dns64"
+}
+
+func (plugin *PluginDNS64) Description() string {
+	return "Synthesize AAAA records from A records for IPv6-only networks"
+}
+
+func (plugin *PluginDNS64) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if msg.Rcode != dns.RcodeSuccess || len(msg.Question) != 1 || msg.Question[0].Qtype != dns.TypeAAAA {
+		return nil
+	}
+	for _, answer := range msg.Answer {
+		if answer.Header().Rrtype == dns.TypeAAAA {
+			return nil
+		}
+	}
+	plugin.RLock()
+	prefixes := plugin.prefixes
+	plugin.RUnlock()
+	if len(prefixes) == 0 {
+		return nil
+	}
+	serverInfo := pluginsState.serverInfo
+	if serverInfo == nil {
+		return nil
+	}
+	aQuery := dns.Msg{}
+	aQuery.SetQuestion(msg.Question[0].Name, dns.TypeA)
+	aQuery.Id = msg.Id
+	aQuery.SetEdns0(uint16(MaxDNSUDPPacketSize), false)
+	query, err := aQuery.Pack()
+	if err != nil {
+		return nil
+	}
+	exchangeStart := time.Now()
+	response, _, err := plugin.proxy.exchangeWithServer(serverInfo, "udp", query)
+	plugin.proxy.serverStats.record(serverInfo.Name, time.Since(exchangeStart), err)
+	if err != nil {
+		return nil
+	}
+	plugin.proxy.metrics.serverResponse(serverInfo.Name, time.Since(exchangeStart))
+	serverInfo.noticeSuccess(plugin.proxy)
+	aResponse := dns.Msg{}
+	if err := aResponse.Unpack(response); err != nil || aResponse.Rcode != dns.RcodeSuccess {
+		return nil
+	}
+	var synthAnswer []dns.RR
+	synthesized := 0
+	for _, answer := range aResponse.Answer {
+		a, ok := answer.(*dns.A)
+		if !ok {
+			if answer.Header().Rrtype == dns.TypeCNAME {
+				synthAnswer = append(synthAnswer, answer)
+			}
+			continue
+		}
+		for _, prefix := range prefixes {
+			header := a.Hdr
+			header.Rrtype = dns.TypeAAAA
+			synthAnswer = append(synthAnswer, &dns.AAAA{Hdr: header, AAAA: dns64Embed(prefix, a.A.To4())})
+			synthesized++
+		}
+	}
+	if synthesized == 0 {
+		return nil
+	}
+	pluginsLog.Debugf("[%s] %d AAAA records synthesized", msg.Question[0].Name, synthesized)
+	msg.Answer = synthAnswer
+	msg.Ns = []dns.RR{}
+	msg.AuthenticatedData = false
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Firefox doesn't enable its own DoH resolver by default when this name doesn't exist
+
+const DoHCanaryName = "use-application-dns.net"
+
+type PluginDoHCanary struct {
+	names []string
+}
+
+func NewPluginDoHCanary(names []string) *PluginDoHCanary {
+	plugin := PluginDoHCanary{names: []string{DoHCanaryName}}
+	for _, name := range names {
+		name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+		if len(name) > 0 && !includesName(plugin.names, name) {
+			plugin.names = append(plugin.names, name)
+		}
+	}
+	return &plugin
+}
+
+func (plugin *PluginDoHCanary) Name() string {
+	return "doh_canary"
+}
+
+func (plugin *PluginDoHCanary) Description() string {
+	return "Answer canary names with NXDOMAIN to keep browsers from bypassing the proxy"
+}
+
+func (plugin *PluginDoHCanary) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(msg.Question) != 1 {
+		return nil
+	}
+	question := msg.Question[0]
+	name := strings.TrimSuffix(strings.ToLower(question.Name), ".")
+	for _, canary := range plugin.names {
+		if !inZone(name, canary) {
+			continue
+		}
+		pluginsLog.Debugf("[%s] is a DoH canary name", question.Name)
+		synth, err := EmptyResponseFromMessage(msg)
+		if err != nil {
+			return err
+		}
+		synth.Rcode = dns.RcodeNameError
+		pluginsState.synthResponse = synth
+		pluginsState.action = PluginsActionSynth
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const ExternalPolicyCheckMethod = "/dnscrypt_proxy.policy.v1.Policy/Check"
+
+const (
+	ExternalPolicyVerdictForward = 0
+	ExternalPolicyVerdictRefuse  = 1
+	ExternalPolicyVerdictRespond = 2
+)
+
+type PluginExternal struct {
+	client   *GRPCClient
+	timeout  time.Duration
+	failOpen bool
+}
+
+func NewPluginExternal(urlStr string, timeout time.Duration, failOpen bool) (*PluginExternal, error) {
+	client, err := NewGRPCClient(urlStr, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid external policy URL: [%s]", urlStr)
+	}
+	return &PluginExternal{client: client, timeout: timeout, failOpen: failOpen}, nil
+}
+
+func (plugin *PluginExternal) Name() string {
+	return "external"
+}
+
+func (plugin *PluginExternal) Description() string {
+	return "Ask an external policy service what to do with queries"
+}
+
+// Queries are sent to the Policy.Check method of policy.proto. The service
+// replies with a verdict: FORWARD the query as usual, REFUSE it, or RESPOND
+// with the DNS message included in the reply instead of forwarding the query.
+// Errors and timeouts either forward the query (fail open) or refuse it (fail closed).
+
+func (plugin *PluginExternal) ask(pluginsState *PluginsState, msg *dns.Msg, query []byte) (int, []byte, error) {
+	request := protoAppendBytes(nil, 1, query)
+	if pluginsState.clientAddr != nil {
+		if ip := ClientIP(*pluginsState.clientAddr); ip != nil {
+			request = protoAppendString(request, 2, ip.String())
+		}
+	}
+	request = protoAppendString(request, 3, msg.Question[0].Name)
+	request = protoAppendUint(request, 4, uint64(msg.Question[0].Qtype))
+	reply, err := plugin.client.call(ExternalPolicyCheckMethod, request, plugin.timeout)
+	if err != nil {
+		return 0, nil, err
+	}
+	verdict, response := ExternalPolicyVerdictForward, []byte(nil)
+	err = protoParse(reply, func(field ProtoField) error {
+		switch {
+		case field.number == 1 && field.wireType == ProtoWireVarint:
+			verdict = int(field.value)
+		case field.number == 2 && field.wireType == ProtoWireBytes:
+			response = field.bytes
+		}
+		return nil
+	})
+	return verdict, response, err
+}
+
+func (plugin *PluginExternal) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(msg.Question) != 1 {
+		return nil
+	}
+	query, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+	qName := msg.Question[0].Name
+	verdict, response, err := plugin.ask(pluginsState, msg, query)
+	if err == nil {
+		switch verdict {
+		case ExternalPolicyVerdictForward:
+			return nil
+		case ExternalPolicyVerdictRefuse:
+			pluginsLog.Debugf("[%s] refused by the external policy", qName)
+			return plugin.refuse(pluginsState, msg)
+		case ExternalPolicyVerdictRespond:
+			synth := &dns.Msg{}
+			if err = synth.Unpack(response); err == nil {
+				pluginsLog.Debugf("[%s] answered by the external policy", qName)
+				synth.Id = msg.Id
+				pluginsState.synthResponse = synth
+				pluginsState.action = PluginsActionSynth
+				return nil
+			}
+		default:
+			err = fmt.Errorf("Unexpected verdict: %d", verdict)
+		}
+	}
+	if plugin.failOpen {
+		pluginsLog.Debugf("[%s] external policy unavailable, forwarding: %s", qName, err)
+		return nil
+	}
+	pluginsLog.Debugf("[%s] external policy unavailable, refusing: %s", qName, err)
+	return plugin.refuse(pluginsState, msg)
+}
+
+func (plugin *PluginExternal) refuse(pluginsState *PluginsState, msg *dns.Msg) error {
+	synth, err := EmptyResponseFromMessage(msg)
+	if err != nil {
+		return err
+	}
+	synth.Rcode = dns.RcodeRefused
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionReject
+	return nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type ForwardRule struct {
+	servers []string
+	ttl     uint32
+}
+
+type PluginForward struct {
+	proxy *Proxy
+	rules *RulesFile
+}
+
+func normalizeForwardServer(server string) (string, error) {
+	if ip := net.ParseIP(strings.Trim(server, "[]")); ip != nil {
+		server = net.JoinHostPort(ip.String(), "53")
+	}
+	if _, err := net.ResolveUDPAddr("udp", server); err != nil {
+		return "", fmt.Errorf("Invalid forwarding server: [%s]", server)
+	}
+	return server, nil
+}
+
+// Rules map a zone pattern to one or more plain DNS servers, such as "corp.example 10.0.0.2,10.0.0.3"
+
+func NewPluginForward(proxy *Proxy, fileName string) (*PluginForward, error) {
+	rules, err := NewRulesFile("forwarding", fileName, func(matcher *PatternMatcher) error {
+		forwardRules := make(map[string]*ForwardRule)
+		return parseRulesFile(fileName, func(line string, _ string, _ int) error {
+			parts, ttl, err := splitRuleTTL(strings.Fields(line))
+			if err != nil {
+				return err
+			}
+			if len(parts) != 2 {
+				return fmt.Errorf("Syntax error: [%s]", line)
+			}
+			pattern := parts[0]
+			rule, ok := forwardRules[pattern]
+			if !ok {
+				rule = &ForwardRule{}
+			}
+			if ttl > 0 {
+				rule.ttl = ttl
+			}
+			for _, server := range strings.Split(parts[1], ",") {
+				server, err := normalizeForwardServer(strings.TrimSpace(server))
+				if err != nil {
+					return err
+				}
+				rule.servers = append(rule.servers, server)
+			}
+			if !ok {
+				forwardRules[pattern] = rule
+				return matcher.Add(pattern, rule)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PluginForward{proxy: proxy, rules: rules}, nil
+}
+
+func (plugin *PluginForward) Name() string {
+	return "forward"
+}
+
+func (plugin *PluginForward) Description() string {
+	return "Route queries matching specific domains to dedicated servers"
+}
+
+func (plugin *PluginForward) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(msg.Question) != 1 {
+		return nil
+	}
+	qName := msg.Question[0].Name
+	match := plugin.rules.Match(qName)
+	if match == nil {
+		return nil
+	}
+	rule := match.value.(*ForwardRule)
+	synth, err := plugin.proxy.exchangeWithPlainServers(pluginsState, rule.servers, msg)
+	if err != nil {
+		return err
+	}
+	if rule.ttl > 0 {
+		pluginsState.ruleTTL = rule.ttl
+	}
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	return nil
+}
+
+// Servers are tried in order, until one of them responds. The one that did
+// is recorded in the plugins state, along with the transport.
+
+func (proxy *Proxy) exchangeWithPlainServers(pluginsState *PluginsState, servers []string, msg *dns.Msg) (*dns.Msg, error) {
+	query, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+	qName := msg.Question[0].Name
+	var response []byte
+	for _, server := range servers {
+		transport := proxy.plainServerProto("udp")
+		response, err = proxy.exchangeWithPlainServer(transport, server, query)
+		if err == nil && transport == "udp" && HasTCFlag(response) {
+			proxy.truncatedResponses.increment(StampProtoTypePlain)
+			transport = "tcp"
+			response, err = proxy.exchangeWithPlainServer("tcp", server, query)
+		}
+		if err == nil {
+			pluginsLog.Debugf("[%s] forwarded to [%s]", qName, server)
+			pluginsState.serverName, pluginsState.transport = server, transport
+			break
+		}
+		pluginsLog.Debugf("[%s] forwarding to [%s] failed: %s", qName, server, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	responseMsg := &dns.Msg{}
+	if err := responseMsg.Unpack(response); err != nil {
+		return nil, err
+	}
+	return responseMsg, nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A plain DNS server answering a single query, which is sent back to the test
+
+func newTestForwardServer(t *testing.T) (string, chan *dns.Msg) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *dns.Msg, 1)
+	go func() {
+		defer pc.Close()
+		packet := make([]byte, MaxDNSPacketSize)
+		length, clientAddr, err := pc.ReadFrom(packet)
+		if err != nil {
+			return
+		}
+		msg := &dns.Msg{}
+		if err := msg.Unpack(packet[:length]); err != nil {
+			return
+		}
+		received <- msg
+		response := &dns.Msg{}
+		response.SetReply(msg)
+		if packet, err := response.Pack(); err == nil {
+			pc.WriteTo(packet, clientAddr)
+		}
+	}()
+	return pc.LocalAddr().String(), received
+}
+
+func forwardQueryWithECS(t *testing.T, forwardECS bool, ecsIPv4Prefix uint8) *dns.Msg {
+	t.Helper()
+	serverAddrStr, received := newTestForwardServer(t)
+	fileName := filepath.Join(t.TempDir(), "forwarding-rules.txt")
+	if err := ioutil.WriteFile(fileName, []byte("example.com "+serverAddrStr+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{
+		timeout:           time.Second,
+		xTransport:        NewXTransport(time.Second),
+		queryPluginsOrder: DefaultQueryPluginsOrder,
+		forwardECS:        forwardECS,
+		ecsIPv4Prefix:     ecsIPv4Prefix,
+	}
+	pluginForward, err := NewPluginForward(proxy, fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy.pluginForward = pluginForward
+
+	msg := dns.Msg{}
+	msg.SetQuestion("www.example.com.", dns.TypeA)
+	msg.SetEdns0(4096, false)
+	opt := msg.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 32,
+		Address:       net.ParseIP("192.0.2.123").To4(),
+	})
+	query, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pluginsState := NewPluginsState(proxy, "udp", &ListenerOptions{}, nil)
+	if _, err := pluginsState.ApplyQueryPlugins(query); err != nil {
+		t.Fatal(err)
+	}
+	if pluginsState.action != PluginsActionSynth {
+		t.Fatalf("The query was not forwarded")
+	}
+	select {
+	case forwarded := <-received:
+		return forwarded
+	default:
+		t.Fatal("The forwarding server didn't receive the query")
+	}
+	return nil
+}
+
+func forwardedECS(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	if opt := msg.IsEdns0(); opt != nil {
+		for _, option := range opt.Option {
+			if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+				return subnet
+			}
+		}
+	}
+	return nil
+}
+
+func TestForwardStripsECS(t *testing.T) {
+	if subnet := forwardedECS(forwardQueryWithECS(t, false, 0)); subnet != nil {
+		t.Fatalf("The client subnet was forwarded: %s", subnet)
+	}
+}
+
+func TestForwardTruncatesECS(t *testing.T) {
+	subnet := forwardedECS(forwardQueryWithECS(t, true, 24))
+	if subnet == nil {
+		t.Fatal("The client subnet was not forwarded")
+	}
+	if subnet.SourceNetmask != 24 || !subnet.Address.Equal(net.ParseIP("192.0.2.0")) {
+		t.Fatalf("The client subnet was not truncated: %s", subnet)
+	}
+}
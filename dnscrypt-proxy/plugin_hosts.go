@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const HostsTTL = 600
+
+type HostsEntry struct {
+	ipv4 []net.IP
+	ipv6 []net.IP
+	ptr  string
+}
+
+type PluginHosts struct {
+	files []*RulesFile
+}
+
+func systemHostsFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("SystemRoot"), "System32", "drivers", "etc", "hosts")
+	}
+	return "/etc/hosts"
+}
+
+// Every line has an address followed by one or more names. Reverse (PTR)
+// entries are added for the first name of every address.
+
+func NewPluginHosts(fileNames []string) (*PluginHosts, error) {
+	plugin := PluginHosts{}
+	for _, fileName := range fileNames {
+		fileName := fileName
+		rules, err := NewRulesFile("hosts", fileName, func(matcher *PatternMatcher) error {
+			entries := make(map[string]*HostsEntry)
+			entry := func(name string) *HostsEntry {
+				name = strings.TrimSuffix(strings.ToLower(name), ".")
+				hostsEntry, ok := entries[name]
+				if !ok {
+					hostsEntry = &HostsEntry{}
+					entries[name] = hostsEntry
+				}
+				return hostsEntry
+			}
+			err := parseRulesFile(fileName, func(line string, _ string, _ int) error {
+				parts := strings.Fields(line)
+				ip := net.ParseIP(parts[0])
+				if ip == nil || len(parts) < 2 {
+					return nil
+				}
+				for _, name := range parts[1:] {
+					if isGlob(name) || strings.HasPrefix(name, "/") {
+						continue
+					}
+					hostsEntry := entry(name)
+					if ipv4 := ip.To4(); ipv4 != nil {
+						hostsEntry.ipv4 = append(hostsEntry.ipv4, ipv4)
+					} else {
+						hostsEntry.ipv6 = append(hostsEntry.ipv6, ip)
+					}
+				}
+				if reverseName, err := dns.ReverseAddr(ip.String()); err == nil {
+					if hostsEntry := entry(reverseName); len(hostsEntry.ptr) == 0 {
+						hostsEntry.ptr = dns.Fqdn(strings.ToLower(parts[1]))
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for name, hostsEntry := range entries {
+				if err := matcher.Add("="+name, hostsEntry); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		plugin.files = append(plugin.files, rules)
+	}
+	return &plugin, nil
+}
+
+func (plugin *PluginHosts) Name() string {
+	return "hosts"
+}
+
+func (plugin *PluginHosts) Description() string {
+	return "Answer queries for names and addresses listed in hosts files"
+}
+
+func (plugin *PluginHosts) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(msg.Question) != 1 {
+		return nil
+	}
+	question := msg.Question[0]
+	if question.Qclass != dns.ClassINET {
+		return nil
+	}
+	var hostsEntry *HostsEntry
+	for _, rules := range plugin.files {
+		if rule := rules.Match(question.Name); rule != nil {
+			hostsEntry = rule.value.(*HostsEntry)
+			break
+		}
+	}
+	if hostsEntry == nil {
+		return nil
+	}
+	synth, err := EmptyResponseFromMessage(msg)
+	if err != nil {
+		return err
+	}
+	header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: HostsTTL}
+	switch question.Qtype {
+	case dns.TypeA:
+		for _, ip := range hostsEntry.ipv4 {
+			synth.Answer = append(synth.Answer, &dns.A{Hdr: header, A: ip})
+		}
+	case dns.TypeAAAA:
+		for _, ip := range hostsEntry.ipv6 {
+			synth.Answer = append(synth.Answer, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	case dns.TypePTR:
+		if len(hostsEntry.ptr) > 0 {
+			synth.Answer = append(synth.Answer, &dns.PTR{Hdr: header, Ptr: hostsEntry.ptr})
+		}
+	}
+	pluginsState.synthResponse = synth
+	pluginsState.action = PluginsActionSynth
+	return nil
+}
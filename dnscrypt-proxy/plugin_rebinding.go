@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var privateNetworks = mustParseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.168.0.0/16", "::/128", "::1/128", "fc00::/7", "fe80::/10",
+)
+
+type PluginRebinding struct {
+	allowed *RulesFile
+	strip   bool
+}
+
+func mustParseCIDRs(cidrsStr ...string) []*net.IPNet {
+	cidrs, err := parseCIDRs(cidrsStr)
+	if err != nil {
+		panic(err)
+	}
+	return cidrs
+}
+
+// The action is either "block", to refuse the whole response, or "strip", to only remove private addresses
+
+func NewPluginRebinding(allowedFile string, action string) (*PluginRebinding, error) {
+	plugin := PluginRebinding{}
+	switch strings.ToLower(action) {
+	case "", "block":
+	case "strip":
+		plugin.strip = true
+	default:
+		return nil, fmt.Errorf("Invalid rebinding protection action: [%s]", action)
+	}
+	if len(allowedFile) > 0 {
+		allowed, err := NewRulesFile("rebinding allowlist", allowedFile, func(matcher *PatternMatcher) error {
+			return parseRulesFile(allowedFile, func(line string, _ string, _ int) error {
+				return matcher.Add(line, nil)
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+		plugin.allowed = allowed
+	}
+	return &plugin, nil
+}
+
+func (plugin *PluginRebinding) Name() string {
+	return "rebinding"
+}
+
+func (plugin *PluginRebinding) Description() string {
+	return "Block responses resolving public names to private addresses"
+}
+
+func isPrivateIP(ip net.IP) bool {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		ip = ipv4
+	}
+	return cidrsContain(privateNetworks, ip)
+}
+
+func (plugin *PluginRebinding) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(msg.Question) != 1 {
+		return nil
+	}
+	qName := msg.Question[0].Name
+	if plugin.allowed != nil && plugin.allowed.Match(qName) != nil {
+		return nil
+	}
+	answers := []dns.RR{}
+	for _, answer := range msg.Answer {
+		var ip net.IP
+		switch answer := answer.(type) {
+		case *dns.A:
+			ip = answer.A
+		case *dns.AAAA:
+			ip = answer.AAAA
+		}
+		if ip == nil || !isPrivateIP(ip) {
+			answers = append(answers, answer)
+			continue
+		}
+		if plugin.strip {
+			pluginsLog.Debugf("[%s] private address [%s] removed", qName, ip)
+			continue
+		}
+		pluginsLog.Debugf("[%s] blocked - resolves to private address [%s]", qName, ip)
+		refuseResponse(msg)
+		pluginsState.blockedBy = &BlockAttribution{plugin: "rebinding", rule: ip.String()}
+		pluginsState.action = PluginsActionReject
+		return nil
+	}
+	msg.Answer = answers
+	return nil
+}
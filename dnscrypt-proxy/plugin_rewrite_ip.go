@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type PluginRewriteIP struct {
+	rewrites map[string]net.IP
+}
+
+// Rules map an address found in responses to the address returned instead, such as "203.0.113.5 192.168.1.5"
+
+func NewPluginRewriteIP(fileName string) (*PluginRewriteIP, error) {
+	plugin := PluginRewriteIP{rewrites: make(map[string]net.IP)}
+	err := parseRulesFile(fileName, func(line string, _ string, _ int) error {
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			return fmt.Errorf("Syntax error: [%s]", line)
+		}
+		from, to := net.ParseIP(parts[0]), net.ParseIP(parts[1])
+		if from == nil || to == nil {
+			return fmt.Errorf("Invalid IP address: [%s]", line)
+		}
+		if (from.To4() == nil) != (to.To4() == nil) {
+			return fmt.Errorf("Addresses from different families: [%s]", line)
+		}
+		if ipv4 := to.To4(); ipv4 != nil {
+			to = ipv4
+		}
+		plugin.rewrites[from.String()] = to
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	pluginsLog.Noticef("%d IP rewriting rules loaded from [%s]", len(plugin.rewrites), fileName)
+	return &plugin, nil
+}
+
+func (plugin *PluginRewriteIP) Name() string {
+	return "rewrite_ip"
+}
+
+func (plugin *PluginRewriteIP) Description() string {
+	return "Replace specific IP addresses in responses"
+}
+
+func (plugin *PluginRewriteIP) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	for _, answer := range msg.Answer {
+		switch answer := answer.(type) {
+		case *dns.A:
+			if to, ok := plugin.rewrites[answer.A.String()]; ok {
+				pluginsLog.Debugf("[%s] rewritten to [%s]", answer.A, to)
+				answer.A = to
+			}
+		case *dns.AAAA:
+			if to, ok := plugin.rewrites[answer.AAAA.String()]; ok {
+				pluginsLog.Debugf("[%s] rewritten to [%s]", answer.AAAA, to)
+				answer.AAAA = to
+			}
+		}
+	}
+	return nil
+}
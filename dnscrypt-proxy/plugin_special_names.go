@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const SpecialNamesTTL = 600
+
+// Special-use zones (RFC 6761, RFC 6762, RFC 7686) that public resolvers must never see
+
+var specialUseZones = []string{"local", "onion", "test", "invalid"}
+
+type PluginSpecialNames struct{}
+
+func (plugin *PluginSpecialNames) Name() string {
+	return "special_names"
+}
+
+func (plugin *PluginSpecialNames) Description() string {
+	return "Answer queries for special-use names locally"
+}
+
+func inZone(name string, zone string) bool {
+	return name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+func (plugin *PluginSpecialNames) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(msg.Question) != 1 {
+		return nil
+	}
+	question := msg.Question[0]
+	name := strings.TrimSuffix(strings.ToLower(question.Name), ".")
+	if inZone(name, "localhost") {
+		synth, err := EmptyResponseFromMessage(msg)
+		if err != nil {
+			return err
+		}
+		header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: SpecialNamesTTL}
+		switch question.Qtype {
+		case dns.TypeA:
+			synth.Answer = []dns.RR{&dns.A{Hdr: header, A: net.IPv4(127, 0, 0, 1).To4()}}
+		case dns.TypeAAAA:
+			synth.Answer = []dns.RR{&dns.AAAA{Hdr: header, AAAA: net.IPv6loopback}}
+		}
+		pluginsState.synthResponse = synth
+		pluginsState.action = PluginsActionSynth
+		return nil
+	}
+	for _, zone := range specialUseZones {
+		if !inZone(name, zone) {
+			continue
+		}
+		pluginsLog.Debugf("[%s] is a special-use name", question.Name)
+		synth, err := EmptyResponseFromMessage(msg)
+		if err != nil {
+			return err
+		}
+		synth.Rcode = dns.RcodeNameError
+		pluginsState.synthResponse = synth
+		pluginsState.action = PluginsActionSynth
+		return nil
+	}
+	return nil
+}
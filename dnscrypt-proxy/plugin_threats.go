@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type ThreatFeed struct {
+	category string
+	rules    *RulesFile
+}
+
+type PluginThreats struct {
+	feeds    []ThreatFeed
+	response *BlockedResponse
+}
+
+// Every feed lists names of a category of threats, such as newly registered
+// domains or malware command and control servers, one pattern per line.
+// Feeds are usually the cache files of signed "rules" sources.
+
+func NewPluginThreats(files map[string]string, response *BlockedResponse) (*PluginThreats, error) {
+	plugin := PluginThreats{response: response}
+	categories := make([]string, 0, len(files))
+	for category := range files {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		fileName := files[category]
+		rules, err := NewRulesFile("threat ("+category+")", fileName, func(matcher *PatternMatcher) error {
+			return parseRulesFile(fileName, func(line string, _ string, lineNo int) error {
+				return matcher.Add(strings.Fields(line)[0], lineNo)
+			})
+		})
+		if err != nil {
+			return nil, err
+		}
+		plugin.feeds = append(plugin.feeds, ThreatFeed{category: category, rules: rules})
+	}
+	return &plugin, nil
+}
+
+func (plugin *PluginThreats) Name() string {
+	return "threats"
+}
+
+func (plugin *PluginThreats) Description() string {
+	return "Block names listed by threat intelligence feeds"
+}
+
+func (plugin *PluginThreats) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if pluginsState.whitelisted || len(msg.Question) != 1 {
+		return nil
+	}
+	qName := msg.Question[0].Name
+	for _, feed := range plugin.feeds {
+		rule := feed.rules.Match(qName)
+		if rule == nil {
+			continue
+		}
+		pluginsLog.Noticef("[%s] blocked - threat [%s], rule [%s]", qName, feed.category, rule.pattern)
+		synth, err := plugin.response.synthesize(msg)
+		if err != nil {
+			return err
+		}
+		pluginsState.blockedBy = &BlockAttribution{plugin: "threats (" + feed.category + ")", fileName: feed.rules.fileName, line: rule.value.(int), rule: rule.pattern}
+		pluginsState.synthResponse = synth
+		pluginsState.action = PluginsActionReject
+		return nil
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+type WhitelistRule struct {
+	comment  string
+	schedule *WeeklyRanges
+}
+
+type PluginWhitelist struct {
+	rules *RulesFile
+}
+
+func NewPluginWhitelist(fileName string, schedules map[string]*WeeklyRanges) (*PluginWhitelist, error) {
+	rules, err := NewRulesFile("whitelist", fileName, func(matcher *PatternMatcher) error {
+		return parseRulesFile(fileName, func(line string, comment string, _ int) error {
+			pattern, schedule, err := parseScheduledRule(line, schedules)
+			if err != nil {
+				return err
+			}
+			return matcher.Add(pattern, &WhitelistRule{comment: comment, schedule: schedule})
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &PluginWhitelist{rules: rules}, nil
+}
+
+func (plugin *PluginWhitelist) Name() string {
+	return "whitelist"
+}
+
+func (plugin *PluginWhitelist) Description() string {
+	return "Allow names matching patterns, even if they are blacklisted"
+}
+
+func (plugin *PluginWhitelist) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
+	if len(msg.Question) != 1 {
+		return nil
+	}
+	qName := msg.Question[0].Name
+	rule := plugin.rules.Match(qName)
+	if rule == nil {
+		return nil
+	}
+	whitelistRule := rule.value.(*WhitelistRule)
+	if !whitelistRule.schedule.Match() {
+		return nil
+	}
+	if comment := whitelistRule.comment; len(comment) > 0 {
+		pluginsLog.Debugf("[%s] whitelisted by rule [%s] (%s)", qName, rule.pattern, comment)
+	} else {
+		pluginsLog.Debugf("[%s] whitelisted by rule [%s]", qName, rule.pattern)
+	}
+	pluginsState.whitelisted = true
+	return nil
+}
@@ -4,7 +4,11 @@ import (
 	"crypto/sha512"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math/rand"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	lru "github.com/hashicorp/golang-lru"
@@ -25,16 +29,54 @@ type PluginsState struct {
 	sessionData            map[string]interface{}
 	action                 PluginsAction
 	originalMaxPayloadSize int
+	clientMaxPayloadSize   int
 	maxPayloadSize         int
 	proto                  string
+	clientAddr             *net.Addr
 	queryPlugins           *[]Plugin
 	responsePlugins        *[]Plugin
 	synthResponse          *dns.Msg
+	tcpKeepAlive           bool
+	forwardECS             bool
+	ecs                    *dns.EDNS0_SUBNET
+	ecsIPv4Prefix          uint8
+	ecsIPv6Prefix          uint8
+	cacheNamespace         string
 	dnssec                 bool
-	cacheSize              int
 	cacheNegTTL            uint32
+	cacheNXDomainTTL       uint32
+	cacheNoDataTTL         uint32
+	cacheServFailTTL       uint32
+	cacheBypass            *CacheBypassRules
+	cacheStats             *CacheStats
+	sharedCache            SharedCache
+	serverInfo             *ServerInfo
+	serverName             string
+	transport              string
+	aggressiveNSEC         bool
+	cacheTTLJitter         int
+	whitelisted            bool
+	cloakedName            string
+	cloakTarget            string
+	cloakTTL               uint32
+	ruleTTL                uint32
+	cacheHit               bool
+	noCache                bool
 	cacheMinTTL            uint32
 	cacheMaxTTL            uint32
+	cachePrefetchMinHits   uint32
+	prefetchStats          *CachedResponseStats
+	blockedBy              *BlockAttribution
+}
+
+// What blocked a query: the plugin, and for rules files, the file, the line
+// and the pattern that matched
+
+type BlockAttribution struct {
+	plugin   string
+	fileName string
+	line     int
+	rule     string
 }
 
 type Plugin interface {
@@ -43,31 +85,163 @@ type Plugin interface {
 	Eval(pluginsState *PluginsState, msg *dns.Msg) error
 }
 
-func NewPluginsState(proxy *Proxy, proto string) PluginsState {
-	queryPlugins := &[]Plugin{}
-	if proxy.pluginBlockIPv6 {
-		*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockIPv6)))
+var (
+	DefaultQueryPluginsOrder    = []string{"block_ipv6", "block_query_types", "doh_canary", "captive_portal", "hosts", "whitelist", "blacklist", "threats", "external", "safe_search", "cloak", "forward", "special_names", "cache"}
+	DefaultResponsePluginsOrder = []string{"dns64", "blacklist_cname", "blacklist_ip", "rebinding", "rewrite_ip", "cache_response"}
+)
+
+// Every plugin must be listed once. Orders in which a plugin could never
+// have any effect are rejected.
+
+func checkPluginsOrder(order []string, defaultOrder []string) error {
+	positions := make(map[string]int)
+	for i, name := range order {
+		if !includesName(defaultOrder, name) {
+			return fmt.Errorf("Unknown plugin: [%s]", name)
+		}
+		if _, ok := positions[name]; ok {
+			return fmt.Errorf("Plugin [%s] listed more than once", name)
+		}
+		positions[name] = i
+	}
+	for _, name := range defaultOrder {
+		if _, ok := positions[name]; !ok {
+			return fmt.Errorf("Plugin [%s] missing", name)
+		}
+	}
+	if whitelist, ok := positions["whitelist"]; ok && (whitelist > positions["blacklist"] || whitelist > positions["threats"]) {
+		return errors.New("The whitelist must come before the blacklist and threats")
+	}
+	if cacheResponse, ok := positions["cache_response"]; ok && cacheResponse != len(order)-1 {
+		return errors.New("Responses must be cached after all the other response plugins")
+	}
+	return nil
+}
+
+func NewPluginsState(proxy *Proxy, proto string, listenerOptions *ListenerOptions, policy *ClientPolicy) PluginsState {
+	pluginWhitelist, pluginBlacklist := proxy.pluginWhitelist, proxy.pluginBlacklist
+	cacheNamespace := listenerOptions.cacheNamespace
+	if policy != nil {
+		pluginWhitelist, pluginBlacklist = policy.whitelist, policy.blacklist
+		cacheNamespace += "|policy:" + policy.name
 	}
-	*queryPlugins = append(*queryPlugins, Plugin(new(PluginGetSetPayloadSize)))
-	if proxy.cache {
-		*queryPlugins = append(*queryPlugins, Plugin(new(PluginCache)))
+	// The EDNS options of the query, including ECS, are always handled first,
+	// before any plugin can respond or send the query elsewhere
+	queryPlugins := &[]Plugin{Plugin(new(PluginGetSetPayloadSize))}
+	for _, name := range proxy.queryPluginsOrder {
+		switch name {
+		case "block_ipv6":
+			if listenerOptions.blockIPv6 {
+				*queryPlugins = append(*queryPlugins, Plugin(new(PluginBlockIPv6)))
+			}
+		case "block_query_types":
+			if proxy.pluginBlockQueryTypes != nil {
+				*queryPlugins = append(*queryPlugins, Plugin(proxy.pluginBlockQueryTypes))
+			}
+		case "doh_canary":
+			if proxy.pluginDoHCanary != nil {
+				*queryPlugins = append(*queryPlugins, Plugin(proxy.pluginDoHCanary))
+			}
+		case "captive_portal":
+			if proxy.pluginCaptivePortal != nil {
+				*queryPlugins = append(*queryPlugins, Plugin(proxy.pluginCaptivePortal))
+			}
+		case "hosts":
+			if proxy.pluginHosts != nil {
+				*queryPlugins = append(*queryPlugins, Plugin(proxy.pluginHosts))
+			}
+		case "whitelist":
+			if pluginWhitelist != nil {
+				*queryPlugins = append(*queryPlugins, Plugin(pluginWhitelist))
+			}
+		case "blacklist":
+			if pluginBlacklist != nil {
+				*queryPlugins = append(*queryPlugins, Plugin(pluginBlacklist))
+			}
+		case "threats":
+			if proxy.pluginThreats != nil {
+				*queryPlugins = append(*queryPlugins, Plugin(proxy.pluginThreats))
+			}
+		case "external":
+			if proxy.pluginExternal != nil {
+				*queryPlugins = append(*queryPlugins, Plugin(proxy.pluginExternal))
+			}
+		case "safe_search":
+			if proxy.pluginSafeSearch != nil {
+				*queryPlugins = append(*queryPlugins, Plugin(proxy.pluginSafeSearch))
+			}
+		case "cloak":
+			if proxy.pluginCloak != nil {
+				*queryPlugins = append(*queryPlugins, Plugin(proxy.pluginCloak))
+			}
+		case "forward":
+			if proxy.pluginForward != nil {
+				*queryPlugins = append(*queryPlugins, Plugin(proxy.pluginForward))
+			}
+		case "special_names":
+			if proxy.pluginSpecialNames {
+				*queryPlugins = append(*queryPlugins, Plugin(new(PluginSpecialNames)))
+			}
+		case "cache":
+			if listenerOptions.cache {
+				*queryPlugins = append(*queryPlugins, Plugin(new(PluginCache)))
+			}
+		}
 	}
 
 	responsePlugins := &[]Plugin{}
-	if proxy.cache {
-		*responsePlugins = append(*responsePlugins, Plugin(new(PluginCacheResponse)))
+	for _, name := range proxy.responsePluginsOrder {
+		switch name {
+		case "dns64":
+			if proxy.pluginDNS64 != nil {
+				*responsePlugins = append(*responsePlugins, Plugin(proxy.pluginDNS64))
+			}
+		case "blacklist_cname":
+			if pluginBlacklist != nil && proxy.cnameBlocking != CNAMEBlockingOff {
+				*responsePlugins = append(*responsePlugins, Plugin(&PluginBlacklistCNAME{blacklist: pluginBlacklist, action: proxy.cnameBlocking, maxDepth: proxy.cnameMaxDepth}))
+			}
+		case "blacklist_ip":
+			if proxy.pluginBlacklistIP != nil {
+				*responsePlugins = append(*responsePlugins, Plugin(proxy.pluginBlacklistIP))
+			}
+		case "rebinding":
+			if proxy.pluginRebinding != nil {
+				*responsePlugins = append(*responsePlugins, Plugin(proxy.pluginRebinding))
+			}
+		case "rewrite_ip":
+			if proxy.pluginRewriteIP != nil {
+				*responsePlugins = append(*responsePlugins, Plugin(proxy.pluginRewriteIP))
+			}
+		case "cache_response":
+			if listenerOptions.cache {
+				*responsePlugins = append(*responsePlugins, Plugin(new(PluginCacheResponse)))
+			}
+		}
 	}
 
 	return PluginsState{
-		action:          PluginsActionForward,
-		maxPayloadSize:  MaxDNSUDPPacketSize - ResponseOverhead,
-		queryPlugins:    queryPlugins,
-		responsePlugins: responsePlugins,
-		proto:           proto,
-		cacheSize:       proxy.cacheSize,
-		cacheNegTTL:     proxy.cacheNegTTL,
-		cacheMinTTL:     proxy.cacheMinTTL,
-		cacheMaxTTL:     proxy.cacheMaxTTL,
+		action:               PluginsActionForward,
+		maxPayloadSize:       MaxDNSUDPPacketSize - ResponseOverhead,
+		clientMaxPayloadSize: MaxDNSUDPPacketSize,
+		queryPlugins:         queryPlugins,
+		responsePlugins:      responsePlugins,
+		proto:                proto,
+		cacheNamespace:       cacheNamespace,
+		cacheNegTTL:          proxy.cacheNegTTL,
+		cacheNXDomainTTL:     proxy.cacheNXDomainTTL,
+		cacheNoDataTTL:       proxy.cacheNoDataTTL,
+		cacheServFailTTL:     proxy.cacheServFailTTL,
+		cacheBypass:          proxy.cacheBypass,
+		cacheStats:           listenerOptions.cacheStats,
+		sharedCache:          proxy.sharedCache,
+		aggressiveNSEC:       proxy.cacheAggressiveNSEC,
+		cacheTTLJitter:       proxy.cacheTTLJitter,
+		cacheMinTTL:          proxy.cacheMinTTL,
+		cacheMaxTTL:          proxy.cacheMaxTTL,
+		cachePrefetchMinHits: proxy.cachePrefetchMinHits,
+		forwardECS:           proxy.forwardECS,
+		ecsIPv4Prefix:        proxy.ecsIPv4Prefix,
+		ecsIPv6Prefix:        proxy.ecsIPv6Prefix,
 	}
 }
 
@@ -112,9 +286,27 @@ func (plugin *PluginGetSetPayloadSize) Description() string {
 
 func (plugin *PluginGetSetPayloadSize) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	pluginsState.originalMaxPayloadSize = 512 - ResponseOverhead
+	pluginsState.clientMaxPayloadSize = 512
 	opt := msg.IsEdns0()
 	dnssec := false
 	if opt != nil {
+		options := []dns.EDNS0{}
+		for _, option := range opt.Option {
+			switch option.Option() {
+			case dns.EDNS0TCPKEEPALIVE:
+				pluginsState.tcpKeepAlive = true
+			case dns.EDNS0SUBNET:
+				if subnet, ok := option.(*dns.EDNS0_SUBNET); ok && pluginsState.forwardECS {
+					if pluginsState.ecs = NormalizedECS(subnet); pluginsState.ecs != nil {
+						pluginsState.ecs = TruncatedECS(pluginsState.ecs, pluginsState.ecsIPv4Prefix, pluginsState.ecsIPv6Prefix)
+					}
+				}
+			default:
+				options = append(options, option)
+			}
+		}
+		opt.Option = options
+		pluginsState.clientMaxPayloadSize = Max(int(opt.UDPSize()), 512)
 		pluginsState.originalMaxPayloadSize = Min(int(opt.UDPSize())-ResponseOverhead, pluginsState.originalMaxPayloadSize)
 		dnssec = opt.Do()
 	}
@@ -130,6 +322,9 @@ func (plugin *PluginGetSetPayloadSize) Eval(pluginsState *PluginsState, msg *dns
 		msg.Extra = extra2
 		msg.SetEdns0(uint16(pluginsState.maxPayloadSize), dnssec)
 	}
+	if opt := msg.IsEdns0(); opt != nil && pluginsState.ecs != nil {
+		opt.Option = append(opt.Option, pluginsState.ecs)
+	}
 	return nil
 }
 
@@ -192,18 +387,113 @@ func (pluginsState *PluginsState) ApplyResponsePlugins(packet []byte) ([]byte, e
 
 // -------- cache plugin --------
 
+const (
+	StaleTTL           = 30
+	CachePrefetchRatio = 10
+)
+
 type CachedResponse struct {
 	expiration time.Time
 	msg        dns.Msg
+	stats      *CachedResponseStats
+	server     string
 }
 
-type CachedResponses struct {
+type CachedResponseStats struct {
+	ttl         time.Duration
+	hits        uint32
+	prefetching int32
+}
+
+type CacheStore interface {
+	Add(key, value interface{})
+	Get(key interface{}) (interface{}, bool)
+	Peek(key interface{}) (interface{}, bool)
+	Contains(key interface{}) bool
+	Remove(key interface{})
+	Purge()
+	Keys() []interface{}
+	Len() int
+}
+
+type LRUCacheStore struct {
+	*lru.Cache
+}
+
+func (store LRUCacheStore) Add(key, value interface{}) {
+	store.Cache.Add(key, value)
+}
+
+// ARC, 2Q and TinyLFU keep entries that are only requested once from evicting
+// popular ones, which plain LRU doesn't do when scanning many names
+
+func NewCacheStore(policy string, size int) (CacheStore, error) {
+	switch policy {
+	case "lru":
+		cache, err := lru.New(size)
+		if err != nil {
+			return nil, err
+		}
+		return LRUCacheStore{cache}, nil
+	case "2q":
+		return lru.New2Q(size)
+	case "arc", "":
+		return lru.NewARC(size)
+	case "tinylfu":
+		return NewTinyLFU(size)
+	}
+	return nil, fmt.Errorf("Unsupported cache policy: [%s]", policy)
+}
+
+type CachedResponsesShard struct {
 	sync.RWMutex
-	cache *lru.ARCCache
+	cache CacheStore
+	size  int
+}
+
+type CachedResponses struct {
+	shards    []*CachedResponsesShard
+	ecsScopes struct {
+		sync.RWMutex
+		seen [2][129]bool
+	}
 }
 
 var cachedResponses CachedResponses
 
+// The cache is split into shards, each with its own lock, so that
+// concurrent queries rarely have to wait for each other
+
+func (cachedResponses *CachedResponses) init(policy string, shardsCount int, cacheSize int) error {
+	shardsCount = Max(1, Min(shardsCount, cacheSize))
+	shards := make([]*CachedResponsesShard, shardsCount)
+	shardSize := (cacheSize + shardsCount - 1) / shardsCount
+	for i := range shards {
+		cache, err := NewCacheStore(policy, shardSize)
+		if err != nil {
+			return err
+		}
+		shards[i] = &CachedResponsesShard{cache: cache, size: shardSize}
+	}
+	cachedResponses.shards = shards
+	return nil
+}
+
+func (cachedResponses *CachedResponses) shard(cacheKey [32]byte) *CachedResponsesShard {
+	if len(cachedResponses.shards) == 0 {
+		return nil
+	}
+	return cachedResponses.shards[binary.LittleEndian.Uint64(cacheKey[0:8])%uint64(len(cachedResponses.shards))]
+}
+
+func (cachedResponses *CachedResponses) occupancy() []int {
+	occupancy := make([]int, len(cachedResponses.shards))
+	for i, shard := range cachedResponses.shards {
+		occupancy[i] = shard.cache.Len()
+	}
+	return occupancy
+}
+
 type PluginCacheResponse struct {
 	cachedResponses *CachedResponses
 }
@@ -216,29 +506,76 @@ func (plugin *PluginCacheResponse) Description() string {
 	return "DNS cache (writer)."
 }
 
+func (pluginsState *PluginsState) negTTL(msg *dns.Msg) uint32 {
+	switch msg.Rcode {
+	case dns.RcodeSuccess:
+		return pluginsState.cacheNoDataTTL
+	case dns.RcodeNameError:
+		return pluginsState.cacheNXDomainTTL
+	case dns.RcodeServerFailure:
+		return pluginsState.cacheServFailTTL
+	}
+	return pluginsState.cacheNegTTL
+}
+
+// Entries don't all expire at the same time if they have been stored at the same time
+
+func jitteredTTL(ttl time.Duration, percent int) time.Duration {
+	delta := int64(ttl) * int64(percent) / 100
+	if delta <= 0 {
+		return ttl
+	}
+	return ttl + time.Duration(rand.Int63n(2*delta+1)-delta)
+}
+
 func (plugin *PluginCacheResponse) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	plugin.cachedResponses = &cachedResponses
-	if msg.Rcode == dns.RcodeServerFailure {
+	if pluginsState.noCache || pluginsState.cacheBypass.matches(msg) {
 		return nil
 	}
-	cacheKey, err := computeCacheKey(pluginsState, msg)
+	if pluginsState.aggressiveNSEC {
+		nsecCache.insert(msg)
+	}
+	if msg.Rcode == dns.RcodeServerFailure && pluginsState.cacheServFailTTL == 0 {
+		return nil
+	}
+	var ecs *dns.EDNS0_SUBNET
+	if responseECS := GetECS(msg); responseECS != nil {
+		if responseECS.SourceScope > 0 && pluginsState.ecs != nil {
+			ecs = ScopedECS(pluginsState.ecs, responseECS.SourceScope)
+			plugin.cachedResponses.addECSScope(ecs)
+		}
+		msg = msg.Copy()
+		RemoveECS(msg)
+	}
+	cacheKey, err := computeCacheKey(pluginsState, msg, ecs)
 	if err != nil {
 		return err
 	}
-	ttl := getMinTTL(msg, pluginsState.cacheMinTTL, pluginsState.cacheMaxTTL, pluginsState.cacheNegTTL)
+	ttl := jitteredTTL(getMinTTL(msg, pluginsState.cacheMinTTL, pluginsState.cacheMaxTTL, pluginsState.negTTL(msg)), pluginsState.cacheTTLJitter)
 	cachedResponse := CachedResponse{
 		expiration: time.Now().Add(ttl),
 		msg:        *msg,
+		stats:      &CachedResponseStats{ttl: ttl},
+		server:     pluginsState.serverName,
 	}
-	plugin.cachedResponses.Lock()
-	defer plugin.cachedResponses.Unlock()
-	if plugin.cachedResponses.cache == nil {
-		plugin.cachedResponses.cache, err = lru.NewARC(pluginsState.cacheSize)
-		if err != nil {
-			return err
+	shard := plugin.cachedResponses.shard(cacheKey)
+	if shard == nil {
+		return nil
+	}
+	shard.Lock()
+	evicting := !shard.cache.Contains(cacheKey) && shard.cache.Len() >= shard.size
+	shard.cache.Add(cacheKey, cachedResponse)
+	shard.Unlock()
+	if pluginsState.sharedCache != nil && ecs == nil {
+		storeShared(pluginsState.sharedCache, cacheKey, msg, cachedResponse.expiration)
+	}
+	if pluginsState.cacheStats != nil {
+		atomic.AddUint64(&pluginsState.cacheStats.insertions, 1)
+		if evicting {
+			atomic.AddUint64(&pluginsState.cacheStats.evictions, 1)
 		}
 	}
-	plugin.cachedResponses.cache.Add(cacheKey, cachedResponse)
 	return nil
 }
 
@@ -256,35 +593,141 @@ func (plugin *PluginCache) Description() string {
 
 func (plugin *PluginCache) Eval(pluginsState *PluginsState, msg *dns.Msg) error {
 	plugin.cachedResponses = &cachedResponses
-
-	cacheKey, err := computeCacheKey(pluginsState, msg)
-	if err != nil {
+	if pluginsState.cacheBypass.matches(msg) {
+		pluginsState.noCache = true
 		return nil
 	}
-	plugin.cachedResponses.RLock()
-	defer plugin.cachedResponses.RUnlock()
-	if plugin.cachedResponses.cache == nil {
-		return nil
+
+	cached, ok := plugin.cachedResponses.lookup(pluginsState, msg, 0)
+	if !ok && pluginsState.sharedCache != nil {
+		cached, ok = plugin.cachedResponses.lookupShared(pluginsState, msg)
+	}
+	if !ok && pluginsState.aggressiveNSEC {
+		if synth := nsecCache.synthesize(msg, pluginsState.dnssec); synth != nil {
+			if pluginsState.cacheStats != nil {
+				atomic.AddUint64(&pluginsState.cacheStats.hits, 1)
+			}
+			pluginsState.cacheHit = true
+			pluginsState.synthResponse = synth
+			pluginsState.action = PluginsActionSynth
+			return nil
+		}
+	}
+	if pluginsState.cacheStats != nil {
+		if ok {
+			atomic.AddUint64(&pluginsState.cacheStats.hits, 1)
+		} else {
+			atomic.AddUint64(&pluginsState.cacheStats.misses, 1)
+		}
 	}
-	cached_any, ok := plugin.cachedResponses.cache.Get(cacheKey)
 	if !ok {
 		return nil
 	}
-	cached := cached_any.(CachedResponse)
-	if time.Now().After(cached.expiration) {
-		return nil
+	now := time.Now()
+	if pluginsState.cachePrefetchMinHits > 0 && cached.stats != nil &&
+		atomic.AddUint32(&cached.stats.hits, 1) >= pluginsState.cachePrefetchMinHits &&
+		cached.expiration.Sub(now) < cached.stats.ttl/CachePrefetchRatio &&
+		atomic.CompareAndSwapInt32(&cached.stats.prefetching, 0, 1) {
+		pluginsState.prefetchStats = cached.stats
 	}
 	synth := cached.msg
 	synth.Id = msg.Id
 	synth.Response = true
 	synth.Compress = true
 	synth.Question = msg.Question
+	pluginsState.cacheHit = true
 	pluginsState.synthResponse = &synth
 	pluginsState.action = PluginsActionSynth
 	return nil
 }
 
-func computeCacheKey(pluginsState *PluginsState, msg *dns.Msg) ([32]byte, error) {
+// Expired entries can still be served for a while, with a short TTL,
+// when every server is unreachable (RFC 8767)
+
+func (pluginsState *PluginsState) staleResponse(query []byte, gracePeriod time.Duration) []byte {
+	msg := dns.Msg{}
+	if err := msg.Unpack(query); err != nil {
+		return nil
+	}
+	cached, ok := cachedResponses.lookup(pluginsState, &msg, gracePeriod)
+	if !ok {
+		return nil
+	}
+	synth := cached.msg.Copy()
+	synth.Id = msg.Id
+	synth.Response = true
+	synth.Compress = true
+	synth.Question = msg.Question
+	for _, rrs := range [][]dns.RR{synth.Answer, synth.Ns, synth.Extra} {
+		for _, rr := range rrs {
+			if header := rr.Header(); header.Rrtype != dns.TypeOPT && header.Ttl > StaleTTL {
+				header.Ttl = StaleTTL
+			}
+		}
+	}
+	response, err := synth.Pack()
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+func (cachedResponses *CachedResponses) addECSScope(ecs *dns.EDNS0_SUBNET) {
+	family := ecs.Family - 1
+	cachedResponses.ecsScopes.RLock()
+	seen := cachedResponses.ecsScopes.seen[family][ecs.SourceNetmask]
+	cachedResponses.ecsScopes.RUnlock()
+	if seen {
+		return
+	}
+	cachedResponses.ecsScopes.Lock()
+	cachedResponses.ecsScopes.seen[family][ecs.SourceNetmask] = true
+	cachedResponses.ecsScopes.Unlock()
+}
+
+// Responses with a non-zero ECS scope are stored for the client subnet
+// truncated to that scope, and are only reused for clients from the same
+// subnet. Lookups try the scopes seen so far, the most specific ones first,
+// then responses shared by all clients.
+
+func (cachedResponses *CachedResponses) lookup(pluginsState *PluginsState, msg *dns.Msg, gracePeriod time.Duration) (CachedResponse, bool) {
+	var ecsOptions []*dns.EDNS0_SUBNET
+	if ecs := pluginsState.ecs; ecs != nil {
+		cachedResponses.ecsScopes.RLock()
+		for scope := int(ecs.SourceNetmask); scope > 0; scope-- {
+			if cachedResponses.ecsScopes.seen[ecs.Family-1][scope] {
+				ecsOptions = append(ecsOptions, ScopedECS(ecs, uint8(scope)))
+			}
+		}
+		cachedResponses.ecsScopes.RUnlock()
+	}
+	ecsOptions = append(ecsOptions, nil)
+	now := time.Now()
+	for _, ecs := range ecsOptions {
+		cacheKey, err := computeCacheKey(pluginsState, msg, ecs)
+		if err != nil {
+			break
+		}
+		shard := cachedResponses.shard(cacheKey)
+		if shard == nil {
+			break
+		}
+		shard.RLock()
+		cachedAny, ok := shard.cache.Get(cacheKey)
+		shard.RUnlock()
+		if !ok {
+			continue
+		}
+		cached := cachedAny.(CachedResponse)
+		if now.After(cached.expiration.Add(gracePeriod)) {
+			continue
+		}
+		return cached, true
+	}
+	return CachedResponse{}, false
+}
+
+func computeCacheKey(pluginsState *PluginsState, msg *dns.Msg, ecs *dns.EDNS0_SUBNET) ([32]byte, error) {
 	questions := msg.Question
 	if len(questions) != 1 {
 		return [32]byte{}, errors.New("No question present")
@@ -301,6 +744,18 @@ func computeCacheKey(pluginsState *PluginsState, msg *dns.Msg) ([32]byte, error)
 	normalizedName := []byte(question.Name)
 	NormalizeName(&normalizedName)
 	h.Write(normalizedName)
+	if len(pluginsState.cacheNamespace) > 0 {
+		h.Write([]byte{0})
+		h.Write([]byte(pluginsState.cacheNamespace))
+	}
+	if ecs != nil {
+		var ecsHeader [4]byte
+		ecsHeader[0] = 1
+		binary.LittleEndian.PutUint16(ecsHeader[1:3], ecs.Family)
+		ecsHeader[3] = ecs.SourceNetmask
+		h.Write(ecsHeader[:])
+		h.Write(ecs.Address)
+	}
 	var sum [32]byte
 	h.Sum(sum[:0])
 	return sum, nil
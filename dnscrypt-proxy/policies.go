@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+)
+
+type ClientPolicy struct {
+	name      string
+	clients   []*net.IPNet
+	whitelist *PluginWhitelist
+	blacklist *PluginBlacklist
+}
+
+type ClientPolicies []*ClientPolicy
+
+func NewClientPolicy(name string, policyConfig PolicyConfig, schedules map[string]*WeeklyRanges, blockedResponse *BlockedResponse) (*ClientPolicy, error) {
+	clients, err := parseCIDRs(policyConfig.Clients)
+	if err != nil {
+		return nil, err
+	}
+	policy := ClientPolicy{name: name, clients: clients}
+	if len(policyConfig.WhitelistFile) > 0 {
+		if policy.whitelist, err = NewPluginWhitelist(policyConfig.WhitelistFile, schedules); err != nil {
+			return nil, err
+		}
+	}
+	if len(policyConfig.BlacklistFile) > 0 {
+		if policy.blacklist, err = NewPluginBlacklist(policyConfig.BlacklistFile, schedules, blockedResponse); err != nil {
+			return nil, err
+		}
+	}
+	return &policy, nil
+}
+
+func (policies ClientPolicies) named(name string) *ClientPolicy {
+	for _, policy := range policies {
+		if policy.name == name {
+			return policy
+		}
+	}
+	return nil
+}
+
+// A policy set for the listener applies to all its clients. Otherwise, the
+// policy with the most specific network containing the client address is used
+
+func (policies ClientPolicies) forClient(listenerOptions *ListenerOptions, clientAddr *net.Addr) *ClientPolicy {
+	if listenerOptions.policy != nil {
+		return listenerOptions.policy
+	}
+	if len(policies) == 0 || clientAddr == nil {
+		return nil
+	}
+	ip := ClientIP(*clientAddr)
+	if ip == nil {
+		return nil
+	}
+	var match *ClientPolicy
+	matchBits := -1
+	for _, policy := range policies {
+		for _, cidr := range policy.clients {
+			if bits, _ := cidr.Mask.Size(); bits > matchBits && cidr.Contains(ip) {
+				match, matchBits = policy, bits
+			}
+		}
+	}
+	return match
+}
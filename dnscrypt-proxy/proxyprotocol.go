@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const MaxProxyProtocolV1HeaderSize = 107
+
+var proxyProtocolV2Signature = []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+type ProxyProtocolConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (conn *ProxyProtocolConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+// Connections from trusted load balancers start with a PROXY protocol header
+// (v1 or v2), carrying the address of the actual client
+
+func (proxy *Proxy) acceptProxyProtocol(clientPc net.Conn) (net.Conn, error) {
+	tcpAddr, ok := clientPc.RemoteAddr().(*net.TCPAddr)
+	if len(proxy.proxyProtocolSources) == 0 || !ok || !cidrsContain(proxy.proxyProtocolSources, tcpAddr.IP) {
+		return clientPc, nil
+	}
+	clientPc.SetReadDeadline(time.Now().Add(proxy.timeout))
+	clientAddr, err := readProxyProtocolHeader(clientPc)
+	if err != nil {
+		return nil, err
+	}
+	if clientAddr == nil {
+		return clientPc, nil
+	}
+	return &ProxyProtocolConn{Conn: clientPc, remoteAddr: clientAddr}, nil
+}
+
+func readProxyProtocolHeader(conn net.Conn) (*net.TCPAddr, error) {
+	header := make([]byte, 5, MaxProxyProtocolV1HeaderSize)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(header, []byte("PROXY")) {
+		return readProxyProtocolV1Header(conn, header)
+	}
+	if bytes.Equal(header, proxyProtocolV2Signature[:5]) {
+		return readProxyProtocolV2Header(conn)
+	}
+	return nil, errors.New("Missing PROXY protocol header")
+}
+
+func readProxyProtocolV1Header(conn net.Conn, header []byte) (*net.TCPAddr, error) {
+	var c [1]byte
+	for !bytes.HasSuffix(header, []byte("\r\n")) {
+		if len(header) >= MaxProxyProtocolV1HeaderSize {
+			return nil, errors.New("PROXY protocol header is too long")
+		}
+		if _, err := io.ReadFull(conn, c[:]); err != nil {
+			return nil, err
+		}
+		header = append(header, c[0])
+	}
+	fields := strings.Fields(string(header))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("Invalid PROXY protocol header")
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 0xffff {
+		return nil, errors.New("Invalid PROXY protocol source address")
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyProtocolV2Header(conn net.Conn) (*net.TCPAddr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)-5+4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:len(proxyProtocolV2Signature)-5], proxyProtocolV2Signature[5:]) {
+		return nil, errors.New("Invalid PROXY protocol signature")
+	}
+	header = header[len(proxyProtocolV2Signature)-5:]
+	versionCommand, family := header[0], header[1]
+	if versionCommand>>4 != 2 {
+		return nil, errors.New("Unsupported PROXY protocol version")
+	}
+	addrs := make([]byte, binary.BigEndian.Uint16(header[2:4]))
+	if _, err := io.ReadFull(conn, addrs); err != nil {
+		return nil, err
+	}
+	if versionCommand&0xf == 0x0 {
+		return nil, nil
+	}
+	switch family >> 4 {
+	case 0x1:
+		if len(addrs) < 12 {
+			return nil, errors.New("Short PROXY protocol addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:4]), Port: int(binary.BigEndian.Uint16(addrs[8:10]))}, nil
+	case 0x2:
+		if len(addrs) < 36 {
+			return nil, errors.New("Short PROXY protocol addresses")
+		}
+		return &net.TCPAddr{IP: net.IP(addrs[0:16]), Port: int(binary.BigEndian.Uint16(addrs[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+type QueryLogFormat int
+
+const (
+	QueryLogFormatLTSV QueryLogFormat = iota
+	QueryLogFormatNDJSON
+)
+
+const QueryLogRateWindow = time.Minute
+
+type QueryLog struct {
+	sync.Mutex
+	out        io.Writer
+	format     QueryLogFormat
+	ignored    *PatternMatcher
+	clientIPs  *ClientIPAnonymizer
+	filter     func(msg *dns.Msg, blockedBy *BlockAttribution) (string, bool)
+	sampling   uint64
+	queries    uint64
+	maxPerName int
+	nameCounts map[string]*QueryLogNameCount
+	windowEnd  time.Time
+}
+
+type QueryLogNameCount struct {
+	logged     int
+	suppressed int
+}
+
+type QueryLogEntry struct {
+	Time       string  `json:"time"`
+	Client     string  `json:"client"`
+	Name       string  `json:"name"`
+	Type       string  `json:"type"`
+	Rcode      string  `json:"rcode"`
+	Server     string  `json:"server"`
+	Transport  string  `json:"transport"`
+	Duration   float64 `json:"duration_ms"`
+	Cached     bool    `json:"cached"`
+	Reason     string  `json:"reason,omitempty"`
+	BlockedBy  string  `json:"blocked_by,omitempty"`
+	RulesFile  string  `json:"rules_file,omitempty"`
+	Line       int     `json:"line,omitempty"`
+	Rule       string  `json:"rule,omitempty"`
+	Sample     uint64  `json:"sample,omitempty"`
+	Suppressed int     `json:"suppressed,omitempty"`
+}
+
+func NewQueryLog(out io.Writer, format string, ignoredNames []string, clientIPs *ClientIPAnonymizer) (*QueryLog, error) {
+	queryLog := QueryLog{out: out, ignored: NewPatternMatcher(), clientIPs: clientIPs}
+	switch strings.ToLower(format) {
+	case "", "ltsv":
+		queryLog.format = QueryLogFormatLTSV
+	case "ndjson":
+		queryLog.format = QueryLogFormatNDJSON
+	default:
+		return nil, fmt.Errorf("Unsupported query log format: [%s]", format)
+	}
+	for _, pattern := range ignoredNames {
+		if err := queryLog.ignored.Add(pattern, nil); err != nil {
+			return nil, err
+		}
+	}
+	return &queryLog, nil
+}
+
+// Logs can be sent to syslog, using "syslog" as a file name, or to the
+// Windows Event Log, using "eventlog". Existing named pipes are written to
+// without ever blocking.
+
+func openQueryLogFile(fileName string, syslog *Syslog, eventLog *EventLog, msgID string) (io.Writer, error) {
+	switch fileName {
+	case "eventlog":
+		if eventLog == nil {
+			return nil, fmt.Errorf("Event Log not enabled for the [%s] log", msgID)
+		}
+		return eventLog.channel(), nil
+	case "syslog":
+		if syslog == nil {
+			return nil, fmt.Errorf("Syslog not configured for the [%s] log", msgID)
+		}
+		return syslog.channel(msgID), nil
+	}
+	if fileInfo, err := os.Stat(fileName); err == nil && fileInfo.Mode()&os.ModeNamedPipe != 0 {
+		return NewFifoWriter(fileName)
+	}
+	return os.OpenFile(fileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+// Sampling logs 1 query in N, and entries include N so that statistics can
+// be scaled back. At most maxPerName entries per minute are logged for the
+// same name; the next entry for a name includes how many were suppressed.
+
+func (queryLog *QueryLog) setLimits(sampling int, maxPerName int) {
+	if sampling > 1 {
+		queryLog.sampling = uint64(sampling)
+	}
+	if maxPerName > 0 {
+		queryLog.maxPerName = maxPerName
+		queryLog.nameCounts = make(map[string]*QueryLogNameCount)
+	}
+}
+
+func (queryLog *QueryLog) rateLimit(name string) (int, bool) {
+	now := time.Now()
+	if now.After(queryLog.windowEnd) {
+		for countedName, nameCount := range queryLog.nameCounts {
+			if nameCount.suppressed == 0 {
+				delete(queryLog.nameCounts, countedName)
+			} else {
+				nameCount.logged = 0
+			}
+		}
+		queryLog.windowEnd = now.Add(QueryLogRateWindow)
+	}
+	nameCount, ok := queryLog.nameCounts[name]
+	if !ok {
+		nameCount = &QueryLogNameCount{}
+		queryLog.nameCounts[name] = nameCount
+	}
+	if nameCount.logged >= queryLog.maxPerName {
+		nameCount.suppressed++
+		return 0, false
+	}
+	nameCount.logged++
+	suppressed := nameCount.suppressed
+	nameCount.suppressed = 0
+	return suppressed, true
+}
+
+// Responses are logged with the question of the client, once cloaked names have been restored
+
+func (queryLog *QueryLog) log(clientAddr *net.Addr, response []byte, serverName string, transport string, cached bool, duration time.Duration, blockedBy *BlockAttribution) {
+	if queryLog.sampling > 1 && atomic.AddUint64(&queryLog.queries, 1)%queryLog.sampling != 0 {
+		return
+	}
+	msg := dns.Msg{}
+	if err := msg.Unpack(response); err != nil || len(msg.Question) != 1 {
+		return
+	}
+	reason := ""
+	if queryLog.filter != nil {
+		var ok bool
+		if reason, ok = queryLog.filter(&msg, blockedBy); !ok {
+			return
+		}
+	}
+	question := msg.Question[0]
+	if queryLog.ignored.Match(question.Name) != nil {
+		return
+	}
+	suppressed := 0
+	if queryLog.maxPerName > 0 {
+		var ok bool
+		queryLog.Lock()
+		suppressed, ok = queryLog.rateLimit(strings.ToLower(question.Name))
+		queryLog.Unlock()
+		if !ok {
+			return
+		}
+	}
+	entry := QueryLogEntry{
+		Time:       time.Now().Format(time.RFC3339),
+		Client:     "-",
+		Name:       question.Name,
+		Type:       dns.TypeToString[question.Qtype],
+		Rcode:      dns.RcodeToString[msg.Rcode],
+		Server:     "-",
+		Transport:  "-",
+		Duration:   float64(duration) / float64(time.Millisecond),
+		Cached:     cached,
+		Reason:     reason,
+		Sample:     queryLog.sampling,
+		Suppressed: suppressed,
+	}
+	if clientAddr != nil {
+		if ip := ClientIP(*clientAddr); ip != nil {
+			entry.Client = queryLog.clientIPs.anonymize(ip)
+		}
+	}
+	if len(serverName) > 0 && !cached {
+		entry.Server = serverName
+	}
+	if len(transport) > 0 && !cached {
+		entry.Transport = transport
+	}
+	if blockedBy != nil {
+		entry.BlockedBy, entry.RulesFile, entry.Line, entry.Rule = blockedBy.plugin, blockedBy.fileName, blockedBy.line, blockedBy.rule
+	}
+	var line []byte
+	if queryLog.format == QueryLogFormatNDJSON {
+		encoded, err := json.Marshal(entry)
+		if err != nil {
+			return
+		}
+		line = append(encoded, '\n')
+	} else {
+		line = []byte(fmt.Sprintf("time:%s\tclient:%s\tname:%s\ttype:%s\trcode:%s\tserver:%s\ttransport:%s\tduration:%.3f\tcached:%t",
+			entry.Time, entry.Client, entry.Name, entry.Type, entry.Rcode, entry.Server, entry.Transport, entry.Duration, entry.Cached))
+		if len(entry.Reason) > 0 {
+			line = append(line, "\treason:"+entry.Reason...)
+		}
+		if len(entry.BlockedBy) > 0 {
+			line = append(line, "\tblocked_by:"+entry.BlockedBy...)
+		}
+		if len(entry.RulesFile) > 0 {
+			line = append(line, fmt.Sprintf("\trules_file:%s\tline:%d", entry.RulesFile, entry.Line)...)
+		}
+		if len(entry.Rule) > 0 {
+			line = append(line, "\trule:"+entry.Rule...)
+		}
+		if entry.Sample > 0 {
+			line = append(line, fmt.Sprintf("\tsample:%d", entry.Sample)...)
+		}
+		if entry.Suppressed > 0 {
+			line = append(line, fmt.Sprintf("\tsuppressed:%d", entry.Suppressed)...)
+		}
+		line = append(line, '\n')
+	}
+	queryLog.Lock()
+	queryLog.out.Write(line)
+	queryLog.Unlock()
+}
+
+func nxDomainFilter(msg *dns.Msg, _ *BlockAttribution) (string, bool) {
+	return "", msg.Rcode == dns.RcodeNameError
+}
+
+func blockedFilter(_ *dns.Msg, blockedBy *BlockAttribution) (string, bool) {
+	return "", blockedBy != nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+type QueryQueue struct {
+	pending chan struct{}
+	active  chan struct{}
+	timeout time.Duration
+}
+
+func NewQueryQueue(maxActive int, maxQueued int, timeout time.Duration) *QueryQueue {
+	return &QueryQueue{
+		pending: make(chan struct{}, maxActive+Max(maxQueued, 0)),
+		active:  make(chan struct{}, maxActive),
+		timeout: timeout,
+	}
+}
+
+// Queries are refused right away when the queue is full, and get a
+// SERVFAIL response if they waited in the queue for too long
+
+func (queue *QueryQueue) enter() int {
+	if queue == nil {
+		return dns.RcodeSuccess
+	}
+	select {
+	case queue.pending <- struct{}{}:
+	default:
+		dlog.Debugf("Query queue is full (%d queries)", cap(queue.pending))
+		return dns.RcodeRefused
+	}
+	select {
+	case queue.active <- struct{}{}:
+		return dns.RcodeSuccess
+	default:
+	}
+	timer := time.NewTimer(queue.timeout)
+	defer timer.Stop()
+	select {
+	case queue.active <- struct{}{}:
+		return dns.RcodeSuccess
+	case <-timer.C:
+		<-queue.pending
+		dlog.Debug("Query timed out in the queue")
+		return dns.RcodeServerFailure
+	}
+}
+
+func (queue *QueryQueue) leave() {
+	if queue == nil {
+		return
+	}
+	<-queue.active
+	<-queue.pending
+}
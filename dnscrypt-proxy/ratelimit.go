@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/jedisct1/dlog"
+)
+
+const RateLimiterMaxClients = 4096
+
+type RateLimitBucket struct {
+	tokens  float64
+	updated time.Time
+	limited uint64
+}
+
+type RateLimiter struct {
+	sync.Mutex
+	qps     float64
+	burst   float64
+	slip    uint64
+	buckets *lru.Cache
+}
+
+func NewRateLimiter(qps int, burst int, slip int) (*RateLimiter, error) {
+	buckets, err := lru.New(RateLimiterMaxClients)
+	if err != nil {
+		return nil, err
+	}
+	if burst <= 0 {
+		burst = qps
+	}
+	return &RateLimiter{qps: float64(qps), burst: float64(burst), slip: uint64(Max(slip, 0)), buckets: buckets}, nil
+}
+
+func (proxy *Proxy) checkRateLimit(clientAddr *net.Addr) (allowed bool, slip bool) {
+	if proxy.rateLimiter == nil || clientAddr == nil {
+		return true, false
+	}
+	return proxy.rateLimiter.check(*clientAddr)
+}
+
+// Token bucket per client IP. Like RRL, every slip-th rate-limited query gets
+// a truncated response instead of being dropped, so that legitimate clients
+// can still retry over TCP, while spoofed sources can't be used for amplification.
+
+func (rateLimiter *RateLimiter) check(clientAddr net.Addr) (allowed bool, slip bool) {
+	ip := ClientIP(clientAddr)
+	if ip == nil {
+		return true, false
+	}
+	key := ip.String()
+	now := time.Now()
+	rateLimiter.Lock()
+	defer rateLimiter.Unlock()
+	var bucket *RateLimitBucket
+	if cached, ok := rateLimiter.buckets.Get(key); ok {
+		bucket = cached.(*RateLimitBucket)
+		bucket.tokens += now.Sub(bucket.updated).Seconds() * rateLimiter.qps
+		if bucket.tokens > rateLimiter.burst {
+			bucket.tokens = rateLimiter.burst
+		}
+	} else {
+		bucket = &RateLimitBucket{tokens: rateLimiter.burst}
+		rateLimiter.buckets.Add(key, bucket)
+	}
+	bucket.updated = now
+	if bucket.tokens >= 1.0 {
+		bucket.tokens--
+		return true, false
+	}
+	bucket.limited++
+	dlog.Debugf("Rate limiting [%s] (%d queries limited so far)", key, bucket.limited)
+	return false, rateLimiter.slip > 0 && bucket.limited%rateLimiter.slip == 0
+}
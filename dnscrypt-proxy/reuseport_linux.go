@@ -0,0 +1,20 @@
+package main
+
+import (
+	"syscall"
+)
+
+const ReusePortSupported = true
+
+// With SO_REUSEPORT, the kernel distributes incoming packets and connections
+// among all the sockets bound to the same address
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
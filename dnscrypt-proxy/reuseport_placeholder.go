@@ -0,0 +1,11 @@
+// +build !linux
+
+package main
+
+import "syscall"
+
+const ReusePortSupported = false
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+type RulesFile struct {
+	sync.RWMutex
+	kind       string
+	fileName   string
+	load       func(matcher *PatternMatcher) error
+	matcher    *PatternMatcher
+	reloadLock sync.Mutex
+	lines      map[string]bool
+	modTime    time.Time
+}
+
+var rulesFiles struct {
+	sync.Mutex
+	files []*RulesFile
+}
+
+func readRulesLines(fileName string) (map[string]bool, error) {
+	lines := make(map[string]bool)
+	err := parseRulesFile(fileName, func(line string, _ string, _ int) error {
+		lines[line] = true
+		return nil
+	})
+	return lines, err
+}
+
+// load fills a new matcher from the file every time it changes
+
+func NewRulesFile(kind string, fileName string, load func(matcher *PatternMatcher) error) (*RulesFile, error) {
+	rulesFile := RulesFile{kind: kind, fileName: fileName, load: load}
+	if fileInfo, err := os.Stat(fileName); err == nil {
+		rulesFile.modTime = fileInfo.ModTime()
+	}
+	matcher := NewPatternMatcher()
+	if err := load(matcher); err != nil {
+		return nil, err
+	}
+	lines, err := readRulesLines(fileName)
+	if err != nil {
+		return nil, err
+	}
+	rulesFile.matcher, rulesFile.lines = matcher, lines
+	matcher.logLoaded(kind, fileName)
+	rulesFiles.Lock()
+	rulesFiles.files = append(rulesFiles.files, &rulesFile)
+	rulesFiles.Unlock()
+	return &rulesFile, nil
+}
+
+func (rulesFile *RulesFile) Match(name string) *PatternRule {
+	rulesFile.RLock()
+	matcher := rulesFile.matcher
+	rulesFile.RUnlock()
+	return matcher.Match(name)
+}
+
+// A file that cannot be parsed any more is reported, and its previous rules are
+// kept until it is fixed. Unless force is set, files that haven't been modified are not reloaded.
+
+func (rulesFile *RulesFile) reload(force bool) {
+	rulesFile.reloadLock.Lock()
+	defer rulesFile.reloadLock.Unlock()
+	fileInfo, err := os.Stat(rulesFile.fileName)
+	if err != nil || (!force && fileInfo.ModTime().Equal(rulesFile.modTime)) {
+		return
+	}
+	matcher := NewPatternMatcher()
+	if err := rulesFile.load(matcher); err != nil {
+		pluginsLog.Errorf("Unable to reload the %s rules: %s", rulesFile.kind, err)
+		return
+	}
+	lines, err := readRulesLines(rulesFile.fileName)
+	if err != nil {
+		pluginsLog.Errorf("Unable to reload the %s rules: %s", rulesFile.kind, err)
+		return
+	}
+	added, removed := 0, 0
+	for line := range lines {
+		if !rulesFile.lines[line] {
+			added++
+		}
+	}
+	for line := range rulesFile.lines {
+		if !lines[line] {
+			removed++
+		}
+	}
+	rulesFile.Lock()
+	rulesFile.matcher, rulesFile.lines = matcher, lines
+	rulesFile.Unlock()
+	rulesFile.modTime = fileInfo.ModTime()
+	pluginsLog.Noticef("%d %s rules reloaded from [%s] (%d added, %d removed)", matcher.count, rulesFile.kind, rulesFile.fileName, added, removed)
+}
+
+func reloadRulesFiles(force bool) {
+	rulesFiles.Lock()
+	files := rulesFiles.files
+	rulesFiles.Unlock()
+	for _, rulesFile := range files {
+		rulesFile.reload(force)
+	}
+}
+
+func startRulesReloader(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			reloadRulesFiles(false)
+		}
+	}()
+}
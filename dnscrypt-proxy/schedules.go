@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type TimeRangeConfig struct {
+	After  string
+	Before string
+}
+
+type ScheduleConfig struct {
+	Sun, Mon, Tue, Wed, Thu, Fri, Sat []TimeRangeConfig
+}
+
+type TimeRange struct {
+	after  int
+	before int
+}
+
+type WeeklyRanges struct {
+	ranges [7][]TimeRange
+}
+
+func parseTimeOfDay(str string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(str), ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("Invalid time of day: [%s]", str)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("Invalid time of day: [%s]", str)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("Invalid time of day: [%s]", str)
+	}
+	return hours*60 + minutes, nil
+}
+
+func ParseWeeklyRanges(scheduleConfig ScheduleConfig) (*WeeklyRanges, error) {
+	var weeklyRanges WeeklyRanges
+	days := [7][]TimeRangeConfig{
+		scheduleConfig.Sun, scheduleConfig.Mon, scheduleConfig.Tue, scheduleConfig.Wed,
+		scheduleConfig.Thu, scheduleConfig.Fri, scheduleConfig.Sat,
+	}
+	for day, timeRangesConfig := range days {
+		for _, timeRangeConfig := range timeRangesConfig {
+			after, err := parseTimeOfDay(timeRangeConfig.After)
+			if err != nil {
+				return nil, err
+			}
+			before, err := parseTimeOfDay(timeRangeConfig.Before)
+			if err != nil {
+				return nil, err
+			}
+			if after == before {
+				return nil, fmt.Errorf("Empty time range: [%s-%s]", timeRangeConfig.After, timeRangeConfig.Before)
+			}
+			weeklyRanges.ranges[day] = append(weeklyRanges.ranges[day], TimeRange{after: after, before: before})
+		}
+	}
+	return &weeklyRanges, nil
+}
+
+// Ranges ending before they start, such as 21:00-07:00, span midnight
+
+func (weeklyRanges *WeeklyRanges) Match() bool {
+	if weeklyRanges == nil {
+		return true
+	}
+	now := time.Now().Local()
+	minute := now.Hour()*60 + now.Minute()
+	for _, timeRange := range weeklyRanges.ranges[now.Weekday()] {
+		if timeRange.after < timeRange.before {
+			if minute >= timeRange.after && minute < timeRange.before {
+				return true
+			}
+		} else if minute >= timeRange.after || minute < timeRange.before {
+			return true
+		}
+	}
+	return false
+}
+
+// Splits a rule such as "*.youtube.com @time-to-sleep" into the pattern and its schedule
+
+func parseScheduledRule(line string, schedules map[string]*WeeklyRanges) (string, *WeeklyRanges, error) {
+	parts := strings.Fields(line)
+	if len(parts) == 1 {
+		return parts[0], nil, nil
+	}
+	if len(parts) != 2 || !strings.HasPrefix(parts[1], "@") {
+		return "", nil, fmt.Errorf("Syntax error: [%s]", line)
+	}
+	schedule, err := lookupSchedule(parts[1][1:], schedules)
+	if err != nil {
+		return "", nil, err
+	}
+	return parts[0], schedule, nil
+}
+
+func lookupSchedule(scheduleName string, schedules map[string]*WeeklyRanges) (*WeeklyRanges, error) {
+	schedule, ok := schedules[scheduleName]
+	if !ok {
+		return nil, fmt.Errorf("Schedule [%s] not defined", scheduleName)
+	}
+	return schedule, nil
+}
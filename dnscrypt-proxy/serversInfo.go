@@ -1,28 +1,34 @@
 package main
 
 import (
-	"encoding/hex"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"math/rand"
 	"net"
+	"net/url"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/VividCortex/ewma"
 	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
 	"golang.org/x/crypto/ed25519"
 )
 
 const (
-	RTTEwmaDecay = 10.0
-	DefaultPort  = 443
+	RTTEwmaDecay            = 10.0
+	DefaultPort             = 443
+	ServerFailuresThreshold = 3
 )
 
-type ServerStamp struct {
-	serverAddrStr string
-	serverPkStr   string
-	providerName  string
+type ServerOptions struct {
+	forcedProto string
+	dohGET      bool
+	dohHeaders  map[string]string
+	rootCAs     *x509.CertPool
+	ecs         *dns.EDNS0_SUBNET
 }
 
 type RegisteredServer struct {
@@ -30,28 +36,30 @@ type RegisteredServer struct {
 	stamp ServerStamp
 }
 
-func NewServerStampFromLegacy(serverAddrStr string, serverPkStr string, providerName string) (ServerStamp, error) {
-	if net.ParseIP(serverAddrStr) != nil {
-		serverAddrStr = fmt.Sprintf("%s:%d", serverAddrStr, DefaultPort)
-	}
-	return ServerStamp{
-		serverAddrStr: serverAddrStr,
-		serverPkStr:   serverPkStr,
-		providerName:  providerName,
-	}, nil
-}
-
 type ServerInfo struct {
 	sync.RWMutex
 	MagicQuery         [8]byte
 	ServerPk           [32]byte
+	ClientPk           [32]byte
 	SharedKey          [32]byte
 	CryptoConstruction CryptoConstruction
 	Name               string
 	Timeout            time.Duration
+	URL                *url.URL
+	HostName           string
+	dohGET             bool
+	dohHeaders         map[string]string
 	UDPAddr            *net.UDPAddr
 	TCPAddr            *net.TCPAddr
+	Proto              StampProtoType
+	forcedProto        string
+	tcpPool            *ConnPool
+	dotClient          *DoTClient
+	odohTargetConfig   *ODoHTargetConfig
+	odohRelays         []*url.URL
 	lastActionTS       time.Time
+	failing            bool
+	failures           int
 	rtt                ewma.MovingAverage
 }
 
@@ -71,6 +79,12 @@ func (serversInfo *ServersInfo) registerServer(proxy *Proxy, name string, stamp
 	newServer.rtt = ewma.NewMovingAverage(RTTEwmaDecay)
 	for i, oldServer := range serversInfo.inner {
 		if oldServer.Name == newServer.Name {
+			if oldServer.tcpPool != nil {
+				oldServer.tcpPool.Close()
+			}
+			if oldServer.dotClient != nil {
+				oldServer.dotClient.Close()
+			}
 			serversInfo.inner[i] = newServer
 			return nil
 		}
@@ -86,7 +100,8 @@ func (serversInfo *ServersInfo) refresh(proxy *Proxy) {
 	registeredServers := serversInfo.registeredServers
 	serversInfo.RUnlock()
 	for _, registeredServer := range registeredServers {
-		serversInfo.registerServer(proxy, registeredServer.name, registeredServer.stamp)
+		err := serversInfo.registerServer(proxy, registeredServer.name, registeredServer.stamp)
+		proxy.webhook.certRefreshed(registeredServer.name, err)
 	}
 }
 
@@ -109,12 +124,67 @@ func (serversInfo *ServersInfo) getOne() *ServerInfo {
 	return serverInfo
 }
 
+func (serversInfo *ServersInfo) getOneAmong(names []string) *ServerInfo {
+	if len(names) == 0 {
+		return serversInfo.getOne()
+	}
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	var candidates []*ServerInfo
+	for i := range serversInfo.inner {
+		if includesName(names, serversInfo.inner[i].Name) {
+			candidates = append(candidates, &serversInfo.inner[i])
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	serverInfo := candidates[rand.Intn(len(candidates))]
+	if other := candidates[rand.Intn(len(candidates))]; other.rtt.Value() < serverInfo.rtt.Value() {
+		serverInfo = other
+	}
+	return serverInfo
+}
+
+func (serversInfo *ServersInfo) allFailing() bool {
+	serversInfo.RLock()
+	defer serversInfo.RUnlock()
+	for i := range serversInfo.inner {
+		serverInfo := &serversInfo.inner[i]
+		serverInfo.RLock()
+		failing := serverInfo.failing
+		serverInfo.RUnlock()
+		if !failing {
+			return false
+		}
+	}
+	return true
+}
+
 func (serversInfo *ServersInfo) fetchServerInfo(proxy *Proxy, name string, stamp ServerStamp) (ServerInfo, error) {
-	serverPk, err := hex.DecodeString(strings.Replace(stamp.serverPkStr, ":", "", -1))
-	if err != nil || len(serverPk) != ed25519.PublicKeySize {
-		dlog.Fatalf("Unsupported public key: [%v]", serverPk)
+	switch stamp.proto {
+	case StampProtoTypeDNSCrypt:
+		return serversInfo.fetchDNSCryptServerInfo(proxy, name, stamp)
+	case StampProtoTypeDoH:
+		return serversInfo.fetchDoHServerInfo(proxy, name, stamp)
+	case StampProtoTypeTLS:
+		return serversInfo.fetchDoTServerInfo(proxy, name, stamp)
+	case StampProtoTypeODoHTarget:
+		return serversInfo.fetchODoHServerInfo(proxy, name, stamp)
 	}
-	certInfo, err := FetchCurrentCert(proxy, proxy.mainProto, serverPk, stamp.serverAddrStr, stamp.providerName)
+	return ServerInfo{}, errors.New("Unsupported protocol")
+}
+
+func (serversInfo *ServersInfo) fetchDNSCryptServerInfo(proxy *Proxy, name string, stamp ServerStamp) (ServerInfo, error) {
+	if len(stamp.serverPk) != ed25519.PublicKeySize {
+		return ServerInfo{}, fmt.Errorf("Unsupported public key for [%s]: [%x]", name, stamp.serverPk)
+	}
+	forcedProto := proxy.serversOptions[name].forcedProto
+	proto := proxy.mainProto
+	if len(forcedProto) > 0 {
+		proto = forcedProto
+	}
+	certInfo, err := FetchCurrentCert(proxy, proto, stamp.serverPk, stamp.serverAddrStr, stamp.providerName)
 	if err != nil {
 		return ServerInfo{}, err
 	}
@@ -126,23 +196,161 @@ func (serversInfo *ServersInfo) fetchServerInfo(proxy *Proxy, name string, stamp
 	if err != nil {
 		return ServerInfo{}, err
 	}
+	clientPk, sharedKey := proxy.proxyPublicKey, certInfo.SharedKey
+	if proxy.ephemeralKeys && proxy.ephemeralKeysPerServer {
+		key, err := NewEphemeralKey(certInfo.CryptoConstruction, &certInfo.ServerPk)
+		if err != nil {
+			return ServerInfo{}, err
+		}
+		clientPk, sharedKey = key.publicKey, key.sharedKey
+	}
 	serverInfo := ServerInfo{
 		MagicQuery:         certInfo.MagicQuery,
 		ServerPk:           certInfo.ServerPk,
-		SharedKey:          certInfo.SharedKey,
+		ClientPk:           clientPk,
+		SharedKey:          sharedKey,
 		CryptoConstruction: certInfo.CryptoConstruction,
 		Name:               name,
 		Timeout:            proxy.timeout,
 		UDPAddr:            remoteUDPAddr,
 		TCPAddr:            remoteTCPAddr,
+		Proto:              StampProtoTypeDNSCrypt,
+		forcedProto:        forcedProto,
 	}
+	serverInfo.tcpPool = proxy.xTransport.NewConnPool(func() (net.Conn, error) {
+		return proxy.xTransport.Dial("tcp", remoteTCPAddr.String())
+	})
 	return serverInfo, nil
 }
 
+func (serversInfo *ServersInfo) fetchDoHServerInfo(proxy *Proxy, name string, stamp ServerStamp) (ServerInfo, error) {
+	tlsServerName := stamp.providerName
+	if host, _, err := net.SplitHostPort(tlsServerName); err == nil {
+		tlsServerName = host
+	}
+	proxy.xTransport.setTLSSettings(tlsServerName, stamp.hashes, proxy.serversOptions[name].rootCAs)
+	if len(stamp.serverAddrStr) > 0 {
+		ipOnly := stamp.serverAddrStr
+		if host, _, err := net.SplitHostPort(stamp.serverAddrStr); err == nil {
+			ipOnly = host
+		}
+		if net.ParseIP(strings.Trim(ipOnly, "[]")) == nil {
+			return ServerInfo{}, fmt.Errorf("Invalid bootstrap address for [%s]: [%s]", name, stamp.serverAddrStr)
+		}
+		hostName := stamp.providerName
+		if host, _, err := net.SplitHostPort(hostName); err == nil {
+			hostName = host
+		}
+		proxy.xTransport.setCachedIP(hostName, strings.Trim(ipOnly, "[]"))
+	}
+	serverURL := &url.URL{
+		Scheme: "https",
+		Host:   stamp.providerName,
+		Path:   stamp.path,
+	}
+	query := new(dns.Msg)
+	query.SetQuestion(".", dns.TypeNS)
+	body, err := query.Pack()
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	SetTransactionID(body, 0)
+	options := proxy.serversOptions[name]
+	_, rtt, err := proxy.xTransport.DoHQuery(options.dohGET, serverURL, options.dohHeaders, body, proxy.timeout)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	dlog.Noticef("[%s] OK (DoH) - rtt: %dms", name, rtt.Nanoseconds()/1000000)
+	serverInfo := ServerInfo{
+		Proto:      StampProtoTypeDoH,
+		Name:       name,
+		Timeout:    proxy.timeout,
+		URL:        serverURL,
+		HostName:   stamp.providerName,
+		dohGET:     options.dohGET,
+		dohHeaders: options.dohHeaders,
+	}
+	return serverInfo, nil
+}
+
+func (serversInfo *ServersInfo) fetchDoTServerInfo(proxy *Proxy, name string, stamp ServerStamp) (ServerInfo, error) {
+	proxy.xTransport.setTLSSettings(stamp.providerName, stamp.hashes, proxy.serversOptions[name].rootCAs)
+	dotClient := NewDoTClient(proxy.xTransport, stamp.serverAddrStr, stamp.providerName, proxy.timeout)
+	query := new(dns.Msg)
+	query.SetQuestion(".", dns.TypeNS)
+	body, err := query.Pack()
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	start := time.Now()
+	if _, err := dotClient.Exchange(body); err != nil {
+		dotClient.Close()
+		return ServerInfo{}, err
+	}
+	rtt := time.Since(start)
+	dlog.Noticef("[%s] OK (DoT) - rtt: %dms", name, rtt.Nanoseconds()/1000000)
+	serverInfo := ServerInfo{
+		Proto:     StampProtoTypeTLS,
+		Name:      name,
+		Timeout:   proxy.timeout,
+		HostName:  stamp.providerName,
+		dotClient: dotClient,
+	}
+	return serverInfo, nil
+}
+
+func (serversInfo *ServersInfo) fetchODoHServerInfo(proxy *Proxy, name string, stamp ServerStamp) (ServerInfo, error) {
+	targetURL := &url.URL{
+		Scheme: "https",
+		Host:   stamp.providerName,
+		Path:   stamp.path,
+	}
+	targetConfig, err := proxy.xTransport.FetchODoHTargetConfig(targetURL)
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	serverInfo := ServerInfo{
+		Proto:            StampProtoTypeODoHTarget,
+		Name:             name,
+		Timeout:          proxy.timeout,
+		URL:              targetURL,
+		HostName:         stamp.providerName,
+		odohTargetConfig: &targetConfig,
+		odohRelays:       proxy.odohRoutes[name],
+	}
+	if len(serverInfo.odohRelays) == 0 {
+		dlog.Warnf("[%s] No ODoH relay configured - queries will be sent directly to the target", name)
+	}
+	query := new(dns.Msg)
+	query.SetQuestion(".", dns.TypeNS)
+	body, err := query.Pack()
+	if err != nil {
+		return ServerInfo{}, err
+	}
+	start := time.Now()
+	if _, err := proxy.exchangeWithODoHServer(&serverInfo, body); err != nil {
+		return ServerInfo{}, err
+	}
+	rtt := time.Since(start)
+	dlog.Noticef("[%s] OK (ODoH) - rtt: %dms", name, rtt.Nanoseconds()/1000000)
+	return serverInfo, nil
+}
+
+// A single lost packet doesn't make a server unusable: it is only considered
+// failing after a number of consecutive failures
+
 func (serverInfo *ServerInfo) noticeFailure(proxy *Proxy) {
 	serverInfo.Lock()
 	serverInfo.rtt.Set(float64(proxy.timeout.Nanoseconds()))
+	wasFailing := serverInfo.failing
+	serverInfo.failures++
+	serverInfo.failing = serverInfo.failures >= ServerFailuresThreshold
+	failing, failures := serverInfo.failing, serverInfo.failures
 	serverInfo.Unlock()
+	if failing && !wasFailing {
+		proxy.hooks.serverDown(serverInfo.Name)
+		proxy.webhook.serverDown(proxy, serverInfo.Name, failures)
+	}
 }
 
 func (serverInfo *ServerInfo) noticeBegin(proxy *Proxy) {
@@ -158,5 +366,11 @@ func (serverInfo *ServerInfo) noticeSuccess(proxy *Proxy) {
 	if elapsed > 0 {
 		serverInfo.rtt.Add(float64(elapsed))
 	}
+	wasFailing := serverInfo.failing
+	serverInfo.failing = false
+	serverInfo.failures = 0
 	serverInfo.Unlock()
+	if wasFailing {
+		proxy.webhook.serverUp(serverInfo.Name)
+	}
 }
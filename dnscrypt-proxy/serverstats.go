@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	ServerStatsSlotDuration = time.Minute
+	ServerStatsSlots        = 10
+)
+
+var serverStatsBuckets = [...]time.Duration{
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond, 100 * time.Millisecond,
+	250 * time.Millisecond, 500 * time.Millisecond, time.Second, 2500 * time.Millisecond,
+}
+
+type ServerStatsSlot struct {
+	start     time.Time
+	buckets   [len(serverStatsBuckets) + 1]uint64
+	successes uint64
+	timeouts  uint64
+	errors    uint64
+}
+
+// Statistics are kept for the last ServerStatsSlots minutes, one slot per minute
+
+type ServerStats struct {
+	sync.Mutex
+	slots [ServerStatsSlots]ServerStatsSlot
+}
+
+type ServerStatsSummary struct {
+	Queries   uint64            `json:"queries"`
+	Successes uint64            `json:"successes"`
+	Timeouts  uint64            `json:"timeouts"`
+	Errors    uint64            `json:"errors"`
+	ErrorRate float64           `json:"error_rate"`
+	P50       float64           `json:"p50_ms"`
+	P90       float64           `json:"p90_ms"`
+	P99       float64           `json:"p99_ms"`
+	Histogram map[string]uint64 `json:"histogram_ms"`
+}
+
+type ServerStatsRegistry struct {
+	sync.Mutex
+	servers map[string]*ServerStats
+}
+
+func (registry *ServerStatsRegistry) forServer(name string) *ServerStats {
+	registry.Lock()
+	defer registry.Unlock()
+	if registry.servers == nil {
+		registry.servers = make(map[string]*ServerStats)
+	}
+	stats, ok := registry.servers[name]
+	if !ok {
+		stats = &ServerStats{}
+		registry.servers[name] = stats
+	}
+	return stats
+}
+
+func (registry *ServerStatsRegistry) record(name string, latency time.Duration, err error) {
+	stats := registry.forServer(name)
+	now := time.Now()
+	start := now.Truncate(ServerStatsSlotDuration)
+	stats.Lock()
+	slot := &stats.slots[(now.Unix()/int64(ServerStatsSlotDuration/time.Second))%ServerStatsSlots]
+	if !slot.start.Equal(start) {
+		*slot = ServerStatsSlot{start: start}
+	}
+	if err == nil {
+		slot.successes++
+		bucket := sort.Search(len(serverStatsBuckets), func(i int) bool { return latency <= serverStatsBuckets[i] })
+		slot.buckets[bucket]++
+	} else if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		slot.timeouts++
+	} else {
+		slot.errors++
+	}
+	stats.Unlock()
+}
+
+// Quantiles are the upper bound of the bucket they fall into, -1 if they are
+// above the largest bucket
+
+func (stats *ServerStats) summary() ServerStatsSummary {
+	var buckets [len(serverStatsBuckets) + 1]uint64
+	summary := ServerStatsSummary{Histogram: make(map[string]uint64)}
+	oldest := time.Now().Add(-ServerStatsSlotDuration * ServerStatsSlots)
+	stats.Lock()
+	for _, slot := range stats.slots {
+		if slot.start.Before(oldest) {
+			continue
+		}
+		for i, count := range slot.buckets {
+			buckets[i] += count
+		}
+		summary.Successes += slot.successes
+		summary.Timeouts += slot.timeouts
+		summary.Errors += slot.errors
+	}
+	stats.Unlock()
+	summary.Queries = summary.Successes + summary.Timeouts + summary.Errors
+	if summary.Queries > 0 {
+		summary.ErrorRate = float64(summary.Timeouts+summary.Errors) / float64(summary.Queries)
+	}
+	quantiles := []*float64{&summary.P50, &summary.P90, &summary.P99}
+	fractions := []float64{0.5, 0.9, 0.99}
+	for i, fraction := range fractions {
+		*quantiles[i] = -1
+		cumulated := uint64(0)
+		for j, count := range buckets {
+			cumulated += count
+			if j < len(serverStatsBuckets) && summary.Successes > 0 && float64(cumulated) >= fraction*float64(summary.Successes) {
+				*quantiles[i] = float64(serverStatsBuckets[j] / time.Millisecond)
+				break
+			}
+		}
+	}
+	for i, count := range buckets {
+		le := "+Inf"
+		if i < len(serverStatsBuckets) {
+			le = fmt.Sprint(int64(serverStatsBuckets[i] / time.Millisecond))
+		}
+		summary.Histogram[le] = count
+	}
+	return summary
+}
+
+func (summary ServerStatsSummary) String() string {
+	quantile := func(value float64) string {
+		if value < 0 {
+			return fmt.Sprintf(">%dms", int64(serverStatsBuckets[len(serverStatsBuckets)-1]/time.Millisecond))
+		}
+		return fmt.Sprintf("<=%dms", int64(value))
+	}
+	return fmt.Sprintf("queries=%d timeouts=%d errors=%d error_rate=%.1f%% p50%s p90%s p99%s",
+		summary.Queries, summary.Timeouts, summary.Errors, summary.ErrorRate*100,
+		quantile(summary.P50), quantile(summary.P90), quantile(summary.P99))
+}
+
+func (registry *ServerStatsRegistry) summaries() map[string]ServerStatsSummary {
+	registry.Lock()
+	servers := make(map[string]*ServerStats, len(registry.servers))
+	for name, stats := range registry.servers {
+		servers[name] = stats
+	}
+	registry.Unlock()
+	summaries := make(map[string]ServerStatsSummary, len(servers))
+	for name, stats := range servers {
+		summaries[name] = stats.summary()
+	}
+	return summaries
+}
+
+func (registry *ServerStatsRegistry) startSummaries(interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			summaries := registry.summaries()
+			names := make([]string, 0, len(summaries))
+			for name := range summaries {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				if summary := summaries[name]; summary.Queries > 0 {
+					dlog.Noticef("[%s] last %d minutes: %s", name, ServerStatsSlots, summary)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	SharedCacheTimeout   = 250 * time.Millisecond
+	SharedCacheKeyPrefix = "dnscrypt-proxy:"
+)
+
+// A cache shared by multiple proxies, queried when an entry is not in the
+// local cache. Entries are stored as a 64-bit expiration timestamp followed
+// by the packed response.
+
+type SharedCache interface {
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte, ttl time.Duration) error
+}
+
+func NewSharedCache(urlStr string) (SharedCache, error) {
+	sharedCacheURL, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(sharedCacheURL.Scheme) {
+	case "redis":
+		return NewRedisSharedCache(sharedCacheURL)
+	case "memcached":
+		return NewMemcachedSharedCache(sharedCacheURL)
+	}
+	return nil, fmt.Errorf("Unsupported shared cache: [%s]", urlStr)
+}
+
+func sharedCacheKey(cacheKey [32]byte) string {
+	return SharedCacheKeyPrefix + hex.EncodeToString(cacheKey[:])
+}
+
+func (cachedResponses *CachedResponses) lookupShared(pluginsState *PluginsState, msg *dns.Msg) (CachedResponse, bool) {
+	cacheKey, err := computeCacheKey(pluginsState, msg, nil)
+	if err != nil {
+		return CachedResponse{}, false
+	}
+	value, err := pluginsState.sharedCache.Get(sharedCacheKey(cacheKey))
+	if err != nil {
+		cacheLog.Debugf("Shared cache: [%s]", err)
+		return CachedResponse{}, false
+	}
+	if len(value) < 8 {
+		return CachedResponse{}, false
+	}
+	now := time.Now()
+	expiration := time.Unix(int64(binary.BigEndian.Uint64(value[0:8])), 0)
+	if !now.Before(expiration) {
+		return CachedResponse{}, false
+	}
+	cached := CachedResponse{expiration: expiration, stats: &CachedResponseStats{ttl: expiration.Sub(now)}, server: "shared cache"}
+	if err := cached.msg.Unpack(value[8:]); err != nil {
+		return CachedResponse{}, false
+	}
+	if shard := cachedResponses.shard(cacheKey); shard != nil {
+		shard.Lock()
+		shard.cache.Add(cacheKey, cached)
+		shard.Unlock()
+	}
+	return cached, true
+}
+
+func storeShared(sharedCache SharedCache, cacheKey [32]byte, msg *dns.Msg, expiration time.Time) {
+	packet, err := msg.Pack()
+	if err != nil {
+		return
+	}
+	value := make([]byte, 8, 8+len(packet))
+	binary.BigEndian.PutUint64(value, uint64(expiration.Unix()))
+	value = append(value, packet...)
+	go func() {
+		if err := sharedCache.Set(sharedCacheKey(cacheKey), value, time.Until(expiration)); err != nil {
+			cacheLog.Debugf("Shared cache: [%s]", err)
+		}
+	}()
+}
+
+// -------- Redis --------
+
+type RedisSharedCache struct {
+	pool *ConnPool
+}
+
+func NewRedisSharedCache(redisURL *url.URL) (*RedisSharedCache, error) {
+	addrStr := redisURL.Host
+	if len(redisURL.Port()) == 0 {
+		addrStr = net.JoinHostPort(redisURL.Hostname(), "6379")
+	}
+	password, _ := redisURL.User.Password()
+	db := strings.Trim(redisURL.Path, "/")
+	if len(db) > 0 {
+		if _, err := strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("Invalid Redis database: [%s]", db)
+		}
+	}
+	dial := func() (net.Conn, error) {
+		conn, err := net.DialTimeout("tcp", addrStr, SharedCacheTimeout)
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(SharedCacheTimeout))
+		reader := bufio.NewReader(conn)
+		if len(password) > 0 {
+			if _, err := redisCommand(conn, reader, "AUTH", []byte(password)); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		if len(db) > 0 {
+			if _, err := redisCommand(conn, reader, "SELECT", []byte(db)); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+	pool := NewConnPool(dial, DefaultMaxIdleConns, 0, DefaultKeepAlive, SharedCacheTimeout)
+	return &RedisSharedCache{pool: pool}, nil
+}
+
+func redisCommand(conn net.Conn, reader *bufio.Reader, args ...interface{}) ([]byte, error) {
+	request := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		var argBin []byte
+		switch arg := arg.(type) {
+		case string:
+			argBin = []byte(arg)
+		case []byte:
+			argBin = arg
+		}
+		request = append(request, fmt.Sprintf("$%d\r\n", len(argBin))...)
+		request = append(request, argBin...)
+		request = append(request, "\r\n"...)
+	}
+	if _, err := conn.Write(request); err != nil {
+		return nil, err
+	}
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("Empty Redis reply")
+	}
+	switch line[0] {
+	case '+', ':':
+		return []byte(line[1:]), nil
+	case '-':
+		return nil, fmt.Errorf("Redis: [%s]", line[1:])
+	case '$':
+		length, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if length < 0 {
+			return nil, nil
+		}
+		if length > MaxDNSPacketSize+8 {
+			return nil, errors.New("Redis value too large")
+		}
+		value := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, value); err != nil {
+			return nil, err
+		}
+		return value[:length], nil
+	}
+	return nil, fmt.Errorf("Unexpected Redis reply: [%s]", line)
+}
+
+func (cache *RedisSharedCache) Get(key string) ([]byte, error) {
+	var value []byte
+	err := cache.pool.Do(func(conn net.Conn) error {
+		var err error
+		conn.SetDeadline(time.Now().Add(SharedCacheTimeout))
+		value, err = redisCommand(conn, bufio.NewReader(conn), "GET", key)
+		return err
+	})
+	return value, err
+}
+
+func (cache *RedisSharedCache) Set(key string, value []byte, ttl time.Duration) error {
+	ttlMs := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	return cache.pool.Do(func(conn net.Conn) error {
+		conn.SetDeadline(time.Now().Add(SharedCacheTimeout))
+		_, err := redisCommand(conn, bufio.NewReader(conn), "SET", key, value, "PX", ttlMs)
+		return err
+	})
+}
+
+// -------- memcached --------
+
+type MemcachedSharedCache struct {
+	pool *ConnPool
+}
+
+func NewMemcachedSharedCache(memcachedURL *url.URL) (*MemcachedSharedCache, error) {
+	addrStr := memcachedURL.Host
+	if len(memcachedURL.Port()) == 0 {
+		addrStr = net.JoinHostPort(memcachedURL.Hostname(), "11211")
+	}
+	dial := func() (net.Conn, error) {
+		return net.DialTimeout("tcp", addrStr, SharedCacheTimeout)
+	}
+	pool := NewConnPool(dial, DefaultMaxIdleConns, 0, DefaultKeepAlive, SharedCacheTimeout)
+	return &MemcachedSharedCache{pool: pool}, nil
+}
+
+func (cache *MemcachedSharedCache) Get(key string) ([]byte, error) {
+	var value []byte
+	err := cache.pool.Do(func(conn net.Conn) error {
+		conn.SetDeadline(time.Now().Add(SharedCacheTimeout))
+		if _, err := conn.Write([]byte("get " + key + "\r\n")); err != nil {
+			return err
+		}
+		reader := bufio.NewReader(conn)
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 1 && fields[0] == "END" {
+			return nil
+		}
+		if len(fields) < 4 || fields[0] != "VALUE" {
+			return fmt.Errorf("Unexpected memcached reply: [%s]", strings.TrimSpace(line))
+		}
+		length, err := strconv.Atoi(fields[3])
+		if err != nil || length < 0 || length > MaxDNSPacketSize+8 {
+			return errors.New("Invalid memcached value length")
+		}
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return err
+		}
+		if line, err = reader.ReadString('\n'); err != nil {
+			return err
+		}
+		if strings.TrimSpace(line) != "END" {
+			return errors.New("Unterminated memcached reply")
+		}
+		value = data[:length]
+		return nil
+	})
+	return value, err
+}
+
+func (cache *MemcachedSharedCache) Set(key string, value []byte, ttl time.Duration) error {
+	exptime := int64(ttl / time.Second)
+	if exptime < 1 {
+		return nil
+	}
+	return cache.pool.Do(func(conn net.Conn) error {
+		conn.SetDeadline(time.Now().Add(SharedCacheTimeout))
+		request := []byte(fmt.Sprintf("set %s 0 %d %d\r\n", key, exptime, len(value)))
+		request = append(request, value...)
+		request = append(request, "\r\n"...)
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(line) != "STORED" {
+			return fmt.Errorf("Unexpected memcached reply: [%s]", strings.TrimSpace(line))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	socks5Version        = 0x05
+	socks5MethodNoAuth   = 0x00
+	socks5MethodUserPass = 0x02
+	socks5CmdConnect     = 0x01
+	socks5AddrIPv4       = 0x01
+	socks5AddrDomain     = 0x03
+	socks5AddrIPv6       = 0x04
+)
+
+var socks5Errors = []string{
+	"",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+// Connects to addrStr through a SOCKS5 proxy (RFC 1928, RFC 1929 authentication).
+// Host names are sent as-is, so that they are resolved by the proxy.
+
+func dialSOCKS5(ctx context.Context, dialer *net.Dialer, proxyURL *url.URL, addrStr string, timeout time.Duration) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addrStr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port <= 0 || port > 0xffff {
+		return nil, fmt.Errorf("Invalid port: [%s]", portStr)
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if err := socks5Handshake(conn, proxyURL, host, port); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy [%s]: %s", proxyURL.Host, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socks5Handshake(conn net.Conn, proxyURL *url.URL, host string, port int) error {
+	methods := []byte{socks5MethodNoAuth}
+	if proxyURL.User != nil {
+		methods = append(methods, socks5MethodUserPass)
+	}
+	request := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return errors.New("unexpected protocol version")
+	}
+	switch reply[1] {
+	case socks5MethodNoAuth:
+	case socks5MethodUserPass:
+		if proxyURL.User == nil {
+			return errors.New("authentication required")
+		}
+		username := proxyURL.User.Username()
+		password, _ := proxyURL.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("credentials are too long")
+		}
+		auth := []byte{0x01, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	default:
+		return errors.New("no acceptable authentication method")
+	}
+	request = []byte{socks5Version, socks5CmdConnect, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name is too long")
+		}
+		request = append(request, socks5AddrDomain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socks5AddrIPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socks5AddrIPv6)
+		request = append(request, ip.To16()...)
+	}
+	request = append(request, byte(port>>8), byte(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		if int(header[1]) < len(socks5Errors) {
+			return errors.New(socks5Errors[header[1]])
+		}
+		return fmt.Errorf("unknown error %d", header[1])
+	}
+	var boundAddrLen int
+	switch header[3] {
+	case socks5AddrIPv4:
+		boundAddrLen = net.IPv4len
+	case socks5AddrIPv6:
+		boundAddrLen = net.IPv6len
+	case socks5AddrDomain:
+		var domainLen [1]byte
+		if _, err := io.ReadFull(conn, domainLen[:]); err != nil {
+			return err
+		}
+		boundAddrLen = int(domainLen[0])
+	default:
+		return errors.New("unexpected address type")
+	}
+	bound := make([]byte, boundAddrLen+2)
+	if _, err := io.ReadFull(conn, bound); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,5 @@
+// +build !mips,!mipsle,!mips64,!mips64le
+
+package main
+
+const soReusePort = 0xf
@@ -4,14 +4,13 @@ import (
 	"encoding/csv"
 	"fmt"
 	"io/ioutil"
-	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"time"
 
 	"github.com/dchest/safefile"
 
-	"github.com/jedisct1/dlog"
 	"github.com/jedisct1/go-minisign"
 )
 
@@ -19,20 +18,26 @@ type SourceFormat int
 
 const (
 	SourceFormatV1 = iota
+	SourceFormatV2
+	SourceFormatRules
 )
 
 type Source struct {
-	url    string
-	format SourceFormat
-	in     string
+	url          string
+	format       SourceFormat
+	in           string
+	xTransport   *XTransport
+	minisignKey  *minisign.PublicKey
+	cacheFile    string
+	refreshDelay time.Duration
 }
 
 func fetchFromCache(cacheFile string) ([]byte, error) {
-	dlog.Infof("Loading source information from cache file [%s]", cacheFile)
+	sourcesLog.Infof("Loading source information from cache file [%s]", cacheFile)
 	return ioutil.ReadFile(cacheFile)
 }
 
-func fetchWithCache(url string, cacheFile string, refreshDelay time.Duration) (in string, cached bool, err error) {
+func fetchWithCache(xTransport *XTransport, urlStr string, cacheFile string, refreshDelay time.Duration) (in string, cached bool, err error) {
 	var bin []byte
 	cached, usableCache := false, false
 	fi, err := os.Stat(cacheFile)
@@ -49,80 +54,122 @@ func fetchWithCache(url string, cacheFile string, refreshDelay time.Duration) (i
 		}
 	}
 	if !cached {
-		var resp *http.Response
-		dlog.Infof("Loading source information from URL [%s]", url)
-		resp, err = http.Get(url)
-		if err != nil {
-			if usableCache {
-				bin, err = fetchFromCache(cacheFile)
-			}
-			if err != nil {
-				return
-			}
+		sourcesLog.Infof("Loading source information from URL [%s]", urlStr)
+		bin, err = fetchFromURL(xTransport, urlStr)
+		if err != nil && usableCache {
+			bin, err = fetchFromCache(cacheFile)
 		}
-		defer resp.Body.Close()
-		bin, err = ioutil.ReadAll(resp.Body)
 		if err != nil {
-			if usableCache {
-				bin, err = fetchFromCache(cacheFile)
-			}
-			if err != nil {
-				return
-			}
+			return
 		}
 	}
 	in = string(bin)
 	return
 }
 
+func fetchFromURL(xTransport *XTransport, urlStr string) ([]byte, error) {
+	parsedURL, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	resp, _, err := xTransport.Fetch("GET", parsedURL, "", "", nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
 func AtomicFileWrite(file string, data []byte) error {
 	return safefile.WriteFile(file, data, 0644)
 }
 
-func NewSource(url string, minisignKeyStr string, cacheFile string, formatStr string, refreshDelay time.Duration) (Source, error) {
-	source := Source{url: url}
-	if formatStr != "v1" {
+func NewSource(xTransport *XTransport, url string, minisignKeyStr string, cacheFile string, formatStr string, refreshDelay time.Duration) (Source, error) {
+	source := Source{url: url, xTransport: xTransport, cacheFile: cacheFile, refreshDelay: refreshDelay}
+	switch formatStr {
+	case "v1":
+		source.format = SourceFormatV1
+	case "v2":
+		source.format = SourceFormatV2
+	case "rules":
+		source.format = SourceFormatRules
+	default:
 		return source, fmt.Errorf("Unsupported source format: [%s]", formatStr)
 	}
-	source.format = SourceFormatV1
 	minisignKey, err := minisign.NewPublicKey(minisignKeyStr)
 	if err != nil {
 		return source, err
 	}
-	in, cached, err := fetchWithCache(url, cacheFile, refreshDelay)
-	if err != nil {
+	source.minisignKey = &minisignKey
+	if err := source.fetch(source.refreshDelay); err != nil {
 		return source, err
 	}
-	sigCacheFile := cacheFile + ".minisig"
-	sigURL := url + ".minisig"
-	sigStr, sigCached, err := fetchWithCache(sigURL, sigCacheFile, refreshDelay)
+	sourcesLog.Noticef("Source [%s] loaded", url)
+	return source, nil
+}
+
+// The cache file is only replaced after the new content has been verified.
+// It is used instead of the URL if it is more recent than maxAge.
+
+func (source *Source) fetch(maxAge time.Duration) error {
+	in, cached, err := fetchWithCache(source.xTransport, source.url, source.cacheFile, maxAge)
+	if err != nil {
+		return err
+	}
+	sigCacheFile := source.cacheFile + ".minisig"
+	sigURL := source.url + ".minisig"
+	sigStr, sigCached, err := fetchWithCache(source.xTransport, sigURL, sigCacheFile, maxAge)
 	if err != nil {
-		return source, err
+		return err
 	}
 	signature, err := minisign.DecodeSignature(sigStr)
 	if err != nil {
-		return source, err
+		return err
 	}
-	res, err := minisignKey.Verify([]byte(in), signature)
+	res, err := source.minisignKey.Verify([]byte(in), signature)
 	if err != nil || res != true {
-		return source, err
+		return err
 	}
 	if cached == false {
-		if err = AtomicFileWrite(cacheFile, []byte(in)); err != nil {
-			return source, err
+		if err = AtomicFileWrite(source.cacheFile, []byte(in)); err != nil {
+			return err
 		}
 	}
 	if sigCached == false {
 		if err = AtomicFileWrite(sigCacheFile, []byte(sigStr)); err != nil {
-			return source, err
+			return err
 		}
 	}
-	dlog.Noticef("Source [%s] loaded", url)
 	source.in = in
-	return source, nil
+	return nil
+}
+
+// Rules sources are downloaded again every refreshDelay - rule files using
+// the cache file are then reloaded like any other modified rule file
+
+func (source *Source) startRefresh(metrics *Metrics) {
+	go func() {
+		for {
+			time.Sleep(source.refreshDelay)
+			err := source.fetch(source.refreshDelay)
+			metrics.sourceFetched(source.url, err)
+			if err != nil {
+				sourcesLog.Warnf("Unable to refresh source [%s]: [%s]", source.url, err)
+				continue
+			}
+			sourcesLog.Infof("Source [%s] refreshed", source.url)
+		}
+	}()
 }
 
 func (source *Source) Parse() ([]RegisteredServer, error) {
+	if source.format == SourceFormatV2 {
+		return source.parseV2()
+	}
+	return source.parseV1()
+}
+
+func (source *Source) parseV1() ([]RegisteredServer, error) {
 	var registeredServers []RegisteredServer
 
 	csvReader := csv.NewReader(strings.NewReader(source.in))
@@ -146,7 +193,8 @@ func (source *Source) Parse() ([]RegisteredServer, error) {
 		serverPkStr := record[12]
 		stamp, err := NewServerStampFromLegacy(serverAddrStr, serverPkStr, providerName)
 		if err != nil {
-			return registeredServers, err
+			sourcesLog.Warnf("Ignoring [%s]: [%s]", name, err)
+			continue
 		}
 		registeredServer := RegisteredServer{
 			name: name, stamp: stamp,
@@ -155,3 +203,31 @@ func (source *Source) Parse() ([]RegisteredServer, error) {
 	}
 	return registeredServers, nil
 }
+
+// v2 sources are markdown documents: every server starts with a "## name"
+// header, followed by a description and one or more sdns:// stamps
+
+func (source *Source) parseV2() ([]RegisteredServer, error) {
+	var registeredServers []RegisteredServer
+	name := ""
+	for lineNo, line := range strings.Split(source.in, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "## ") {
+			name = strings.TrimSpace(line[3:])
+			continue
+		}
+		if !strings.HasPrefix(line, StampScheme) {
+			continue
+		}
+		if len(name) == 0 {
+			return registeredServers, fmt.Errorf("Stamp without a server name at line %d", lineNo+1)
+		}
+		stamp, err := NewServerStampFromString(line)
+		if err != nil {
+			sourcesLog.Warnf("Ignoring [%s]: [%s]", name, err)
+			continue
+		}
+		registeredServers = append(registeredServers, RegisteredServer{name: name, stamp: stamp})
+	}
+	return registeredServers, nil
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+const StampScheme = "sdns://"
+
+type StampProtoType uint8
+
+const (
+	StampProtoTypePlain      = StampProtoType(0x00)
+	StampProtoTypeDNSCrypt   = StampProtoType(0x01)
+	StampProtoTypeDoH        = StampProtoType(0x02)
+	StampProtoTypeTLS        = StampProtoType(0x03)
+	StampProtoTypeDoQ        = StampProtoType(0x04)
+	StampProtoTypeODoHTarget = StampProtoType(0x05)
+)
+
+func (stampProtoType *StampProtoType) String() string {
+	switch *stampProtoType {
+	case StampProtoTypePlain:
+		return "Plain"
+	case StampProtoTypeDNSCrypt:
+		return "DNSCrypt"
+	case StampProtoTypeDoH:
+		return "DoH"
+	case StampProtoTypeTLS:
+		return "DoT"
+	case StampProtoTypeDoQ:
+		return "DoQ"
+	case StampProtoTypeODoHTarget:
+		return "ODoH target"
+	default:
+		panic("Unexpected protocol")
+	}
+}
+
+type ServerInformalProperties uint64
+
+const (
+	ServerInformalPropertyDNSSEC   = ServerInformalProperties(1) << 0
+	ServerInformalPropertyNoLog    = ServerInformalProperties(1) << 1
+	ServerInformalPropertyNoFilter = ServerInformalProperties(1) << 2
+)
+
+type ServerStamp struct {
+	serverAddrStr string
+	serverPk      []byte
+	hashes        [][]byte
+	providerName  string
+	path          string
+	props         ServerInformalProperties
+	proto         StampProtoType
+}
+
+func NewServerStampFromLegacy(serverAddrStr string, serverPkStr string, providerName string) (ServerStamp, error) {
+	if net.ParseIP(serverAddrStr) != nil {
+		serverAddrStr = fmt.Sprintf("%s:%d", serverAddrStr, DefaultPort)
+	}
+	serverPk, err := hex.DecodeString(strings.Replace(serverPkStr, ":", "", -1))
+	if err != nil || len(serverPk) != ed25519.PublicKeySize {
+		return ServerStamp{}, fmt.Errorf("Unsupported public key: [%s]", serverPkStr)
+	}
+	return ServerStamp{
+		serverAddrStr: serverAddrStr,
+		serverPk:      serverPk,
+		providerName:  providerName,
+		proto:         StampProtoTypeDNSCrypt,
+	}, nil
+}
+
+func NewDoHServerStampFromLegacy(urlStr string, serverAddrStr string, pinsStr []string) (ServerStamp, error) {
+	serverURL, err := url.Parse(urlStr)
+	if err != nil {
+		return ServerStamp{}, err
+	}
+	if serverURL.Scheme != "https" || len(serverURL.Host) == 0 {
+		return ServerStamp{}, fmt.Errorf("Unsupported DoH URL: [%s]", urlStr)
+	}
+	path := serverURL.Path
+	if len(path) == 0 {
+		path = "/dns-query"
+	}
+	hashes, err := decodeSPKIPins(pinsStr)
+	if err != nil {
+		return ServerStamp{}, err
+	}
+	return ServerStamp{
+		serverAddrStr: serverAddrStr,
+		providerName:  serverURL.Host,
+		path:          path,
+		hashes:        hashes,
+		proto:         StampProtoTypeDoH,
+	}, nil
+}
+
+func NewODoHTargetStampFromLegacy(urlStr string) (ServerStamp, error) {
+	stamp, err := NewDoHServerStampFromLegacy(urlStr, "", nil)
+	if err != nil {
+		return stamp, err
+	}
+	stamp.proto = StampProtoTypeODoHTarget
+	return stamp, nil
+}
+
+func NewDoTServerStampFromLegacy(urlStr string, serverAddrStr string, tlsServerName string, pinsStr []string) (ServerStamp, error) {
+	serverURL, err := url.Parse(urlStr)
+	if err != nil {
+		return ServerStamp{}, err
+	}
+	if serverURL.Scheme != "tls" || len(serverURL.Host) == 0 {
+		return ServerStamp{}, fmt.Errorf("Unsupported DoT URL: [%s]", urlStr)
+	}
+	hostName, port := serverURL.Hostname(), serverURL.Port()
+	if len(port) == 0 {
+		port = fmt.Sprintf("%d", DefaultDoTPort)
+	}
+	if len(serverAddrStr) == 0 {
+		serverAddrStr = hostName
+	}
+	if net.ParseIP(strings.Trim(serverAddrStr, "[]")) != nil || strings.IndexByte(serverAddrStr, ':') < 0 {
+		serverAddrStr = net.JoinHostPort(strings.Trim(serverAddrStr, "[]"), port)
+	}
+	if len(tlsServerName) > 0 {
+		hostName = tlsServerName
+	}
+	hashes, err := decodeSPKIPins(pinsStr)
+	if err != nil {
+		return ServerStamp{}, err
+	}
+	return ServerStamp{
+		serverAddrStr: serverAddrStr,
+		providerName:  hostName,
+		hashes:        hashes,
+		proto:         StampProtoTypeTLS,
+	}, nil
+}
+
+func NewServerStampFromString(stampStr string) (ServerStamp, error) {
+	if !strings.HasPrefix(stampStr, StampScheme) {
+		return ServerStamp{}, fmt.Errorf("Stamps are expected to start with %s", StampScheme)
+	}
+	bin, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(stampStr[len(StampScheme):], "="))
+	if err != nil {
+		return ServerStamp{}, err
+	}
+	if len(bin) < 1 {
+		return ServerStamp{}, errors.New("Stamp is too short")
+	}
+	switch StampProtoType(bin[0]) {
+	case StampProtoTypePlain:
+		return newPlainServerStamp(bin)
+	case StampProtoTypeDNSCrypt:
+		return newDNSCryptServerStamp(bin)
+	case StampProtoTypeDoH:
+		return newDoHServerStamp(bin)
+	case StampProtoTypeTLS, StampProtoTypeDoQ:
+		return newDoTServerStamp(bin)
+	case StampProtoTypeODoHTarget:
+		return newODoHTargetStamp(bin)
+	}
+	return ServerStamp{}, errors.New("Unsupported stamp version or protocol")
+}
+
+// id(u8)=0x00 props 0x00 addrLen(1) serverAddr
+
+func newPlainServerStamp(bin []byte) (ServerStamp, error) {
+	stamp := ServerStamp{proto: StampProtoTypePlain}
+	pos, err := stampReadProps(&stamp, bin)
+	if err != nil {
+		return stamp, err
+	}
+	serverAddr, err := stampReadLP(bin, &pos)
+	if err != nil {
+		return stamp, err
+	}
+	stamp.serverAddrStr = stampAddrWithPort(string(serverAddr), 53)
+	return stamp, stampCheckEnd(bin, pos)
+}
+
+// id(u8)=0x01 props addrLen(1) serverAddr pkStrlen(1) pkStr providerNameLen(1) providerName
+
+func newDNSCryptServerStamp(bin []byte) (ServerStamp, error) {
+	stamp := ServerStamp{proto: StampProtoTypeDNSCrypt}
+	pos, err := stampReadProps(&stamp, bin)
+	if err != nil {
+		return stamp, err
+	}
+	serverAddr, err := stampReadLP(bin, &pos)
+	if err != nil {
+		return stamp, err
+	}
+	stamp.serverAddrStr = stampAddrWithPort(string(serverAddr), DefaultPort)
+	if stamp.serverPk, err = stampReadLP(bin, &pos); err != nil {
+		return stamp, err
+	}
+	if len(stamp.serverPk) != ed25519.PublicKeySize {
+		return stamp, errors.New("Invalid public key length")
+	}
+	providerName, err := stampReadLP(bin, &pos)
+	if err != nil {
+		return stamp, err
+	}
+	stamp.providerName = string(providerName)
+	return stamp, stampCheckEnd(bin, pos)
+}
+
+// id(u8)=0x02 props addrLen(1) serverAddr hashLen(1) hash hostNameLen(1) hostName pathLen(1) path
+
+func newDoHServerStamp(bin []byte) (ServerStamp, error) {
+	stamp := ServerStamp{proto: StampProtoTypeDoH}
+	pos, err := stampReadProps(&stamp, bin)
+	if err != nil {
+		return stamp, err
+	}
+	serverAddr, err := stampReadLP(bin, &pos)
+	if err != nil {
+		return stamp, err
+	}
+	stamp.serverAddrStr = string(serverAddr)
+	if stamp.hashes, err = stampReadVLP(bin, &pos); err != nil {
+		return stamp, err
+	}
+	providerName, err := stampReadLP(bin, &pos)
+	if err != nil {
+		return stamp, err
+	}
+	stamp.providerName = string(providerName)
+	path, err := stampReadLP(bin, &pos)
+	if err != nil {
+		return stamp, err
+	}
+	stamp.path = string(path)
+	if pos < len(bin) {
+		// Optional bootstrap resolvers, unused
+		if _, err := stampReadVLP(bin, &pos); err != nil {
+			return stamp, err
+		}
+	}
+	return stamp, stampCheckEnd(bin, pos)
+}
+
+// id(u8)=0x03|0x04 props addrLen(1) serverAddr hashLen(1) hash hostNameLen(1) hostName
+
+func newDoTServerStamp(bin []byte) (ServerStamp, error) {
+	stamp := ServerStamp{proto: StampProtoType(bin[0])}
+	pos, err := stampReadProps(&stamp, bin)
+	if err != nil {
+		return stamp, err
+	}
+	serverAddr, err := stampReadLP(bin, &pos)
+	if err != nil {
+		return stamp, err
+	}
+	if stamp.hashes, err = stampReadVLP(bin, &pos); err != nil {
+		return stamp, err
+	}
+	providerName, err := stampReadLP(bin, &pos)
+	if err != nil {
+		return stamp, err
+	}
+	stamp.providerName = string(providerName)
+	if len(serverAddr) == 0 {
+		serverAddr = providerName
+		if host, _, err := net.SplitHostPort(stamp.providerName); err == nil {
+			serverAddr = []byte(host)
+		}
+	}
+	stamp.serverAddrStr = stampAddrWithPort(string(serverAddr), DefaultDoTPort)
+	if pos < len(bin) {
+		// Optional bootstrap resolvers, unused
+		if _, err := stampReadVLP(bin, &pos); err != nil {
+			return stamp, err
+		}
+	}
+	return stamp, stampCheckEnd(bin, pos)
+}
+
+// id(u8)=0x05 props hostNameLen(1) hostName pathLen(1) path
+
+func newODoHTargetStamp(bin []byte) (ServerStamp, error) {
+	stamp := ServerStamp{proto: StampProtoTypeODoHTarget}
+	pos, err := stampReadProps(&stamp, bin)
+	if err != nil {
+		return stamp, err
+	}
+	providerName, err := stampReadLP(bin, &pos)
+	if err != nil {
+		return stamp, err
+	}
+	stamp.providerName = string(providerName)
+	path, err := stampReadLP(bin, &pos)
+	if err != nil {
+		return stamp, err
+	}
+	stamp.path = string(path)
+	return stamp, stampCheckEnd(bin, pos)
+}
+
+func stampReadProps(stamp *ServerStamp, bin []byte) (int, error) {
+	if len(bin) < 9 {
+		return 0, errors.New("Stamp is too short")
+	}
+	stamp.props = ServerInformalProperties(binary.LittleEndian.Uint64(bin[1:9]))
+	return 9, nil
+}
+
+func stampReadLP(bin []byte, pos *int) ([]byte, error) {
+	if *pos >= len(bin) {
+		return nil, errors.New("Stamp is too short")
+	}
+	length := int(bin[*pos])
+	*pos++
+	if *pos+length > len(bin) {
+		return nil, errors.New("Invalid stamp")
+	}
+	value := bin[*pos : *pos+length]
+	*pos += length
+	return value, nil
+}
+
+func stampReadVLP(bin []byte, pos *int) ([][]byte, error) {
+	var values [][]byte
+	for {
+		if *pos >= len(bin) {
+			return nil, errors.New("Stamp is too short")
+		}
+		vlen := bin[*pos]
+		length := int(vlen & ^uint8(0x80))
+		*pos++
+		if *pos+length > len(bin) {
+			return nil, errors.New("Invalid stamp")
+		}
+		if length > 0 {
+			values = append(values, bin[*pos:*pos+length])
+		}
+		*pos += length
+		if vlen&0x80 != 0x80 {
+			break
+		}
+	}
+	return values, nil
+}
+
+func stampCheckEnd(bin []byte, pos int) error {
+	if pos != len(bin) {
+		return errors.New("Invalid stamp (garbage after end)")
+	}
+	return nil
+}
+
+func stampAddrWithPort(addrStr string, defaultPort int) string {
+	if len(addrStr) == 0 {
+		return addrStr
+	}
+	if net.ParseIP(strings.Trim(addrStr, "[]")) != nil {
+		return net.JoinHostPort(strings.Trim(addrStr, "[]"), fmt.Sprintf("%d", defaultPort))
+	}
+	return addrStr
+}
+
+func stampWriteLP(bin []byte, value []byte) []byte {
+	bin = append(bin, uint8(len(value)))
+	return append(bin, value...)
+}
+
+func stampWriteVLP(bin []byte, values [][]byte) []byte {
+	if len(values) == 0 {
+		return append(bin, 0)
+	}
+	for i, value := range values {
+		vlen := uint8(len(value))
+		if i < len(values)-1 {
+			vlen |= 0x80
+		}
+		bin = append(bin, vlen)
+		bin = append(bin, value...)
+	}
+	return bin
+}
+
+func (stamp *ServerStamp) String() string {
+	bin := []byte{uint8(stamp.proto), 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint64(bin[1:9], uint64(stamp.props))
+	switch stamp.proto {
+	case StampProtoTypePlain:
+		bin = stampWriteLP(bin, []byte(stamp.serverAddrStr))
+	case StampProtoTypeDNSCrypt:
+		bin = stampWriteLP(bin, []byte(stamp.serverAddrStr))
+		bin = stampWriteLP(bin, stamp.serverPk)
+		bin = stampWriteLP(bin, []byte(stamp.providerName))
+	case StampProtoTypeDoH:
+		bin = stampWriteLP(bin, []byte(stamp.serverAddrStr))
+		bin = stampWriteVLP(bin, stamp.hashes)
+		bin = stampWriteLP(bin, []byte(stamp.providerName))
+		bin = stampWriteLP(bin, []byte(stamp.path))
+	case StampProtoTypeTLS, StampProtoTypeDoQ:
+		bin = stampWriteLP(bin, []byte(stamp.serverAddrStr))
+		bin = stampWriteVLP(bin, stamp.hashes)
+		bin = stampWriteLP(bin, []byte(stamp.providerName))
+	case StampProtoTypeODoHTarget:
+		bin = stampWriteLP(bin, []byte(stamp.providerName))
+		bin = stampWriteLP(bin, []byte(stamp.path))
+	}
+	return StampScheme + base64.RawURLEncoding.EncodeToString(bin)
+}
+
+func (stamp *ServerStamp) dialHostName() string {
+	hostPort := stamp.providerName
+	if stamp.proto == StampProtoTypeDNSCrypt || stamp.proto == StampProtoTypeTLS || stamp.proto == StampProtoTypePlain {
+		hostPort = stamp.serverAddrStr
+	}
+	if host, _, err := net.SplitHostPort(hostPort); err == nil {
+		return host
+	}
+	return hostPort
+}
+
+func (stamp *ServerStamp) Describe() string {
+	var lines []string
+	lines = append(lines, fmt.Sprintf("Protocol:      %s", stamp.proto.String()))
+	if len(stamp.serverAddrStr) > 0 {
+		lines = append(lines, fmt.Sprintf("Address:       %s", stamp.serverAddrStr))
+	}
+	if len(stamp.serverPk) > 0 {
+		lines = append(lines, fmt.Sprintf("Public key:    %s", hex.EncodeToString(stamp.serverPk)))
+	}
+	if len(stamp.providerName) > 0 {
+		lines = append(lines, fmt.Sprintf("Provider name: %s", stamp.providerName))
+	}
+	if len(stamp.path) > 0 {
+		lines = append(lines, fmt.Sprintf("Path:          %s", stamp.path))
+	}
+	for _, hash := range stamp.hashes {
+		lines = append(lines, fmt.Sprintf("Hash:          %s", hex.EncodeToString(hash)))
+	}
+	lines = append(lines, fmt.Sprintf("DNSSEC:        %v", stamp.props&ServerInformalPropertyDNSSEC != 0))
+	lines = append(lines, fmt.Sprintf("No logs:       %v", stamp.props&ServerInformalPropertyNoLog != 0))
+	lines = append(lines, fmt.Sprintf("No filter:     %v", stamp.props&ServerInformalPropertyNoFilter != 0))
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const StatsDMaxPacketSize = 1432
+
+var (
+	statsDNameReplacer = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_")
+	statsDTagReplacer  = strings.NewReplacer("|", "_", "@", "_", "#", "_", ",", "_", " ", "_")
+)
+
+type StatsD struct {
+	conn        net.Conn
+	prefix      string
+	tags        []string
+	dogStatsD   bool
+	queries     map[MetricsQueryKey]uint64
+	blocked     map[string]uint64
+	cacheHits   map[string]uint64
+	cacheMisses map[string]uint64
+	servers     map[string]MetricsHistogram
+	failures    map[string]uint64
+}
+
+// Counters are sent as the difference since the previous flush. With plain
+// StatsD, labels are appended to metric names; DogStatsD sends them as tags.
+
+func NewStatsD(address string, prefix string, tags []string, dogStatsD bool) (*StatsD, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if len(prefix) > 0 && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &StatsD{
+		conn:        conn,
+		prefix:      prefix,
+		tags:        tags,
+		dogStatsD:   dogStatsD,
+		queries:     make(map[MetricsQueryKey]uint64),
+		blocked:     make(map[string]uint64),
+		cacheHits:   make(map[string]uint64),
+		cacheMisses: make(map[string]uint64),
+		servers:     make(map[string]MetricsHistogram),
+		failures:    make(map[string]uint64),
+	}, nil
+}
+
+func (statsd *StatsD) line(name string, value string, kind string, labels ...string) string {
+	if !statsd.dogStatsD {
+		for i := 1; i < len(labels); i += 2 {
+			name += "." + statsDNameReplacer.Replace(labels[i])
+		}
+		return fmt.Sprintf("%s%s:%s|%s", statsd.prefix, name, value, kind)
+	}
+	tags := append([]string{}, statsd.tags...)
+	for i := 1; i < len(labels); i += 2 {
+		tags = append(tags, labels[i-1]+":"+statsDTagReplacer.Replace(labels[i]))
+	}
+	line := fmt.Sprintf("%s%s:%s|%s", statsd.prefix, name, value, kind)
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+func statsDDelta(previous map[string]uint64, key string, current uint64) uint64 {
+	delta := current - previous[key]
+	if current < previous[key] {
+		delta = current
+	}
+	previous[key] = current
+	return delta
+}
+
+func (statsd *StatsD) collect(proxy *Proxy) []string {
+	var lines []string
+	metrics := proxy.metrics
+	metrics.Lock()
+	for key, count := range metrics.queries {
+		if delta := count - statsd.queries[key]; delta > 0 {
+			lines = append(lines, statsd.line("queries", fmt.Sprint(delta), "c", "rcode", key.rcode, "qtype", key.qtype))
+		}
+		statsd.queries[key] = count
+	}
+	for plugin, count := range metrics.blocked {
+		if delta := statsDDelta(statsd.blocked, plugin, count); delta > 0 {
+			lines = append(lines, statsd.line("blocked", fmt.Sprint(delta), "c", "plugin", plugin))
+		}
+	}
+	for serverName, histogram := range metrics.servers {
+		previous := statsd.servers[serverName]
+		if count := histogram.count - previous.count; count > 0 {
+			mean := (histogram.sum - previous.sum) / float64(count) * 1000
+			lines = append(lines, statsd.line("server.responses", fmt.Sprint(count), "c", "server", serverName))
+			lines = append(lines, statsd.line("server.latency_ms", fmt.Sprintf("%.3f", mean), "g", "server", serverName))
+		}
+		statsd.servers[serverName] = MetricsHistogram{count: histogram.count, sum: histogram.sum}
+	}
+	now := time.Now()
+	for url, source := range metrics.sources {
+		if delta := statsDDelta(statsd.failures, url, source.failures); delta > 0 {
+			lines = append(lines, statsd.line("source.failures", fmt.Sprint(delta), "c", "source", url))
+		}
+		if !source.lastSuccess.IsZero() {
+			lines = append(lines, statsd.line("source.age_seconds", fmt.Sprint(int64(now.Sub(source.lastSuccess).Seconds())), "g", "source", url))
+		}
+	}
+	metrics.Unlock()
+	proxy.cacheStats.Lock()
+	for listenAddrStr, stats := range proxy.cacheStats.listeners {
+		if delta := statsDDelta(statsd.cacheHits, listenAddrStr, atomic.LoadUint64(&stats.hits)); delta > 0 {
+			lines = append(lines, statsd.line("cache.hits", fmt.Sprint(delta), "c", "listener", listenAddrStr))
+		}
+		if delta := statsDDelta(statsd.cacheMisses, listenAddrStr, atomic.LoadUint64(&stats.misses)); delta > 0 {
+			lines = append(lines, statsd.line("cache.misses", fmt.Sprint(delta), "c", "listener", listenAddrStr))
+		}
+	}
+	proxy.cacheStats.Unlock()
+	count, capacity := cachedResponses.entries()
+	lines = append(lines, statsd.line("cache.entries", fmt.Sprint(count), "g"))
+	lines = append(lines, statsd.line("cache.size", fmt.Sprint(capacity), "g"))
+	return lines
+}
+
+// Lines are packed into datagrams that fit in a typical MTU
+
+func (statsd *StatsD) flush(proxy *Proxy) {
+	packet := ""
+	for _, line := range statsd.collect(proxy) {
+		if len(packet) > 0 && len(packet)+1+len(line) > StatsDMaxPacketSize {
+			statsd.conn.Write([]byte(packet))
+			packet = ""
+		}
+		if len(packet) > 0 {
+			packet += "\n"
+		}
+		packet += line
+	}
+	if len(packet) > 0 {
+		statsd.conn.Write([]byte(packet))
+	}
+}
+
+func (statsd *StatsD) start(proxy *Proxy, interval time.Duration) {
+	go func() {
+		for {
+			time.Sleep(interval)
+			statsd.flush(proxy)
+		}
+	}()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+type SuspiciousQueries struct {
+	maxNameLength int
+	maxLabels     int
+	qtypes        map[uint16]bool
+}
+
+func NewSuspiciousQueries(maxNameLength int, maxLabels int, qtypeNames []string) (*SuspiciousQueries, error) {
+	suspicious := SuspiciousQueries{maxNameLength: maxNameLength, maxLabels: maxLabels, qtypes: make(map[uint16]bool)}
+	for _, qtypeName := range qtypeNames {
+		qtype, ok := dns.StringToType[strings.ToUpper(qtypeName)]
+		if !ok {
+			return nil, fmt.Errorf("Unknown query type: [%s]", qtypeName)
+		}
+		suspicious.qtypes[qtype] = true
+	}
+	return &suspicious, nil
+}
+
+func hasUnusualCharacters(name string) bool {
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// Names with non-ASCII or escaped characters, with many labels, very long
+// names, and unusual query types are common with DNS tunneling
+
+func (suspicious *SuspiciousQueries) filter(msg *dns.Msg, _ *BlockAttribution) (string, bool) {
+	question := msg.Question[0]
+	var reasons []string
+	if hasUnusualCharacters(question.Name) {
+		reasons = append(reasons, "characters")
+	}
+	if suspicious.maxNameLength > 0 && len(strings.TrimSuffix(question.Name, ".")) > suspicious.maxNameLength {
+		reasons = append(reasons, "length")
+	}
+	if suspicious.maxLabels > 0 && dns.CountLabel(question.Name) > suspicious.maxLabels {
+		reasons = append(reasons, "labels")
+	}
+	if suspicious.qtypes[question.Qtype] {
+		reasons = append(reasons, "type")
+	}
+	return strings.Join(reasons, ","), len(reasons) > 0
+}
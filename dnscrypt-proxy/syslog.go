@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SyslogSeverityCritical = 2
+	SyslogSeverityInfo     = 6
+	SyslogAppName          = "dnscrypt-proxy"
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11, "local0": 16, "local1": 17, "local2": 18,
+	"local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"DEBUG": 7, "INFO": 6, "NOTICE": 5, "WARNING": 4, "ERROR": 3, "CRITICAL": 2, "FATAL": 1,
+}
+
+var localSyslogSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+type Syslog struct {
+	sync.Mutex
+	network  string
+	address  string
+	facility int
+	hostname string
+	conn     net.Conn
+}
+
+// Messages are sent in the RFC 5424 format, to a local socket, or to a remote
+// collector given as "udp://host:port" or "tcp://host:port"
+
+func NewSyslog(address string, facilityName string) (*Syslog, error) {
+	facility, ok := syslogFacilities[strings.ToLower(facilityName)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown syslog facility: [%s]", facilityName)
+	}
+	syslog := Syslog{facility: facility}
+	syslog.hostname, _ = os.Hostname()
+	if len(syslog.hostname) == 0 {
+		syslog.hostname = "-"
+	}
+	switch {
+	case len(address) == 0:
+		syslog.network = "unixgram"
+	case strings.HasPrefix(address, "udp://"):
+		syslog.network, syslog.address = "udp", address[6:]
+	case strings.HasPrefix(address, "tcp://"):
+		syslog.network, syslog.address = "tcp", address[6:]
+	default:
+		return nil, fmt.Errorf("Invalid syslog address: [%s]", address)
+	}
+	if syslog.network != "unixgram" {
+		if _, _, err := net.SplitHostPort(syslog.address); err != nil {
+			syslog.address = net.JoinHostPort(syslog.address, "514")
+		}
+	}
+	if err := syslog.connect(); err != nil {
+		return nil, err
+	}
+	return &syslog, nil
+}
+
+func (syslog *Syslog) connect() error {
+	if syslog.network != "unixgram" {
+		conn, err := net.Dial(syslog.network, syslog.address)
+		if err != nil {
+			return err
+		}
+		syslog.conn = conn
+		return nil
+	}
+	for _, socket := range localSyslogSockets {
+		if conn, err := net.Dial("unixgram", socket); err == nil {
+			syslog.conn = conn
+			return nil
+		}
+	}
+	return errors.New("Local syslog socket not found")
+}
+
+// TCP messages are framed with their length (RFC 6587 octet counting).
+// Messages that cannot be sent are sent again once, after reconnecting.
+
+func (syslog *Syslog) send(severity int, msgID string, message string) error {
+	if len(msgID) == 0 {
+		msgID = "-"
+	}
+	line := fmt.Sprintf("<%d>1 %s %s %s %d %s - %s", syslog.facility*8+severity,
+		time.Now().Format("2006-01-02T15:04:05.000000Z07:00"), syslog.hostname, SyslogAppName, os.Getpid(), msgID, message)
+	if syslog.network == "tcp" {
+		line = fmt.Sprintf("%d %s", len(line), line)
+	}
+	syslog.Lock()
+	defer syslog.Unlock()
+	var err error
+	for i := 0; i < 2; i++ {
+		if syslog.conn == nil {
+			if err = syslog.connect(); err != nil {
+				continue
+			}
+		}
+		if _, err = syslog.conn.Write([]byte(line)); err == nil {
+			return nil
+		}
+		syslog.conn.Close()
+		syslog.conn = nil
+	}
+	return err
+}
+
+type SyslogChannel struct {
+	syslog *Syslog
+	msgID  string
+}
+
+func (channel *SyslogChannel) Write(p []byte) (int, error) {
+	if err := channel.syslog.send(SyslogSeverityInfo, channel.msgID, strings.TrimSuffix(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (syslog *Syslog) channel(msgID string) io.Writer {
+	return &SyslogChannel{syslog: syslog, msgID: msgID}
+}
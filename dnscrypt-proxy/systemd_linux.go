@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/jedisct1/dlog"
+)
+
+const SystemDListenFDsStart = 3
+
+// Uses the sockets passed by systemd (socket activation), if any
+
+func (proxy *Proxy) SystemDListeners() (bool, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return false, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return false, nil
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	for fd := SystemDListenFDsStart; fd < SystemDListenFDsStart+nfds; fd++ {
+		syscall.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("systemd socket %d", fd))
+		if listener, err := net.FileListener(file); err == nil {
+			tcpListener, ok := listener.(*net.TCPListener)
+			if !ok {
+				return false, fmt.Errorf("Unsupported socket passed by systemd: [%v]", listener.Addr())
+			}
+			proxy.tcpListener(tcpListener, proxy.listenerOptions(tcpListener.Addr().String()))
+		} else if pc, err := net.FilePacketConn(file); err == nil {
+			udpConn, ok := pc.(*net.UDPConn)
+			if !ok {
+				return false, fmt.Errorf("Unsupported socket passed by systemd: [%v]", pc.LocalAddr())
+			}
+			proxy.udpListener(udpConn, proxy.listenerOptions(udpConn.LocalAddr().String()))
+		} else {
+			return false, fmt.Errorf("Unable to use the socket passed by systemd: [%s]", err)
+		}
+		file.Close()
+	}
+	dlog.Noticef("Using %d sockets passed by systemd - listen_addresses is ignored", nfds)
+	return true, nil
+}
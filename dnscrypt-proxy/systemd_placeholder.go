@@ -0,0 +1,7 @@
+// +build !linux
+
+package main
+
+func (proxy *Proxy) SystemDListeners() (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"syscall"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	TCPFastOpenSupported = true
+	tcpFastOpenConnect   = 0x1e
+)
+
+// TCP_FASTOPEN_CONNECT (Linux >= 4.11) makes connect() return immediately;
+// the first write is then sent along with the SYN
+
+func tcpFastOpenControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, tcpFastOpenConnect, 1)
+	}); err != nil {
+		return err
+	}
+	if sockErr != nil {
+		dlog.Debugf("Unable to enable TCP Fast Open: [%s]", sockErr)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package main
+
+import "syscall"
+
+const TCPFastOpenSupported = false
+
+func tcpFastOpenControl(network, address string, c syscall.RawConn) error {
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+const (
+	TinyLFUSketchDepth = 4
+	TinyLFUMaxCount    = 15
+)
+
+// Approximate access counts, halved after a number of increments proportional
+// to the cache size, so that names that used to be popular eventually age out
+
+type CountMinSketch struct {
+	rows      [TinyLFUSketchDepth][]uint8
+	mask      uint64
+	additions int
+	resetAt   int
+}
+
+func NewCountMinSketch(size int) *CountMinSketch {
+	width := 16
+	for width < size {
+		width <<= 1
+	}
+	sketch := CountMinSketch{mask: uint64(width - 1), resetAt: 10 * Max(size, 1)}
+	for i := range sketch.rows {
+		sketch.rows[i] = make([]uint8, width)
+	}
+	return &sketch
+}
+
+func (sketch *CountMinSketch) index(hash uint64, row int) uint64 {
+	hash += uint64(row) * 0x9e3779b97f4a7c15
+	hash ^= hash >> 31
+	hash *= 0xbf58476d1ce4e5b9
+	hash ^= hash >> 29
+	return hash & sketch.mask
+}
+
+func (sketch *CountMinSketch) increment(hash uint64) {
+	for row := range sketch.rows {
+		i := sketch.index(hash, row)
+		if sketch.rows[row][i] < TinyLFUMaxCount {
+			sketch.rows[row][i]++
+		}
+	}
+	sketch.additions++
+	if sketch.additions >= sketch.resetAt {
+		for row := range sketch.rows {
+			for i := range sketch.rows[row] {
+				sketch.rows[row][i] >>= 1
+			}
+		}
+		sketch.additions /= 2
+	}
+}
+
+func (sketch *CountMinSketch) estimate(hash uint64) uint8 {
+	estimate := uint8(TinyLFUMaxCount)
+	for row := range sketch.rows {
+		if count := sketch.rows[row][sketch.index(hash, row)]; count < estimate {
+			estimate = count
+		}
+	}
+	return estimate
+}
+
+const (
+	TinyLFUWindow = iota
+	TinyLFUProbation
+	TinyLFUProtected
+)
+
+type TinyLFUEntry struct {
+	key     interface{}
+	value   interface{}
+	segment int
+}
+
+// W-TinyLFU: new entries go to a small LRU window. Entries leaving the window
+// only replace the least recently used entry of the main segmented LRU if
+// they have been requested more often, so that one-off names never evict
+// popular ones.
+
+type TinyLFUCache struct {
+	sync.Mutex
+	sketch       *CountMinSketch
+	items        map[interface{}]*list.Element
+	segments     [3]*list.List
+	windowSize   int
+	mainSize     int
+	protectedMax int
+}
+
+func NewTinyLFU(size int) (*TinyLFUCache, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("Must provide a positive size")
+	}
+	windowSize := Max(1, size/100)
+	mainSize := size - windowSize
+	cache := TinyLFUCache{
+		sketch:       NewCountMinSketch(size),
+		items:        make(map[interface{}]*list.Element),
+		windowSize:   windowSize,
+		mainSize:     mainSize,
+		protectedMax: mainSize * 8 / 10,
+	}
+	for i := range cache.segments {
+		cache.segments[i] = list.New()
+	}
+	return &cache, nil
+}
+
+func tinyLFUHash(key interface{}) uint64 {
+	if cacheKey, ok := key.([32]byte); ok {
+		return binary.LittleEndian.Uint64(cacheKey[8:16])
+	}
+	h := fnv.New64a()
+	fmt.Fprint(h, key)
+	return h.Sum64()
+}
+
+func (cache *TinyLFUCache) touch(element *list.Element) {
+	entry := element.Value.(*TinyLFUEntry)
+	switch entry.segment {
+	case TinyLFUWindow, TinyLFUProtected:
+		cache.segments[entry.segment].MoveToFront(element)
+	case TinyLFUProbation:
+		cache.segments[TinyLFUProbation].Remove(element)
+		entry.segment = TinyLFUProtected
+		cache.items[entry.key] = cache.segments[TinyLFUProtected].PushFront(entry)
+		if cache.segments[TinyLFUProtected].Len() > cache.protectedMax {
+			demoted := cache.segments[TinyLFUProtected].Back()
+			cache.segments[TinyLFUProtected].Remove(demoted)
+			demotedEntry := demoted.Value.(*TinyLFUEntry)
+			demotedEntry.segment = TinyLFUProbation
+			cache.items[demotedEntry.key] = cache.segments[TinyLFUProbation].PushFront(demotedEntry)
+		}
+	}
+}
+
+func (cache *TinyLFUCache) remove(element *list.Element) {
+	entry := element.Value.(*TinyLFUEntry)
+	cache.segments[entry.segment].Remove(element)
+	delete(cache.items, entry.key)
+}
+
+func (cache *TinyLFUCache) Add(key, value interface{}) {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.sketch.increment(tinyLFUHash(key))
+	if element, ok := cache.items[key]; ok {
+		element.Value.(*TinyLFUEntry).value = value
+		cache.touch(element)
+		return
+	}
+	cache.items[key] = cache.segments[TinyLFUWindow].PushFront(&TinyLFUEntry{key: key, value: value, segment: TinyLFUWindow})
+	if cache.segments[TinyLFUWindow].Len() <= cache.windowSize {
+		return
+	}
+	candidate := cache.segments[TinyLFUWindow].Back()
+	candidateEntry := candidate.Value.(*TinyLFUEntry)
+	if cache.segments[TinyLFUProbation].Len()+cache.segments[TinyLFUProtected].Len() < cache.mainSize {
+		cache.segments[TinyLFUWindow].Remove(candidate)
+		candidateEntry.segment = TinyLFUProbation
+		cache.items[candidateEntry.key] = cache.segments[TinyLFUProbation].PushFront(candidateEntry)
+		return
+	}
+	victim := cache.segments[TinyLFUProbation].Back()
+	if victim == nil {
+		victim = cache.segments[TinyLFUProtected].Back()
+	}
+	if victim == nil || cache.sketch.estimate(tinyLFUHash(candidateEntry.key)) <= cache.sketch.estimate(tinyLFUHash(victim.Value.(*TinyLFUEntry).key)) {
+		cache.remove(candidate)
+		return
+	}
+	cache.remove(victim)
+	cache.segments[TinyLFUWindow].Remove(candidate)
+	candidateEntry.segment = TinyLFUProbation
+	cache.items[candidateEntry.key] = cache.segments[TinyLFUProbation].PushFront(candidateEntry)
+}
+
+func (cache *TinyLFUCache) Get(key interface{}) (interface{}, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.sketch.increment(tinyLFUHash(key))
+	element, ok := cache.items[key]
+	if !ok {
+		return nil, false
+	}
+	cache.touch(element)
+	return element.Value.(*TinyLFUEntry).value, true
+}
+
+func (cache *TinyLFUCache) Peek(key interface{}) (interface{}, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	element, ok := cache.items[key]
+	if !ok {
+		return nil, false
+	}
+	return element.Value.(*TinyLFUEntry).value, true
+}
+
+func (cache *TinyLFUCache) Contains(key interface{}) bool {
+	cache.Lock()
+	defer cache.Unlock()
+	_, ok := cache.items[key]
+	return ok
+}
+
+func (cache *TinyLFUCache) Remove(key interface{}) {
+	cache.Lock()
+	defer cache.Unlock()
+	if element, ok := cache.items[key]; ok {
+		cache.remove(element)
+	}
+}
+
+func (cache *TinyLFUCache) Purge() {
+	cache.Lock()
+	defer cache.Unlock()
+	cache.items = make(map[interface{}]*list.Element)
+	for _, segment := range cache.segments {
+		segment.Init()
+	}
+}
+
+func (cache *TinyLFUCache) Keys() []interface{} {
+	cache.Lock()
+	defer cache.Unlock()
+	keys := make([]interface{}, 0, len(cache.items))
+	for _, segment := range []*list.List{cache.segments[TinyLFUProbation], cache.segments[TinyLFUProtected], cache.segments[TinyLFUWindow]} {
+		for element := segment.Back(); element != nil; element = element.Prev() {
+			keys = append(keys, element.Value.(*TinyLFUEntry).key)
+		}
+	}
+	return keys
+}
+
+func (cache *TinyLFUCache) Len() int {
+	cache.Lock()
+	defer cache.Unlock()
+	return len(cache.items)
+}
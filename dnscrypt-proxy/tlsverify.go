@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/jedisct1/dlog"
+)
+
+type TLSServerSettings struct {
+	pins    [][]byte
+	rootCAs *x509.CertPool
+}
+
+type TLSSettings struct {
+	sync.RWMutex
+	servers map[string]TLSServerSettings
+}
+
+func (xTransport *XTransport) setTLSSettings(serverName string, pins [][]byte, rootCAs *x509.CertPool) {
+	xTransport.tlsSettings.Lock()
+	xTransport.tlsSettings.servers[strings.ToLower(serverName)] = TLSServerSettings{pins: pins, rootCAs: rootCAs}
+	xTransport.tlsSettings.Unlock()
+}
+
+// Certificates are verified by verifyConnection rather than by crypto/tls,
+// so that every server can have its own roots and pins
+
+func (xTransport *XTransport) tlsClientConfig(serverName string) *tls.Config {
+	return &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(serverName) > 0 {
+				return xTransport.verifyConnection(serverName, cs)
+			}
+			return xTransport.verifyConnection(cs.ServerName, cs)
+		},
+	}
+}
+
+func (xTransport *XTransport) verifyConnection(serverName string, cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("No server certificate")
+	}
+	xTransport.tlsSettings.RLock()
+	settings := xTransport.tlsSettings.servers[strings.ToLower(serverName)]
+	xTransport.tlsSettings.RUnlock()
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         settings.rootCAs,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := cs.PeerCertificates[0].Verify(opts); err != nil {
+		dlog.Errorf("[%s] Invalid server certificate: [%s]", serverName, err)
+		return err
+	}
+	if len(settings.pins) > 0 {
+		return verifyCertPins(serverName, cs.PeerCertificates, settings.pins)
+	}
+	return nil
+}
+
+// Pins can be hashes of either the public key (SPKI) or the TBS certificate
+// of any certificate of the chain, the latter being what stamps use
+
+func verifyCertPins(serverName string, certs []*x509.Certificate, pins [][]byte) error {
+	var seen []string
+	for _, cert := range certs {
+		spkiHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		tbsHash := sha256.Sum256(cert.RawTBSCertificate)
+		for _, pin := range pins {
+			if bytes.Equal(pin, spkiHash[:]) || bytes.Equal(pin, tbsHash[:]) {
+				return nil
+			}
+		}
+		seen = append(seen, hex.EncodeToString(spkiHash[:]))
+	}
+	dlog.Criticalf("[%s] No certificate matches the pinned public keys - the connection may have been intercepted. Public keys presented by the server: %s", serverName, strings.Join(seen, ", "))
+	return fmt.Errorf("[%s] No certificate matches the pinned public keys", serverName)
+}
+
+func decodeSPKIPins(pinsStr []string) ([][]byte, error) {
+	var pins [][]byte
+	for _, pinStr := range pinsStr {
+		pin, err := hex.DecodeString(pinStr)
+		if err != nil || len(pin) != sha256.Size {
+			return pins, fmt.Errorf("Invalid certificate pin: [%s]", pinStr)
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+func (xTransport *XTransport) dialTLSContext(ctx context.Context, network, addrStr string) (net.Conn, error) {
+	host, _, err := net.SplitHostPort(addrStr)
+	if err != nil {
+		return nil, err
+	}
+	rawConn, err := xTransport.dialContext(ctx, network, addrStr)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := xTransport.tlsClientConfig(host)
+	tlsConfig.NextProtos = []string{"h2", "http/1.1"}
+	conn := tls.Client(rawConn, tlsConfig)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func loadCAFile(fileName string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	rootCAs := x509.NewCertPool()
+	if !rootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in [%s]", fileName)
+	}
+	return rootCAs, nil
+}
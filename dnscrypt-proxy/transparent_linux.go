@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	TransparentProxySupported = true
+	ipTransparent             = 19
+	ipRecvOrigDstAddr         = 20
+	ipv6Transparent           = 75
+	ipv6RecvOrigDstAddr       = 74
+)
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	if err := c.Control(func(fd uintptr) {
+		if sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); sockErr != nil {
+			return
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, ipTransparent, 1)
+		syscall.SetsockoptInt(int(fd), syscall.SOL_IP, ipRecvOrigDstAddr, 1)
+		if network == "udp6" || network == "tcp6" {
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1); err == nil {
+				sockErr = nil
+			}
+			syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1)
+		}
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
+
+// Queries intercepted by TPROXY rules keep their original destination.
+// Responses have to be sent from that address, so that clients accept them.
+
+func (proxy *Proxy) transparentListener(listenAddrStr string) error {
+	listenConfig := net.ListenConfig{Control: transparentControl}
+	pc, err := listenConfig.ListenPacket(context.Background(), "udp", listenAddrStr)
+	if err != nil {
+		return err
+	}
+	acceptPc, err := listenConfig.Listen(context.Background(), "tcp", listenAddrStr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	clientPc := pc.(*net.UDPConn)
+	listenerOptions := proxy.listenerOptions(listenAddrStr)
+	go func() {
+		defer clientPc.Close()
+		listenersLog.Noticef("Now listening to %v [UDP, transparent]", clientPc.LocalAddr())
+		for {
+			buffer := make([]byte, MaxDNSPacketSize-1)
+			oob := make([]byte, 128)
+			length, oobLength, _, clientAddr, err := clientPc.ReadMsgUDP(buffer, oob)
+			if err != nil {
+				return
+			}
+			packet := buffer[:length]
+			origDstAddr := parseOrigDstAddr(oob[:oobLength])
+			go func() {
+				var replyPc *net.UDPConn
+				if origDstAddr == nil {
+					replyPc = clientPc
+				} else {
+					replyConn, err := listenConfig.ListenPacket(context.Background(), "udp", origDstAddr.String())
+					if err != nil {
+						listenersLog.Debugf("Unable to reply from [%v]: [%s]", origDstAddr, err)
+						return
+					}
+					defer replyConn.Close()
+					replyPc = replyConn.(*net.UDPConn)
+					listenersLog.Debugf("Intercepted query from [%v] to [%v]", clientAddr, origDstAddr)
+				}
+				netClientAddr := net.Addr(clientAddr)
+				replyPc.SetWriteDeadline(time.Now().Add(proxy.timeout))
+				proxy.processIncomingQuery(listenerOptions, "udp", proxy.mainProto, packet, &netClientAddr, replyPc)
+			}()
+		}
+	}()
+	proxy.tcpListener(acceptPc.(*net.TCPListener), listenerOptions)
+	return nil
+}
+
+func parseOrigDstAddr(oob []byte) *net.UDPAddr {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == syscall.SOL_IP && msg.Header.Type == ipRecvOrigDstAddr && len(msg.Data) >= 8 {
+			return &net.UDPAddr{
+				IP:   net.IPv4(msg.Data[4], msg.Data[5], msg.Data[6], msg.Data[7]),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}
+		}
+		if msg.Header.Level == syscall.SOL_IPV6 && msg.Header.Type == ipv6RecvOrigDstAddr && len(msg.Data) >= 24 {
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte{}, msg.Data[8:24]...)),
+				Port: int(binary.BigEndian.Uint16(msg.Data[2:4])),
+			}
+		}
+	}
+	return nil
+}
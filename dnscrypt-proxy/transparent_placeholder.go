@@ -0,0 +1,11 @@
+// +build !linux
+
+package main
+
+import "errors"
+
+const TransparentProxySupported = false
+
+func (proxy *Proxy) transparentListener(listenAddrStr string) error {
+	return errors.New("Transparent proxying is not supported on this platform")
+}
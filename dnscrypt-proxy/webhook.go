@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+)
+
+const (
+	WebhookQueueSize           = 100
+	WebhookRetries             = 3
+	WebhookTimeout             = 10 * time.Second
+	WebhookCertRefreshFailures = 3
+)
+
+type WebhookEvent struct {
+	Time     string `json:"time"`
+	Event    string `json:"event"`
+	Host     string `json:"host"`
+	Server   string `json:"server,omitempty"`
+	Failures int    `json:"failures,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Events are sent one at a time, in the order they happened. Events are
+// dropped if the endpoint is too slow to keep up.
+
+type Webhook struct {
+	sync.Mutex
+	url      string
+	headers  map[string]string
+	client   *http.Client
+	hostname string
+	events   chan WebhookEvent
+	// Guarded by the mutex
+	noServers    bool
+	downServers  map[string]bool
+	certFailures map[string]int
+}
+
+func NewWebhook(urlStr string, headers map[string]string) (*Webhook, error) {
+	parsedURL, err := url.Parse(urlStr)
+	if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+		return nil, fmt.Errorf("Invalid webhook URL: [%s]", urlStr)
+	}
+	hostname, _ := os.Hostname()
+	webhook := Webhook{
+		url:      urlStr,
+		headers:  headers,
+		client:   &http.Client{Timeout: WebhookTimeout},
+		hostname: hostname,
+		events:   make(chan WebhookEvent, WebhookQueueSize),
+
+		downServers:  make(map[string]bool),
+		certFailures: make(map[string]int),
+	}
+	go webhook.run()
+	return &webhook, nil
+}
+
+func (webhook *Webhook) notify(event WebhookEvent) {
+	if webhook == nil {
+		return
+	}
+	event.Time = time.Now().Format(time.RFC3339)
+	event.Host = webhook.hostname
+	select {
+	case webhook.events <- event:
+	default:
+	}
+}
+
+// Servers are reported down once they are considered failing, after a
+// number of consecutive failures, not after every lost query
+
+func (webhook *Webhook) serverDown(proxy *Proxy, name string, failures int) {
+	if webhook == nil {
+		return
+	}
+	webhook.Lock()
+	webhook.downServers[name] = true
+	webhook.Unlock()
+	webhook.notify(WebhookEvent{Event: "server_down", Server: name, Failures: failures})
+	if !proxy.serversInfo.allFailing() {
+		return
+	}
+	webhook.Lock()
+	wasUsable := !webhook.noServers
+	webhook.noServers = true
+	webhook.Unlock()
+	if wasUsable {
+		webhook.notify(WebhookEvent{Event: "no_servers"})
+	}
+}
+
+func (webhook *Webhook) serverUp(name string) {
+	if webhook == nil {
+		return
+	}
+	webhook.Lock()
+	wasDown := webhook.downServers[name]
+	delete(webhook.downServers, name)
+	wasUnusable := webhook.noServers
+	webhook.noServers = false
+	webhook.Unlock()
+	if !wasDown {
+		return
+	}
+	webhook.notify(WebhookEvent{Event: "server_up", Server: name})
+	if wasUnusable {
+		webhook.notify(WebhookEvent{Event: "servers_available"})
+	}
+}
+
+func (webhook *Webhook) certRefreshed(name string, err error) {
+	if webhook == nil {
+		return
+	}
+	webhook.Lock()
+	if err == nil {
+		delete(webhook.certFailures, name)
+		webhook.Unlock()
+		return
+	}
+	webhook.certFailures[name]++
+	failures := webhook.certFailures[name]
+	webhook.Unlock()
+	if failures == WebhookCertRefreshFailures {
+		webhook.notify(WebhookEvent{Event: "cert_refresh_failed", Server: name, Failures: failures, Error: err.Error()})
+	}
+}
+
+func (webhook *Webhook) run() {
+	for event := range webhook.events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			continue
+		}
+		for attempt := 0; attempt < WebhookRetries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(1<<uint(attempt)) * time.Second)
+			}
+			if err = webhook.post(body); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			dlog.Warnf("Unable to send the [%s] event to [%s]: %s", event.Event, webhook.url, err)
+		}
+	}
+}
+
+func (webhook *Webhook) post(body []byte) error {
+	req, err := http.NewRequest("POST", webhook.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range webhook.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := webhook.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected status code: %d", resp.StatusCode)
+	}
+	return nil
+}
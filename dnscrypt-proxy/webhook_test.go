@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/VividCortex/ewma"
+)
+
+func TestWebhookServerStateChanges(t *testing.T) {
+	events := make(chan WebhookEvent, 10)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		var event WebhookEvent
+		if err := json.NewDecoder(request.Body).Decode(&event); err == nil {
+			events <- event
+		}
+	}))
+	defer endpoint.Close()
+	webhook, err := NewWebhook(endpoint.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &Proxy{timeout: time.Second, webhook: webhook}
+	proxy.serversInfo.inner = []ServerInfo{{Name: "example", rtt: ewma.NewMovingAverage(RTTEwmaDecay)}}
+	serverInfo := &proxy.serversInfo.inner[0]
+
+	// Isolated failures, such as lost packets, are not reported
+	for i := 0; i < 3; i++ {
+		for j := 0; j < ServerFailuresThreshold-1; j++ {
+			serverInfo.noticeFailure(proxy)
+		}
+		serverInfo.noticeSuccess(proxy)
+	}
+	for i := 0; i < ServerFailuresThreshold+2; i++ {
+		serverInfo.noticeFailure(proxy)
+	}
+	serverInfo.noticeSuccess(proxy)
+	serverInfo.noticeSuccess(proxy)
+
+	expected := []WebhookEvent{
+		{Event: "server_down", Server: "example", Failures: ServerFailuresThreshold},
+		{Event: "no_servers"},
+		{Event: "server_up", Server: "example"},
+		{Event: "servers_available"},
+	}
+	for _, expectedEvent := range expected {
+		select {
+		case event := <-events:
+			if event.Event != expectedEvent.Event || event.Server != expectedEvent.Server || event.Failures != expectedEvent.Failures {
+				t.Fatalf("Got %+v, expected %+v", event, expectedEvent)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Missing event: %+v", expectedEvent)
+		}
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("Unexpected event: %+v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
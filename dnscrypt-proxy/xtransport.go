@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/jedisct1/dlog"
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultKeepAlive = 30 * time.Second
+	DoHMediaType     = "application/dns-message"
+)
+
+type CachedIPs struct {
+	sync.RWMutex
+	cache map[string][]string
+}
+
+type XTransport struct {
+	transport        *http.Transport
+	keepAlive        time.Duration
+	maxIdleConns     int
+	maxConns         int
+	timeout          time.Duration
+	cachedIPs        CachedIPs
+	tcpFastOpen      bool
+	fallbackResolver string
+	ignoreSystemDNS  bool
+	proxyURL         *url.URL
+	httpProxyURL     *url.URL
+	ipFamilies       IPFamilies
+	tlsSettings      TLSSettings
+}
+
+func NewXTransport(timeout time.Duration) *XTransport {
+	xTransport := XTransport{
+		cachedIPs:    CachedIPs{cache: make(map[string][]string)},
+		tlsSettings:  TLSSettings{servers: make(map[string]TLSServerSettings)},
+		ipFamilies:   IPFamilies{preferred: make(map[string]int), succeeded: make(map[string]int)},
+		keepAlive:    DefaultKeepAlive,
+		maxIdleConns: DefaultMaxIdleConns,
+		timeout:      timeout,
+	}
+	xTransport.rebuildTransport()
+	return &xTransport
+}
+
+func (xTransport *XTransport) rebuildTransport() {
+	dlog.Debug("Rebuilding transport")
+	if xTransport.transport != nil {
+		xTransport.transport.CloseIdleConnections()
+	}
+	timeout := xTransport.timeout
+	transport := &http.Transport{
+		DisableKeepAlives:      xTransport.maxIdleConns == 0,
+		DisableCompression:     true,
+		MaxIdleConnsPerHost:    xTransport.maxIdleConns,
+		MaxConnsPerHost:        xTransport.maxConns,
+		IdleConnTimeout:        xTransport.keepAlive,
+		ResponseHeaderTimeout:  timeout,
+		ExpectContinueTimeout:  timeout,
+		MaxResponseHeaderBytes: 4096,
+		ForceAttemptHTTP2:      true,
+		TLSClientConfig:        xTransport.tlsClientConfig(""),
+		DialContext:            xTransport.dialContext,
+		DialTLSContext:         xTransport.dialTLSContext,
+	}
+	if xTransport.httpProxyURL != nil {
+		transport.Proxy = http.ProxyURL(xTransport.httpProxyURL)
+	}
+	xTransport.transport = transport
+}
+
+func (xTransport *XTransport) resolve(ctx context.Context, host string) ([]string, error) {
+	if net.ParseIP(host) != nil {
+		return []string{host}, nil
+	}
+	xTransport.cachedIPs.RLock()
+	cachedIPs := xTransport.cachedIPs.cache[host]
+	xTransport.cachedIPs.RUnlock()
+	if len(cachedIPs) > 0 {
+		return cachedIPs, nil
+	}
+	if !xTransport.ignoreSystemDNS || len(xTransport.fallbackResolver) == 0 {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err == nil && len(addrs) > 0 {
+			return addrs, nil
+		}
+		if len(xTransport.fallbackResolver) == 0 {
+			return nil, err
+		}
+		dlog.Noticef("System DNS configuration not usable yet, exceptionally resolving [%s] using fallback resolver [%s]", host, xTransport.fallbackResolver)
+	}
+	ips, err := xTransport.resolveUsingFallback(host)
+	if err != nil {
+		return nil, err
+	}
+	xTransport.cachedIPs.Lock()
+	xTransport.cachedIPs.cache[host] = ips
+	xTransport.cachedIPs.Unlock()
+	return ips, nil
+}
+
+func (xTransport *XTransport) resolveUsingFallback(host string) ([]string, error) {
+	client := dns.Client{Net: "udp", Timeout: xTransport.timeout}
+	var ips []string
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(dns.Fqdn(host), qtype)
+		msg.SetEdns0(uint16(MaxDNSUDPPacketSize), false)
+		in, _, err := client.Exchange(msg, xTransport.fallbackResolver)
+		if err != nil {
+			if len(ips) > 0 {
+				break
+			}
+			return nil, err
+		}
+		for _, answer := range in.Answer {
+			switch rr := answer.(type) {
+			case *dns.A:
+				ips = append(ips, rr.A.String())
+			case *dns.AAAA:
+				ips = append(ips, rr.AAAA.String())
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("No address found for [%s] using fallback resolver [%s]", host, xTransport.fallbackResolver)
+	}
+	return ips, nil
+}
+
+func (xTransport *XTransport) dialContext(ctx context.Context, network, addrStr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addrStr)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: xTransport.timeout, KeepAlive: xTransport.timeout}
+	if xTransport.tcpFastOpen {
+		dialer.Control = tcpFastOpenControl
+	}
+	if xTransport.proxyURL != nil {
+		xTransport.cachedIPs.RLock()
+		if cachedIPs := xTransport.cachedIPs.cache[host]; len(cachedIPs) > 0 {
+			addrStr = net.JoinHostPort(cachedIPs[0], port)
+		}
+		xTransport.cachedIPs.RUnlock()
+		return dialSOCKS5(ctx, dialer, xTransport.proxyURL, addrStr, xTransport.timeout)
+	}
+	ips, err := xTransport.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return xTransport.dialHappyEyeballs(ctx, dialer, network, host, port, ips)
+}
+
+func (xTransport *XTransport) Dial(network, addrStr string) (net.Conn, error) {
+	return xTransport.dialContext(context.Background(), network, addrStr)
+}
+
+func (xTransport *XTransport) setCachedIP(host string, ip string) {
+	xTransport.cachedIPs.Lock()
+	xTransport.cachedIPs.cache[host] = []string{ip}
+	xTransport.cachedIPs.Unlock()
+}
+
+func (xTransport *XTransport) Fetch(method string, url *url.URL, accept string, contentType string, extraHeaders map[string]string, body *[]byte, timeout time.Duration) (*http.Response, time.Duration, error) {
+	if timeout <= 0 {
+		timeout = xTransport.timeout
+	}
+	client := http.Client{Transport: xTransport.transport, Timeout: timeout}
+	header := map[string][]string{"User-Agent": {"dnscrypt-proxy"}}
+	if len(accept) > 0 {
+		header["Accept"] = []string{accept}
+	}
+	if len(contentType) > 0 {
+		header["Content-Type"] = []string{contentType}
+	}
+	for name, value := range extraHeaders {
+		header[http.CanonicalHeaderKey(name)] = []string{value}
+	}
+	req := &http.Request{
+		Method: method,
+		URL:    url,
+		Header: header,
+		Close:  false,
+	}
+	if body != nil {
+		req.ContentLength = int64(len(*body))
+		req.Body = ioutil.NopCloser(bytes.NewReader(*body))
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	rtt := time.Since(start)
+	if err != nil {
+		xTransport.transport.CloseIdleConnections()
+		dlog.Debugf("[%s]: [%s]", req.URL, err)
+		return nil, rtt, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, rtt, fmt.Errorf("Webserver returned code %d", resp.StatusCode)
+	}
+	return resp, rtt, nil
+}
+
+func (xTransport *XTransport) Post(url *url.URL, accept string, contentType string, extraHeaders map[string]string, body []byte, timeout time.Duration) (*http.Response, time.Duration, error) {
+	return xTransport.Fetch("POST", url, accept, contentType, extraHeaders, &body, timeout)
+}
+
+func (xTransport *XTransport) Get(url *url.URL, accept string, extraHeaders map[string]string, timeout time.Duration) (*http.Response, time.Duration, error) {
+	return xTransport.Fetch("GET", url, accept, "", extraHeaders, nil, timeout)
+}
+
+func (xTransport *XTransport) DoHQuery(useGet bool, url *url.URL, extraHeaders map[string]string, body []byte, timeout time.Duration) ([]byte, time.Duration, error) {
+	var resp *http.Response
+	var rtt time.Duration
+	var err error
+	if useGet {
+		getURL := *url
+		values := getURL.Query()
+		values.Set("dns", base64.RawURLEncoding.EncodeToString(body))
+		getURL.RawQuery = values.Encode()
+		resp, rtt, err = xTransport.Get(&getURL, DoHMediaType, extraHeaders, timeout)
+	} else {
+		resp, rtt, err = xTransport.Post(url, DoHMediaType, DoHMediaType, extraHeaders, body, timeout)
+	}
+	if err != nil {
+		return nil, rtt, err
+	}
+	defer resp.Body.Close()
+	response, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(MaxDNSPacketSize)))
+	if err != nil {
+		return nil, rtt, err
+	}
+	if len(response) < MinDNSPacketSize {
+		return nil, rtt, errors.New("Response too short")
+	}
+	return response, rtt, nil
+}